@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// deniedFlowInterval is the time a denied flow is not logged again
+	deniedFlowInterval = time.Minute
+	// deniedFlowMax is the number of denied flows remembered
+	deniedFlowMax = 1024
+)
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	first, last uint16
+}
+
+// ACLRule allows the packets to a destination network, Proto 0 is any
+// protocol and the rule matches any port if there are no Ports
+type ACLRule struct {
+	Network *net.IPNet
+	Proto   uint8
+	Ports   []portRange
+}
+
+// Match returns true if the rule allows the packet
+func (r ACLRule) Match(p packetInfo) bool {
+	if !r.Network.Contains(p.dst) {
+		return false
+	}
+	if r.Proto != 0 && r.Proto != p.proto {
+		return false
+	}
+	if len(r.Ports) == 0 {
+		return true
+	}
+	// The fragments without transport header have port 0
+	for _, ports := range r.Ports {
+		if p.dstPort != 0 && p.dstPort >= ports.first && p.dstPort <= ports.last {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the rule in the format parsed by parseACLRule
+func (r ACLRule) String() string {
+	s := r.Network.String()
+	if r.Proto == 0 {
+		return s
+	}
+	s += " " + packetInfo{proto: r.Proto}.protoName()
+	ports := make([]string, len(r.Ports))
+	for i, p := range r.Ports {
+		ports[i] = strconv.Itoa(int(p.first))
+		if p.last != p.first {
+			ports[i] += "-" + strconv.Itoa(int(p.last))
+		}
+	}
+	if len(ports) > 0 {
+		s += " " + strings.Join(ports, ",")
+	}
+	return s
+}
+
+// PeerACL is a rule of the access control list of the peers in a network
+type PeerACL struct {
+	Network *net.IPNet
+	Rule    ACLRule
+}
+
+// ACL is the access control list of a session, the packets received from the
+// peer are only written to the interface if a rule allows their destination.
+// TAP sessions can resolve the addresses with ARP, the other frames that are
+// not IP are denied.
+type ACL struct {
+	Rules []ACLRule
+}
+
+// Allow parses the packet and returns true if a rule allows it
+func (a *ACL) Allow(packet []byte, tap bool) (packetInfo, bool) {
+	var info packetInfo
+	var ok bool
+	if tap {
+		if info, ok = parseEthernetFrame(packet); !ok && info.etherType == etherTypeARP {
+			return info, true
+		}
+	} else {
+		info, ok = parseIPPacket(packet)
+	}
+	if !ok {
+		return info, false
+	}
+	for _, r := range a.Rules {
+		if r.Match(info) {
+			return info, true
+		}
+	}
+	return info, false
+}
+
+// String returns the rules of the list
+func (a *ACL) String() string {
+	if len(a.Rules) == 0 {
+		return "deny all"
+	}
+	rules := make([]string, len(a.Rules))
+	for i, r := range a.Rules {
+		rules[i] = r.String()
+	}
+	return strings.Join(rules, ", ")
+}
+
+// aclFor returns the list with the rules of the most specific network
+// containing the peer address, nil if there are no access control lists.
+// The peers that are in none of the networks are denied everything. The peer
+// is the address its connection comes from, as seen by the relay in relay
+// mode, so the peers behind the same NAT share the list.
+func aclFor(peer string, acls []PeerACL) *ACL {
+	if len(acls) == 0 {
+		return nil
+	}
+	acl := &ACL{}
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		host = peer
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return acl
+	}
+	var best *net.IPNet
+	for _, a := range acls {
+		if !a.Network.Contains(ip) {
+			continue
+		}
+		if best != nil {
+			ones, _ := a.Network.Mask.Size()
+			bestOnes, _ := best.Mask.Size()
+			if ones < bestOnes {
+				continue
+			}
+			if ones > bestOnes {
+				acl.Rules = nil
+			}
+		}
+		best = a.Network
+		acl.Rules = append(acl.Rules, a.Rule)
+	}
+	return acl
+}
+
+// parsePeerACL parses "network=destination [protocol [ports]]", a single
+// address is a host network, the protocol is tcp, udp, icmp, icmp6 or any
+// and the ports a list of ports and ranges, i.e. 10.0.0.0/8=10.1.0.0/16 tcp 80,8000-8080
+func parsePeerACL(s string) (PeerACL, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return PeerACL{}, fmt.Errorf("Invalid ACL %q, expected network=destination [protocol [ports]]", s)
+	}
+	network, err := parseNetwork(parts[0])
+	if err != nil {
+		return PeerACL{}, fmt.Errorf("Invalid ACL peer network %q", parts[0])
+	}
+	rule, err := parseACLRule(parts[1])
+	if err != nil {
+		return PeerACL{}, err
+	}
+	return PeerACL{Network: network, Rule: rule}, nil
+}
+
+// parseACLRule parses "destination [protocol [ports]]"
+func parseACLRule(s string) (ACLRule, error) {
+	var rule ACLRule
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 3 {
+		return rule, fmt.Errorf("Invalid ACL rule %q, expected destination [protocol [ports]]", s)
+	}
+	var err error
+	if rule.Network, err = parseNetwork(fields[0]); err != nil {
+		return rule, fmt.Errorf("Invalid ACL destination %q", fields[0])
+	}
+	if len(fields) == 1 {
+		return rule, nil
+	}
+	switch fields[1] {
+	case "any":
+	case "tcp":
+		rule.Proto = protoTCP
+	case "udp":
+		rule.Proto = protoUDP
+	case "icmp":
+		rule.Proto = protoICMP
+	case "icmp6":
+		rule.Proto = protoICMPv6
+	default:
+		return rule, fmt.Errorf("Invalid ACL protocol %q, valid values are tcp, udp, icmp, icmp6 and any", fields[1])
+	}
+	if len(fields) == 2 {
+		return rule, nil
+	}
+	if rule.Proto != protoTCP && rule.Proto != protoUDP {
+		return rule, fmt.Errorf("Invalid ACL rule %q, ports require tcp or udp", s)
+	}
+	for _, p := range strings.Split(fields[2], ",") {
+		ports := strings.SplitN(p, "-", 2)
+		first, err := strconv.ParseUint(ports[0], 10, 16)
+		if err != nil || first == 0 {
+			return rule, fmt.Errorf("Invalid ACL port %q", p)
+		}
+		last := first
+		if len(ports) == 2 {
+			if last, err = strconv.ParseUint(ports[1], 10, 16); err != nil || last < first {
+				return rule, fmt.Errorf("Invalid ACL port range %q", p)
+			}
+		}
+		rule.Ports = append(rule.Ports, portRange{first: uint16(first), last: uint16(last)})
+	}
+	return rule, nil
+}
+
+// parseNetwork parses a CIDR, a single address is a host network
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() == nil {
+			s += "/128"
+		} else {
+			s += "/32"
+		}
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+// deniedFlowLog logs the flows denied by the access control list once per
+// deniedFlowInterval, it is used by a single goroutine
+type deniedFlowLog struct {
+	log  *Logger
+	seen map[string]time.Time
+}
+
+func newDeniedFlowLog(log *Logger) *deniedFlowLog {
+	return &deniedFlowLog{
+		log:  log,
+		seen: map[string]time.Time{},
+	}
+}
+
+// Log logs the denied packet if its flow was not logged recently
+func (d *deniedFlowLog) Log(p packetInfo, length int) {
+	// The packets that can't be parsed are logged as a single flow, the
+	// frames that are not IP as one flow per type
+	key := ""
+	if p.version != 0 {
+		key = fmt.Sprintf("%d %s %d %s %d", p.proto, p.src, p.srcPort, p.dst, p.dstPort)
+	} else if p.etherType != 0 {
+		key = fmt.Sprintf("ethertype %#04x", p.etherType)
+	}
+	now := time.Now()
+	if last, ok := d.seen[key]; ok && now.Sub(last) < deniedFlowInterval {
+		return
+	}
+	if len(d.seen) >= deniedFlowMax {
+		for k, t := range d.seen {
+			if now.Sub(t) >= deniedFlowInterval {
+				delete(d.seen, k)
+			}
+		}
+		if len(d.seen) >= deniedFlowMax {
+			d.seen = map[string]time.Time{}
+		}
+	}
+	d.seen[key] = now
+	if key == "" {
+		d.log.Info("Denied invalid packet", "length", length)
+		return
+	}
+	if p.version == 0 {
+		d.log.Info("Denied frame", "etherType", fmt.Sprintf("%#04x", p.etherType), "length", length)
+		return
+	}
+	kv := []interface{}{"proto", p.protoName(), "src", p.src, "dst", p.dst}
+	if p.proto == protoTCP || p.proto == protoUDP {
+		kv = append(kv, "srcPort", p.srcPort, "dstPort", p.dstPort)
+	}
+	d.log.Info("Denied flow", kv...)
+}
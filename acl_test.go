@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// mustACL returns the list with the rules
+func mustACL(t *testing.T, rules ...string) *ACL {
+	t.Helper()
+	acl := &ACL{}
+	for _, r := range rules {
+		rule, err := parseACLRule(r)
+		if err != nil {
+			t.Fatalf("parseACLRule(%q) error: %v", r, err)
+		}
+		acl.Rules = append(acl.Rules, rule)
+	}
+	return acl
+}
+
+// newTestPacket6 returns an IPv6 packet with a TCP or UDP header
+func newTestPacket6(proto uint8, dst string, dstPort uint16) []byte {
+	pkt := make([]byte, 60)
+	pkt[0] = 0x60
+	pkt[5] = 20
+	pkt[6] = proto
+	pkt[7] = 64
+	copy(pkt[8:24], net.ParseIP("fd00::1"))
+	copy(pkt[24:40], net.ParseIP(dst))
+	pkt[40], pkt[41] = 0x9c, 0x40
+	pkt[42], pkt[43] = byte(dstPort>>8), byte(dstPort)
+	return pkt
+}
+
+func TestACLAllow(t *testing.T) {
+	acl := mustACL(t, "172.17.0.0/16 tcp 80,8000-8080", "172.18.0.10 udp 53", "172.19.0.0/16 icmp", "fd00:1::/64")
+	tcp := func(dst string, port uint16) []byte {
+		return newTestPacket(protoTCP, "192.168.166.2", dst, 40000, port, 60)
+	}
+	fragment := tcp("172.17.0.2", 80)
+	// A fragment after the first one has no transport header
+	fragment[7] = 10
+	tests := []struct {
+		name   string
+		packet []byte
+		tap    bool
+		allow  bool
+	}{
+		{"port", tcp("172.17.0.2", 80), false, true},
+		{"port range", tcp("172.17.0.2", 8080), false, true},
+		{"port out of range", tcp("172.17.0.2", 8081), false, false},
+		{"protocol", newTestPacket(protoUDP, "192.168.166.2", "172.17.0.2", 40000, 80, 60), false, false},
+		{"host", newTestPacket(protoUDP, "192.168.166.2", "172.18.0.10", 40000, 53, 60), false, true},
+		{"other host", newTestPacket(protoUDP, "192.168.166.2", "172.18.0.11", 40000, 53, 60), false, false},
+		{"any port", newTestPacket(protoICMP, "192.168.166.2", "172.19.1.1", 0, 0, 60), false, true},
+		{"network", tcp("10.0.0.1", 80), false, false},
+		{"fragment", fragment, false, false},
+		{"ipv6", newTestPacket6(protoUDP, "fd00:1::5", 5000), false, true},
+		{"ipv6 network", newTestPacket6(protoUDP, "fd00:2::5", 5000), false, false},
+		{"invalid", []byte{0x45, 0, 0}, false, false},
+		{"tap", newEthernetFrame(etherTypeIPv4, tcp("172.17.0.2", 80)), true, true},
+		{"tap denied", newEthernetFrame(etherTypeIPv4, tcp("10.0.0.1", 80)), true, false},
+		{"tap arp", newEthernetFrame(etherTypeARP, make([]byte, 28)), true, true},
+		{"tap unknown ethertype", newEthernetFrame(0x88cc, make([]byte, 40)), true, false},
+		{"tap vlan", newEthernetFrame(etherTypeIPv4, tcp("172.17.0.2", 80), etherTypeVLAN), true, true},
+		{"tap vlan denied", newEthernetFrame(etherTypeIPv4, tcp("10.0.0.1", 80), etherTypeVLAN), true, false},
+		{"tap qinq denied", newEthernetFrame(etherTypeIPv4, tcp("10.0.0.1", 80), etherTypeQinQ, etherTypeVLAN), true, false},
+		{"tap double 802.1q denied", newEthernetFrame(etherTypeIPv4, tcp("10.0.0.1", 80), etherTypeVLAN, etherTypeVLAN), true, false},
+		{"tap truncated tag", newEthernetFrame(etherTypeVLAN, []byte{0, 10}), true, false},
+		{"tap short", make([]byte, 10), true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := acl.Allow(tt.packet, tt.tap); got != tt.allow {
+				t.Errorf("Allow() = %v, want %v", got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestACLDenyAll(t *testing.T) {
+	acl := &ACL{}
+	if _, ok := acl.Allow(newTestPacket(protoTCP, "192.168.166.2", "172.17.0.2", 40000, 80, 60), false); ok {
+		t.Errorf("Allow() of an empty list allowed the packet")
+	}
+	if got := acl.String(); got != "deny all" {
+		t.Errorf("String() = %q, want deny all", got)
+	}
+}
+
+func TestACLFor(t *testing.T) {
+	parse := func(s string) PeerACL {
+		a, err := parsePeerACL(s)
+		if err != nil {
+			t.Fatalf("parsePeerACL(%q) error: %v", s, err)
+		}
+		return a
+	}
+	acls := []PeerACL{
+		parse("10.0.0.0/8=172.17.0.0/16"),
+		parse("10.1.0.0/16=172.18.0.0/16 tcp 443"),
+		parse("10.1.0.0/16=172.19.0.0/16"),
+	}
+	tests := []struct {
+		peer  string
+		rules string
+	}{
+		{"10.2.0.1:5000", "172.17.0.0/16"},
+		// The most specific network has all its rules
+		{"10.1.0.1:5000", "172.18.0.0/16 tcp 443, 172.19.0.0/16"},
+		{"192.168.1.1:5000", "deny all"},
+		{"not an address", "deny all"},
+	}
+	for _, tt := range tests {
+		if got := aclFor(tt.peer, acls).String(); got != tt.rules {
+			t.Errorf("aclFor(%q) = %q, want %q", tt.peer, got, tt.rules)
+		}
+	}
+	if aclFor("10.1.0.1:5000", nil) != nil {
+		t.Errorf("aclFor() without lists is not nil")
+	}
+}
+
+func TestParsePeerACL(t *testing.T) {
+	valid := map[string]string{
+		"10.0.0.0/8=172.17.0.0/16":             "10.0.0.0/8=172.17.0.0/16",
+		"10.0.0.1=172.17.0.1 tcp 80,8000-8080": "10.0.0.1/32=172.17.0.1/32 tcp 80,8000-8080",
+		"fd00::/64=fd01::/64 icmp6":            "fd00::/64=fd01::/64 icmp6",
+		"10.0.0.0/8=172.17.0.0/16 any":         "10.0.0.0/8=172.17.0.0/16",
+	}
+	for in, want := range valid {
+		a, err := parsePeerACL(in)
+		if err != nil {
+			t.Errorf("parsePeerACL(%q) error: %v", in, err)
+			continue
+		}
+		if got := a.Network.String() + "=" + a.Rule.String(); got != want {
+			t.Errorf("parsePeerACL(%q) = %q, want %q", in, got, want)
+		}
+	}
+	for _, in := range []string{
+		"172.17.0.0/16",
+		"bad=172.17.0.0/16",
+		"10.0.0.0/8=bad",
+		"10.0.0.0/8=172.17.0.0/16 sctp",
+		"10.0.0.0/8=172.17.0.0/16 icmp 80",
+		"10.0.0.0/8=172.17.0.0/16 tcp 0",
+		"10.0.0.0/8=172.17.0.0/16 tcp 90-80",
+		"10.0.0.0/8=172.17.0.0/16 tcp 80 extra",
+	} {
+		if _, err := parsePeerACL(in); err == nil {
+			t.Errorf("parsePeerACL(%q) succeeded", in)
+		}
+	}
+}
+
+func TestDeniedFlowLog(t *testing.T) {
+	var out bytes.Buffer
+	log, _ := NewLogger(&out, "logfmt", LevelInfo, 0)
+	d := newDeniedFlowLog(log)
+	acl := &ACL{}
+	packets := [][]byte{
+		newTestPacket(protoTCP, "192.168.166.2", "172.17.0.2", 40000, 80, 60),
+		// The same flow is logged once
+		newTestPacket(protoTCP, "192.168.166.2", "172.17.0.2", 40000, 80, 1000),
+		newEthernetFrame(0x88cc, make([]byte, 40)),
+		newEthernetFrame(0x88cc, make([]byte, 40)),
+	}
+	for i, pkt := range packets {
+		info, ok := acl.Allow(pkt, i >= 2)
+		if ok {
+			t.Fatalf("Allow() of packet %d succeeded", i)
+		}
+		d.Log(info, len(pkt))
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "Denied flow") || !strings.Contains(lines[1], "0x88cc") {
+		t.Errorf("denied flows logged:\n%s", out.String())
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Benchmark packets are sent through the tunnel as IPv4 UDP packets, so they are
+// steered like real traffic, the payload starts with the packet kind followed
+// by a sequence number or counter and a value
+const (
+	benchEcho = iota + 1
+	benchEchoReply
+	benchData
+	benchUploadEnd
+	benchUploadReport
+	benchDownload
+	benchDownloadEnd
+
+	benchIPHeaderLen = 28
+	benchHeaderLen   = benchIPHeaderLen + 17
+	// benchPort is the source port of the first flow
+	benchPort = 10000
+)
+
+// benchTimeout is the time to wait for the answers of the server
+var benchTimeout = 5 * time.Second
+
+// maxBenchDuration and maxBenchFlows limit the download a client can request
+const (
+	maxBenchDuration = time.Minute
+	maxBenchFlows    = 64
+)
+
+// maxBenchSession is the longest benchmark session the server answers, it
+// fits the latency test and both throughput tests with their timeouts
+var maxBenchSession = 4 * maxBenchDuration
+
+// BenchConfig configures a tunnel benchmark
+type BenchConfig struct {
+	// Duration of each throughput test
+	Duration time.Duration
+	// PacketSize is the size of the packets sent through the tunnel
+	PacketSize int
+	// Pings is the number of echo packets used to measure the latency
+	Pings int
+	// PingInterval is the interval between echo packets
+	PingInterval time.Duration
+	// Flows is the number of flows sent in parallel in the throughput tests
+	Flows int
+	// Queues is the number of queues of the local in-memory device
+	Queues int
+}
+
+// NewBenchConfig returns a BenchConfig with default settings
+func NewBenchConfig() BenchConfig {
+	return BenchConfig{
+		Duration:     5 * time.Second,
+		PacketSize:   1400,
+		Pings:        100,
+		PingInterval: 10 * time.Millisecond,
+		Flows:        1,
+		Queues:       1,
+	}
+}
+
+// BenchReport is the result of a tunnel benchmark
+type BenchReport struct {
+	Peer       string          `json:"peer"`
+	PacketSize int             `json:"packetSize"`
+	Flows      int             `json:"flows"`
+	Queues     int             `json:"queues"`
+	Upload     BenchThroughput `json:"upload"`
+	Download   BenchThroughput `json:"download"`
+	Latency    BenchLatency    `json:"latency"`
+}
+
+// BenchThroughput is the result of a throughput test in one direction
+type BenchThroughput struct {
+	// Packets and Bytes are the ones received by the other end
+	Packets          uint64  `json:"packets"`
+	Bytes            uint64  `json:"bytes"`
+	Lost             uint64  `json:"lost"`
+	Seconds          float64 `json:"seconds"`
+	BitsPerSecond    float64 `json:"bitsPerSecond"`
+	PacketsPerSecond float64 `json:"packetsPerSecond"`
+}
+
+// BenchLatency is the result of the latency test
+type BenchLatency struct {
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	MinMs    float64 `json:"minMs"`
+	AvgMs    float64 `json:"avgMs"`
+	MaxMs    float64 `json:"maxMs"`
+	JitterMs float64 `json:"jitterMs"`
+}
+
+// WriteText writes the report in human readable form
+func (r *BenchReport) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "peer: %s packet size %d bytes flows %d queues %d\n", r.Peer, r.PacketSize, r.Flows, r.Queues)
+	for _, t := range []struct {
+		name string
+		t    BenchThroughput
+	}{
+		{"upload", r.Upload},
+		{"download", r.Download},
+	} {
+		fmt.Fprintf(w, "%s: %.2f Mbit/s %.0f packets/s %d packets %d bytes in %.2fs lost %d (%.2f%%)\n",
+			t.name, t.t.BitsPerSecond/1e6, t.t.PacketsPerSecond, t.t.Packets, t.t.Bytes, t.t.Seconds, t.t.Lost, percent(t.t.Lost, t.t.Lost+t.t.Packets))
+	}
+	l := r.Latency
+	fmt.Fprintf(w, "rtt: min %.3f ms avg %.3f ms max %.3f ms jitter %.3f ms lost %d/%d (%.2f%%)\n",
+		l.MinMs, l.AvgMs, l.MaxMs, l.JitterMs, l.Sent-l.Received, l.Sent, percent(uint64(l.Sent-l.Received), uint64(l.Sent)))
+}
+
+// WriteJSON writes the report as JSON
+func (r *BenchReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func percent(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// newBenchPacket returns a benchmark packet of size bytes for the flow
+func newBenchPacket(kind byte, flow int, seq, value uint64, size int) []byte {
+	if size < benchHeaderLen {
+		size = benchHeaderLen
+	}
+	pkt := make([]byte, size)
+	// IPv4 header from the benchmarking network 198.18.0.0/15
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(size))
+	pkt[8] = 64
+	pkt[9] = protoUDP
+	copy(pkt[12:16], []byte{198, 18, 0, 1})
+	copy(pkt[16:20], []byte{198, 18, 0, 2})
+	// UDP header to the discard port
+	binary.BigEndian.PutUint16(pkt[20:22], uint16(benchPort+flow))
+	binary.BigEndian.PutUint16(pkt[22:24], 9)
+	binary.BigEndian.PutUint16(pkt[24:26], uint16(size-20))
+	p := pkt[benchIPHeaderLen:]
+	p[0] = kind
+	binary.BigEndian.PutUint64(p[1:9], seq)
+	binary.BigEndian.PutUint64(p[9:17], value)
+	return pkt
+}
+
+// parseBenchPacket returns the kind, sequence and value of the benchmark packet
+func parseBenchPacket(pkt []byte) (byte, uint64, uint64, bool) {
+	if len(pkt) < benchHeaderLen {
+		return 0, 0, 0, false
+	}
+	p := pkt[benchIPHeaderLen:]
+	return p[0], binary.BigEndian.Uint64(p[1:9]), binary.BigEndian.Uint64(p[9:17]), true
+}
+
+// benchResponder answers the benchmark packets received on the device until it is closed
+func benchResponder(dev *memDevice) {
+	var packets, bytes, ends uint64
+	for {
+		pkt, err := dev.Receive()
+		if err != nil {
+			return
+		}
+		kind, seq, value, ok := parseBenchPacket(pkt)
+		if !ok {
+			continue
+		}
+		switch kind {
+		case benchEcho:
+			pkt[benchIPHeaderLen] = benchEchoReply
+			dev.Inject(pkt)
+		case benchData:
+			packets++
+			bytes += uint64(len(pkt))
+		case benchUploadEnd:
+			// Report once all the flows ended
+			ends++
+			if ends < value {
+				continue
+			}
+			dev.Inject(newBenchPacket(benchUploadReport, 0, packets, bytes, benchHeaderLen))
+			packets, bytes, ends = 0, 0, 0
+		case benchDownload:
+			d := time.Duration(seq)
+			if d > maxBenchDuration {
+				d = maxBenchDuration
+			}
+			// The value has the packet size and the number of flows
+			size := int(value & 0xffffffff)
+			if size > maxPacketSize {
+				size = maxPacketSize
+			}
+			if size < benchHeaderLen {
+				size = benchHeaderLen
+			}
+			flows := int(value >> 32)
+			if flows < 1 || flows > maxBenchFlows {
+				flows = 1
+			}
+			go benchFlood(dev, d, size, flows, benchDownloadEnd)
+		}
+	}
+}
+
+// benchFlood sends data packets from one goroutine per flow during d and
+// returns the number of packets and bytes sent. Every flow ends with a packet
+// of kind end with the number of packets and bytes of the flow, the flows can
+// be steered to different queues so only the order within a flow is kept.
+func benchFlood(dev *memDevice, d time.Duration, size, flows int, end byte) (uint64, uint64, error) {
+	var packets, bytes uint64
+	var wg sync.WaitGroup
+	errCh := make(chan error, flows)
+	start := time.Now()
+	for flow := 0; flow < flows; flow++ {
+		wg.Add(1)
+		go func(flow int) {
+			defer wg.Done()
+			var seq uint64
+			for ; time.Since(start) < d; seq++ {
+				if err := dev.Inject(newBenchPacket(benchData, flow, seq, 0, size)); err != nil {
+					errCh <- err
+					return
+				}
+				atomic.AddUint64(&packets, 1)
+				atomic.AddUint64(&bytes, uint64(size))
+			}
+			if err := dev.Inject(newBenchPacket(end, flow, seq, uint64(flows), benchHeaderLen)); err != nil {
+				errCh <- err
+			}
+		}(flow)
+	}
+	wg.Wait()
+	select {
+	case err := <-errCh:
+		return 0, 0, err
+	default:
+	}
+	return packets, bytes, nil
+}
+
+// benchReceiver dispatches the benchmark packets received from the device
+type benchReceiver struct {
+	// packets and bytes count the data received
+	packets uint64
+	bytes   uint64
+	replies chan []byte
+	control chan []byte
+	done    chan struct{}
+}
+
+func newBenchReceiver(dev *memDevice) *benchReceiver {
+	r := &benchReceiver{
+		replies: make(chan []byte, memDeviceQueueLen),
+		control: make(chan []byte, maxBenchFlows),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		for {
+			pkt, err := dev.Receive()
+			if err != nil {
+				return
+			}
+			kind, _, _, ok := parseBenchPacket(pkt)
+			if !ok {
+				continue
+			}
+			switch kind {
+			case benchEchoReply:
+				select {
+				case r.replies <- pkt:
+				default:
+				}
+			case benchData:
+				atomic.AddUint64(&r.packets, 1)
+				atomic.AddUint64(&r.bytes, uint64(len(pkt)))
+			case benchUploadReport, benchDownloadEnd:
+				r.control <- pkt
+			}
+		}
+	}()
+	return r
+}
+
+// waitControl waits for the control packet of kind
+func (r *benchReceiver) waitControl(kind byte, timeout time.Duration) (uint64, uint64, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case pkt := <-r.control:
+			k, seq, value, _ := parseBenchPacket(pkt)
+			if k == kind {
+				return seq, value, nil
+			}
+		case <-r.done:
+			return 0, 0, fmt.Errorf("Tunnel closed")
+		case <-timer.C:
+			return 0, 0, fmt.Errorf("Timed out waiting for the server")
+		}
+	}
+}
+
+// runBench runs the benchmark against a benchResponder through the device
+func runBench(dev *memDevice, cfg BenchConfig) (*BenchReport, error) {
+	if cfg.PacketSize < benchHeaderLen || cfg.PacketSize > maxPacketSize {
+		return nil, fmt.Errorf("Invalid packet size %d, it has to be between %d and %d", cfg.PacketSize, benchHeaderLen, maxPacketSize)
+	}
+	if cfg.Duration <= 0 || cfg.Duration > maxBenchDuration {
+		return nil, fmt.Errorf("Invalid duration %v, maximum %v", cfg.Duration, maxBenchDuration)
+	}
+	if cfg.Flows < 1 || cfg.Flows > maxBenchFlows {
+		return nil, fmt.Errorf("Invalid number of flows %d, maximum %d", cfg.Flows, maxBenchFlows)
+	}
+	report := &BenchReport{
+		PacketSize: cfg.PacketSize,
+		Flows:      cfg.Flows,
+		Queues:     len(dev.in),
+	}
+	r := newBenchReceiver(dev)
+
+	// Latency
+	var rtts []time.Duration
+	report.Latency.Sent = cfg.Pings
+	ticker := time.NewTicker(cfg.PingInterval)
+	sent := 0
+	var wait <-chan time.Time
+	for len(rtts) < cfg.Pings {
+		select {
+		case <-ticker.C:
+			if sent == cfg.Pings {
+				continue
+			}
+			if err := dev.Inject(newBenchPacket(benchEcho, 0, uint64(sent), uint64(time.Now().UnixNano()), cfg.PacketSize)); err != nil {
+				ticker.Stop()
+				return nil, err
+			}
+			sent++
+			if sent == cfg.Pings {
+				wait = time.After(benchTimeout)
+			}
+		case pkt := <-r.replies:
+			_, _, ts, _ := parseBenchPacket(pkt)
+			rtts = append(rtts, time.Since(time.Unix(0, int64(ts))))
+		case <-wait:
+			// The missing replies are lost
+			report.Latency.Sent = sent
+			wait = nil
+			cfg.Pings = len(rtts)
+		case <-r.done:
+			ticker.Stop()
+			return nil, fmt.Errorf("Tunnel closed")
+		}
+	}
+	ticker.Stop()
+	report.Latency.Received = len(rtts)
+	if len(rtts) > 0 {
+		min, max, sum, jitter := rtts[0], rtts[0], time.Duration(0), time.Duration(0)
+		for i, rtt := range rtts {
+			if rtt < min {
+				min = rtt
+			}
+			if rtt > max {
+				max = rtt
+			}
+			sum += rtt
+			// Jitter is the mean deviation between consecutive samples
+			if i > 0 {
+				d := rtt - rtts[i-1]
+				if d < 0 {
+					d = -d
+				}
+				jitter += d
+			}
+		}
+		report.Latency.MinMs = milliseconds(min)
+		report.Latency.MaxMs = milliseconds(max)
+		report.Latency.AvgMs = milliseconds(sum / time.Duration(len(rtts)))
+		if len(rtts) > 1 {
+			report.Latency.JitterMs = milliseconds(jitter / time.Duration(len(rtts)-1))
+		}
+	}
+
+	// Upload
+	start := time.Now()
+	packets, _, err := benchFlood(dev, cfg.Duration, cfg.PacketSize, cfg.Flows, benchUploadEnd)
+	if err != nil {
+		return nil, err
+	}
+	received, receivedBytes, err := r.waitControl(benchUploadReport, benchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	report.Upload = throughput(packets, received, receivedBytes, time.Since(start))
+
+	// Download
+	atomic.StoreUint64(&r.packets, 0)
+	atomic.StoreUint64(&r.bytes, 0)
+	start = time.Now()
+	if err := dev.Inject(newBenchPacket(benchDownload, 0, uint64(cfg.Duration), uint64(cfg.Flows)<<32|uint64(cfg.PacketSize), benchHeaderLen)); err != nil {
+		return nil, err
+	}
+	// Every flow reports the packets sent
+	packets = 0
+	for i := 0; i < cfg.Flows; i++ {
+		sent, _, err := r.waitControl(benchDownloadEnd, cfg.Duration+benchTimeout)
+		if err != nil {
+			return nil, err
+		}
+		packets += sent
+	}
+	report.Download = throughput(packets, atomic.LoadUint64(&r.packets), atomic.LoadUint64(&r.bytes), time.Since(start))
+	return report, nil
+}
+
+func throughput(sent, received, bytes uint64, elapsed time.Duration) BenchThroughput {
+	t := BenchThroughput{
+		Packets: received,
+		Bytes:   bytes,
+		Seconds: elapsed.Seconds(),
+	}
+	if sent > received {
+		t.Lost = sent - received
+	}
+	if elapsed > 0 {
+		t.BitsPerSecond = float64(bytes) * 8 / elapsed.Seconds()
+		t.PacketsPerSecond = float64(received) / elapsed.Seconds()
+	}
+	return t
+}
+
+// Bench measures the throughput, latency and loss of the tunnel with a
+// benchmark session, the server answers it without creating an interface
+func (c *Client) Bench(cfg BenchConfig) (*BenchReport, error) {
+	var err error
+	c.log = c.Log.With("peer", c.RemoteHost)
+	c.conn, err = net.DialTimeout("tcp", c.RemoteHost, benchTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Can't connect to server %q: %v", c.RemoteHost, err)
+	}
+	defer c.conn.Close()
+	return c.benchSession(cfg)
+}
+
+// benchSession runs the benchmark session on the connection to the server
+func (c *Client) benchSession(cfg BenchConfig) (*BenchReport, error) {
+	c.bench = true
+	c.conn.SetDeadline(time.Now().Add(benchTimeout))
+	if err := c.handShake(); err != nil {
+		return nil, fmt.Errorf("Can't establish connection: %v", err)
+	}
+	c.conn.SetDeadline(time.Time{})
+	c.conn = bufferedConn{Conn: c.conn, r: c.reader}
+	c.session = c.Metrics.NewSession(c.RemoteHost)
+	c.session.log = c.log.With("session", c.session.ID)
+
+	dev := newMemDevice(cfg.Queues)
+	defer dev.Close()
+	go func() {
+		TunnelQueues(c.conn, dev.Queues(), c.session)
+		dev.Close()
+	}()
+	report, err := runBench(dev, cfg)
+	if err != nil {
+		return nil, err
+	}
+	report.Peer = c.RemoteHost
+	return report, nil
+}
+
+// BenchInProcess runs the benchmark against a responder in the same process,
+// both ends of the tunnel use an in-memory device and connection
+func BenchInProcess(cfg BenchConfig) (*BenchReport, error) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	clientDev, serverDev := newMemDevice(cfg.Queues), newMemDevice(cfg.Queues)
+	defer clientDev.Close()
+	defer serverDev.Close()
+
+	go benchResponder(serverDev)
+	go func() {
+		TunnelQueues(serverConn, serverDev.Queues(), &Session{ID: 1, Peer: "in-process"})
+		serverDev.Close()
+	}()
+	go func() {
+		TunnelQueues(clientConn, clientDev.Queues(), &Session{ID: 1, Peer: "in-process"})
+		clientDev.Close()
+	}()
+	report, err := runBench(clientDev, cfg)
+	if err != nil {
+		return nil, err
+	}
+	report.Peer = "in-process"
+	return report, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBenchConfig is a short benchmark
+func testBenchConfig() BenchConfig {
+	cfg := NewBenchConfig()
+	cfg.Duration = 100 * time.Millisecond
+	cfg.Pings = 5
+	cfg.PingInterval = time.Millisecond
+	return cfg
+}
+
+// startBenchServer starts a server that dials the clients accepted by ln
+func startBenchServer(t *testing.T, ln net.Listener, allow bool) *Server {
+	t.Helper()
+	var rec NetworkRecorder
+	s := newTestServer(ln, &rec)
+	s.AllowBench = allow
+	s.Once = true
+	go s.Start()
+	return s
+}
+
+// acceptBenchClient returns a client on the connection of the server
+func acceptBenchClient(t *testing.T, ln net.Listener) *Client {
+	t.Helper()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error: %v", err)
+	}
+	c := NewClient("")
+	c.conn = conn
+	c.log = c.Log
+	return c
+}
+
+func TestBenchSession(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := startBenchServer(t, ln, true)
+	defer s.Down()
+	c := acceptBenchClient(t, ln)
+	defer c.conn.Close()
+	report, err := c.benchSession(testBenchConfig())
+	if err != nil {
+		t.Fatalf("benchSession() error: %v", err)
+	}
+	if report.Latency.Received == 0 || report.Upload.Packets == 0 || report.Download.Packets == 0 {
+		t.Errorf("report without traffic: %+v", report)
+	}
+}
+
+func TestBenchRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := startBenchServer(t, ln, false)
+	defer s.Down()
+	c := acceptBenchClient(t, ln)
+	defer c.conn.Close()
+	_, err = c.benchSession(testBenchConfig())
+	if err == nil {
+		t.Fatalf("benchSession() refused by default succeeded")
+	}
+	if !strings.Contains(err.Error(), "deviceType not-allowed") {
+		t.Errorf("benchSession() error = %v, want a deviceType rejection", err)
+	}
+}
+
+func TestBenchSessionLimit(t *testing.T) {
+	defer func(d time.Duration) { maxBenchSession = d }(maxBenchSession)
+	maxBenchSession = 200 * time.Millisecond
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := startBenchServer(t, ln, true)
+	defer s.Down()
+	c := acceptBenchClient(t, ln)
+	defer c.conn.Close()
+	cfg := testBenchConfig()
+	cfg.Duration = 5 * time.Second
+	start := time.Now()
+	if _, err := c.benchSession(cfg); err == nil {
+		t.Fatalf("benchSession() longer than the limit succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("The server closed the session after %v", elapsed)
+	}
+}
+
+func BenchmarkBenchInProcess(b *testing.B) {
+	for _, size := range []int{64, 512, 1400} {
+		for _, queues := range []int{1, 4} {
+			b.Run(fmt.Sprintf("size=%d/queues=%d", size, queues), func(b *testing.B) {
+				cfg := testBenchConfig()
+				cfg.PacketSize = size
+				cfg.Queues = queues
+				cfg.Flows = queues
+				var bytes uint64
+				var seconds float64
+				for i := 0; i < b.N; i++ {
+					report, err := BenchInProcess(cfg)
+					if err != nil {
+						b.Fatalf("BenchInProcess() error: %v", err)
+					}
+					bytes += report.Upload.Bytes + report.Download.Bytes
+					seconds += report.Upload.Seconds + report.Download.Seconds
+				}
+				if seconds > 0 {
+					b.ReportMetric(float64(bytes)*8/seconds/1e6, "Mbps")
+				}
+			})
+		}
+	}
+}
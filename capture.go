@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pcapng block types and options, see https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-00.html
+const (
+	pcapngSectionHeader   = 0x0A0D0D0A
+	pcapngInterfaceDesc   = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1A2B3C4D
+	pcapngOptEnd          = 0
+	pcapngOptComment      = 1
+	pcapngOptName         = 2
+	pcapngOptEPBFlags     = 2
+	pcapngFlagInbound     = 1
+	pcapngFlagOutbound    = 2
+	linkTypeRaw           = 101
+	linkTypeEthernet      = 1
+	pcapngInterfaceTUN    = 0
+	pcapngInterfaceTAP    = 1
+	pcapngBlockOverhead   = 12
+	pcapngEPBHeaderLength = 20
+)
+
+// CaptureConfig configures a packet capture
+type CaptureConfig struct {
+	// File is the pcapng file, rotated files are suffixed with .1, .2, ...
+	File string `json:"file"`
+	// Filter selects the packets captured, e.g. "tcp and dst port 80"
+	Filter string `json:"filter,omitempty"`
+	// MaxSize is the size in bytes that triggers the rotation, 0 disables it
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// MaxFiles is the number of files kept when rotating
+	MaxFiles int `json:"maxFiles,omitempty"`
+}
+
+// PacketCapture writes the packets forwarded by the tunnel sessions to a
+// pcapng file, it can be started and stopped while the tunnel is running
+type PacketCapture struct {
+	// active is checked in the packet path to avoid the lock when not capturing
+	active int32
+	mu     sync.Mutex
+	config CaptureConfig
+	filter packetFilter
+	file   *os.File
+	w      *bufio.Writer
+	size   int64
+}
+
+// Start starts capturing packets
+func (c *PacketCapture) Start(cfg CaptureConfig) error {
+	if cfg.File == "" {
+		return fmt.Errorf("Capture file required")
+	}
+	if cfg.MaxSize < 0 || cfg.MaxFiles < 0 {
+		return fmt.Errorf("Invalid capture rotation size %d files %d", cfg.MaxSize, cfg.MaxFiles)
+	}
+	filter, err := parseFilter(cfg.Filter)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file != nil {
+		return fmt.Errorf("Capture already running to %s", c.config.File)
+	}
+	c.config = cfg
+	c.filter = filter
+	if err := c.open(); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&c.active, 1)
+	logger.Info("Capture started", "file", cfg.File, "filter", cfg.Filter)
+	return nil
+}
+
+// Stop stops capturing packets and closes the capture file
+func (c *PacketCapture) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return fmt.Errorf("Capture not running")
+	}
+	logger.Info("Capture stopped", "file", c.config.File)
+	return c.close()
+}
+
+// File returns the file of the running capture, empty if not capturing
+func (c *PacketCapture) File() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return ""
+	}
+	return c.config.File
+}
+
+// Write captures the packet if it matches the filter, outbound packets are
+// the ones read from the interface and sent to the peer of the session
+func (c *PacketCapture) Write(s *Session, outbound bool, packet []byte) {
+	if c == nil || atomic.LoadInt32(&c.active) == 0 {
+		return
+	}
+	var info packetInfo
+	if s.TAP {
+		info, _ = parseEthernetFrame(packet)
+	} else {
+		info, _ = parseIPPacket(packet)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil || !c.filter.Match(info) {
+		return
+	}
+	if err := c.writePacket(s, outbound, packet); err != nil {
+		logger.Error("Error writing capture, capture stopped", "file", c.config.File, "err", err)
+		c.close()
+	}
+}
+
+func (c *PacketCapture) open() error {
+	f, err := os.OpenFile(c.config.File, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	c.file = f
+	c.w = bufio.NewWriter(f)
+	c.size = 0
+	if err := c.writeHeader(); err != nil {
+		c.close()
+		return err
+	}
+	return nil
+}
+
+func (c *PacketCapture) close() error {
+	atomic.StoreInt32(&c.active, 0)
+	if c.file == nil {
+		return nil
+	}
+	err := c.w.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	c.file = nil
+	c.w = nil
+	return err
+}
+
+// rotate moves file to file.1, file.1 to file.2, ... and starts a new file
+func (c *PacketCapture) rotate() error {
+	if err := c.close(); err != nil {
+		return err
+	}
+	path := c.config.File
+	if c.config.MaxFiles > 1 {
+		for i := c.config.MaxFiles - 2; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		}
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+	if err := c.open(); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&c.active, 1)
+	return nil
+}
+
+// writeHeader writes the section header and the interface descriptions,
+// the packets of TUN interfaces are raw IP and the ones of TAP are Ethernet
+func (c *PacketCapture) writeHeader() error {
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	// Unknown section length
+	binary.LittleEndian.PutUint64(shb[8:], 0xFFFFFFFFFFFFFFFF)
+	if err := c.writeBlock(pcapngSectionHeader, shb); err != nil {
+		return err
+	}
+	for _, idb := range []struct {
+		linkType uint16
+		name     string
+	}{
+		{linkTypeRaw, "tun"},
+		{linkTypeEthernet, "tap"},
+	} {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint16(b[0:], idb.linkType)
+		binary.LittleEndian.PutUint32(b[4:], maxPacketSize)
+		b = appendOption(b, pcapngOptName, []byte(idb.name))
+		b = appendOption(b, pcapngOptEnd, nil)
+		if err := c.writeBlock(pcapngInterfaceDesc, b); err != nil {
+			return err
+		}
+	}
+	return c.w.Flush()
+}
+
+// writePacket writes an enhanced packet block annotated with the direction
+// and the session, rotating the file if it exceeds the maximum size
+func (c *PacketCapture) writePacket(s *Session, outbound bool, packet []byte) error {
+	ifID := uint32(pcapngInterfaceTUN)
+	if s.TAP {
+		ifID = pcapngInterfaceTAP
+	}
+	// Timestamps are in microseconds, the default resolution
+	ts := uint64(time.Now().UnixNano() / int64(time.Microsecond))
+	b := make([]byte, pcapngEPBHeaderLength, pcapngEPBHeaderLength+len(packet)+64)
+	binary.LittleEndian.PutUint32(b[0:], ifID)
+	binary.LittleEndian.PutUint32(b[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(b[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(b[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(b[16:], uint32(len(packet)))
+	b = append(b, packet...)
+	b = append(b, make([]byte, pad4(len(packet)))...)
+	flags := make([]byte, 4)
+	if outbound {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagOutbound)
+	} else {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagInbound)
+	}
+	b = appendOption(b, pcapngOptEPBFlags, flags)
+	b = appendOption(b, pcapngOptComment, []byte(fmt.Sprintf("session %d peer %s", s.ID, s.Peer)))
+	b = appendOption(b, pcapngOptEnd, nil)
+
+	if c.config.MaxSize > 0 && c.size > 0 && c.size+int64(len(b)+pcapngBlockOverhead) > c.config.MaxSize {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	if err := c.writeBlock(pcapngEnhancedPacket, b); err != nil {
+		return err
+	}
+	// Don't lose the packets if tuncat is killed
+	return c.w.Flush()
+}
+
+// writeBlock writes the block type, its length, the body and the length again
+func (c *PacketCapture) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(len(body) + pcapngBlockOverhead)
+	hdr := make([]byte, 8)
+	binary.LittleEndian.PutUint32(hdr[0:], blockType)
+	binary.LittleEndian.PutUint32(hdr[4:], length)
+	if _, err := c.w.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(body); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(hdr[4:]); err != nil {
+		return err
+	}
+	c.size += int64(length)
+	return nil
+}
+
+// appendOption appends a pcapng option padded to 32 bits
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	opt := make([]byte, 4, 4+len(value)+3)
+	binary.LittleEndian.PutUint16(opt[0:], code)
+	binary.LittleEndian.PutUint16(opt[2:], uint16(len(value)))
+	opt = append(opt, value...)
+	opt = append(opt, make([]byte, pad4(len(value)))...)
+	return append(b, opt...)
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
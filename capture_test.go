@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pcapngBlock is a block read from a pcapng file
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+// readPcapng returns the blocks of the file checking their framing
+func readPcapng(t *testing.T, path string) []pcapngBlock {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocks []pcapngBlock
+	for len(b) > 0 {
+		if len(b) < pcapngBlockOverhead {
+			t.Fatalf("Truncated block in %s", path)
+		}
+		length := binary.LittleEndian.Uint32(b[4:8])
+		if length%4 != 0 || int(length) > len(b) || binary.LittleEndian.Uint32(b[length-4:length]) != length {
+			t.Fatalf("Invalid block length %d in %s", length, path)
+		}
+		blocks = append(blocks, pcapngBlock{binary.LittleEndian.Uint32(b[0:4]), b[8 : length-4]})
+		b = b[length:]
+	}
+	return blocks
+}
+
+// epbFlags returns the flags option of an enhanced packet block
+func epbFlags(body []byte) (uint32, string) {
+	captured := binary.LittleEndian.Uint32(body[12:16])
+	opts := body[pcapngEPBHeaderLength+int(captured)+pad4(int(captured)):]
+	var flags uint32
+	var comment string
+	for len(opts) >= 4 {
+		code := binary.LittleEndian.Uint16(opts[0:2])
+		n := int(binary.LittleEndian.Uint16(opts[2:4]))
+		value := opts[4 : 4+n]
+		switch code {
+		case pcapngOptEPBFlags:
+			flags = binary.LittleEndian.Uint32(value)
+		case pcapngOptComment:
+			comment = string(value)
+		}
+		opts = opts[4+n+pad4(n):]
+	}
+	return flags, comment
+}
+
+func TestCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	c := &PacketCapture{}
+	if err := c.Start(CaptureConfig{File: path, Filter: "udp"}); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if err := c.Start(CaptureConfig{File: path}); err == nil {
+		t.Errorf("Start() of a running capture succeeded")
+	}
+	s := &Session{ID: 7, Peer: "10.0.0.1:1000"}
+	tcp := newTestPacket(protoTCP, "10.0.0.1", "172.17.0.2", 40000, 80, 60)
+	udp := newTestPacket(protoUDP, "10.0.0.1", "172.17.0.2", 40000, 53, 61)
+	c.Write(s, true, tcp)
+	c.Write(s, false, udp)
+	c.Write(s, true, udp)
+	if c.File() != path {
+		t.Errorf("File() = %q, want %q", c.File(), path)
+	}
+	if err := c.Stop(); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	if err := c.Stop(); err == nil {
+		t.Errorf("Stop() of a stopped capture succeeded")
+	}
+	// Not captured once stopped
+	c.Write(s, true, udp)
+
+	blocks := readPcapng(t, path)
+	types := []uint32{pcapngSectionHeader, pcapngInterfaceDesc, pcapngInterfaceDesc, pcapngEnhancedPacket, pcapngEnhancedPacket}
+	if len(blocks) != len(types) {
+		t.Fatalf("%d blocks, want %d", len(blocks), len(types))
+	}
+	for i, b := range blocks {
+		if b.blockType != types[i] {
+			t.Errorf("block %d type %#x, want %#x", i, b.blockType, types[i])
+		}
+	}
+	if magic := binary.LittleEndian.Uint32(blocks[0].body); magic != pcapngByteOrderMagic {
+		t.Errorf("byte order magic %#x", magic)
+	}
+	if lt := binary.LittleEndian.Uint16(blocks[1].body); lt != linkTypeRaw {
+		t.Errorf("TUN link type %d, want %d", lt, linkTypeRaw)
+	}
+	for i, want := range []uint32{pcapngFlagInbound, pcapngFlagOutbound} {
+		body := blocks[3+i].body
+		if id := binary.LittleEndian.Uint32(body[0:4]); id != pcapngInterfaceTUN {
+			t.Errorf("packet %d interface %d, want %d", i, id, pcapngInterfaceTUN)
+		}
+		captured := binary.LittleEndian.Uint32(body[12:16])
+		if !bytes.Equal(body[pcapngEPBHeaderLength:pcapngEPBHeaderLength+captured], udp) {
+			t.Errorf("packet %d content differs", i)
+		}
+		flags, comment := epbFlags(body)
+		if flags != want {
+			t.Errorf("packet %d flags %d, want %d", i, flags, want)
+		}
+		if !strings.Contains(comment, "session 7 peer 10.0.0.1:1000") {
+			t.Errorf("packet %d comment %q", i, comment)
+		}
+	}
+}
+
+func TestCaptureRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	c := &PacketCapture{}
+	if err := c.Start(CaptureConfig{File: path, MaxSize: 1024, MaxFiles: 3}); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	s := &Session{ID: 1, Peer: "10.0.0.1:1000"}
+	for i := 0; i < 20; i++ {
+		c.Write(s, true, newTestPacket(protoUDP, "10.0.0.1", "172.17.0.2", 40000, 53, 200))
+	}
+	c.Stop()
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Rotated file missing: %v", err)
+		}
+		if fi.Size() > 1024 {
+			t.Errorf("%s size %d exceeds the maximum", name, fi.Size())
+		}
+		if blocks := readPcapng(t, name); blocks[0].blockType != pcapngSectionHeader {
+			t.Errorf("%s doesn't start with a section header", name)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("More files than the maximum kept")
+	}
+}
+
+func TestCaptureConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, cfg := range []CaptureConfig{
+		{},
+		{File: filepath.Join(dir, "a"), Filter: "port"},
+		{File: filepath.Join(dir, "b"), MaxSize: -1},
+		{File: filepath.Join(dir, "missing", "c")},
+	} {
+		c := &PacketCapture{}
+		if err := c.Start(cfg); err == nil {
+			t.Errorf("Start(%+v) succeeded", cfg)
+			c.Stop()
+		}
+	}
+}
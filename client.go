@@ -3,40 +3,127 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/songgao/water"
 )
 
 // Client represents a client to our server.
 type Client struct {
 	conn   net.Conn
-	ifce   *water.Interface
-	netCfg Netconfig
+	reader *bufio.Reader
+	ifce   interfaceQueues
+	// session is the tunnel session with the server
+	session *Session
+	netCfg  NetworkConfigurator
+	helper  *cleanupHelper
+	// connector waits for the server in reverse tunnels
+	connector Connector
+	// done is closed when the client is closed
+	done      chan struct{}
+	closeOnce sync.Once
+	started   time.Time
+	// mu protects the interface read by the control socket
+	mu sync.Mutex
+	// dhcpRouter is set if the gateway is the router of the DHCP lease
+	dhcpRouter bool
+	// NewNetworkConfigurator creates the configurator used to modify the host network
+	NewNetworkConfigurator NetworkConfiguratorFunc
+	// HostNetwork answers the queries about the current network of the host
+	HostNetwork HostNetwork
+	// Metrics of the tunnel session
+	Metrics *Metrics
+	// Capture of the tunnel packets
+	Capture *PacketCapture
+	// Log is the logger of the client, log adds the session context
+	Log *Logger
+	log *Logger
 	// Config
-	IfAddress     string
-	RemoteHost    string
+	IfAddress  string
+	Interface  InterfaceConfig
+	RemoteHost string
+	// ListenAddress, if set, is the address where the client waits for the
+	// server to connect (reverse tunnel), only the host of RemoteHost is
+	// accepted if it is set
+	ListenAddress string
+	// Relay, if set, is where the client meets the server
+	Relay         *RelayConfig
 	RemoteNetwork string
 	RemoteGateway string
+	// HardwareAddr is the MAC address of the TAP interface
+	HardwareAddr string
+	// DHCP obtains the TAP interface address from the remote network
+	DHCP bool
+	// Privileges, if set, is the identity used once the network is configured
+	Privileges *PrivilegeConfig
+	// Compression is the codec requested to compress the frames
+	Compression string
+	// FullTunnel routes all the traffic through the tunnel
+	FullTunnel bool
+	// AcceptDNS applies the DNS configuration pushed by the server, it's off by
+	// default because it lets the server take over the name resolution
+	AcceptDNS bool
+	// AcceptRoutes routes the networks advertised by the server through the
+	// tunnel, it's off by default because it lets the server take over the
+	// traffic to those networks
+	AcceptRoutes bool
+	// bench requests a benchmark session instead of a tunnel
+	bench bool
+	// gso is set if the server accepts super-packets
+	gso bool
+	// compression is the codec accepted by the server
+	compression string
+	// dns is the DNS configuration pushed by the server, dnsConfigured is set once applied
+	dns           *DNSConfig
+	dnsConfigured bool
+	// routes are the static routes added, the route pinned to the server
+	// goes first so it is deleted last
+	routes []StaticRoute
+	// acceptedRoutes is set if the client accepted the networks advertised,
+	// serverRoutes are the ones advertised in the handshake and advertised
+	// the routes added to them
+	acceptedRoutes bool
+	serverRoutes   []string
+	advertised     []StaticRoute
 }
 
+// dhcpTimeout is the time to wait for each DHCP reply
+const dhcpTimeout = 5 * time.Second
+
 // NewClient returns a new instance of Client with default settings.
 func NewClient(remoteHost string) *Client {
 	return &Client{
-		RemoteHost: remoteHost,
+		done:                   make(chan struct{}),
+		RemoteHost:             remoteHost,
+		Interface:              NewInterfaceConfig(),
+		NewNetworkConfigurator: newHostNetworkConfigurator,
+		HostNetwork:            hostNetwork{},
+		Metrics:                NewMetrics(),
+		Capture:                &PacketCapture{},
+		Log:                    logger,
+		Compression:            compressionNone,
 	}
 }
 
 // Start a new tunnel client
 func (c *Client) Start() error {
 	var err error
-	c.conn, err = net.Dial("tcp", c.RemoteHost)
-	if err != nil {
+	c.started = time.Now()
+	if c.ListenAddress != "" || c.Relay != nil {
+		if err := c.waitServer(); err != nil {
+			select {
+			case <-c.done:
+				// Closed on purpose
+				return nil
+			default:
+				return err
+			}
+		}
+	} else if c.conn, err = net.Dial("tcp", c.RemoteHost); err != nil {
 		return fmt.Errorf("Can't connect to server %q: %v", c.RemoteHost, err)
 	}
+	c.log = c.Log.With("peer", c.RemoteHost)
 	// Establish the connection: send the tunnel parameters
 	errChan := make(chan error, 1)
 	timeout := 10 * time.Second
@@ -49,38 +136,190 @@ func (c *Client) Start() error {
 	select {
 	case err := <-errChan:
 		if err != nil {
-			log.Fatalf("Can't establish connection: %v", err)
+			reason := "error"
+			if _, ok := err.(*RouteRejection); ok {
+				reason = "rejected"
+			}
+			c.Metrics.HandshakeFailed(reason)
+			return fmt.Errorf("Can't establish connection: %v", err)
 		}
 	case <-time.After(timeout):
-		log.Fatal("Can't establish connection: Timed Out")
+		c.Metrics.HandshakeFailed("timeout")
+		return fmt.Errorf("Can't establish connection: Timed Out")
 	}
+	c.Metrics.HandshakeSucceeded()
+	// The handshake reader may have buffered the first frames
+	c.conn = dataConn(c.conn, c.reader)
+	c.session = c.Metrics.NewSession(c.RemoteHost)
+	c.session.TAP = c.Interface.TAP
+	c.session.GSO = c.gso
+	c.session.Compression = c.compression
+	c.session.capture = c.Capture
+	if c.acceptedRoutes {
+		c.session.onRoutes = func(routes []string) {
+			c.setAdvertised(c.ifce.Name(), routes)
+		}
+	}
+	c.log = c.log.With("session", c.session.ID)
+	c.log.Info("Session established", "compression", c.compression)
 
 	// Create the Host Interface
-	log.Println("Create Host Interface ...")
 	err = c.createInterface()
 	if err != nil {
-		log.Fatalf("Error creating Host Interface: %v", err)
+		return fmt.Errorf("Error creating Host Interface: %v", err)
 	}
 	// Configure the interface network
-	log.Println("Setup Interface Network...")
-	err = c.setupNetwork()
+	err = c.setupNetwork(c.ifce.Name())
 	if err != nil {
-		log.Fatalf("Error creating Host Interface: %v", err)
+		return fmt.Errorf("Error creating Host Interface: %v", err)
+	}
+	c.session.log = c.log
+	// Run the tunnel
+	tunnelErr := make(chan error, 1)
+	go func() {
+		tunnelErr <- TunnelQueues(c.conn, c.ifce.readWriters(), c.session)
+	}()
+	// The DHCP server is reached through the tunnel
+	if c.DHCP {
+		c.log.Info("Requesting DHCP lease")
+		if err := c.configureDHCP(c.ifce.Name()); err != nil {
+			return fmt.Errorf("Error obtaining DHCP lease: %v", err)
+		}
+	}
+	// Root is no longer needed
+	if c.Privileges != nil {
+		c.log.Info("Dropping privileges", "uid", c.Privileges.UID, "gid", c.Privileges.GID)
+		// The routes are not updated once the helper has a copy
+		c.mu.Lock()
+		c.helper, err = dropPrivileges(*c.Privileges, cleanupSpec{
+			IfAddress:     c.IfAddress,
+			RemoteNetwork: c.RemoteNetwork,
+			RemoteGateway: c.routeGateway(),
+			Dev:           c.ifce.Name(),
+			Routes:        append(append([]StaticRoute{}, c.routes...), c.advertised...),
+			DNS:           c.configuredDNS(),
+		})
+		c.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("Error dropping privileges: %v", err)
+		}
+	}
+	// Block until the tunnel finishes
+	err = <-tunnelErr
+	select {
+	case <-c.done:
+		// Closed on purpose
+		return nil
+	default:
+		return err
 	}
-	// Run the tunnel and block
-	return Tunnel(c.conn, c.ifce)
+}
+
+// waitServer waits for the connection of the server, the connections from
+// other hosts than RemoteHost, if set, are refused. With a relay the server
+// is met there.
+func (c *Client) waitServer() error {
+	if c.Relay != nil {
+		return c.waitRelay()
+	}
+	ln, err := newListenConnector(c.ListenAddress)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	c.mu.Lock()
+	c.connector = ln
+	c.mu.Unlock()
+	allowed, _, _ := net.SplitHostPort(c.RemoteHost)
+	var allowedIPs []net.IP
+	if allowed != "" {
+		if allowedIPs, err = net.LookupIP(allowed); err != nil {
+			return fmt.Errorf("Can't resolve server %q: %v", allowed, err)
+		}
+	}
+	c.Log.Info("Waiting for the server", "address", c.ListenAddress, "allowed", allowed)
+	for {
+		conn, err := ln.Connect()
+		if err != nil {
+			return err
+		}
+		if allowed != "" && !containsIP(allowedIPs, conn.RemoteAddr().(*net.TCPAddr).IP) {
+			c.Log.Warn("Refusing connection", "peer", conn.RemoteAddr().String(), "allowed", allowed)
+			conn.Close()
+			continue
+		}
+		c.mu.Lock()
+		c.conn = conn
+		c.RemoteHost = conn.RemoteAddr().String()
+		c.mu.Unlock()
+		return nil
+	}
+}
+
+// waitRelay waits for the server at the relay
+func (c *Client) waitRelay() error {
+	connector := newRelayConnector(*c.Relay, relayRoleClient, c.Log)
+	c.mu.Lock()
+	c.connector = connector
+	c.mu.Unlock()
+	c.Log.Info("Connecting to relay", "address", c.Relay.Address, "punch", c.Relay.Punch)
+	conn, err := connector.Connect()
+	if err != nil {
+		connector.Close()
+		return err
+	}
+	c.mu.Lock()
+	c.conn = conn
+	c.RemoteHost = conn.RemoteAddr().String()
+	c.mu.Unlock()
+	return nil
+}
+
+// containsIP returns true if the address is in the list
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // Close disconnects the underlying connection to the server.
 func (c *Client) Close() {
-	log.Println("Shutting down the client...")
+	c.closeOnce.Do(c.close)
+}
+
+func (c *Client) close() {
+	if c.log == nil {
+		c.log = c.Log
+	}
+	c.log.Info("Shutting down the client")
+	close(c.done)
+	c.mu.Lock()
+	if c.connector != nil {
+		c.connector.Close()
+	}
+	c.mu.Unlock()
 	// Close the connection
 	if c.conn != nil {
 		c.conn.Close()
 	}
+	if c.session != nil {
+		c.Metrics.EndSession(c.session)
+	}
 	// Delete host interface network configuration
-	if err := c.netCfg.DeleteRoutes(); err != nil {
-		log.Printf("Error deleting routes: %v", err)
+	if c.helper != nil {
+		if err := c.helper.Close(); err != nil {
+			c.log.Error("Error cleaning up network", "err", err)
+		}
+	} else if c.netCfg != nil {
+		if c.dnsConfigured {
+			if err := c.netCfg.RevertDNS(*c.dns); err != nil {
+				c.log.Error("Error restoring DNS configuration", "err", err)
+			}
+		}
+		c.deleteRoutes()
 	}
 	if c.ifce != nil {
 		// Close interface
@@ -88,61 +327,547 @@ func (c *Client) Close() {
 	}
 }
 
+// deleteRoutes deletes the routes through the interface, the advertised ones first
+func (c *Client) deleteRoutes() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.advertised {
+		if err := c.netCfg.DeleteRoute(r); err != nil {
+			c.log.Error("Error deleting routes", "err", err)
+		}
+	}
+	c.advertised = nil
+	if err := c.netCfg.DeleteRoutes(); err != nil {
+		c.log.Error("Error deleting routes", "err", err)
+	}
+	for i := len(c.routes) - 1; i >= 0; i-- {
+		if err := c.netCfg.DeleteRoute(c.routes[i]); err != nil {
+			c.log.Error("Error deleting routes", "err", err)
+		}
+	}
+	c.routes = nil
+}
+
+// Status returns the status of the tunnel
+func (c *Client) Status() *Status {
+	status := &Status{
+		Mode:     "client",
+		Peer:     c.RemoteHost,
+		Uptime:   time.Since(c.started).Round(time.Second).String(),
+		Capture:  c.Capture.File(),
+		Sessions: []SessionStatus{},
+	}
+	if c.RemoteNetwork != "" {
+		status.Routes = []string{fmt.Sprintf("%s via %s", c.RemoteNetwork, c.routeGateway())}
+	}
+	for _, s := range c.Metrics.Sessions() {
+		status.Sessions = append(status.Sessions, sessionStatus(s))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.routes {
+		status.Routes = append(status.Routes, r.String())
+	}
+	for _, r := range c.advertised {
+		status.Routes = append(status.Routes, r.String())
+	}
+	status.DNS = c.configuredDNS()
+	if c.ifce != nil {
+		status.Interface = c.ifce.Name()
+		status.Addresses = interfaceAddresses(c.ifce.Name())
+	}
+	return status
+}
+
+// Down tears down the tunnel
+func (c *Client) Down() error {
+	c.Close()
+	return nil
+}
+
+// Kick is not supported, the client only has one session
+func (c *Client) Kick(session uint64) error {
+	return fmt.Errorf("The client only has one session, use down instead")
+}
+
+func (c *Client) packetCapture() *PacketCapture {
+	return c.Capture
+}
+
 // handShake do the tunnel connection negotiation sending the configuration parameters for the serveer
 // messages has to be echoed from the server in order to the connection to be established
 func (c *Client) handShake() error {
-	reader := bufio.NewReader(c.conn)
+	c.reader = bufio.NewReader(c.conn)
 	// Send configuration to the server
-	text := fmt.Sprintf("remoteNetwork:%s", c.RemoteNetwork)
+	if err := c.sendParameter(c.reader, "remoteNetwork", c.RemoteNetwork); err != nil {
+		return err
+	}
+	if err := c.sendParameter(c.reader, "remoteGateway", c.RemoteGateway); err != nil {
+		return err
+	}
+	deviceType := "tun"
+	if c.Interface.TAP {
+		deviceType = "tap"
+	}
+	if c.bench {
+		deviceType = "bench"
+	}
+	if err := c.sendParameter(c.reader, "deviceType", deviceType); err != nil {
+		return err
+	}
+	// Each side announces if it wants to receive super-packets, they are never
+	// sent on the direct UDP path
+	offload := "none"
+	if c.Interface.Offload && !c.bench && !directPath(c.conn) {
+		offload = "gso"
+	}
+	serverOffload, err := c.negotiateParameter(c.reader, "offload", offload)
+	if err != nil {
+		return err
+	}
+	c.gso = serverOffload == "gso" && !directPath(c.conn)
+	// The server answers the codec used, none if it doesn't accept the one requested
+	compression := c.Compression
+	if c.bench {
+		compression = compressionNone
+	}
+	if c.compression, err = c.negotiateParameter(c.reader, "compression", compression); err != nil {
+		return err
+	}
+	if c.compression != compression && c.compression != compressionNone {
+		return fmt.Errorf("Connection error, Requested compression: %s Received: %s", compression, c.compression)
+	}
+	// The server routes the tunnel address back through the tunnel
+	fullTunnel := "none"
+	if c.FullTunnel && !c.bench {
+		fullTunnel = c.IfAddress
+	}
+	if err := c.sendParameter(c.reader, "fullTunnel", fullTunnel); err != nil {
+		return err
+	}
+	// The server answers the DNS configuration to apply, if any
+	acceptDNS := "ignore"
+	if c.AcceptDNS && !c.bench {
+		acceptDNS = "accept"
+		// The server routes the answers of its DNS forwarder to the address
+		if !c.Interface.TAP && c.IfAddress != "" {
+			acceptDNS += " " + c.IfAddress
+		}
+	}
+	dns, err := c.negotiateParameter(c.reader, "dns", acceptDNS)
+	if err != nil {
+		return err
+	}
+	if c.dns, err = parseDNSHandshake(dns); err != nil {
+		return err
+	}
+	// The server answers the networks it advertises, if any
+	acceptRoutes := "ignore"
+	if c.AcceptRoutes && !c.Interface.TAP && !c.bench {
+		acceptRoutes = "accept"
+		// The server routes the replies of the advertised networks to the address
+		if c.IfAddress != "" {
+			acceptRoutes += " " + c.IfAddress
+		}
+	}
+	routes, err := c.negotiateParameter(c.reader, "routes", acceptRoutes)
+	if err != nil {
+		return err
+	}
+	if c.serverRoutes, err = parseRoutesHandshake(routes); err != nil {
+		return err
+	}
+	c.acceptedRoutes = strings.HasPrefix(acceptRoutes, "accept")
+	return nil
+}
+
+// sendParameter sends a configuration parameter and waits for the server acknowledge
+func (c *Client) sendParameter(reader *bufio.Reader, key, value string) error {
+	text := fmt.Sprintf("%s:%s", key, value)
 	c.conn.Write([]byte(text + "\n"))
 	// wait for acknowledge
 	message, _ := reader.ReadString('\n')
-	// output message received
-	log.Printf("Message Received: %s", message)
-	if strings.TrimSpace(message) != text {
-		return fmt.Errorf("Connection error, Sent: %s Received: %s", text, message)
+	c.log.Debug("Handshake message received", "message", strings.TrimSpace(message))
+	if r, ok := parseRouteRejection(message); ok {
+		return r
 	}
-	// Send configuration to the server
-	text = fmt.Sprintf("remoteGateway:%s", c.RemoteGateway)
-	c.conn.Write([]byte(text + "\n"))
-	// wait for acknowledge
-	message, _ = reader.ReadString('\n')
-	// output message received
-	log.Printf("Message Received: %s", message)
 	if strings.TrimSpace(message) != text {
 		return fmt.Errorf("Connection error, Sent: %s Received: %s", text, message)
 	}
 	return nil
 }
 
+// negotiateParameter sends a configuration parameter and returns the value the server answers
+func (c *Client) negotiateParameter(reader *bufio.Reader, key, value string) (string, error) {
+	text := fmt.Sprintf("%s:%s", key, value)
+	c.conn.Write([]byte(text + "\n"))
+	message, _ := reader.ReadString('\n')
+	c.log.Debug("Handshake message received", "message", strings.TrimSpace(message))
+	if r, ok := parseRouteRejection(message); ok {
+		return "", r
+	}
+	m := strings.SplitN(strings.TrimSpace(message), ":", 2)
+	if len(m) != 2 || m[0] != key {
+		return "", fmt.Errorf("Connection error, Sent: %s Received: %s", text, message)
+	}
+	return m[1], nil
+}
+
 func (c *Client) createInterface() error {
 	// Create TUN interface
-	// TODO: Windows have some network specific parameters
-	// https://github.com/songgao/water/blob/master/params_windows.go
-	var err error
-	c.ifce, err = water.New(water.Config{
-		DeviceType: water.TUN,
-	})
+	cfg := c.Interface
+	cfg.Address = c.IfAddress
+	ifce, err := newInterfaceQueues(cfg)
 	if err != nil {
-		return fmt.Errorf("Error creating interface: %v", err)
+		return err
 	}
-	log.Printf("Interface Name: %s\n", c.ifce.Name())
+	c.mu.Lock()
+	c.ifce = ifce
+	c.mu.Unlock()
+	c.log = c.log.With("interface", ifce.Name())
+	c.log.Info("Interface created")
 	return nil
 }
 
-func (c *Client) setupNetwork() error {
+// routeGateway returns the gateway of the remote network, TUN interfaces are point
+// to point but TAP interfaces need a gateway in the remote network
+func (c *Client) routeGateway() string {
+	if c.Interface.TAP {
+		return c.RemoteGateway
+	}
+	return c.IfAddress
+}
+
+// setupNetwork configures the interface, it can be called again to configure
+// the address and routes once they are known, i.e. obtained by DHCP
+func (c *Client) setupNetwork(ifName string) error {
 	// Create the networking configuration
 	// Set up routes to remote network depending if we are a server or a client
-	c.netCfg = NewNetconfig(c.IfAddress, c.RemoteNetwork, c.IfAddress, c.ifce.Name())
+	c.netCfg = c.NewNetworkConfigurator(c.IfAddress, c.RemoteNetwork, c.routeGateway(), ifName)
+	if c.HardwareAddr != "" {
+		if err := c.netCfg.SetHardwareAddr(c.HardwareAddr); err != nil {
+			return fmt.Errorf("Error setting interface hardware address: %v", err)
+		}
+	}
 	// The network configuration is deleted when the interface is destroyed
 	if err := c.netCfg.SetupNetwork(); err != nil {
 		return fmt.Errorf("Error configuting interface network: %v", err)
 	}
-	log.Printf("Interface Up: %s\n", c.ifce.Name())
+	c.log.Info("Interface up")
+	if c.dns != nil && !c.dnsConfigured {
+		// The tunnel is still useful without the names
+		c.log.Info("Configure DNS", "servers", strings.Join(c.dns.Servers, ","), "search", strings.Join(c.dns.Search, ","))
+		if err := c.netCfg.SetDNS(*c.dns); err != nil {
+			c.log.Warn("Error configuring DNS", "err", err)
+		} else {
+			c.mu.Lock()
+			c.dnsConfigured = true
+			c.mu.Unlock()
+		}
+	}
+	// Wait for the address to configure the routes
+	if c.IfAddress == "" {
+		return nil
+	}
 
-	log.Printf("Add route %v\n", c.netCfg.routes)
+	if err := c.pinServerRoute(); err != nil {
+		return err
+	}
+	c.log.Info("Add route", "network", c.RemoteNetwork, "gateway", c.routeGateway())
 	if err := c.netCfg.CreateRoutes(); err != nil {
 		return fmt.Errorf("Error creating routes: %v", err)
 	}
+	if c.dnsConfigured && !c.Interface.TAP {
+		// The DNS forwarder of the server listens on its tunnel address
+		for _, server := range c.dns.Tunnel {
+			if server == c.IfAddress {
+				c.log.Warn("Not routing the DNS server, it's the interface address", "server", server)
+				continue
+			}
+			r := StaticRoute{Network: server, Dev: ifName}
+			c.log.Info("Add DNS server route", "network", r.Network, "dev", r.Dev)
+			if err := c.netCfg.AddRoute(r); err != nil {
+				return fmt.Errorf("Error creating routes: %v", err)
+			}
+			c.mu.Lock()
+			c.routes = append(c.routes, r)
+			c.mu.Unlock()
+		}
+	}
+	if c.FullTunnel {
+		// The halves of the address space are more specific than the default
+		// route, that is kept, and less specific than the local networks
+		for _, network := range splitDefault(c.IfAddress) {
+			r := StaticRoute{Network: network, Dev: ifName}
+			c.log.Info("Add full tunnel route", "network", r.Network, "dev", r.Dev)
+			if err := c.netCfg.AddRoute(r); err != nil {
+				return fmt.Errorf("Error creating routes: %v", err)
+			}
+			c.mu.Lock()
+			c.routes = append(c.routes, r)
+			c.mu.Unlock()
+		}
+	}
+	if c.acceptedRoutes {
+		c.setAdvertised(ifName, c.serverRoutes)
+	}
 	return nil
 }
+
+// setAdvertised routes the networks advertised by the server through the
+// interface and deletes the routes to the ones no longer advertised. The
+// networks that are too broad, overlap the local ones or contain the server
+// are not routed.
+func (c *Client) setAdvertised(ifName string, networks []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	connected, err := c.HostNetwork.ConnectedNetworks()
+	if err != nil {
+		c.log.Error("Error listing the local networks", "err", err)
+		return
+	}
+	if c.RemoteNetwork != "" {
+		if remote, err := parseNetwork(c.RemoteNetwork); err == nil {
+			connected = append(connected, remote)
+		}
+	}
+	server, _ := parseNetwork(c.serverIP().String())
+	wanted := map[string]bool{}
+	for _, network := range networks {
+		ipNet, err := parseNetwork(network)
+		if err != nil {
+			c.log.Warn("Ignoring invalid advertised network", "network", network)
+			continue
+		}
+		if routeTooBroad(ipNet) {
+			c.log.Warn("Ignoring advertised network too broad to be routed", "network", ipNet)
+			continue
+		}
+		if server != nil && networksOverlap(ipNet, server) {
+			c.log.Warn("Ignoring advertised network containing the server", "network", ipNet)
+			continue
+		}
+		overlap := false
+		for _, n := range connected {
+			if networksOverlap(ipNet, n) {
+				c.log.Warn("Ignoring advertised network overlapping a local network", "network", ipNet, "local", n)
+				overlap = true
+				break
+			}
+		}
+		if !overlap {
+			wanted[ipNet.String()] = true
+		}
+	}
+	changed := len(wanted) != len(c.advertised)
+	for _, r := range c.advertised {
+		changed = changed || !wanted[r.Network]
+	}
+	if !changed {
+		return
+	}
+	if c.helper != nil {
+		c.log.Warn("Can't update the advertised routes without privileges", "networks", strings.Join(networks, ","))
+		return
+	}
+	var advertised []StaticRoute
+	for _, r := range c.advertised {
+		if wanted[r.Network] {
+			advertised = append(advertised, r)
+			delete(wanted, r.Network)
+			continue
+		}
+		c.log.Info("Delete advertised route", "network", r.Network, "dev", r.Dev)
+		if err := c.netCfg.DeleteRoute(r); err != nil {
+			c.log.Error("Error deleting routes", "err", err)
+		}
+	}
+	for _, network := range networks {
+		ipNet, err := parseNetwork(network)
+		if err != nil || !wanted[ipNet.String()] {
+			continue
+		}
+		delete(wanted, ipNet.String())
+		r := StaticRoute{Network: ipNet.String(), Dev: ifName}
+		c.log.Info("Add advertised route", "network", r.Network, "dev", r.Dev)
+		if err := c.netCfg.AddRoute(r); err != nil {
+			c.log.Error("Error creating routes", "err", err)
+			continue
+		}
+		advertised = append(advertised, r)
+	}
+	c.advertised = advertised
+}
+
+// splitDefault returns the two networks that cover the address space of the address family
+func splitDefault(address string) []string {
+	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+		return []string{"::/1", "8000::/1"}
+	}
+	return []string{"0.0.0.0/1", "128.0.0.0/1"}
+}
+
+// pinServerRoute pins the route to the server through its current gateway if the
+// remote network contains it or in full tunnel mode, otherwise the tunnel
+// connection would be routed into the tunnel itself
+func (c *Client) pinServerRoute() error {
+	if len(c.routes) > 0 {
+		return nil
+	}
+	server := c.serverIP()
+	if server == nil {
+		return nil
+	}
+	if !c.FullTunnel {
+		if c.RemoteNetwork == "" {
+			return nil
+		}
+		_, network, err := net.ParseCIDR(c.RemoteNetwork)
+		if err != nil {
+			return err
+		}
+		if !network.Contains(server) {
+			return nil
+		}
+	}
+	r, err := c.HostNetwork.HostRoute(server.String())
+	if err != nil || r.Network == "" {
+		return err
+	}
+	c.log.Info("Pinning the route to the server", "server", server, "gateway", r.Gateway, "dev", r.Dev)
+	if err := c.netCfg.AddRoute(r); err != nil {
+		return fmt.Errorf("Error pinning the route to the server: %v", err)
+	}
+	c.mu.Lock()
+	c.routes = append(c.routes, r)
+	c.mu.Unlock()
+	return nil
+}
+
+// configuredDNS returns the DNS configuration applied, nil if none
+func (c *Client) configuredDNS() *DNSConfig {
+	if !c.dnsConfigured {
+		return nil
+	}
+	return c.dns
+}
+
+// serverIP returns the address of the server, nil if it is not known
+func (c *Client) serverIP() net.IP {
+	conn := c.conn
+	if b, ok := conn.(bufferedConn); ok {
+		conn = b.Conn
+	}
+	// The relayed tunnels go through the relay
+	if r, ok := conn.(*relayConn); ok {
+		conn = r.Conn
+	}
+	if conn != nil {
+		switch addr := conn.RemoteAddr().(type) {
+		case *net.TCPAddr:
+			return addr.IP
+		case *net.UDPAddr:
+			return addr.IP
+		}
+	}
+	host, _, err := net.SplitHostPort(c.RemoteHost)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// configureDHCP obtains the interface address from a DHCP server in the remote
+// network and keeps renewing it while the tunnel is up
+func (c *Client) configureDHCP(ifName string) error {
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return err
+	}
+	conn, err := listenDHCP(ifName)
+	if err != nil {
+		return err
+	}
+	lease, err := RequestLease(conn, ifi.HardwareAddr, nil, dhcpTimeout)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	c.log.Info("DHCP lease obtained", "address", lease.Address.String(), "router", lease.Router, "lease", lease.Lease)
+	c.IfAddress = lease.Address.String()
+	if c.RemoteGateway == "" && lease.Router != nil {
+		c.RemoteGateway = lease.Router.String()
+		c.dhcpRouter = true
+	}
+	if err := c.setupNetwork(ifName); err != nil {
+		conn.Close()
+		return err
+	}
+	go func() {
+		defer conn.Close()
+		c.renewDHCP(conn, ifi.HardwareAddr, ifName, lease)
+	}()
+	return nil
+}
+
+// renewDHCP renews the lease at half of its time until the client is closed,
+// the failed renewals are retried with backoff and once the lease expires a
+// new one is requested. The address and the router are applied if they change.
+func (c *Client) renewDHCP(conn net.PacketConn, mac net.HardwareAddr, ifName string, lease *DHCPLease) {
+	expiry := time.Now().Add(lease.Lease)
+	wait := lease.Lease / 2
+	backoff := dhcpRetryInterval
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-time.After(wait):
+		}
+		ip := lease.Address.IP
+		if time.Now().After(expiry) {
+			ip = nil
+		}
+		next, err := RequestLease(conn, mac, ip, dhcpTimeout)
+		if err != nil {
+			wait = dhcpRetryWait(backoff, time.Until(expiry))
+			if backoff *= 2; backoff > dhcpMaxRetryInterval {
+				backoff = dhcpMaxRetryInterval
+			}
+			c.log.Warn("Error renewing DHCP lease", "err", err, "retry", wait)
+			continue
+		}
+		if next.Address.String() != lease.Address.String() || !next.Router.Equal(lease.Router) {
+			if err := c.applyLease(ifName, next); err != nil {
+				c.log.Error("Error applying DHCP lease", "err", err)
+			}
+		}
+		lease = next
+		expiry = time.Now().Add(lease.Lease)
+		wait = lease.Lease / 2
+		backoff = dhcpRetryInterval
+	}
+}
+
+// applyLease replaces the address and the routes of the previous lease
+func (c *Client) applyLease(ifName string, lease *DHCPLease) error {
+	if c.helper != nil {
+		return fmt.Errorf("Can't change the interface address without privileges")
+	}
+	c.log.Info("DHCP lease changed", "address", lease.Address.String(), "router", lease.Router)
+	c.deleteRoutes()
+	if err := c.netCfg.DeleteAddress(); err != nil {
+		c.log.Warn("Error deleting the previous address", "err", err)
+	}
+	c.mu.Lock()
+	c.IfAddress = lease.Address.String()
+	if c.dhcpRouter && lease.Router != nil {
+		c.RemoteGateway = lease.Router.String()
+	}
+	c.mu.Unlock()
+	return c.setupNetwork(ifName)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClientSetupNetwork(t *testing.T) {
+	tests := []struct {
+		name          string
+		remoteNetwork string
+		remoteGateway string
+		tap           bool
+		hardwareAddr  string
+		dns           *DNSConfig
+		setup         []string
+		teardown      []string
+	}{
+		{
+			name:          "remote network",
+			remoteNetwork: "172.17.0.0/16",
+			setup: []string{
+				"link set tun0 up",
+				"address add 192.168.166.2 dev tun0",
+				"route add 172.17.0.0/16 via 192.168.166.2",
+			},
+			teardown: []string{
+				"route del 172.17.0.0/16 via 192.168.166.2",
+			},
+		},
+		{
+			name:          "dns",
+			remoteNetwork: "172.17.0.0/16",
+			dns:           &DNSConfig{Servers: []string{"172.17.0.1"}, Search: []string{"docker"}},
+			setup: []string{
+				"link set tun0 up",
+				"address add 192.168.166.2 dev tun0",
+				"dns add dev tun0 servers 172.17.0.1 search docker",
+				"route add 172.17.0.0/16 via 192.168.166.2",
+			},
+			teardown: []string{
+				"dns del dev tun0 servers 172.17.0.1 search docker",
+				"route del 172.17.0.0/16 via 192.168.166.2",
+			},
+		},
+		{
+			name: "dns forwarder",
+			dns:  &DNSConfig{Servers: []string{"192.168.166.1"}, Tunnel: []string{"192.168.166.1"}},
+			setup: []string{
+				"link set tun0 up",
+				"address add 192.168.166.2 dev tun0",
+				"dns add dev tun0 servers 192.168.166.1 search ",
+				"route add 192.168.166.1 dev tun0",
+			},
+			teardown: []string{
+				"dns del dev tun0 servers 192.168.166.1 search ",
+				"route del 192.168.166.1 dev tun0",
+			},
+		},
+		{
+			name:          "tap",
+			remoteNetwork: "172.17.0.0/16",
+			remoteGateway: "172.17.0.1",
+			tap:           true,
+			hardwareAddr:  "02:00:00:00:00:01",
+			setup: []string{
+				"link set tun0 address 02:00:00:00:00:01",
+				"link set tun0 up",
+				"address add 192.168.166.2 dev tun0",
+				"route add 172.17.0.0/16 via 172.17.0.1",
+			},
+			teardown: []string{
+				"route del 172.17.0.0/16 via 172.17.0.1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rec NetworkRecorder
+			c := NewClient("")
+			c.NewNetworkConfigurator = rec.NewNetworkConfigurator
+			c.log = c.Log
+			c.IfAddress = "192.168.166.2"
+			c.RemoteNetwork = tt.remoteNetwork
+			c.RemoteGateway = tt.remoteGateway
+			c.Interface.TAP = tt.tap
+			c.HardwareAddr = tt.hardwareAddr
+			c.dns = tt.dns
+			if err := c.setupNetwork("tun0"); err != nil {
+				t.Fatalf("setupNetwork() error: %v", err)
+			}
+			if got := changeStrings(rec.Changes()); !reflect.DeepEqual(got, tt.setup) {
+				t.Errorf("setup changes:\n got %q\nwant %q", got, tt.setup)
+			}
+			rec.Reset()
+			c.Close()
+			if got := changeStrings(rec.Changes()); !reflect.DeepEqual(got, tt.teardown) {
+				t.Errorf("teardown changes:\n got %q\nwant %q", got, tt.teardown)
+			}
+		})
+	}
+}
+
+func TestClientApplyLease(t *testing.T) {
+	var rec NetworkRecorder
+	c := NewClient("")
+	c.NewNetworkConfigurator = rec.NewNetworkConfigurator
+	c.log = c.Log
+	c.Interface.TAP = true
+	c.IfAddress = "10.0.0.5/24"
+	c.RemoteNetwork = "172.17.0.0/16"
+	c.RemoteGateway = "10.0.0.1"
+	c.dhcpRouter = true
+	if err := c.setupNetwork("tun0"); err != nil {
+		t.Fatalf("setupNetwork() error: %v", err)
+	}
+	rec.Reset()
+	lease := &DHCPLease{
+		Address: net.IPNet{IP: net.IPv4(10, 0, 0, 6).To4(), Mask: net.CIDRMask(24, 32)},
+		Router:  net.IPv4(10, 0, 0, 254).To4(),
+		Lease:   time.Hour,
+	}
+	if err := c.applyLease("tun0", lease); err != nil {
+		t.Fatalf("applyLease() error: %v", err)
+	}
+	want := []string{
+		"route del 172.17.0.0/16 via 10.0.0.1",
+		"address del 10.0.0.5/24 dev tun0",
+		"link set tun0 up",
+		"address add 10.0.0.6/24 dev tun0",
+		"route add 172.17.0.0/16 via 10.0.0.254",
+	}
+	if got := changeStrings(rec.Changes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestClientSetAdvertised(t *testing.T) {
+	_, local, _ := net.ParseCIDR("192.168.1.0/24")
+	var rec NetworkRecorder
+	c := NewClient("203.0.113.1:5555")
+	c.HostNetwork = FakeHostNetwork{Networks: []*net.IPNet{local}}
+	c.log = c.Log
+	c.netCfg = rec.NewNetworkConfigurator("192.168.166.2", "", "", "tun0")
+	c.setAdvertised("tun0", []string{
+		"172.18.0.0/16",
+		"0.0.0.0/1",
+		"128.0.0.0/1",
+		"::/1",
+		"192.168.1.0/25",
+		"203.0.113.0/24",
+		"bogus",
+	})
+	want := []string{"route add 172.18.0.0/16 dev tun0"}
+	if got := changeStrings(rec.Changes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes:\n got %q\nwant %q", got, want)
+	}
+	rec.Reset()
+	c.setAdvertised("tun0", []string{"172.19.0.0/16"})
+	want = []string{"route del 172.18.0.0/16 dev tun0", "route add 172.19.0.0/16 dev tun0"}
+	if got := changeStrings(rec.Changes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes:\n got %q\nwant %q", got, want)
+	}
+}
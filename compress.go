@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Compression codecs negotiated in the handshake
+const (
+	compressionNone    = "none"
+	compressionDeflate = "deflate"
+)
+
+const (
+	// compressMinSize is the smallest payload compressed, smaller ones can't save much
+	compressMinSize = 128
+	// compressMaxEntropy in bits per byte, payloads above it are likely
+	// encrypted or already compressed and are sent as they are
+	compressMaxEntropy = 7.0
+	// entropySampleSize is the number of bytes used to estimate the entropy
+	entropySampleSize = 512
+)
+
+// validateCompression checks that the codec is supported
+func validateCompression(codec string) error {
+	switch codec {
+	case compressionNone, compressionDeflate:
+		return nil
+	}
+	return fmt.Errorf("Invalid compression %q, valid values are none and deflate", codec)
+}
+
+// frameCompressor compresses the payloads of the frames sent, every payload
+// is compressed on its own so the frames can be decompressed in any order
+type frameCompressor struct {
+	w   *flate.Writer
+	buf bytes.Buffer
+}
+
+func newFrameCompressor() *frameCompressor {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &frameCompressor{w: w}
+}
+
+// compress returns the payload of a compressed frame carrying the frame, it
+// returns false if the payload is not worth compressing or doesn't shrink
+func (c *frameCompressor) compress(frameType byte, payload []byte) ([]byte, bool) {
+	if len(payload) < compressMinSize {
+		return nil, false
+	}
+	sample := payload
+	if len(sample) > entropySampleSize {
+		sample = sample[len(sample)-entropySampleSize:]
+	}
+	if entropy(sample) > compressMaxEntropy {
+		return nil, false
+	}
+	c.buf.Reset()
+	c.buf.WriteByte(frameType)
+	c.w.Reset(&c.buf)
+	if _, err := c.w.Write(payload); err != nil {
+		return nil, false
+	}
+	if err := c.w.Close(); err != nil {
+		return nil, false
+	}
+	if c.buf.Len() >= len(payload) {
+		return nil, false
+	}
+	return c.buf.Bytes(), true
+}
+
+// entropy returns the Shannon entropy of b in bits per byte
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var e float64
+	n := float64(len(b))
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / n
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// frameDecompressor decompresses the payloads of the compressed frames received
+type frameDecompressor struct {
+	r   io.ReadCloser
+	src bytes.Reader
+	buf []byte
+	// extra detects the payloads bigger than buf
+	extra [1]byte
+}
+
+func newFrameDecompressor() *frameDecompressor {
+	return &frameDecompressor{
+		buf: make([]byte, maxPacketSize),
+	}
+}
+
+// decompress returns the type and the payload of the frame carried, the
+// payload is valid until the next call
+func (d *frameDecompressor) decompress(payload []byte) (byte, []byte, error) {
+	if len(payload) < 1 {
+		return 0, nil, fmt.Errorf("Empty compressed frame")
+	}
+	d.src.Reset(payload[1:])
+	if d.r == nil {
+		d.r = flate.NewReader(&d.src)
+	} else if err := d.r.(flate.Resetter).Reset(&d.src, nil); err != nil {
+		return 0, nil, err
+	}
+	n := 0
+	for {
+		var m int
+		var err error
+		if n < len(d.buf) {
+			m, err = d.r.Read(d.buf[n:])
+			n += m
+		} else if m, err = d.r.Read(d.extra[:]); m > 0 {
+			// The payload can't be bigger than the buffer
+			return 0, nil, fmt.Errorf("Compressed frame too big")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("Error decompressing frame: %v", err)
+		}
+	}
+	return payload[0], d.buf[:n], nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// jsonPayload returns a compressible payload like the JSON of an API
+func jsonPayload(size int) []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < size; i++ {
+		b.WriteString(`{"id":` + strings.Repeat("1", i%5+1) + `,"name":"container","status":"running"},`)
+	}
+	return b.Bytes()[:size]
+}
+
+// randomPayload returns an incompressible payload like encrypted traffic
+func randomPayload(size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+func TestFrameCompression(t *testing.T) {
+	c, d := newFrameCompressor(), newFrameDecompressor()
+	for _, size := range []int{compressMinSize, 1500, maxPacketSize} {
+		payload := jsonPayload(size)
+		compressed, ok := c.compress(frameGSO, payload)
+		if !ok {
+			t.Fatalf("compress() of %d bytes of JSON skipped", size)
+		}
+		if len(compressed) >= len(payload) {
+			t.Errorf("compress() of %d bytes = %d bytes, want less", size, len(compressed))
+		}
+		frameType, got, err := d.decompress(compressed)
+		if err != nil {
+			t.Fatalf("decompress() error: %v", err)
+		}
+		if frameType != frameGSO || !bytes.Equal(got, payload) {
+			t.Errorf("decompress() of %d bytes = type %d, %d bytes", size, frameType, len(got))
+		}
+	}
+}
+
+func TestFrameCompressionSkipped(t *testing.T) {
+	c := newFrameCompressor()
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"small", jsonPayload(compressMinSize - 1)},
+		{"encrypted", randomPayload(1500)},
+		// The entropy is estimated on the end of the payload
+		{"encrypted after headers", append(jsonPayload(60), randomPayload(1400)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := c.compress(frameData, tt.payload); ok {
+				t.Errorf("compress() of %d bytes didn't skip the payload", len(tt.payload))
+			}
+		})
+	}
+}
+
+func TestFrameDecompressionErrors(t *testing.T) {
+	// A payload bigger than the largest packet
+	var big bytes.Buffer
+	big.WriteByte(frameData)
+	w, _ := flate.NewWriter(&big, flate.BestSpeed)
+	w.Write(make([]byte, maxPacketSize+1))
+	w.Close()
+	valid, _ := newFrameCompressor().compress(frameData, jsonPayload(1000))
+	valid = append([]byte(nil), valid...)
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"corrupted", []byte{frameData, 0xff, 0xff, 0xff, 0xff}},
+		{"truncated", valid[:len(valid)/2]},
+		{"too big", big.Bytes()},
+	}
+	d := newFrameDecompressor()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := d.decompress(tt.payload); err == nil {
+				t.Errorf("decompress() succeeded")
+			}
+		})
+	}
+	// The decompressor is still usable after the errors
+	if _, got, err := d.decompress(valid); err != nil || !bytes.Equal(got, jsonPayload(1000)) {
+		t.Errorf("decompress() after the errors = %d bytes, %v", len(got), err)
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		min  float64
+		max  float64
+	}{
+		{"constant", bytes.Repeat([]byte{'a'}, 512), 0, 0},
+		{"two symbols", bytes.Repeat([]byte{'a', 'b'}, 256), 1, 1},
+		{"all bytes", func() []byte {
+			b := make([]byte, 512)
+			for i := range b {
+				b[i] = byte(i)
+			}
+			return b
+		}(), 8, 8},
+		{"json", jsonPayload(512), 0, compressMaxEntropy},
+		{"random", randomPayload(512), compressMaxEntropy, 8},
+	}
+	for _, tt := range tests {
+		if got := entropy(tt.b); got < tt.min || got > tt.max {
+			t.Errorf("%s: entropy() = %.2f, want between %.2f and %.2f", tt.name, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	for _, codec := range []string{compressionNone, compressionDeflate} {
+		if err := validateCompression(codec); err != nil {
+			t.Errorf("validateCompression(%q) error: %v", codec, err)
+		}
+	}
+	if err := validateCompression("lz4"); err == nil {
+		t.Errorf("validateCompression(\"lz4\") succeeded")
+	}
+}
+
+func TestTunnelCompression(t *testing.T) {
+	client := &Session{Compression: compressionDeflate}
+	server := &Session{Compression: compressionDeflate}
+	tun := newTestTunnel(client, server, 1)
+	compressible := newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 1000, 8080, 1500)
+	copy(compressible[28:], jsonPayload(1500-28))
+	encrypted := newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 1000, 443, 1500)
+	copy(encrypted[28:], randomPayload(1500-28))
+	for _, pkt := range [][]byte{compressible, encrypted} {
+		tun.client.Inject(pkt)
+		if got := receive(t, tun.server); !bytes.Equal(got, pkt) {
+			t.Fatalf("Packet corrupted through the compressed tunnel")
+		}
+	}
+	tun.Close()
+	stats := client.Stats.Snapshot()
+	if stats.CompressedPackets != 1 || stats.CompressedBytes != 1500 {
+		t.Errorf("compressed %d packets %d bytes, want 1 packet 1500 bytes", stats.CompressedPackets, stats.CompressedBytes)
+	}
+	if ratio := stats.CompressionRatio(); ratio <= 1 {
+		t.Errorf("CompressionRatio() = %.2f, want more than 1", ratio)
+	}
+	if got := server.Stats.Snapshot().Malformed; got != 0 {
+		t.Errorf("server malformed = %d, want 0", got)
+	}
+}
+
+func TestCompressionRatio(t *testing.T) {
+	if got := (TunnelStats{TxBytes: 1000}).CompressionRatio(); got != 1 {
+		t.Errorf("CompressionRatio() without compression = %v, want 1", got)
+	}
+	stats := TunnelStats{TxBytes: 3000, CompressedPackets: 1, CompressedBytes: 2000, CompressedWireBytes: 500}
+	if got := stats.CompressionRatio(); got != 2 {
+		t.Errorf("CompressionRatio() = %v, want 2", got)
+	}
+}
+
+func BenchmarkFrameCompression(b *testing.B) {
+	for _, tt := range []struct {
+		name    string
+		payload []byte
+	}{
+		{"json", jsonPayload(1400)},
+		{"encrypted", randomPayload(1400)},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			c := newFrameCompressor()
+			b.SetBytes(int64(len(tt.payload)))
+			for i := 0; i < b.N; i++ {
+				c.compress(frameData, tt.payload)
+			}
+		})
+	}
+}
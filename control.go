@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// controlSocketDir is the directory of the default control sockets
+const controlSocketDir = "/var/run"
+
+// noControlSocket disables the control socket
+const noControlSocket = "none"
+
+// controlSocketPath returns the control socket path, by default each tunnel
+// has its own socket named after its interface, the tunnels with an interface
+// named by the OS have no default socket
+func controlSocketPath(path, ifName string) string {
+	switch {
+	case path == noControlSocket:
+		return ""
+	case path != "":
+		return path
+	case ifName != "":
+		return filepath.Join(controlSocketDir, "tuncat-"+ifName+".sock")
+	}
+	return ""
+}
+
+// ControlRequest is a command sent to the control socket
+type ControlRequest struct {
+	// Command is one of "status", "down", "kick", "capture-start" or "capture-stop"
+	Command string `json:"command"`
+	// Session is the session to kick
+	Session uint64 `json:"session,omitempty"`
+	// Capture is the capture to start
+	Capture *CaptureConfig `json:"capture,omitempty"`
+}
+
+// ControlResponse is the answer to a ControlRequest
+type ControlResponse struct {
+	Error  string  `json:"error,omitempty"`
+	Status *Status `json:"status,omitempty"`
+}
+
+// Status describes a running tunnel
+type Status struct {
+	// Mode is "client" or "server"
+	Mode      string   `json:"mode"`
+	Interface string   `json:"interface,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	Routes    []string `json:"routes,omitempty"`
+	// Advertised are the networks the server advertises to the clients
+	Advertised []string `json:"advertised,omitempty"`
+	// DNS is the DNS configuration applied by the client
+	DNS    *DNSConfig `json:"dns,omitempty"`
+	Peer   string     `json:"peer,omitempty"`
+	Uptime string     `json:"uptime"`
+	// Capture is the file of the running packet capture
+	Capture  string          `json:"capture,omitempty"`
+	Sessions []SessionStatus `json:"sessions"`
+}
+
+// SessionStatus describes a tunnel session
+type SessionStatus struct {
+	ID        uint64 `json:"id"`
+	Peer      string `json:"peer"`
+	Uptime    string `json:"uptime"`
+	TxPackets uint64 `json:"txPackets"`
+	TxBytes   uint64 `json:"txBytes"`
+	RxPackets uint64 `json:"rxPackets"`
+	RxBytes   uint64 `json:"rxBytes"`
+	Dropped   uint64 `json:"dropped"`
+	Malformed uint64 `json:"malformed"`
+	RTT       string `json:"rtt"`
+	// Compression is the codec negotiated, CompressionRatio the ratio
+	// between the bytes sent and their size on the wire
+	Compression       string  `json:"compression,omitempty"`
+	CompressedPackets uint64  `json:"compressedPackets,omitempty"`
+	CompressionRatio  float64 `json:"compressionRatio,omitempty"`
+	// RateLimit is the bandwidth allowed, the counters are the packets
+	// delayed and dropped by it
+	RateLimit     *RateLimit `json:"rateLimit,omitempty"`
+	TxShaped      uint64     `json:"txShaped,omitempty"`
+	RxShaped      uint64     `json:"rxShaped,omitempty"`
+	TxRateDropped uint64     `json:"txRateDropped,omitempty"`
+	RxRateDropped uint64     `json:"rxRateDropped,omitempty"`
+	// ACL are the rules of the access control list, Denied the packets it denied
+	ACL    string `json:"acl,omitempty"`
+	Denied uint64 `json:"denied,omitempty"`
+}
+
+// WriteText writes the status in human readable form
+func (s *Status) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "mode: %s\n", s.Mode)
+	fmt.Fprintf(w, "interface: %s\n", s.Interface)
+	for _, a := range s.Addresses {
+		fmt.Fprintf(w, "address: %s\n", a)
+	}
+	for _, r := range s.Routes {
+		fmt.Fprintf(w, "route: %s\n", r)
+	}
+	for _, a := range s.Advertised {
+		fmt.Fprintf(w, "advertised: %s\n", a)
+	}
+	if s.DNS != nil {
+		fmt.Fprintf(w, "dns: %s\n", s.DNS)
+	}
+	if s.Peer != "" {
+		fmt.Fprintf(w, "peer: %s\n", s.Peer)
+	}
+	fmt.Fprintf(w, "uptime: %s\n", s.Uptime)
+	if s.Capture != "" {
+		fmt.Fprintf(w, "capture: %s\n", s.Capture)
+	}
+	fmt.Fprintf(w, "sessions: %d\n", len(s.Sessions))
+	for _, ss := range s.Sessions {
+		fmt.Fprintf(w, "  %d %s uptime %s tx %d packets %d bytes rx %d packets %d bytes dropped %d malformed %d rtt %s",
+			ss.ID, ss.Peer, ss.Uptime, ss.TxPackets, ss.TxBytes, ss.RxPackets, ss.RxBytes, ss.Dropped, ss.Malformed, ss.RTT)
+		if ss.Compression != "" && ss.Compression != compressionNone {
+			fmt.Fprintf(w, " compression %s %d packets ratio %.2f", ss.Compression, ss.CompressedPackets, ss.CompressionRatio)
+		}
+		if ss.RateLimit != nil {
+			fmt.Fprintf(w, " rate-limit %s shaped %d/%d rate-dropped %d/%d",
+				ss.RateLimit, ss.TxShaped, ss.RxShaped, ss.TxRateDropped, ss.RxRateDropped)
+		}
+		if ss.ACL != "" {
+			fmt.Fprintf(w, " acl %q denied %d", ss.ACL, ss.Denied)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// sessionStatus returns the status of the session
+func sessionStatus(s *Session) SessionStatus {
+	stats := s.Stats.Snapshot()
+	status := SessionStatus{
+		ID:                s.ID,
+		Peer:              s.Peer,
+		Uptime:            time.Since(s.Start).Round(time.Second).String(),
+		TxPackets:         stats.TxPackets,
+		TxBytes:           stats.TxBytes,
+		RxPackets:         stats.RxPackets,
+		RxBytes:           stats.RxBytes,
+		Dropped:           stats.Dropped,
+		Malformed:         stats.Malformed,
+		RTT:               stats.RTT().String(),
+		Compression:       s.Compression,
+		CompressedPackets: stats.CompressedPackets,
+		CompressionRatio:  stats.CompressionRatio(),
+	}
+	if s.Limit != (RateLimit{}) {
+		limit := s.Limit
+		status.RateLimit = &limit
+		status.TxShaped = stats.TxShaped
+		status.RxShaped = stats.RxShaped
+		status.TxRateDropped = stats.TxRateDropped
+		status.RxRateDropped = stats.RxRateDropped
+	}
+	if s.ACL != nil {
+		status.ACL = s.ACL.String()
+		status.Denied = stats.Denied
+	}
+	return status
+}
+
+// interfaceAddresses returns the addresses configured in the interface
+func interfaceAddresses(name string) []string {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	var addresses []string
+	for _, a := range addrs {
+		addresses = append(addresses, a.String())
+	}
+	return addresses
+}
+
+// controller is a tunnel that can be managed through the control socket
+type controller interface {
+	Status() *Status
+	// Down tears down the tunnel
+	Down() error
+	// Kick closes the session
+	Kick(session uint64) error
+	packetCapture() *PacketCapture
+}
+
+// ControlServer serves the control socket of a running tunnel
+type ControlServer struct {
+	path     string
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+// ServeControl serves the control socket on path for the tunnel c
+func ServeControl(path string, c controller) (*ControlServer, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Only root can manage the tunnel
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	cs := &ControlServer{
+		path:     path,
+		listener: ln,
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			cs.wg.Add(1)
+			go func() {
+				defer cs.wg.Done()
+				defer conn.Close()
+				cs.handle(conn, c)
+			}()
+		}
+	}()
+	logger.Info("Serving control socket", "path", path)
+	return cs, nil
+}
+
+func (cs *ControlServer) handle(conn net.Conn, c controller) {
+	var req ControlRequest
+	var resp ControlResponse
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+	logger.Info("Control command received", "command", req.Command)
+	var err error
+	switch req.Command {
+	case "status":
+		resp.Status = c.Status()
+	case "down":
+		err = c.Down()
+	case "kick":
+		err = c.Kick(req.Session)
+	case "capture-start":
+		if req.Capture == nil {
+			err = fmt.Errorf("Capture configuration required")
+			break
+		}
+		err = c.packetCapture().Start(*req.Capture)
+	case "capture-stop":
+		err = c.packetCapture().Stop()
+	default:
+		err = fmt.Errorf("Unknown command %q", req.Command)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// removeStaleSocket removes the socket left by a tuncat that didn't exit
+// cleanly, the socket of a running tuncat and other files are kept
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("Control socket %s exists and is not a socket", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("Control socket %s in use", path)
+	}
+	// Nobody listens on the socket
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("Control socket %s unusable: %v", path, err)
+	}
+	return os.Remove(path)
+}
+
+// Close stops serving the control socket, waits for the commands in progress
+// and removes the socket
+func (cs *ControlServer) Close() error {
+	err := cs.listener.Close()
+	cs.wg.Wait()
+	if rerr := os.Remove(cs.path); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// SendControl sends the request to the control socket on path
+func SendControl(path string, req ControlRequest) (*ControlResponse, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't connect to control socket %s: %v", path, err)
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return &resp, fmt.Errorf("%s", resp.Error)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestControlSocketPath(t *testing.T) {
+	tests := []struct {
+		path, ifName, want string
+	}{
+		{"", "", ""},
+		{"", "tun1", "/var/run/tuncat-tun1.sock"},
+		{"/tmp/ctl.sock", "tun1", "/tmp/ctl.sock"},
+		{"none", "tun1", ""},
+	}
+	for _, tt := range tests {
+		if got := controlSocketPath(tt.path, tt.ifName); got != tt.want {
+			t.Errorf("controlSocketPath(%q, %q) = %q, want %q", tt.path, tt.ifName, got, tt.want)
+		}
+	}
+}
+
+// testController is a tunnel without sessions
+type testController struct {
+	down bool
+}
+
+func (c *testController) Status() *Status {
+	return &Status{Mode: "server", Sessions: []SessionStatus{}}
+}
+
+func (c *testController) Down() error {
+	c.down = true
+	return nil
+}
+
+func (c *testController) Kick(session uint64) error {
+	return nil
+}
+
+func (c *testController) packetCapture() *PacketCapture {
+	return &PacketCapture{}
+}
+
+func TestControlServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	c := &testController{}
+	cs, err := ServeControl(path, c)
+	if err != nil {
+		t.Fatalf("ServeControl() error: %v", err)
+	}
+	// A second tunnel can't steal the socket
+	if _, err := ServeControl(path, c); err == nil {
+		t.Errorf("ServeControl() on a socket in use succeeded")
+	}
+	resp, err := SendControl(path, ControlRequest{Command: "status"})
+	if err != nil || resp.Status == nil || resp.Status.Mode != "server" {
+		t.Errorf("status = %+v, %v", resp, err)
+	}
+	if _, err := SendControl(path, ControlRequest{Command: "down"}); err != nil || !c.down {
+		t.Errorf("down error: %v", err)
+	}
+	if _, err := SendControl(path, ControlRequest{Command: "bogus"}); err == nil {
+		t.Errorf("Unknown command succeeded")
+	}
+	if err := cs.Close(); err != nil {
+		t.Errorf("Close() error: %v", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("Control socket not removed on Close: %v", err)
+	}
+}
+
+func TestControlStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	// A socket left by a tuncat killed
+	stale := filepath.Join(dir, "stale.sock")
+	ln, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	cs, err := ServeControl(stale, &testController{})
+	if err != nil {
+		t.Fatalf("ServeControl() on a stale socket error: %v", err)
+	}
+	cs.Close()
+
+	// Other files are kept
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ServeControl(file, &testController{}); err == nil {
+		t.Errorf("ServeControl() replaced a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Regular file removed: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DHCP message types and options, RFC 2131 and RFC 2132
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpNak      = 6
+
+	dhcpOptSubnetMask   = 1
+	dhcpOptRouter       = 3
+	dhcpOptDNS          = 6
+	dhcpOptRequestedIP  = 50
+	dhcpOptLeaseTime    = 51
+	dhcpOptMessageType  = 53
+	dhcpOptServerID     = 54
+	dhcpOptParamRequest = 55
+	dhcpOptEnd          = 255
+
+	dhcpHeaderLen = 236
+
+	// dhcpMinLease is the shortest lease accepted, the shorter ones would
+	// renew continuously
+	dhcpMinLease = time.Minute
+	// dhcpRetryInterval and dhcpMaxRetryInterval bound the backoff of the
+	// failed renewals
+	dhcpRetryInterval    = 5 * time.Second
+	dhcpMaxRetryInterval = time.Minute
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+var dhcpServerAddr = &net.UDPAddr{IP: net.IPv4bcast, Port: 67}
+
+// DHCPLease is an address obtained from a DHCP server
+type DHCPLease struct {
+	Address  net.IPNet
+	Router   net.IP
+	DNS      []net.IP
+	ServerID net.IP
+	Lease    time.Duration
+}
+
+// dhcpMessage is the subset of a DHCP message used by the client
+type dhcpMessage struct {
+	msgType byte
+	xid     uint32
+	yiaddr  net.IP
+	options map[byte][]byte
+}
+
+// marshalDHCP builds a BOOTREQUEST message
+func marshalDHCP(msgType byte, xid uint32, mac net.HardwareAddr, options map[byte][]byte) []byte {
+	b := make([]byte, dhcpHeaderLen)
+	b[0] = 1 // BOOTREQUEST
+	b[1] = 1 // Ethernet
+	b[2] = 6 // hardware address length
+	binary.BigEndian.PutUint32(b[4:8], xid)
+	// The client has no address yet, ask for broadcast replies
+	binary.BigEndian.PutUint16(b[10:12], 0x8000)
+	copy(b[28:44], mac)
+	b = append(b, dhcpMagicCookie...)
+	b = append(b, dhcpOptMessageType, 1, msgType)
+	b = append(b, dhcpOptParamRequest, 4, dhcpOptSubnetMask, dhcpOptRouter, dhcpOptDNS, dhcpOptLeaseTime)
+	for code, value := range options {
+		b = append(b, code, byte(len(value)))
+		b = append(b, value...)
+	}
+	return append(b, dhcpOptEnd)
+}
+
+// unmarshalDHCP parses a BOOTREPLY message
+func unmarshalDHCP(b []byte) (*dhcpMessage, error) {
+	if len(b) < dhcpHeaderLen+len(dhcpMagicCookie) || b[0] != 2 {
+		return nil, fmt.Errorf("Invalid DHCP reply")
+	}
+	if !bytes.Equal(b[dhcpHeaderLen:dhcpHeaderLen+4], dhcpMagicCookie) {
+		return nil, fmt.Errorf("Invalid DHCP magic cookie")
+	}
+	m := &dhcpMessage{
+		xid:     binary.BigEndian.Uint32(b[4:8]),
+		yiaddr:  net.IP(append([]byte(nil), b[16:20]...)),
+		options: map[byte][]byte{},
+	}
+	opts := b[dhcpHeaderLen+4:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		// Pad
+		if code == 0 {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("Truncated DHCP option %d", code)
+		}
+		m.options[code] = opts[2 : 2+int(opts[1])]
+		opts = opts[2+int(opts[1]):]
+	}
+	if t := m.options[dhcpOptMessageType]; len(t) == 1 {
+		m.msgType = t[0]
+	}
+	return m, nil
+}
+
+// lease returns the lease described by an ACK message
+func (m *dhcpMessage) lease() (*DHCPLease, error) {
+	mask := m.options[dhcpOptSubnetMask]
+	if len(mask) != net.IPv4len {
+		return nil, fmt.Errorf("DHCP reply without subnet mask")
+	}
+	l := &DHCPLease{
+		Address:  net.IPNet{IP: m.yiaddr, Mask: net.IPMask(mask)},
+		ServerID: net.IP(m.options[dhcpOptServerID]),
+		Lease:    time.Hour,
+	}
+	if r := m.options[dhcpOptRouter]; len(r) >= net.IPv4len {
+		l.Router = net.IP(r[:net.IPv4len])
+	}
+	dns := m.options[dhcpOptDNS]
+	for i := 0; i+net.IPv4len <= len(dns); i += net.IPv4len {
+		l.DNS = append(l.DNS, net.IP(dns[i:i+net.IPv4len]))
+	}
+	if t := m.options[dhcpOptLeaseTime]; len(t) == 4 {
+		l.Lease = time.Duration(binary.BigEndian.Uint32(t)) * time.Second
+	}
+	if l.Lease < dhcpMinLease {
+		l.Lease = dhcpMinLease
+	}
+	return l, nil
+}
+
+// dhcpExchange sends the message and waits for a reply of the expected types
+func dhcpExchange(conn net.PacketConn, msg []byte, xid uint32, timeout time.Duration, types ...byte) (*dhcpMessage, error) {
+	if _, err := conn.WriteTo(msg, dhcpServerAddr); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		m, err := unmarshalDHCP(buf[:n])
+		if err != nil || m.xid != xid {
+			continue
+		}
+		for _, t := range types {
+			if m.msgType == t {
+				return m, nil
+			}
+		}
+	}
+}
+
+// RequestLease obtains an address for the hardware address mac, if ip is not
+// nil the client tries to renew it skipping the discovery
+func RequestLease(conn net.PacketConn, mac net.HardwareAddr, ip net.IP, timeout time.Duration) (*DHCPLease, error) {
+	// The replies to other clients on the bridge are told apart by the xid
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, fmt.Errorf("Can't generate the DHCP transaction ID: %v", err)
+	}
+	xid := binary.BigEndian.Uint32(b[:])
+	options := map[byte][]byte{}
+	if ip == nil {
+		offer, err := dhcpExchange(conn, marshalDHCP(dhcpDiscover, xid, mac, nil), xid, timeout, dhcpOffer)
+		if err != nil {
+			return nil, fmt.Errorf("No DHCP offer received: %v", err)
+		}
+		ip = offer.yiaddr
+		options[dhcpOptServerID] = offer.options[dhcpOptServerID]
+	}
+	options[dhcpOptRequestedIP] = ip.To4()
+	ack, err := dhcpExchange(conn, marshalDHCP(dhcpRequest, xid, mac, options), xid, timeout, dhcpAck, dhcpNak)
+	if err != nil {
+		return nil, fmt.Errorf("No DHCP acknowledge received: %v", err)
+	}
+	if ack.msgType == dhcpNak {
+		return nil, fmt.Errorf("DHCP request for %s rejected", ip)
+	}
+	return ack.lease()
+}
+
+// dhcpRetryWait returns the time to wait before retrying a failed renewal,
+// the backoff is shortened to retry a few times before the lease expires
+func dhcpRetryWait(backoff, left time.Duration) time.Duration {
+	if left/2 < backoff {
+		backoff = left / 2
+	}
+	if backoff < dhcpRetryInterval {
+		backoff = dhcpRetryInterval
+	}
+	return backoff
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// listenDHCP opens the DHCP client socket on the interface dev,
+// the interface doesn't need to have an address
+func listenDHCP(dev string) (net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) {
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+					return
+				}
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
+					return
+				}
+				err = syscall.BindToDevice(int(fd), dev)
+			})
+			return err
+		},
+	}
+	return lc.ListenPacket(context.Background(), "udp4", "0.0.0.0:68")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDHCPLeaseTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		seconds []byte
+		want    time.Duration
+	}{
+		{"default", nil, time.Hour},
+		{"zero", []byte{0, 0, 0, 0}, dhcpMinLease},
+		{"short", []byte{0, 0, 0, 10}, dhcpMinLease},
+		{"long", []byte{0, 0, 0x0e, 0x10}, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &dhcpMessage{
+				msgType: dhcpAck,
+				yiaddr:  net.IPv4(10, 0, 0, 5).To4(),
+				options: map[byte][]byte{dhcpOptSubnetMask: {255, 255, 255, 0}},
+			}
+			if tt.seconds != nil {
+				m.options[dhcpOptLeaseTime] = tt.seconds
+			}
+			l, err := m.lease()
+			if err != nil {
+				t.Fatalf("lease() error: %v", err)
+			}
+			if l.Lease != tt.want {
+				t.Errorf("lease = %v, want %v", l.Lease, tt.want)
+			}
+		})
+	}
+}
+
+func TestDHCPRetryWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff time.Duration
+		left    time.Duration
+		want    time.Duration
+	}{
+		{"backoff", 10 * time.Second, time.Hour, 10 * time.Second},
+		{"close to expiry", time.Minute, 40 * time.Second, 20 * time.Second},
+		{"minimum", time.Minute, time.Second, dhcpRetryInterval},
+		{"expired", time.Minute, -time.Second, dhcpRetryInterval},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dhcpRetryWait(tt.backoff, tt.left); got != tt.want {
+				t.Errorf("dhcpRetryWait(%v, %v) = %v, want %v", tt.backoff, tt.left, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeDHCPConn is a PacketConn answered by a DHCP server, each answer is
+// preceded by one to another transaction
+type fakeDHCPConn struct {
+	address  net.IP
+	nak      bool
+	silent   bool
+	replies  chan []byte
+	mu       sync.Mutex
+	requests []*dhcpMessage
+	deadline time.Time
+}
+
+func newFakeDHCPConn() *fakeDHCPConn {
+	return &fakeDHCPConn{
+		address: net.IPv4(10, 0, 0, 5).To4(),
+		replies: make(chan []byte, 4),
+	}
+}
+
+// reply returns the BOOTREPLY of the type to the transaction
+func (c *fakeDHCPConn) reply(msgType byte, xid uint32, yiaddr net.IP) []byte {
+	b := marshalDHCP(msgType, xid, nil, map[byte][]byte{
+		dhcpOptServerID:   {10, 0, 0, 1},
+		dhcpOptSubnetMask: {255, 255, 255, 0},
+		dhcpOptRouter:     {10, 0, 0, 1},
+		dhcpOptLeaseTime:  {0, 0, 0x0e, 0x10},
+	})
+	b[0] = 2
+	copy(b[16:20], yiaddr)
+	return b
+}
+
+func (c *fakeDHCPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	// The requests are parsed as replies
+	msg := append([]byte(nil), b...)
+	msg[0] = 2
+	req, err := unmarshalDHCP(msg)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	c.requests = append(c.requests, req)
+	c.mu.Unlock()
+	if c.silent {
+		return len(b), nil
+	}
+	replyType := byte(dhcpOffer)
+	if req.msgType == dhcpRequest {
+		replyType = dhcpAck
+		if c.nak {
+			replyType = dhcpNak
+		}
+	}
+	c.replies <- c.reply(replyType, req.xid+1, net.IPv4(10, 0, 0, 99).To4())
+	c.replies <- c.reply(replyType, req.xid, c.address)
+	return len(b), nil
+}
+
+func (c *fakeDHCPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timeout = time.After(time.Until(deadline))
+	}
+	select {
+	case reply := <-c.replies:
+		return copy(b, reply), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 67}, nil
+	case <-timeout:
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Err: errors.New("i/o timeout")}
+	}
+}
+
+func (c *fakeDHCPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *fakeDHCPConn) Close() error                       { return nil }
+func (c *fakeDHCPConn) LocalAddr() net.Addr                { return &net.UDPAddr{Port: 68} }
+func (c *fakeDHCPConn) SetDeadline(t time.Time) error      { return c.SetReadDeadline(t) }
+func (c *fakeDHCPConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestRequestLease(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	tests := []struct {
+		name     string
+		renew    net.IP
+		nak      bool
+		silent   bool
+		requests []byte
+		err      bool
+	}{
+		{name: "discovery", requests: []byte{dhcpDiscover, dhcpRequest}},
+		{name: "renewal", renew: net.IPv4(10, 0, 0, 5), requests: []byte{dhcpRequest}},
+		{name: "rejected", nak: true, requests: []byte{dhcpDiscover, dhcpRequest}, err: true},
+		{name: "no server", silent: true, requests: []byte{dhcpDiscover}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newFakeDHCPConn()
+			conn.nak, conn.silent = tt.nak, tt.silent
+			lease, err := RequestLease(conn, mac, tt.renew, 100*time.Millisecond)
+			if len(conn.requests) != len(tt.requests) {
+				t.Fatalf("%d requests sent, want %d", len(conn.requests), len(tt.requests))
+			}
+			for i, req := range conn.requests {
+				if req.msgType != tt.requests[i] || req.xid != conn.requests[0].xid {
+					t.Errorf("request %d = type %d, xid %#x, want type %d, xid %#x", i, req.msgType, req.xid, tt.requests[i], conn.requests[0].xid)
+				}
+			}
+			if tt.err {
+				if err == nil {
+					t.Fatalf("RequestLease() = %+v, want an error", lease)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RequestLease() error: %v", err)
+			}
+			// The reply to the other transaction is ignored
+			if got := lease.Address.String(); got != "10.0.0.5/24" {
+				t.Errorf("lease address = %s, want 10.0.0.5/24", got)
+			}
+			if !lease.Router.Equal(net.IPv4(10, 0, 0, 1)) || lease.Lease != time.Hour {
+				t.Errorf("lease = %+v, want router 10.0.0.1 for an hour", lease)
+			}
+			request := conn.requests[len(conn.requests)-1]
+			if got := net.IP(request.options[dhcpOptRequestedIP]); !got.Equal(conn.address) {
+				t.Errorf("requested address = %v, want %v", got, conn.address)
+			}
+		})
+	}
+}
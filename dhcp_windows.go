@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenDHCP is only supported on Linux
+func listenDHCP(dev string) (net.PacketConn, error) {
+	return nil, fmt.Errorf("DHCP is only supported on Linux")
+}
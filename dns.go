@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resolvConfPath is the resolver configuration managed without systemd-resolved
+const resolvConfPath = "/etc/resolv.conf"
+
+// DNSConfig are the DNS servers and search domains the server pushes to the clients
+type DNSConfig struct {
+	Servers []string `json:"servers,omitempty"`
+	Search  []string `json:"search,omitempty"`
+	// Tunnel are the servers listening on the tunnel address of the server,
+	// the clients route them through the interface
+	Tunnel []string `json:"tunnel,omitempty"`
+}
+
+func (d DNSConfig) String() string {
+	return fmt.Sprintf("servers %s search %s", strings.Join(d.Servers, ","), strings.Join(d.Search, ","))
+}
+
+// validateDNSConfig checks the addresses of the servers and the search domains
+func validateDNSConfig(d DNSConfig) error {
+	for _, s := range d.Servers {
+		if net.ParseIP(s) == nil {
+			return fmt.Errorf("Invalid DNS server %q", s)
+		}
+	}
+	for _, t := range d.Tunnel {
+		if ip := net.ParseIP(t); ip == nil || ip.IsUnspecified() || ip.IsLoopback() || ip.IsMulticast() {
+			return fmt.Errorf("Invalid DNS server %q routed through the tunnel", t)
+		}
+	}
+	for _, domain := range d.Search {
+		if domain == "" || strings.ContainsAny(domain, " \t\n#;") {
+			return fmt.Errorf("Invalid DNS search domain %q", domain)
+		}
+	}
+	return nil
+}
+
+// handshakeValue returns the value of the dns parameter, none if there is nothing to push
+func (d DNSConfig) handshakeValue() string {
+	if len(d.Servers) == 0 && len(d.Search) == 0 {
+		return "none"
+	}
+	b, _ := json.Marshal(d)
+	return string(b)
+}
+
+// parseDNSHandshake parses the value of the dns parameter, nil if the server pushes nothing
+func parseDNSHandshake(value string) (*DNSConfig, error) {
+	if value == "none" {
+		return nil, nil
+	}
+	d := &DNSConfig{}
+	if err := json.Unmarshal([]byte(value), d); err != nil {
+		return nil, fmt.Errorf("Connection error, invalid DNS configuration %q", value)
+	}
+	if err := validateDNSConfig(*d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// resolv.conf markers of the section managed for an interface, the lines of
+// the original configuration that the section overrides are commented out
+func resolvConfMarkers(dev string) (begin, end, disabled string) {
+	return "# BEGIN tuncat " + dev, "# END tuncat " + dev, "#tuncat:" + dev + "# "
+}
+
+// addResolvConf returns the resolv.conf content with a section for the interface,
+// its servers go first and its search domains before the original ones
+func addResolvConf(content, dev string, d DNSConfig) string {
+	content = removeResolvConf(content, dev)
+	begin, end, disabled := resolvConfMarkers(dev)
+	search := append([]string{}, d.Search...)
+	var rest []string
+	for _, line := range strings.SplitAfter(content, "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		// Only the last search line is used, the domains are merged
+		if len(d.Search) > 0 && len(fields) > 0 && (fields[0] == "search" || fields[0] == "domain") {
+			search = append(search, fields[1:]...)
+			line = disabled + line
+		}
+		rest = append(rest, line)
+	}
+	var b strings.Builder
+	b.WriteString(begin + "\n")
+	for _, s := range d.Servers {
+		b.WriteString("nameserver " + s + "\n")
+	}
+	if len(search) > 0 {
+		b.WriteString("search " + strings.Join(search, " ") + "\n")
+	}
+	b.WriteString(end + "\n")
+	for _, line := range rest {
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// removeResolvConf returns the resolv.conf content without the section of the interface
+func removeResolvConf(content, dev string) string {
+	begin, end, disabled := resolvConfMarkers(dev)
+	var b strings.Builder
+	inSection := false
+	for _, line := range strings.SplitAfter(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == begin:
+			inSection = true
+		case trimmed == end:
+			inSection = false
+		case inSection:
+		default:
+			b.WriteString(strings.TrimPrefix(line, disabled))
+		}
+	}
+	return b.String()
+}
+
+// updateResolvConf rewrites the resolv.conf at path with the content returned
+// by update. The new content is written to a temporary file that is renamed
+// into place, so the resolvers never read a partial file, and symlinks are
+// not followed, they belong to other resolver managers.
+func updateResolvConf(path string, update func(content string) string) error {
+	mode := os.FileMode(0644)
+	var content []byte
+	fi, err := os.Lstat(path)
+	switch {
+	case err == nil && fi.Mode()&os.ModeSymlink != 0:
+		return fmt.Errorf("Not modifying %s, it's a symlink managed by another program", path)
+	case err == nil && !fi.Mode().IsRegular():
+		return fmt.Errorf("Not modifying %s, it isn't a regular file", path)
+	case err == nil:
+		mode = fi.Mode().Perm()
+		if content, err = ioutil.ReadFile(path); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	updated := update(string(content))
+	if updated == string(content) {
+		return nil
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tuncat")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(updated); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
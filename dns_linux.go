@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// resolvedRuntimeDir exists while systemd-resolved is running
+const resolvedRuntimeDir = "/run/systemd/resolve"
+
+// useResolved returns true if the DNS configuration is managed by systemd-resolved
+func useResolved() bool {
+	if _, err := os.Stat(resolvedRuntimeDir); err != nil {
+		return false
+	}
+	_, err := exec.LookPath("busctl")
+	return err == nil
+}
+
+// resolvedCall calls a method of the systemd-resolved D-Bus manager
+func resolvedCall(method, signature string, args ...string) error {
+	cmdArgs := append([]string{"call", "org.freedesktop.resolve1", "/org/freedesktop/resolve1",
+		"org.freedesktop.resolve1.Manager", method, signature}, args...)
+	if out, err := exec.Command("busctl", cmdArgs...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v %s", method, err, out)
+	}
+	return nil
+}
+
+// SetDNS configures the DNS servers and search domains of the interface with
+// systemd-resolved if it is running, otherwise in a section of resolv.conf
+func (n Netconfig) SetDNS(d DNSConfig) error {
+	if !useResolved() {
+		return updateResolvConf(resolvConfPath, func(content string) string {
+			return addResolvConf(content, n.dev, d)
+		})
+	}
+	ifi, err := net.InterfaceByName(n.dev)
+	if err != nil {
+		return err
+	}
+	index := strconv.Itoa(ifi.Index)
+	if len(d.Servers) > 0 {
+		args := []string{index, strconv.Itoa(len(d.Servers))}
+		for _, s := range d.Servers {
+			ip := net.ParseIP(s)
+			family, addr := "10", ip.To16()
+			if ip4 := ip.To4(); ip4 != nil {
+				family, addr = "2", ip4
+			}
+			args = append(args, family, strconv.Itoa(len(addr)))
+			for _, b := range addr {
+				args = append(args, strconv.Itoa(int(b)))
+			}
+		}
+		if err := resolvedCall("SetLinkDNS", "ia(iay)", args...); err != nil {
+			return err
+		}
+	}
+	if len(d.Search) > 0 {
+		args := []string{index, strconv.Itoa(len(d.Search))}
+		for _, domain := range d.Search {
+			// Search domains, not only routing domains
+			args = append(args, domain, "false")
+		}
+		if err := resolvedCall("SetLinkDomains", "ia(sb)", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevertDNS restores the DNS configuration previous to SetDNS
+func (n Netconfig) RevertDNS(d DNSConfig) error {
+	if !useResolved() {
+		return updateResolvConf(resolvConfPath, func(content string) string {
+			return removeResolvConf(content, n.dev)
+		})
+	}
+	ifi, err := net.InterfaceByName(n.dev)
+	if err != nil {
+		// systemd-resolved forgets the links deleted
+		return nil
+	}
+	return resolvedCall("RevertLink", "i", strconv.Itoa(ifi.Index))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestResolvConf(t *testing.T) {
+	original := "nameserver 192.168.1.1\nsearch home.lan\noptions ndots:1\n"
+	d := DNSConfig{Servers: []string{"10.0.0.1"}, Search: []string{"svc.local"}}
+	got := addResolvConf(original, "tun0", d)
+	want := "# BEGIN tuncat tun0\nnameserver 10.0.0.1\nsearch svc.local home.lan\n# END tuncat tun0\n" +
+		"nameserver 192.168.1.1\n#tuncat:tun0# search home.lan\noptions ndots:1\n"
+	if got != want {
+		t.Errorf("addResolvConf():\n got %q\nwant %q", got, want)
+	}
+	// Adding the section again replaces it
+	if again := addResolvConf(got, "tun0", d); again != want {
+		t.Errorf("addResolvConf() twice:\n got %q\nwant %q", again, want)
+	}
+	if got := removeResolvConf(got, "tun0"); got != original {
+		t.Errorf("removeResolvConf():\n got %q\nwant %q", got, original)
+	}
+	// The sections of other interfaces are kept
+	other := addResolvConf(addResolvConf(original, "tun1", DNSConfig{Servers: []string{"10.1.0.1"}}), "tun0", d)
+	if got, want := removeResolvConf(other, "tun0"), addResolvConf(original, "tun1", DNSConfig{Servers: []string{"10.1.0.1"}}); got != want {
+		t.Errorf("removeResolvConf() other interface:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestDNSHandshake(t *testing.T) {
+	if got := (DNSConfig{}).handshakeValue(); got != "none" {
+		t.Errorf("handshakeValue() = %q, want none", got)
+	}
+	if d, err := parseDNSHandshake("none"); err != nil || d != nil {
+		t.Errorf("parseDNSHandshake(none) = %v, %v", d, err)
+	}
+	d := DNSConfig{Servers: []string{"10.0.0.1", "fd00::1"}, Search: []string{"svc.local"}}
+	got, err := parseDNSHandshake(d.handshakeValue())
+	if err != nil {
+		t.Fatalf("parseDNSHandshake() error: %v", err)
+	}
+	if !reflect.DeepEqual(*got, d) {
+		t.Errorf("parseDNSHandshake() = %+v, want %+v", *got, d)
+	}
+	for _, value := range []string{"", "{", `{"servers":["dns"]}`, `{"search":["a b"]}`, `{"search":["a\nnameserver 1.1.1.1"]}`} {
+		if _, err := parseDNSHandshake(value); err == nil {
+			t.Errorf("parseDNSHandshake(%q) succeeded", value)
+		}
+	}
+}
+
+func TestUpdateResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tuncat-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "resolv.conf")
+	original := "nameserver 192.168.1.1\n"
+	if err := ioutil.WriteFile(path, []byte(original), 0640); err != nil {
+		t.Fatal(err)
+	}
+	d := DNSConfig{Servers: []string{"10.0.0.1"}}
+	add := func(content string) string { return addResolvConf(content, "tun0", d) }
+	remove := func(content string) string { return removeResolvConf(content, "tun0") }
+
+	if err := updateResolvConf(path, add); err != nil {
+		t.Fatalf("updateResolvConf() error: %v", err)
+	}
+	if got, _ := ioutil.ReadFile(path); string(got) != add(original) {
+		t.Errorf("resolv.conf = %q, want %q", got, add(original))
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0640 {
+		t.Errorf("resolv.conf mode = %v, want 0640", fi.Mode().Perm())
+	}
+	if err := updateResolvConf(path, remove); err != nil {
+		t.Fatalf("updateResolvConf() error: %v", err)
+	}
+	if got, _ := ioutil.ReadFile(path); string(got) != original {
+		t.Errorf("resolv.conf = %q, want %q", got, original)
+	}
+	// The temporary files are renamed or removed
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files in the directory, want 1", len(files))
+	}
+
+	// Reverting a missing file doesn't create it
+	missing := filepath.Join(dir, "missing.conf")
+	if err := updateResolvConf(missing, remove); err != nil {
+		t.Fatalf("updateResolvConf() error: %v", err)
+	}
+	if _, err := os.Lstat(missing); !os.IsNotExist(err) {
+		t.Errorf("updateResolvConf() created %s", missing)
+	}
+
+	// The symlinks are not followed
+	if runtime.GOOS == "windows" {
+		return
+	}
+	link := filepath.Join(dir, "link.conf")
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateResolvConf(link, add); err == nil {
+		t.Errorf("updateResolvConf() followed the symlink")
+	}
+	if got, _ := ioutil.ReadFile(path); string(got) != original {
+		t.Errorf("symlink target = %q, want %q", got, original)
+	}
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("symlink replaced: %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import "fmt"
+
+func (n Netconfig) SetDNS(d DNSConfig) error {
+	return fmt.Errorf("DNS configuration is only supported on Linux")
+}
+
+func (n Netconfig) RevertDNS(d DNSConfig) error {
+	return nil
+}
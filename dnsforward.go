@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dnsForwardTimeout is the time to wait for the upstream answer
+	dnsForwardTimeout = 3 * time.Second
+	// dnsMaxMessageSize is the largest DNS message over UDP with EDNS
+	dnsMaxMessageSize = 65535
+	// dnsMaxQueries is the number of queries answered at the same time, each
+	// one may lock a thread to reach the upstream in its namespace
+	dnsMaxQueries = 64
+	// DNS response codes
+	dnsRcodeServFail = 2
+	dnsRcodeRefused  = 5
+)
+
+// dnsBuffer holds a DNS message received over UDP
+type dnsBuffer [dnsMaxMessageSize]byte
+
+var dnsBufferPool = sync.Pool{
+	New: func() interface{} { return new(dnsBuffer) },
+}
+
+// DNSForwarder forwards the DNS queries of the clients for its zones to an
+// upstream server, i.e. the docker embedded DNS of a container network
+type DNSForwarder struct {
+	// Upstream is the address of the upstream server
+	Upstream string
+	// Zones are the domains forwarded, the queries for other names are
+	// refused, all the names are forwarded if there are no zones
+	Zones []string
+	// UpstreamNetns is the network namespace where the upstream is reached
+	UpstreamNetns string
+	// Metrics counts the queries by result
+	Metrics *Metrics
+	Log     *Logger
+
+	mu       sync.Mutex
+	udp      net.PacketConn
+	tcp      net.Listener
+	listened bool
+}
+
+// Listen serves DNS over UDP and TCP on the address until Close
+func (f *DNSForwarder) Listen(address string) error {
+	udp, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return fmt.Errorf("Can't listen for DNS on %s: %v", address, err)
+	}
+	tcp, err := net.Listen("tcp", address)
+	if err != nil {
+		udp.Close()
+		return fmt.Errorf("Can't listen for DNS on %s: %v", address, err)
+	}
+	f.mu.Lock()
+	f.udp, f.tcp, f.listened = udp, tcp, true
+	f.mu.Unlock()
+	// The UDP and TCP queries share the limit
+	queries := make(chan struct{}, dnsMaxQueries)
+	go f.serveUDP(udp, queries)
+	go f.serveTCP(tcp, queries)
+	return nil
+}
+
+// Close stops serving DNS
+func (f *DNSForwarder) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.listened {
+		return
+	}
+	f.udp.Close()
+	f.tcp.Close()
+	f.listened = false
+}
+
+// serveUDP answers the queries received on conn, the next query is not read
+// while there are too many in flight
+func (f *DNSForwarder) serveUDP(conn net.PacketConn, queries chan struct{}) {
+	for {
+		queries <- struct{}{}
+		buf := dnsBufferPool.Get().(*dnsBuffer)
+		n, addr, err := conn.ReadFrom(buf[:])
+		if err != nil {
+			dnsBufferPool.Put(buf)
+			<-queries
+			return
+		}
+		go func() {
+			if answer := f.answer(buf[:n], "udp"); answer != nil {
+				conn.WriteTo(answer, addr)
+			}
+			dnsBufferPool.Put(buf)
+			<-queries
+		}()
+	}
+}
+
+// serveTCP answers the queries of the connections accepted on ln, each query
+// waits while there are too many in flight
+func (f *DNSForwarder) serveTCP(ln net.Listener, queries chan struct{}) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetReadDeadline(time.Now().Add(dnsForwardTimeout * 10))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				queries <- struct{}{}
+				answer := f.answer(query, "tcp")
+				<-queries
+				if answer == nil {
+					return
+				}
+				if err := writeTCPMessage(conn, answer); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// answer returns the answer to the query, nil if it is not a valid query
+func (f *DNSForwarder) answer(query []byte, network string) []byte {
+	name, end, ok := parseDNSQuestion(query)
+	if !ok {
+		f.count("malformed")
+		return nil
+	}
+	if !f.forwarded(name) {
+		f.count("refused")
+		f.Log.Debug("DNS query refused", "name", name)
+		return dnsError(query, end, dnsRcodeRefused)
+	}
+	answer, err := f.exchange(query, network)
+	if err != nil {
+		f.count("failed")
+		f.Log.Warn("DNS query failed", "name", name, "upstream", f.Upstream, "err", err)
+		return dnsError(query, end, dnsRcodeServFail)
+	}
+	f.count("forwarded")
+	return answer
+}
+
+// forwarded returns true if the name belongs to one of the zones
+func (f *DNSForwarder) forwarded(name string) bool {
+	if len(f.Zones) == 0 {
+		return true
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, zone := range f.Zones {
+		zone = strings.ToLower(strings.Trim(zone, "."))
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchange sends the query to the upstream server and returns its answer
+func (f *DNSForwarder) exchange(query []byte, network string) ([]byte, error) {
+	var conn net.Conn
+	err := inNetns(f.UpstreamNetns, func() error {
+		var err error
+		conn, err = net.DialTimeout(network, f.Upstream, dnsForwardTimeout)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsForwardTimeout))
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := dnsBufferPool.Get().(*dnsBuffer)
+	defer dnsBufferPool.Put(buf)
+	for {
+		n, err := conn.Read(buf[:])
+		if err != nil {
+			return nil, err
+		}
+		// Ignore the answers to other queries
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return append([]byte(nil), buf[:n]...), nil
+		}
+	}
+}
+
+func (f *DNSForwarder) count(result string) {
+	if f.Metrics != nil {
+		f.Metrics.DNSQuery(result)
+	}
+}
+
+// parseDNSUpstream returns the address of the upstream server, the port is 53 if omitted
+func parseDNSUpstream(s string) (string, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = s, "53"
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("Invalid DNS upstream %q, expected an address and an optional port", s)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return "", fmt.Errorf("Invalid DNS upstream port %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// parseDNSQuestion returns the name of the first question of the query and
+// the offset where the question ends
+func parseDNSQuestion(msg []byte) (string, int, bool) {
+	// Queries have the QR bit unset and at least one question
+	if len(msg) < 12 || msg[2]&0x80 != 0 || binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return "", 0, false
+	}
+	var labels []string
+	off := 12
+	for {
+		if off >= len(msg) {
+			return "", 0, false
+		}
+		l := int(msg[off])
+		off++
+		if l == 0 {
+			break
+		}
+		// Compression pointers are not expected in the questions
+		if l&0xc0 != 0 || off+l > len(msg) {
+			return "", 0, false
+		}
+		labels = append(labels, string(msg[off:off+l]))
+		off += l
+	}
+	// Type and class
+	if off+4 > len(msg) {
+		return "", 0, false
+	}
+	return strings.Join(labels, ".") + ".", off + 4, true
+}
+
+// dnsError returns an answer to the query with the response code, end is the
+// end of its first question
+func dnsError(query []byte, end, rcode int) []byte {
+	answer := make([]byte, end)
+	copy(answer, query[:end])
+	// QR, the opcode and RD are kept, RA is set
+	answer[2] = 0x80 | query[2]&0x79
+	answer[3] = 0x80 | byte(rcode)
+	binary.BigEndian.PutUint16(answer[4:6], 1)
+	binary.BigEndian.PutUint16(answer[6:8], 0)
+	binary.BigEndian.PutUint16(answer[8:10], 0)
+	binary.BigEndian.PutUint16(answer[10:12], 0)
+	return answer
+}
+
+// readTCPMessage reads a DNS message prefixed by its length
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeTCPMessage writes a DNS message prefixed by its length
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
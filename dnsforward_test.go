@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newDNSQuery returns a query of the A record of the name
+func newDNSQuery(id uint16, name string) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	// RD
+	msg[2] = 0x01
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	// Root label, type A and class IN
+	return append(msg, 0, 0, 1, 0, 1)
+}
+
+// stubAnswer is the answer of the stub upstream, the query with QR set and a
+// marker appended
+func stubAnswer(query []byte) []byte {
+	answer := append([]byte{}, query...)
+	answer[2] |= 0x80
+	return append(answer, "stub"...)
+}
+
+// startStubUpstream serves the stub answers over UDP and TCP on the same
+// port of the loopback, it returns its address
+func startStubUpstream(t *testing.T) string {
+	t.Helper()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close() })
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+	go func() {
+		buf := make([]byte, dnsMaxMessageSize)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(stubAnswer(buf[:n]), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					query, err := readTCPMessage(conn)
+					if err != nil {
+						return
+					}
+					writeTCPMessage(conn, stubAnswer(query))
+				}
+			}()
+		}
+	}()
+	return udp.LocalAddr().String()
+}
+
+// closedAddress returns a loopback address where nothing listens
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+	return address
+}
+
+func (m *Metrics) dnsQueryCount(result string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dnsQueries[result]
+}
+
+func TestParseDNSQuestion(t *testing.T) {
+	query := newDNSQuery(1, "web.docker")
+	name, end, ok := parseDNSQuestion(query)
+	if !ok || name != "web.docker." || end != len(query) {
+		t.Errorf("parseDNSQuestion() = %q, %d, %v, want web.docker., %d, true", name, end, ok, len(query))
+	}
+	answer := stubAnswer(query)
+	noQuestions := append([]byte{}, query...)
+	binary.BigEndian.PutUint16(noQuestions[4:6], 0)
+	pointer := append(append([]byte{}, query[:12]...), 0xc0, 0x0c, 0, 1, 0, 1)
+	for name, msg := range map[string][]byte{
+		"short":        query[:10],
+		"answer":       answer,
+		"no questions": noQuestions,
+		"truncated":    query[:len(query)-2],
+		"label":        query[:14],
+		"pointer":      pointer,
+	} {
+		if _, _, ok := parseDNSQuestion(msg); ok {
+			t.Errorf("parseDNSQuestion(%s) succeeded", name)
+		}
+	}
+}
+
+func TestDNSError(t *testing.T) {
+	query := newDNSQuery(0x1234, "web.docker")
+	// Additional EDNS records are not copied
+	query = append(query, 0, 0, 41, 16, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(query[10:12], 1)
+	_, end, _ := parseDNSQuestion(query)
+	answer := dnsError(query, end, dnsRcodeRefused)
+	if len(answer) != end {
+		t.Fatalf("dnsError() length = %d, want %d", len(answer), end)
+	}
+	if id := binary.BigEndian.Uint16(answer[0:2]); id != 0x1234 {
+		t.Errorf("ID = %#x, want 0x1234", id)
+	}
+	if answer[2] != 0x81 || answer[3] != 0x80|dnsRcodeRefused {
+		t.Errorf("flags = %#x %#x, want 0x81 0x85", answer[2], answer[3])
+	}
+	if counts := answer[4:12]; !bytes.Equal(counts, []byte{0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("counts = %v, want one question", counts)
+	}
+	if !bytes.Equal(answer[12:], query[12:end]) {
+		t.Errorf("question = %v, want %v", answer[12:], query[12:end])
+	}
+}
+
+func TestParseDNSUpstream(t *testing.T) {
+	tests := []struct {
+		upstream string
+		want     string
+		err      bool
+	}{
+		{upstream: "127.0.0.11", want: "127.0.0.11:53"},
+		{upstream: "127.0.0.11:5353", want: "127.0.0.11:5353"},
+		{upstream: "fd00::53", want: "[fd00::53]:53"},
+		{upstream: "[fd00::53]:5353", want: "[fd00::53]:5353"},
+		{upstream: "dns.local", err: true},
+		{upstream: "127.0.0.11:0", err: true},
+		{upstream: "127.0.0.11:dns", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseDNSUpstream(tt.upstream)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("parseDNSUpstream(%q) = %q, %v", tt.upstream, got, err)
+		}
+	}
+}
+
+func TestDNSForwarderZones(t *testing.T) {
+	f := &DNSForwarder{Zones: []string{"docker.", "Svc.Local"}}
+	for name, want := range map[string]bool{
+		"docker.":           true,
+		"web.docker.":       true,
+		"WEB.DOCKER.":       true,
+		"api.svc.local.":    true,
+		"notdocker.":        false,
+		"docker.example.":   false,
+		"example.com.":      false,
+		"svc.local.example": false,
+	} {
+		if got := f.forwarded(name); got != want {
+			t.Errorf("forwarded(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if !(&DNSForwarder{}).forwarded("example.com.") {
+		t.Errorf("forwarded() without zones = false, want true")
+	}
+}
+
+func TestDNSForwarder(t *testing.T) {
+	f := &DNSForwarder{
+		Upstream: startStubUpstream(t),
+		Zones:    []string{"docker"},
+		Metrics:  NewMetrics(),
+		Log:      logger,
+	}
+	if err := f.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	defer f.Close()
+
+	udp, err := net.Dial("udp", f.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	exchangeUDP := func(query []byte) []byte {
+		t.Helper()
+		udp.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := udp.Write(query); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, dnsMaxMessageSize)
+		n, err := udp.Read(buf)
+		if err != nil {
+			t.Fatalf("Read() error: %v", err)
+		}
+		return buf[:n]
+	}
+	query := newDNSQuery(1, "web.docker")
+	if got := exchangeUDP(query); !bytes.Equal(got, stubAnswer(query)) {
+		t.Errorf("UDP answer = %q, want %q", got, stubAnswer(query))
+	}
+	refused := newDNSQuery(2, "example.com")
+	if got := exchangeUDP(refused); len(got) < 4 || got[3]&0x0f != dnsRcodeRefused {
+		t.Errorf("UDP answer to a name outside the zones = %v, want refused", got)
+	}
+	// The malformed queries are not answered
+	udp.Write([]byte{0, 1, 2})
+
+	tcp, err := net.Dial("tcp", f.tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	tcp.SetDeadline(time.Now().Add(5 * time.Second))
+	// Several queries are answered on the same connection
+	for id := uint16(3); id < 5; id++ {
+		query := newDNSQuery(id, "db.docker")
+		if err := writeTCPMessage(tcp, query); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readTCPMessage(tcp)
+		if err != nil {
+			t.Fatalf("readTCPMessage() error: %v", err)
+		}
+		if !bytes.Equal(got, stubAnswer(query)) {
+			t.Errorf("TCP answer = %q, want %q", got, stubAnswer(query))
+		}
+	}
+
+	for i := 0; i < 100 && f.Metrics.dnsQueryCount("malformed") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for result, want := range map[string]uint64{"forwarded": 3, "refused": 1, "malformed": 1} {
+		if got := f.Metrics.dnsQueryCount(result); got != want {
+			t.Errorf("%s queries = %d, want %d", result, got, want)
+		}
+	}
+}
+
+func TestDNSForwarderQueryLimit(t *testing.T) {
+	// The upstream never answers, the queries stay in flight until the timeout
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	received := make(chan struct{}, 2*dnsMaxQueries)
+	go func() {
+		buf := make([]byte, dnsMaxMessageSize)
+		for {
+			if _, _, err := upstream.ReadFrom(buf); err != nil {
+				return
+			}
+			received <- struct{}{}
+		}
+	}()
+	f := &DNSForwarder{Upstream: upstream.LocalAddr().String(), Log: logger}
+	if err := f.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	defer f.Close()
+	udp, err := net.Dial("udp", f.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	for id := 0; id < 2*dnsMaxQueries; id++ {
+		udp.Write(newDNSQuery(uint16(id), "web.docker"))
+	}
+	for i := 0; i < dnsMaxQueries; i++ {
+		select {
+		case <-received:
+		case <-time.After(dnsForwardTimeout):
+			t.Fatalf("%d queries forwarded, want %d", i, dnsMaxQueries)
+		}
+	}
+	select {
+	case <-received:
+		t.Errorf("More than %d queries in flight", dnsMaxQueries)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestDNSForwarderUpstreamDown(t *testing.T) {
+	f := &DNSForwarder{
+		Upstream: closedAddress(t),
+		Metrics:  NewMetrics(),
+		Log:      logger,
+	}
+	for _, network := range []string{"tcp", "udp"} {
+		answer := f.answer(newDNSQuery(1, "web.docker"), network)
+		if len(answer) < 4 || answer[3]&0x0f != dnsRcodeServFail {
+			t.Errorf("%s answer = %v, want a server failure", network, answer)
+		}
+	}
+	if got := f.Metrics.dnsQueryCount("failed"); got != 2 {
+		t.Errorf("failed queries = %d, want 2", got)
+	}
+}
+
+func TestDNSForwarderHandshake(t *testing.T) {
+	tests := []struct {
+		name      string
+		ifAddress string
+		tunnel    []string
+		rejected  bool
+	}{
+		{name: "forwarder", ifAddress: "192.168.166.2", tunnel: []string{"192.168.166.1"}},
+		{name: "server address", ifAddress: "192.168.166.1", rejected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			var rec NetworkRecorder
+			s := newTestServer(ln, &rec)
+			s.DNSForwarder = &DNSForwarder{Upstream: "127.0.0.11:53", Log: logger}
+			s.DNS = DNSConfig{Servers: []string{s.IfAddress}, Search: []string{"docker"}}
+			// Port 53 requires privileges
+			s.dnsListening = true
+			errChan := make(chan error, 1)
+			go func() {
+				errChan <- s.Start()
+			}()
+			defer func() {
+				s.Down()
+				<-errChan
+			}()
+
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatalf("Accept() error: %v", err)
+			}
+			c := NewClient("")
+			c.conn = conn
+			c.IfAddress = tt.ifAddress
+			c.AcceptDNS = true
+			err = c.handShake()
+			conn.Close()
+			if tt.rejected {
+				if r, ok := err.(*RouteRejection); !ok || r.Parameter != "dns" || r.Reason != rejectOverlap {
+					t.Fatalf("handShake() error = %v, want a dns overlap rejection", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handShake() error: %v", err)
+			}
+			if c.dns == nil || !reflect.DeepEqual(c.dns.Tunnel, tt.tunnel) {
+				t.Fatalf("DNS configuration = %+v, want the tunnel servers %q", c.dns, tt.tunnel)
+			}
+			route := "route add " + tt.ifAddress + " dev tun0"
+			for i := 0; i < 100 && !containsString(changeStrings(rec.Changes()), route); i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if changes := changeStrings(rec.Changes()); !containsString(changes, route) {
+				t.Errorf("server changes %q, want %q", changes, route)
+			}
+		})
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultDockerSocket is the Unix socket of the Docker Engine API
+const defaultDockerSocket = "/var/run/docker.sock"
+
+// dockerRetryInterval is the time to wait to watch the events again
+var dockerRetryInterval = 5 * time.Second
+
+// dockerPredefinedNetworks are created by docker, the rest are user-defined
+var dockerPredefinedNetworks = map[string]bool{"bridge": true, "host": true, "none": true}
+
+// dockerNetwork is the network resource of the Docker Engine API
+type dockerNetwork struct {
+	Name string `json:"Name"`
+	IPAM struct {
+		Config []struct {
+			Subnet string `json:"Subnet"`
+		} `json:"Config"`
+	} `json:"IPAM"`
+}
+
+// dockerEvent is an event of the Docker Engine API
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// DockerDiscovery advertises the subnets of the docker networks to the clients,
+// the networks are listed again every time one is created or removed
+type DockerDiscovery struct {
+	// Socket is the Unix socket of the Docker Engine API
+	Socket string
+	// Networks are the names of the networks advertised, all the
+	// user-defined networks if empty
+	Networks []string
+	Log      *Logger
+
+	client *http.Client
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	routes []string
+	// subscribers receive the routes every time they change
+	subscribers map[chan []string]bool
+}
+
+// Start lists the networks and watches the changes until Stop
+func (d *DockerDiscovery) Start() error {
+	d.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", d.Socket)
+			},
+		},
+	}
+	routes, err := d.list()
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.routes = routes
+	d.subscribers = map[chan []string]bool{}
+	d.mu.Unlock()
+	d.Log.Info("Docker networks discovered", "networks", strings.Join(routes, ","))
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	go d.watch(ctx, dockerRetryInterval)
+	return nil
+}
+
+// Stop stops watching the networks
+func (d *DockerDiscovery) Stop() {
+	if d.cancel != nil {
+		d.cancel()
+	}
+}
+
+// Routes returns the subnets of the networks advertised
+func (d *DockerDiscovery) Routes() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.routes
+}
+
+// Subscribe returns a channel that receives the current routes and then the
+// new ones every time they change, only the last routes are kept if the
+// subscriber is slow. cancel releases the channel.
+func (d *DockerDiscovery) Subscribe() (<-chan []string, func()) {
+	ch := make(chan []string, 1)
+	d.mu.Lock()
+	d.subscribers[ch] = true
+	ch <- d.routes
+	d.mu.Unlock()
+	return ch, func() {
+		d.mu.Lock()
+		delete(d.subscribers, ch)
+		d.mu.Unlock()
+	}
+}
+
+// update publishes the routes if they changed
+func (d *DockerDiscovery) update(routes []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if equalStrings(d.routes, routes) {
+		return
+	}
+	d.Log.Info("Docker networks changed", "networks", strings.Join(routes, ","))
+	d.routes = routes
+	for ch := range d.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- routes
+	}
+}
+
+// watch lists the networks again on every network event, the events are
+// watched again if the stream fails
+func (d *DockerDiscovery) watch(ctx context.Context, retryInterval time.Duration) {
+	for {
+		err := d.events(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		d.Log.Warn("Error watching docker events", "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+		// The changes may have been missed
+		if routes, err := d.list(); err == nil {
+			d.update(routes)
+		}
+	}
+}
+
+// events reads the stream of network events until it fails
+func (d *DockerDiscovery) events(ctx context.Context) error {
+	filters := `{"type":["network"],"event":["create","destroy"]}`
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://docker/events?filters="+url.QueryEscape(filters), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Docker API error: %s", resp.Status)
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event dockerEvent
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		if event.Type != "network" {
+			continue
+		}
+		d.Log.Debug("Docker network event", "action", event.Action, "network", event.Actor.Attributes["name"])
+		routes, err := d.list()
+		if err != nil {
+			return err
+		}
+		d.update(routes)
+	}
+}
+
+// list returns the sorted subnets of the networks advertised
+func (d *DockerDiscovery) list() ([]string, error) {
+	resp, err := d.client.Get("http://docker/networks")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing docker networks: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error listing docker networks: %s", resp.Status)
+	}
+	var networks []dockerNetwork
+	if err := json.NewDecoder(resp.Body).Decode(&networks); err != nil {
+		return nil, fmt.Errorf("Error listing docker networks: %v", err)
+	}
+	selected := map[string]bool{}
+	for _, name := range d.Networks {
+		selected[name] = true
+	}
+	seen := map[string]bool{}
+	routes := []string{}
+	for _, n := range networks {
+		if len(selected) > 0 && !selected[n.Name] || len(selected) == 0 && dockerPredefinedNetworks[n.Name] {
+			continue
+		}
+		for _, c := range n.IPAM.Config {
+			_, subnet, err := net.ParseCIDR(c.Subnet)
+			if err != nil || seen[subnet.String()] {
+				continue
+			}
+			seen[subnet.String()] = true
+			routes = append(routes, subnet.String())
+		}
+	}
+	sort.Strings(routes)
+	return routes, nil
+}
+
+// equalStrings returns true if the slices have the same elements in the same order
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDocker serves the networks and the events of the Docker Engine API on
+// a Unix socket
+type fakeDocker struct {
+	Socket string
+
+	server *httptest.Server
+	mu     sync.Mutex
+	// networks is the JSON answer to the network list
+	networks string
+	status   int
+	events   chan dockerEvent
+	// drop closes the event streams
+	drop chan struct{}
+	// watching receives the event streams opened
+	watching chan struct{}
+}
+
+func newFakeDocker(t *testing.T, networks string) *fakeDocker {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tuncat-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	f := &fakeDocker{
+		Socket:   filepath.Join(dir, "docker.sock"),
+		networks: networks,
+		events:   make(chan dockerEvent),
+		drop:     make(chan struct{}),
+		watching: make(chan struct{}, 10),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/networks", f.serveNetworks)
+	mux.HandleFunc("/events", f.serveEvents)
+	f.server = httptest.NewUnstartedServer(mux)
+	ln, err := net.Listen("unix", f.Socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.server.Listener.Close()
+	f.server.Listener = ln
+	f.server.Start()
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeDocker) setNetworks(networks string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.networks = networks
+}
+
+func (f *fakeDocker) setStatus(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+}
+
+func (f *fakeDocker) serveNetworks(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		return
+	}
+	w.Write([]byte(f.networks))
+}
+
+func (f *fakeDocker) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.URL.Query().Get("filters"), `"network"`) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	drop := f.drop
+	f.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	select {
+	case f.watching <- struct{}{}:
+	default:
+	}
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event := <-f.events:
+			encoder.Encode(event)
+			w.(http.Flusher).Flush()
+		case <-drop:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// waitWatching waits for an event stream to be opened
+func (f *fakeDocker) waitWatching(t *testing.T) {
+	t.Helper()
+	select {
+	case <-f.watching:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Nobody watches the docker events")
+	}
+}
+
+// dropEvents closes the current event streams
+func (f *fakeDocker) dropEvents() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	close(f.drop)
+	f.drop = make(chan struct{})
+}
+
+func (f *fakeDocker) sendEvent(t *testing.T, typ, action, name string) {
+	t.Helper()
+	event := dockerEvent{Type: typ, Action: action}
+	event.Actor.Attributes = map[string]string{"name": name}
+	select {
+	case f.events <- event:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Nobody watches the docker events")
+	}
+}
+
+// receiveRoutes waits for the routes published to the subscriber
+func receiveRoutes(t *testing.T, ch <-chan []string) []string {
+	t.Helper()
+	select {
+	case routes := <-ch:
+		return routes
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No routes published")
+	}
+	return nil
+}
+
+const testDockerNetworks = `[
+	{"Name": "bridge", "IPAM": {"Config": [{"Subnet": "172.17.0.0/16"}]}},
+	{"Name": "host", "IPAM": {"Config": []}},
+	{"Name": "none", "IPAM": {"Config": []}},
+	{"Name": "app", "IPAM": {"Config": [{"Subnet": "172.18.0.0/16"}, {"Subnet": "fd00:18::/64"}]}},
+	{"Name": "db", "IPAM": {"Config": [{"Subnet": "172.19.0.0/16"}, {"Subnet": "bogus"}]}},
+	{"Name": "copy", "IPAM": {"Config": [{"Subnet": "172.18.0.0/16"}]}}
+]`
+
+func TestDockerDiscoveryList(t *testing.T) {
+	f := newFakeDocker(t, testDockerNetworks)
+	tests := []struct {
+		name     string
+		networks []string
+		want     []string
+	}{
+		{
+			name: "user-defined",
+			want: []string{"172.18.0.0/16", "172.19.0.0/16", "fd00:18::/64"},
+		},
+		{
+			name:     "selected",
+			networks: []string{"bridge", "db", "missing"},
+			want:     []string{"172.17.0.0/16", "172.19.0.0/16"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DockerDiscovery{Socket: f.Socket, Networks: tt.networks, Log: logger}
+			if err := d.Start(); err != nil {
+				t.Fatalf("Start() error: %v", err)
+			}
+			defer d.Stop()
+			if got := d.Routes(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Routes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDockerDiscoveryErrors(t *testing.T) {
+	f := newFakeDocker(t, "[")
+	d := &DockerDiscovery{Socket: f.Socket, Log: logger}
+	if err := d.Start(); err == nil {
+		d.Stop()
+		t.Errorf("Start() with an invalid answer succeeded")
+	}
+	f.setStatus(http.StatusInternalServerError)
+	if err := d.Start(); err == nil {
+		d.Stop()
+		t.Errorf("Start() with an API error succeeded")
+	}
+	d = &DockerDiscovery{Socket: filepath.Join(filepath.Dir(f.Socket), "missing.sock"), Log: logger}
+	if err := d.Start(); err == nil {
+		d.Stop()
+		t.Errorf("Start() without the API succeeded")
+	}
+}
+
+func TestDockerDiscoveryEvents(t *testing.T) {
+	f := newFakeDocker(t, `[{"Name": "app", "IPAM": {"Config": [{"Subnet": "172.18.0.0/16"}]}}]`)
+	d := &DockerDiscovery{Socket: f.Socket, Log: logger}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	defer d.Stop()
+	ch, cancel := d.Subscribe()
+	defer cancel()
+	if got, want := receiveRoutes(t, ch), []string{"172.18.0.0/16"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("routes = %q, want %q", got, want)
+	}
+
+	f.setNetworks(`[
+		{"Name": "app", "IPAM": {"Config": [{"Subnet": "172.18.0.0/16"}]}},
+		{"Name": "db", "IPAM": {"Config": [{"Subnet": "172.19.0.0/16"}]}}
+	]`)
+	f.sendEvent(t, "network", "create", "db")
+	want := []string{"172.18.0.0/16", "172.19.0.0/16"}
+	if got := receiveRoutes(t, ch); !reflect.DeepEqual(got, want) {
+		t.Errorf("routes = %q, want %q", got, want)
+	}
+	if got := d.Routes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Routes() = %q, want %q", got, want)
+	}
+
+	// The events that don't change the networks are not published
+	f.sendEvent(t, "network", "create", "db")
+	f.setNetworks(`[{"Name": "db", "IPAM": {"Config": [{"Subnet": "172.19.0.0/16"}]}}]`)
+	f.sendEvent(t, "network", "destroy", "app")
+	if got, want := receiveRoutes(t, ch), []string{"172.19.0.0/16"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("routes = %q, want %q", got, want)
+	}
+}
+
+func TestDockerDiscoveryRetry(t *testing.T) {
+	defer func(d time.Duration) { dockerRetryInterval = d }(dockerRetryInterval)
+	dockerRetryInterval = 10 * time.Millisecond
+	f := newFakeDocker(t, `[{"Name": "app", "IPAM": {"Config": [{"Subnet": "172.18.0.0/16"}]}}]`)
+	d := &DockerDiscovery{Socket: f.Socket, Log: logger}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	defer d.Stop()
+	ch, cancel := d.Subscribe()
+	defer cancel()
+	receiveRoutes(t, ch)
+	f.waitWatching(t)
+
+	// The changes missed while the stream is down are listed again
+	f.setNetworks(`[{"Name": "db", "IPAM": {"Config": [{"Subnet": "172.19.0.0/16"}]}}]`)
+	f.dropEvents()
+	if got, want := receiveRoutes(t, ch), []string{"172.19.0.0/16"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("routes = %q, want %q", got, want)
+	}
+	// And the events are watched again
+	f.setNetworks(`[]`)
+	f.sendEvent(t, "network", "destroy", "db")
+	if got, want := receiveRoutes(t, ch), []string{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("routes = %q, want %q", got, want)
+	}
+}
+
+func TestDockerAdvertisedHandshake(t *testing.T) {
+	f := newFakeDocker(t, `[{"Name": "app", "IPAM": {"Config": [{"Subnet": "172.18.0.0/16"}]}}]`)
+	d := &DockerDiscovery{Socket: f.Socket, Log: logger}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	defer d.Stop()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var rec NetworkRecorder
+	s := newTestServer(ln, &rec)
+	s.Docker = d
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- s.Start()
+	}()
+	defer func() {
+		s.Down()
+		<-errChan
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error: %v", err)
+	}
+	defer conn.Close()
+	c := NewClient("")
+	c.conn = conn
+	c.IfAddress = "192.168.166.2"
+	c.AcceptRoutes = true
+	if err := c.handShake(); err != nil {
+		t.Fatalf("handShake() error: %v", err)
+	}
+	if want := []string{"172.18.0.0/16"}; !reflect.DeepEqual(c.serverRoutes, want) {
+		t.Errorf("advertised routes = %q, want %q", c.serverRoutes, want)
+	}
+	// The replies of the containers go back through the tunnel
+	route := "route add 192.168.166.2 dev tun0"
+	for i := 0; i < 100 && !containsString(changeStrings(rec.Changes()), route); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if changes := changeStrings(rec.Changes()); !containsString(changes, route) {
+		t.Errorf("server changes %q, want %q", changes, route)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+)
+
+// dryRunInterface is the interface name used when the OS would choose one
+const dryRunInterface = "tun0"
+
+// DryRunReport describes the network changes one end of the tunnel would apply
+type DryRunReport struct {
+	// Mode is "client" or "server"
+	Mode      string          `json:"mode"`
+	Interface string          `json:"interface"`
+	Changes   []NetworkChange `json:"changes"`
+}
+
+// WriteText writes the report in human readable form
+func (r DryRunReport) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "%s interface %s\n", r.Mode, r.Interface)
+	for _, c := range r.Changes {
+		fmt.Fprintf(w, "  %s\n", c)
+	}
+}
+
+// WriteJSON writes the report as JSON
+func (r DryRunReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// DryRun simulates a connection between the client and the server over an
+// in-memory connection and records the network changes that both ends would
+// apply, without modifying the host. The host is not queried either, it has
+// no other networks and reaches the peers directly.
+func DryRun(client *Client, server *Server) (DryRunReport, DryRunReport, error) {
+	var clientNet, serverNet NetworkRecorder
+	client.NewNetworkConfigurator = clientNet.NewNetworkConfigurator
+	server.NewNetworkConfigurator = serverNet.NewNetworkConfigurator
+	client.HostNetwork = FakeHostNetwork{}
+	server.HostNetwork = FakeHostNetwork{}
+	// The changes are recorded, they are not applied in the namespace
+	server.Netns = ""
+	client.conn, server.conn = net.Pipe()
+	defer client.conn.Close()
+	defer server.conn.Close()
+
+	errChan := make(chan error, 1)
+	go func() {
+		err := server.handShake()
+		if err != nil {
+			// unblock the client
+			server.conn.Close()
+		}
+		errChan <- err
+	}()
+	if err := client.handShake(); err != nil {
+		return DryRunReport{}, DryRunReport{}, fmt.Errorf("Client handshake error: %v", err)
+	}
+	if err := <-errChan; err != nil {
+		return DryRunReport{}, DryRunReport{}, fmt.Errorf("Server handshake error: %v", err)
+	}
+
+	clientDev := dryRunInterfaceName(client.Interface)
+	if err := client.setupNetwork(clientDev); err != nil {
+		return DryRunReport{}, DryRunReport{}, err
+	}
+	serverDev := dryRunInterfaceName(server.Interface)
+	if err := server.setupNetwork(serverDev); err != nil {
+		return DryRunReport{}, DryRunReport{}, err
+	}
+	clientReport := DryRunReport{
+		Mode:      "client",
+		Interface: clientDev,
+		Changes:   clientNet.Changes(),
+	}
+	serverReport := DryRunReport{
+		Mode:      "server",
+		Interface: serverDev,
+		Changes:   serverNet.Changes(),
+	}
+	return clientReport, serverReport, nil
+}
+
+// dryRunInterfaceName returns the configured interface name or a placeholder
+func dryRunInterfaceName(cfg InterfaceConfig) string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return dryRunInterface
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	_, exported, _ := net.ParseCIDR("172.17.0.0/16")
+	tests := []struct {
+		name          string
+		remoteNetwork string
+		remoteGateway string
+		wantErr       bool
+		client        []string
+		server        []string
+	}{
+		{
+			name:          "exported network",
+			remoteNetwork: "172.17.0.0/16",
+			remoteGateway: "172.17.0.1",
+			client: []string{
+				"link set tun0 up",
+				"address add 192.168.166.2 dev tun0",
+				"route add 172.17.0.0/16 via 192.168.166.2",
+			},
+			server: []string{
+				"link set tun0 up",
+				"address add 192.168.166.1 dev tun0",
+				"route add 172.17.0.0/16 via 172.17.0.1",
+				"nat add POSTROUTING -o eth0 -j MASQUERADE",
+				"route add default via 192.168.166.1 table 10",
+				"rule add from 172.17.0.0/16 table 10 priority 10",
+			},
+		},
+		{
+			name:          "network not exported",
+			remoteNetwork: "10.0.0.0/8",
+			remoteGateway: "10.0.0.1",
+			wantErr:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewClient("")
+			client.IfAddress = "192.168.166.2"
+			client.RemoteNetwork = tt.remoteNetwork
+			client.RemoteGateway = tt.remoteGateway
+			server := NewServer("")
+			server.ExportNetworks = []*net.IPNet{exported}
+			// The dry-run doesn't enter the namespace
+			server.Netns = "/nonexistent"
+			clientReport, serverReport, err := DryRun(client, server)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DryRun() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := changeStrings(clientReport.Changes); !reflect.DeepEqual(got, tt.client) {
+				t.Errorf("client changes:\n got %q\nwant %q", got, tt.client)
+			}
+			if got := changeStrings(serverReport.Changes); !reflect.DeepEqual(got, tt.server) {
+				t.Errorf("server changes:\n got %q\nwant %q", got, tt.server)
+			}
+		})
+	}
+}
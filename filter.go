@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// packetFilter matches packets with a subset of the BPF filter syntax:
+//
+//	expr := term { "or" term }
+//	term := factor { "and" factor }
+//	factor := "not" factor | "(" expr ")" | primitive
+//	primitive := [ "src" | "dst" ] ( "host" IP | "net" CIDR | "port" N ) |
+//	             "ip" | "ip6" | "tcp" | "udp" | "icmp" | "icmp6"
+//
+// "src" and "dst" without qualifier are shorthands for "src host" and "dst host",
+// "&&", "||" and "!" can be used instead of "and", "or" and "not".
+type packetFilter interface {
+	Match(p packetInfo) bool
+}
+
+type filterFunc func(p packetInfo) bool
+
+func (f filterFunc) Match(p packetInfo) bool {
+	return f(p)
+}
+
+// parseFilter compiles the filter expression, an empty expression matches everything
+func parseFilter(expr string) (packetFilter, error) {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(expr)
+	p := &filterParser{tokens: strings.Fields(expr)}
+	if len(p.tokens) == 0 {
+		return filterFunc(func(packetInfo) bool { return true }), nil
+	}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected %q in filter", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("Unexpected end of filter")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *filterParser) parseOr() (packetFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = filterFunc(func(pkt packetInfo) bool { return l.Match(pkt) || right.Match(pkt) })
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (packetFilter, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = filterFunc(func(pkt packetInfo) bool { return l.Match(pkt) && right.Match(pkt) })
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (packetFilter, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.pos++
+		f, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return filterFunc(func(pkt packetInfo) bool { return !f.Match(pkt) }), nil
+	case "(":
+		p.pos++
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(); err != nil || tok != ")" {
+			return nil, fmt.Errorf("Missing ) in filter")
+		}
+		return f, nil
+	}
+	return p.parsePrimitive()
+}
+
+func (p *filterParser) parsePrimitive() (packetFilter, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case "ip":
+		return filterFunc(func(pkt packetInfo) bool { return pkt.version == 4 }), nil
+	case "ip6":
+		return filterFunc(func(pkt packetInfo) bool { return pkt.version == 6 }), nil
+	case "tcp", "udp", "icmp", "icmp6":
+		return filterFunc(func(pkt packetInfo) bool { return pkt.version != 0 && pkt.protoName() == tok }), nil
+	}
+
+	src, dst := true, true
+	switch tok {
+	case "src":
+		dst = false
+	case "dst":
+		src = false
+	default:
+		p.pos--
+	}
+	kind := "host"
+	switch p.peek() {
+	case "host", "net", "port":
+		kind, _ = p.next()
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "host":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid host %q in filter", value)
+		}
+		return filterFunc(func(pkt packetInfo) bool {
+			return (src && ip.Equal(pkt.src)) || (dst && ip.Equal(pkt.dst))
+		}), nil
+	case "net":
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid net %q in filter", value)
+		}
+		return filterFunc(func(pkt packetInfo) bool {
+			return (src && pkt.src != nil && ipNet.Contains(pkt.src)) || (dst && pkt.dst != nil && ipNet.Contains(pkt.dst))
+		}), nil
+	default:
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port %q in filter", value)
+		}
+		return filterFunc(func(pkt packetInfo) bool {
+			if pkt.proto != protoTCP && pkt.proto != protoUDP {
+				return false
+			}
+			return (src && pkt.srcPort == uint16(port)) || (dst && pkt.dstPort == uint16(port))
+		}), nil
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	tcp := newTestPacket(protoTCP, "10.0.0.1", "172.17.0.2", 40000, 80, 60)
+	udp := newTestPacket(protoUDP, "172.17.0.2", "10.0.0.1", 53, 40000, 60)
+	tests := []struct {
+		expr string
+		tcp  bool
+		udp  bool
+	}{
+		{"", true, true},
+		{"tcp", true, false},
+		{"udp", false, true},
+		{"icmp", false, false},
+		{"ip", true, true},
+		{"ip6", false, false},
+		{"host 10.0.0.1", true, true},
+		{"src host 10.0.0.1", true, false},
+		{"dst 10.0.0.1", false, true},
+		{"net 172.17.0.0/16", true, true},
+		{"dst net 172.17.0.0/16", true, false},
+		{"port 80", true, false},
+		{"src port 53", false, true},
+		{"dst port 53", false, false},
+		{"tcp and dst port 80", true, false},
+		{"tcp && port 53", false, false},
+		{"tcp or udp", true, true},
+		{"udp || port 80", true, true},
+		{"not tcp", false, true},
+		{"! udp", true, false},
+		{"not (tcp or udp)", false, false},
+		{"(tcp and port 80) or (udp and port 53)", true, true},
+		{"udp or tcp and port 80", true, true},
+		{"not tcp and not udp", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			f, err := parseFilter(tt.expr)
+			if err != nil {
+				t.Fatalf("parseFilter(%q) error: %v", tt.expr, err)
+			}
+			for _, c := range []struct {
+				name   string
+				packet []byte
+				want   bool
+			}{
+				{"tcp", tcp, tt.tcp},
+				{"udp", udp, tt.udp},
+			} {
+				info, _ := parseIPPacket(c.packet)
+				if got := f.Match(info); got != c.want {
+					t.Errorf("%q matches the %s packet = %v, want %v", tt.expr, c.name, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"tcp and",
+		"(tcp",
+		"tcp)",
+		"host",
+		"host 10.0.0",
+		"net 10.0.0.0",
+		"port 70000",
+		"port http",
+		"src",
+		"tcp udp",
+	} {
+		if _, err := parseFilter(expr); err == nil {
+			t.Errorf("parseFilter(%q) succeeded", expr)
+		}
+	}
+}
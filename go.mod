@@ -1,6 +1,6 @@
 module github.com/aojea/tuncat
 
-go 1.13
+go 1.16
 
 require (
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
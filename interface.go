@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/songgao/water"
+)
+
+// InterfaceConfig represent the configuration of the tunnel interface
+type InterfaceConfig struct {
+	// Name of the interface, if empty the OS assigns one
+	Name string
+	// TAP creates a Layer 2 TAP interface instead of a TUN interface
+	TAP bool
+	// Persist keeps the interface after tuncat closes it
+	Persist bool
+	// Owner is the user ID allowed to use the interface, -1 for any user
+	Owner int
+	// Group is the group ID allowed to use the interface, -1 for any group
+	Group int
+	// Queues is the number of queues, more than one creates a multi-queue interface
+	Queues int
+	// Offload enables the segmentation offloads, the packets are read and
+	// written with a virtio-net header
+	Offload bool
+	// Address is the address of the interface, the Windows driver needs it
+	// to emulate a TUN interface
+	Address string
+}
+
+// NewInterfaceConfig returns an InterfaceConfig with default settings
+func NewInterfaceConfig() InterfaceConfig {
+	return InterfaceConfig{
+		Owner:  -1,
+		Group:  -1,
+		Queues: 1,
+	}
+}
+
+// tunQueue is a queue of the interface
+type tunQueue interface {
+	io.ReadWriteCloser
+	Name() string
+}
+
+// newInterface creates the TUN interface
+func newInterface(cfg InterfaceConfig) (tunQueue, error) {
+	if cfg.Offload {
+		q, err := newOffloadInterface(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return q, nil
+	}
+	config, err := waterConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ifce, err := water.New(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating interface: %v", err)
+	}
+	return ifce, nil
+}
+
+// tunDevice is the device the tunnel forwards the packets to and from
+type tunDevice interface {
+	Name() string
+	Close() error
+	readWriters() []io.ReadWriter
+}
+
+// interfaceQueues are the queues of an interface, a single queue interface has one
+type interfaceQueues []tunQueue
+
+// Name returns the name of the interface
+func (q interfaceQueues) Name() string {
+	return q[0].Name()
+}
+
+// Close detaches from all the queues
+func (q interfaceQueues) Close() error {
+	var err error
+	for _, ifce := range q {
+		if cerr := ifce.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// readWriters returns the queues to be used by TunnelQueues
+func (q interfaceQueues) readWriters() []io.ReadWriter {
+	rws := make([]io.ReadWriter, len(q))
+	for i, ifce := range q {
+		rws[i] = ifce
+	}
+	return rws
+}
+
+// newTunDevice creates the interface with all its queues
+func newTunDevice(cfg InterfaceConfig) (tunDevice, error) {
+	q, err := newInterfaceQueues(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// newInterfaceQueues creates the interface and attaches to all its queues
+func newInterfaceQueues(cfg InterfaceConfig) (interfaceQueues, error) {
+	if cfg.Queues < 1 {
+		return nil, fmt.Errorf("Invalid number of queues %d", cfg.Queues)
+	}
+	cfg = keepPersist(cfg)
+	ifce, err := newInterface(cfg)
+	if err != nil {
+		return nil, err
+	}
+	queues := interfaceQueues{ifce}
+	// The other queues attach to the interface created
+	cfg.Name = ifce.Name()
+	for i := 1; i < cfg.Queues; i++ {
+		q, err := newInterface(cfg)
+		if err != nil {
+			queues.Close()
+			return nil, fmt.Errorf("Error attaching queue %d: %v", i, err)
+		}
+		queues = append(queues, q)
+	}
+	return queues, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/songgao/water"
+)
+
+// waterConfig returns the water configuration for the interface
+func waterConfig(cfg InterfaceConfig) (water.Config, error) {
+	if cfg.TAP {
+		return water.Config{}, fmt.Errorf("TAP mode is only supported on Linux")
+	}
+	if cfg.Persist || cfg.Owner >= 0 || cfg.Group >= 0 {
+		return water.Config{}, fmt.Errorf("Interface persistence and ownership are only supported on Linux")
+	}
+	if cfg.Queues > 1 {
+		return water.Config{}, fmt.Errorf("Multi-queue interfaces are only supported on Linux")
+	}
+	config := water.Config{
+		DeviceType: water.TUN,
+	}
+	// The system driver requires utunN names
+	config.Name = cfg.Name
+	return config, nil
+}
+
+// keepPersist returns the configuration unchanged, the interfaces can't persist
+func keepPersist(cfg InterfaceConfig) InterfaceConfig {
+	return cfg
+}
+
+// MakeTun is only supported on Linux
+func MakeTun(cfg InterfaceConfig) (string, error) {
+	return "", fmt.Errorf("mktun is only supported on Linux")
+}
+
+// RemoveTun is only supported on Linux
+func RemoveTun(name string) error {
+	return fmt.Errorf("rmtun is only supported on Linux")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/songgao/water"
+)
+
+// waterConfig returns the water configuration for the interface
+func waterConfig(cfg InterfaceConfig) (water.Config, error) {
+	config := water.Config{
+		DeviceType: water.TUN,
+	}
+	if cfg.TAP {
+		config.DeviceType = water.TAP
+	}
+	config.Name = cfg.Name
+	config.Persist = cfg.Persist
+	config.MultiQueue = cfg.Queues > 1
+	if cfg.Owner >= 0 || cfg.Group >= 0 {
+		// the kernel interprets -1 as "no owner"
+		config.Permissions = &water.DevicePermissions{
+			Owner: uint(uint32(cfg.Owner)),
+			Group: uint(uint32(cfg.Group)),
+		}
+	}
+	return config, nil
+}
+
+// keepPersist keeps the persist flag of the named interface if it already
+// exists, attaching to an interface created by mktun without the flag would
+// delete it once closed
+func keepPersist(cfg InterfaceConfig) InterfaceConfig {
+	if cfg.Persist || cfg.Name == "" {
+		return cfg
+	}
+	b, err := ioutil.ReadFile("/sys/class/net/" + cfg.Name + "/tun_flags")
+	if err != nil {
+		return cfg
+	}
+	flags, err := strconv.ParseUint(strings.TrimSpace(string(b)), 0, 32)
+	cfg.Persist = err == nil && flags&iffPersist != 0
+	return cfg
+}
+
+// MakeTun creates a persistent interface that can be used later
+// by its owner without privileges
+func MakeTun(cfg InterfaceConfig) (string, error) {
+	if cfg.Name == "" {
+		return "", fmt.Errorf("Interface name is required")
+	}
+	cfg.Persist = true
+	ifce, err := newInterface(cfg)
+	if err != nil {
+		return "", err
+	}
+	return ifce.Name(), ifce.Close()
+}
+
+// RemoveTun deletes a persistent interface
+func RemoveTun(name string) error {
+	if name == "" {
+		return fmt.Errorf("Interface name is required")
+	}
+	cfg := NewInterfaceConfig()
+	cfg.Name = name
+	// Attaching to the interface without the persist flag clears it,
+	// the interface is deleted when it is closed
+	ifce, err := newInterface(cfg)
+	if err != nil {
+		// Multi-queue interfaces can only be attached as multi-queue
+		cfg.Queues = 2
+		var mqErr error
+		if ifce, mqErr = newInterface(cfg); mqErr != nil {
+			return err
+		}
+	}
+	return ifce.Close()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/songgao/water"
+)
+
+// waterConfig returns the water configuration for the interface
+func waterConfig(cfg InterfaceConfig) (water.Config, error) {
+	if cfg.TAP {
+		return water.Config{}, fmt.Errorf("TAP mode is only supported on Linux")
+	}
+	if cfg.Persist || cfg.Owner >= 0 || cfg.Group >= 0 {
+		return water.Config{}, fmt.Errorf("Interface persistence and ownership are only supported on Linux")
+	}
+	if cfg.Queues > 1 {
+		return water.Config{}, fmt.Errorf("Multi-queue interfaces are only supported on Linux")
+	}
+	config := water.Config{
+		DeviceType: water.TUN,
+	}
+	if cfg.Address == "" {
+		if cfg.Name != "" {
+			return water.Config{}, fmt.Errorf("Interface address is required to select the interface %s", cfg.Name)
+		}
+		return config, nil
+	}
+	// The driver answers the ARP requests of the tunnel peers, that share
+	// the /24 network of the address
+	ip := net.ParseIP(cfg.Address).To4()
+	if ip == nil {
+		return water.Config{}, fmt.Errorf("Invalid interface address %q", cfg.Address)
+	}
+	// Setting any parameter overrides all the water defaults, the driver
+	// is the one of OpenVPN that water uses by default
+	config.ComponentID = tapWindowsComponentID
+	config.Network = (&net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)}).String()
+	config.InterfaceName = cfg.Name
+	return config, nil
+}
+
+// tapWindowsComponentID is the component of the TAP-Windows driver
+const tapWindowsComponentID = "tap0901"
+
+// keepPersist returns the configuration unchanged, the interfaces can't persist
+func keepPersist(cfg InterfaceConfig) InterfaceConfig {
+	return cfg
+}
+
+// MakeTun is only supported on Linux
+func MakeTun(cfg InterfaceConfig) (string, error) {
+	return "", fmt.Errorf("mktun is only supported on Linux")
+}
+
+// RemoveTun is only supported on Linux
+func RemoveTun(name string) error {
+	return fmt.Errorf("rmtun is only supported on Linux")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogLevel is the severity of a log line
+type LogLevel int
+
+// Log levels
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	}
+	return "error"
+}
+
+// ParseLogLevel returns the level named s
+func ParseLogLevel(s string) (LogLevel, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if l.String() == s {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Invalid log level %q", s)
+}
+
+// logger is the logger used by the components that don't belong to a session
+var logger, _ = NewLogger(os.Stderr, "logfmt", LevelInfo, 0)
+
+// logOutput is the destination shared by a logger and the loggers derived from it
+type logOutput struct {
+	mu     sync.Mutex
+	w      io.Writer
+	json   bool
+	level  LogLevel
+	sample uint64
+	// packets counts the packets seen to sample them
+	packets uint64
+}
+
+// Logger writes structured log lines in logfmt or JSON format, every line
+// carries the key value pairs of the logger, i.e. the session context.
+// A nil Logger discards everything.
+type Logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+// NewLogger returns a logger writing lines with at least level to w in
+// format "logfmt" or "json". At debug level one of every packetSample packets
+// is logged, 0 disables the packet logging.
+func NewLogger(w io.Writer, format string, level LogLevel, packetSample int) (*Logger, error) {
+	out := &logOutput{
+		w:     w,
+		level: level,
+	}
+	switch format {
+	case "logfmt":
+	case "json":
+		out.json = true
+	default:
+		return nil, fmt.Errorf("Invalid log format %q", format)
+	}
+	if packetSample < 0 {
+		return nil, fmt.Errorf("Invalid packet sample rate %d", packetSample)
+	}
+	out.sample = uint64(packetSample)
+	return &Logger{out: out}, nil
+}
+
+// With returns a logger that adds the key value pairs to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Enabled returns true if the lines with level are written
+func (l *Logger) Enabled(level LogLevel) bool {
+	return l != nil && level >= l.out.level
+}
+
+// Debug logs msg and the key value pairs at debug level
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+// Info logs msg and the key value pairs at info level
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+// Warn logs msg and the key value pairs at warn level
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+}
+
+// Error logs msg and the key value pairs at error level
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+}
+
+// Fatal logs msg and the key value pairs at error level and exits
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+// Packet logs a summary of a sampled packet at debug level, outbound packets
+// are the ones sent to the peer
+func (l *Logger) Packet(outbound, tap bool, packet []byte) {
+	if !l.Enabled(LevelDebug) || l.out.sample == 0 {
+		return
+	}
+	if (atomic.AddUint64(&l.out.packets, 1)-1)%l.out.sample != 0 {
+		return
+	}
+	var info packetInfo
+	var ok bool
+	if tap {
+		info, ok = parseEthernetFrame(packet)
+	} else {
+		info, ok = parseIPPacket(packet)
+	}
+	direction := "rx"
+	if outbound {
+		direction = "tx"
+	}
+	if !ok {
+		l.Debug("Packet", "direction", direction, "length", len(packet))
+		return
+	}
+	kv := []interface{}{"direction", direction, "proto", info.protoName(), "src", info.src, "dst", info.dst}
+	if info.proto == protoTCP || info.proto == protoUDP {
+		kv = append(kv, "srcPort", info.srcPort, "dstPort", info.dstPort)
+	}
+	l.Debug("Packet", append(kv, "length", info.length)...)
+}
+
+func (l *Logger) log(level LogLevel, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	var buf bytes.Buffer
+	pairs := append([]interface{}{"time", time.Now().Format("2006-01-02T15:04:05.000Z07:00"), "level", level.String(), "msg", msg}, l.fields...)
+	pairs = append(pairs, kv...)
+	if len(pairs)%2 != 0 {
+		pairs = append(pairs, "")
+	}
+	if l.out.json {
+		buf.WriteByte('{')
+		for i := 0; i < len(pairs); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(fmt.Sprint(pairs[i]))
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(jsonValue(pairs[i+1]))
+		}
+		buf.WriteString("}\n")
+	} else {
+		for i := 0; i < len(pairs); i += 2 {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(fmt.Sprint(pairs[i]))
+			buf.WriteByte('=')
+			buf.WriteString(logfmtValue(pairs[i+1]))
+		}
+		buf.WriteByte('\n')
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+// valueString returns the text of a log value
+func valueString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// logfmtValue quotes the value if needed
+func logfmtValue(v interface{}) string {
+	s := valueString(v)
+	if s == "" || strings.ContainsAny(s, " =\"\\\n\t") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// jsonValue keeps numbers and booleans, everything else is a string
+func jsonValue(v interface{}) []byte {
+	var b []byte
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool:
+		b, _ = json.Marshal(v)
+	default:
+		b, _ = json.Marshal(valueString(v))
+	}
+	return b
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/user"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 func validate(ifAddress, remoteNetwork, remoteGateway string) error {
@@ -31,19 +35,450 @@ func validate(ifAddress, remoteNetwork, remoteGateway string) error {
 	return nil
 }
 
+// validateTAP validates the configuration of a TAP client, the interface address
+// needs a prefix length unless it is obtained by DHCP
+func validateTAP(ifAddress, remoteNetwork, remoteGateway, hardwareAddr string, dhcp bool) error {
+	if !dhcp {
+		if _, _, err := net.ParseCIDR(ifAddress); err != nil {
+			return fmt.Errorf("Invalid Interface CIDR address")
+		}
+	}
+	if remoteNetwork != "" {
+		if _, _, err := net.ParseCIDR(remoteNetwork); err != nil {
+			return err
+		}
+		// DHCP can provide the gateway
+		if remoteGateway == "" && !dhcp {
+			return fmt.Errorf("Remote network requires a Remote Gateway in TAP mode")
+		}
+	}
+	if len(remoteGateway) > 0 && net.ParseIP(remoteGateway) == nil {
+		return fmt.Errorf("Invalid Remote Gateway IP address")
+	}
+	if len(hardwareAddr) > 0 {
+		if _, err := net.ParseMAC(hardwareAddr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interfaceFlags are the command line options of the tunnel interface
+type interfaceFlags struct {
+	name    string
+	persist bool
+	owner   string
+	group   string
+	queues  int
+	offload bool
+}
+
+func (f *interfaceFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.name, "if-name", "", "Interface name, by default the OS assigns one")
+	fs.BoolVar(&f.persist, "if-persist", false, "Keep the interface after exiting (Linux only)")
+	fs.StringVar(&f.owner, "if-owner", "", "User name or ID allowed to use the interface (Linux only)")
+	fs.StringVar(&f.group, "if-group", "", "Group name or ID allowed to use the interface, defaults to the owner primary group (Linux only)")
+	fs.IntVar(&f.queues, "if-queues", 1, "Number of interface queues forwarded in parallel (Linux only)")
+	fs.BoolVar(&f.offload, "if-offload", false, "Enable the TUN segmentation offloads to forward packets of up to 64KB (Linux only)")
+}
+
+// config returns the InterfaceConfig for the parsed options
+func (f *interfaceFlags) config() (InterfaceConfig, error) {
+	var err error
+	cfg := NewInterfaceConfig()
+	cfg.Name = f.name
+	cfg.Persist = f.persist
+	if f.queues < 1 {
+		return cfg, fmt.Errorf("Invalid number of interface queues %d", f.queues)
+	}
+	cfg.Queues = f.queues
+	cfg.Offload = f.offload
+	if f.group != "" {
+		if cfg.Group, err = lookupGroup(f.group); err != nil {
+			return cfg, err
+		}
+	}
+	if f.owner != "" {
+		var gid int
+		if cfg.Owner, gid, err = lookupUser(f.owner); err != nil {
+			return cfg, err
+		}
+		// The kernel requires both owner and group
+		if cfg.Group < 0 {
+			cfg.Group = gid
+		}
+	} else if cfg.Group >= 0 {
+		return cfg, fmt.Errorf("Interface group requires an interface owner")
+	}
+	return cfg, nil
+}
+
+// privilegeFlags are the command line options to drop privileges
+type privilegeFlags struct {
+	user          string
+	group         string
+	cleanupHelper bool
+}
+
+func (f *privilegeFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.user, "user", "", "User name or ID to switch to once the network is configured (Linux only, the binary has to be built with CGO_ENABLED=0 or the netgo,osusergo tags)")
+	fs.StringVar(&f.group, "group", "", "Group name or ID to switch to, defaults to the user primary group")
+	fs.BoolVar(&f.cleanupHelper, "cleanup-helper", false, "Drop all capabilities and delete the network configuration from a privileged helper process")
+}
+
+// config returns the PrivilegeConfig for the parsed options, nil if privileges are kept
+func (f *privilegeFlags) config() (*PrivilegeConfig, error) {
+	if f.user == "" {
+		if f.group != "" || f.cleanupHelper {
+			return nil, fmt.Errorf("Dropping privileges requires a user")
+		}
+		return nil, nil
+	}
+	// Fail before the network is configured
+	if err := checkDropPrivileges(); err != nil {
+		return nil, err
+	}
+	uid, gid, err := lookupUser(f.user)
+	if err != nil {
+		return nil, err
+	}
+	if f.group != "" {
+		if gid, err = lookupGroup(f.group); err != nil {
+			return nil, err
+		}
+	}
+	return &PrivilegeConfig{
+		UID:           uid,
+		GID:           gid,
+		CleanupHelper: f.cleanupHelper,
+	}, nil
+}
+
+// relayFlags are the command line options to meet the peer at a relay
+type relayFlags struct {
+	address string
+	token   string
+	punch   bool
+}
+
+func (f *relayFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.address, "relay", "", "Relay where the peers with the same -relay-token are paired, when neither peer is reachable (e.g. relay.example.com:7777)")
+	fs.StringVar(&f.token, "relay-token", "", "Session token shared by the client and the server at the relay")
+	fs.BoolVar(&f.punch, "relay-punch", false, "Try to send the frames directly to the peer over UDP, the relay is used if the hole punching fails")
+}
+
+// config returns the RelayConfig for the parsed options, nil if no relay is used
+func (f *relayFlags) config() (*RelayConfig, error) {
+	if f.address == "" {
+		if f.token != "" || f.punch {
+			return nil, fmt.Errorf("The relay options require -relay")
+		}
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(f.address); err != nil {
+		return nil, fmt.Errorf("Invalid -relay address %q: %v", f.address, err)
+	}
+	if err := validateRelayToken(f.token); err != nil {
+		return nil, err
+	}
+	return &RelayConfig{
+		Address: f.address,
+		Token:   f.token,
+		Punch:   f.punch,
+	}, nil
+}
+
+// captureFlags are the command line options of the packet capture
+type captureFlags struct {
+	file     string
+	filter   string
+	maxSize  int64
+	maxFiles int
+}
+
+func (f *captureFlags) register(fs *flag.FlagSet, fileFlag string) {
+	fs.StringVar(&f.file, fileFlag, "", "Capture the tunnel packets to this pcapng file")
+	fs.StringVar(&f.filter, "capture-filter", "", "Capture only the packets matching the filter (e.g. \"tcp and port 80\")")
+	fs.Int64Var(&f.maxSize, "capture-size", 0, "Rotate the capture file when it reaches this size in MB, 0 disables the rotation")
+	fs.IntVar(&f.maxFiles, "capture-files", 2, "Number of capture files kept when rotating")
+}
+
+// config returns the CaptureConfig for the parsed options
+func (f *captureFlags) config() CaptureConfig {
+	return CaptureConfig{
+		File:     f.file,
+		Filter:   f.filter,
+		MaxSize:  f.maxSize * 1000 * 1000,
+		MaxFiles: f.maxFiles,
+	}
+}
+
+// peerRateLimitFlags are the repeated -peer-rate-limit options
+type peerRateLimitFlags []PeerRateLimit
+
+func (f *peerRateLimitFlags) String() string {
+	limits := make([]string, len(*f))
+	for i, l := range *f {
+		limits[i] = fmt.Sprintf("%s=%s", l.Network, l.Limit)
+	}
+	return strings.Join(limits, ",")
+}
+
+func (f *peerRateLimitFlags) Set(value string) error {
+	limit, err := parsePeerRateLimit(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, limit)
+	return nil
+}
+
+// networkFlags are repeated network options
+type networkFlags []*net.IPNet
+
+func (f *networkFlags) String() string {
+	networks := make([]string, len(*f))
+	for i, n := range *f {
+		networks[i] = n.String()
+	}
+	return strings.Join(networks, ",")
+}
+
+func (f *networkFlags) Set(value string) error {
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, network)
+	return nil
+}
+
+// stringFlags are repeated string options
+type stringFlags []string
+
+func (f *stringFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// aclFlags are the repeated -acl options
+type aclFlags []PeerACL
+
+func (f *aclFlags) String() string {
+	acls := make([]string, len(*f))
+	for i, a := range *f {
+		acls[i] = fmt.Sprintf("%s=%s", a.Network, a.Rule)
+	}
+	return strings.Join(acls, ";")
+}
+
+func (f *aclFlags) Set(value string) error {
+	acl, err := parsePeerACL(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, acl)
+	return nil
+}
+
+// logFlags are the command line options of the logger
+type logFlags struct {
+	level        string
+	format       string
+	packetSample int
+}
+
+func (f *logFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.level, "log-level", "info", "Log level: debug, info, warn or error")
+	fs.StringVar(&f.format, "log-format", "logfmt", "Log format: logfmt or json")
+	fs.IntVar(&f.packetSample, "log-packet-sample", 100, "Log one of every N packets at debug level, 0 disables the packet logging")
+}
+
+// logger returns the Logger for the parsed options
+func (f *logFlags) logger() (*Logger, error) {
+	level, err := ParseLogLevel(f.level)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogger(os.Stderr, f.format, level, f.packetSample)
+}
+
+// lookupUser returns the user ID and primary group ID of the user name or numeric ID
+func lookupUser(name string) (int, int, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return -1, -1, err
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return -1, -1, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return -1, -1, err
+	}
+	return uid, gid, nil
+}
+
+// lookupGroup returns the ID of the group name or numeric ID
+func lookupGroup(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// serveMetrics serves the metrics, tuncat keeps running if it fails
+func serveMetrics(m *Metrics, address string) {
+	if err := m.ListenAndServe(address); err != nil {
+		logger.Error("Metrics server error", "err", err)
+	}
+}
+
+// printDryRun writes the report to stdout in the requested format
+func printDryRun(report DryRunReport, output string) error {
+	switch output {
+	case "text":
+		report.WriteText(os.Stdout)
+		return nil
+	case "json":
+		return report.WriteJSON(os.Stdout)
+	}
+	return fmt.Errorf("Invalid output format %q", output)
+}
+
 func main() {
 
-	var remoteNetwork, remoteGateway, ifAddress string
+	var remoteNetwork, remoteGateway, ifAddress, output string
+	var dryRun, tap bool
+	var metricsAddress, controlSocket, compression string
+	var ifFlags interfaceFlags
+	var privFlags privilegeFlags
+	var capFlags captureFlags
+	var lgFlags logFlags
+	var rlFlags relayFlags
 	connectCmd := flag.NewFlagSet("connect", flag.ExitOnError)
 	remoteAddress := connectCmd.String("dst-host", "", "remote host address")
 	remotePort := connectCmd.Int("dst-port", 0, "specify the local port to be used")
-	connectCmd.StringVar(&ifAddress, "if-address", "192.168.166.1", "Local interface address")
+	listenHost := connectCmd.String("listen-host", "0.0.0.0", "Local address where the client waits for the server with -listen-port")
+	listenPort := connectCmd.Int("listen-port", 0, "Wait for the server to connect on this port instead of connecting to it (reverse tunnel), only -dst-host is accepted if set")
+	connectCmd.StringVar(&ifAddress, "if-address", "192.168.166.1", "Local interface address, it has to differ from the server one (192.168.166.1) to accept its DNS forwarder or advertised routes")
 	connectCmd.StringVar(&remoteNetwork, "remote-network", "", "Remote network via the tunnel")
 	connectCmd.StringVar(&remoteGateway, "remote-gateway", "", "Remote gateway via the tunnel")
+	connectCmd.BoolVar(&dryRun, "dry-run", false, "Print the network changes without applying them")
+	connectCmd.StringVar(&output, "output", "text", "Dry-run output format: text or json")
+	ifFlags.register(connectCmd)
+	connectCmd.StringVar(&controlSocket, "control-socket", "", "Control socket path, defaults to /var/run/tuncat-<if-name>.sock if the interface is named, none to disable")
+	connectCmd.StringVar(&metricsAddress, "metrics-address", "", "Address to serve Prometheus metrics on /metrics (e.g. :9090)")
+	connectCmd.BoolVar(&tap, "tap", false, "Use a TAP interface bridged to the remote network (Linux only)")
+	connectCmd.StringVar(&compression, "compression", compressionNone, "Compression requested for the frames: none or deflate")
+	dhcp := connectCmd.Bool("dhcp", false, "Obtain the TAP interface address by DHCP")
+	hardwareAddr := connectCmd.String("if-mac", "", "TAP interface MAC address")
+	acceptDNS := connectCmd.Bool("accept-dns", false, "Apply the DNS servers and search domains pushed by the server (Linux only)")
+	acceptRoutes := connectCmd.Bool("accept-routes", false, "Route the networks advertised by the server through the tunnel")
+	fullTunnel := connectCmd.Bool("full-tunnel", false, "Route all the traffic through the tunnel, the server and the local networks stay reachable")
+	rlFlags.register(connectCmd)
+	privFlags.register(connectCmd)
+	capFlags.register(connectCmd, "capture")
+	lgFlags.register(connectCmd)
 
 	listenCmd := flag.NewFlagSet("listen", flag.ExitOnError)
 	sourceAddress := listenCmd.String("src-host", "0.0.0.0", "specify the local address to be used")
 	sourcePort := listenCmd.Int("src-port", 0, "specify the local port to be used")
+	dial := listenCmd.String("dial", "", "Connect to a client waiting with -listen-port instead of accepting connections (reverse tunnel), e.g. jumpbox:5555")
+	listenCmd.BoolVar(&dryRun, "dry-run", false, "Print the network changes without applying them")
+	once := listenCmd.Bool("once", false, "Exit when the first session finishes, required to drop privileges with -user")
+	listenCmd.StringVar(&output, "output", "text", "Dry-run output format: text or json")
+	listenCmd.StringVar(&remoteNetwork, "remote-network", "", "Remote network requested by the client (dry-run only)")
+	listenCmd.StringVar(&remoteGateway, "remote-gateway", "", "Remote gateway requested by the client (dry-run only)")
+	ifFlags.register(listenCmd)
+	listenCmd.StringVar(&controlSocket, "control-socket", "", "Control socket path, defaults to /var/run/tuncat-<if-name>.sock if the interface is named, none to disable")
+	listenCmd.StringVar(&metricsAddress, "metrics-address", "", "Address to serve Prometheus metrics on /metrics (e.g. :9090)")
+	bridge := listenCmd.String("bridge", "", "Linux bridge where the TAP interfaces of the clients are attached (e.g. docker0)")
+	listenCmd.StringVar(&compression, "compression", compressionNone, "Compression accepted for the frames: none or deflate")
+	rateLimit := listenCmd.String("rate-limit", "", "Bandwidth allowed to each session in bits per second sent/received, e.g. 10M/2M")
+	var peerRateLimits peerRateLimitFlags
+	listenCmd.Var(&peerRateLimits, "peer-rate-limit", "Bandwidth allowed to the peers in a network, e.g. 10.0.0.0/8=50M/10M (repeatable)")
+	var exportNetworks networkFlags
+	listenCmd.Var(&exportNetworks, "export-network", "Network the clients can request routes to (repeatable), the clients can't request routes without it")
+	var acls aclFlags
+	listenCmd.Var(&acls, "acl", "Destination allowed to the peers in a network, e.g. \"10.0.0.0/8=172.16.0.0/24 tcp 80,443\" (repeatable), the peers in no network are denied everything")
+	logDenied := listenCmd.Bool("acl-log", false, "Log the flows denied by the access control lists")
+	var dnsServers, dnsSearch stringFlags
+	listenCmd.Var(&dnsServers, "dns-server", "DNS server pushed to the clients (repeatable)")
+	listenCmd.Var(&dnsSearch, "dns-search", "DNS search domain pushed to the clients (repeatable)")
+	dnsForwardUpstream := listenCmd.String("dns-forward-upstream", "", "Upstream server of the DNS forwarder listening on the tunnel address, e.g. 127.0.0.11")
+	var dnsForwardZones stringFlags
+	listenCmd.Var(&dnsForwardZones, "dns-forward-zone", "Domain forwarded by the DNS forwarder (repeatable), all the names are forwarded without zones")
+	dnsForwardNetns := listenCmd.String("dns-forward-netns", "", "Network namespace where the DNS forwarder reaches the upstream, a path or the PID of a process")
+	netns := listenCmd.String("netns", "", "Network namespace where the interface is created and the network configured, a path (e.g. /var/run/netns/name) or the PID of a process (e.g. a container)")
+	docker := listenCmd.Bool("docker", false, "Advertise the subnets of the docker networks to the clients, updated when the networks change")
+	dockerSocket := listenCmd.String("docker-socket", defaultDockerSocket, "Unix socket of the Docker Engine API")
+	var dockerNetworks stringFlags
+	listenCmd.Var(&dockerNetworks, "docker-network", "Docker network advertised (repeatable), all the user-defined networks if omitted")
+	allowFullTunnel := listenCmd.Bool("allow-full-tunnel", false, "Masquerade all the traffic of the clients in full tunnel mode")
+	allowBench := listenCmd.Bool("allow-bench", false, "Answer the benchmark sessions of the clients")
+	rlFlags.register(listenCmd)
+	privFlags.register(listenCmd)
+	capFlags.register(listenCmd, "capture")
+	lgFlags.register(listenCmd)
+
+	mktunCmd := flag.NewFlagSet("mktun", flag.ExitOnError)
+	ifFlags.register(mktunCmd)
+	mktunCmd.BoolVar(&tap, "tap", false, "Create a TAP interface")
+
+	rmtunCmd := flag.NewFlagSet("rmtun", flag.ExitOnError)
+	rmtunCmd.StringVar(&ifFlags.name, "if-name", "", "Interface name")
+
+	statusCmd := flag.NewFlagSet("status", flag.ExitOnError)
+	statusCmd.StringVar(&controlSocket, "control-socket", "", "Control socket path")
+	statusCmd.StringVar(&ifFlags.name, "if-name", "", "Interface name of the tunnel, selects its default control socket")
+	statusCmd.StringVar(&output, "output", "text", "Output format: text or json")
+
+	downCmd := flag.NewFlagSet("down", flag.ExitOnError)
+	downCmd.StringVar(&controlSocket, "control-socket", "", "Control socket path")
+	downCmd.StringVar(&ifFlags.name, "if-name", "", "Interface name of the tunnel, selects its default control socket")
+
+	kickCmd := flag.NewFlagSet("kick", flag.ExitOnError)
+	kickCmd.StringVar(&controlSocket, "control-socket", "", "Control socket path")
+	kickCmd.StringVar(&ifFlags.name, "if-name", "", "Interface name of the tunnel, selects its default control socket")
+	kickSession := kickCmd.Uint64("session", 0, "Session ID to disconnect")
+
+	captureCmd := flag.NewFlagSet("capture", flag.ExitOnError)
+	captureCmd.StringVar(&controlSocket, "control-socket", "", "Control socket path")
+	captureCmd.StringVar(&ifFlags.name, "if-name", "", "Interface name of the tunnel, selects its default control socket")
+	capFlags.register(captureCmd, "file")
+	captureStop := captureCmd.Bool("stop", false, "Stop the running capture")
+
+	relayCmd := flag.NewFlagSet("relay", flag.ExitOnError)
+	relayHost := relayCmd.String("src-host", "0.0.0.0", "specify the local address to be used")
+	relayPort := relayCmd.Int("src-port", 0, "specify the local port to be used, for TCP and UDP")
+	relayRateLimit := relayCmd.String("rate-limit", "", "Bandwidth allowed to each tunnel in each direction in bits per second, e.g. 10M")
+	relayTotalRateLimit := relayCmd.String("total-rate-limit", "", "Bandwidth of the relay shared by all the tunnels in each direction, e.g. 100M")
+	lgFlags.register(relayCmd)
+
+	benchConfig := NewBenchConfig()
+	benchCmd := flag.NewFlagSet("bench", flag.ExitOnError)
+	benchHost := benchCmd.String("dst-host", "", "remote host address")
+	benchPort := benchCmd.Int("dst-port", 0, "remote port")
+	benchInProcess := benchCmd.Bool("in-process", false, "Run against an in-memory tunnel in the same process")
+	benchCmd.DurationVar(&benchConfig.Duration, "duration", benchConfig.Duration, "Duration of each throughput test")
+	benchCmd.IntVar(&benchConfig.PacketSize, "size", benchConfig.PacketSize, "Packet size in bytes")
+	benchCmd.IntVar(&benchConfig.Pings, "pings", benchConfig.Pings, "Number of packets used to measure the latency")
+	benchCmd.DurationVar(&benchConfig.PingInterval, "ping-interval", benchConfig.PingInterval, "Interval between latency packets")
+	benchCmd.IntVar(&benchConfig.Flows, "flows", benchConfig.Flows, "Number of parallel flows in the throughput tests")
+	benchCmd.IntVar(&benchConfig.Queues, "queues", benchConfig.Queues, "Number of queues of the in-memory device")
+	benchCmd.StringVar(&output, "output", "text", "Output format: text or json")
 
 	if len(os.Args) < 2 {
 		fmt.Println("usage: tuncat [<args>] <command>")
@@ -51,6 +486,14 @@ func main() {
 		fmt.Println("tuncat commands are: ")
 		fmt.Println(" connect [<args>] Connect to a remote host")
 		fmt.Println(" listen [<args>] Listen on a local port")
+		fmt.Println(" mktun [<args>] Create a persistent interface")
+		fmt.Println(" rmtun [<args>] Delete a persistent interface")
+		fmt.Println(" status [<args>] Show the status of a running tunnel")
+		fmt.Println(" down [<args>] Tear down a running tunnel")
+		fmt.Println(" kick [<args>] Disconnect a session from a running server")
+		fmt.Println(" capture [<args>] Start or stop capturing the packets of a running tunnel")
+		fmt.Println(" bench [<args>] Measure the throughput and latency of the tunnel")
+		fmt.Println(" relay [<args>] Pair the peers that can't reach each other")
 		os.Exit(1)
 	}
 
@@ -60,6 +503,28 @@ func main() {
 		listenCmd.Parse(os.Args[2:])
 	case "connect":
 		connectCmd.Parse(os.Args[2:])
+	case "mktun":
+		mktunCmd.Parse(os.Args[2:])
+	case "rmtun":
+		rmtunCmd.Parse(os.Args[2:])
+	case "status":
+		statusCmd.Parse(os.Args[2:])
+	case "down":
+		downCmd.Parse(os.Args[2:])
+	case "kick":
+		kickCmd.Parse(os.Args[2:])
+	case "capture":
+		captureCmd.Parse(os.Args[2:])
+	case "bench":
+		benchCmd.Parse(os.Args[2:])
+	case "relay":
+		relayCmd.Parse(os.Args[2:])
+	case "cleanup-helper":
+		// Internal command used to tear down the network after dropping privileges
+		if err := runCleanupHelper(os.Stdin); err != nil {
+			log.Fatalf("Cleanup helper error: %v", err)
+		}
+		return
 	default:
 		fmt.Println("usage: tuncat [<args>] <command>")
 		flag.PrintDefaults()
@@ -68,58 +533,411 @@ func main() {
 		connectCmd.PrintDefaults()
 		fmt.Println(" listen [<args>] Listen on a local port")
 		listenCmd.PrintDefaults()
+		fmt.Println(" mktun [<args>] Create a persistent interface")
+		mktunCmd.PrintDefaults()
+		fmt.Println(" rmtun [<args>] Delete a persistent interface")
+		rmtunCmd.PrintDefaults()
+		fmt.Println(" status [<args>] Show the status of a running tunnel")
+		statusCmd.PrintDefaults()
+		fmt.Println(" down [<args>] Tear down a running tunnel")
+		downCmd.PrintDefaults()
+		fmt.Println(" kick [<args>] Disconnect a session from a running server")
+		kickCmd.PrintDefaults()
+		fmt.Println(" capture [<args>] Start or stop capturing the packets of a running tunnel")
+		captureCmd.PrintDefaults()
+		fmt.Println(" bench [<args>] Measure the throughput and latency of the tunnel")
+		benchCmd.PrintDefaults()
+		fmt.Println(" relay [<args>] Pair the peers that can't reach each other")
+		relayCmd.PrintDefaults()
 		os.Exit(1)
 	}
 
 	// Global configuration
 	flag.Parse()
 
+	// Interface configuration
+	ifConfig, err := ifFlags.config()
+	if err != nil {
+		log.Fatalf("Validation error %v", err)
+	}
+	ifConfig.TAP = tap
+	// Each tunnel has its own control socket
+	controlSocket = controlSocketPath(controlSocket, ifConfig.Name)
+	if (statusCmd.Parsed() || downCmd.Parsed() || kickCmd.Parsed() || captureCmd.Parsed()) && controlSocket == "" {
+		log.Fatalf("Validation error -control-socket or -if-name required")
+	}
+	if ifConfig.Offload && tap {
+		log.Fatalf("Validation error -if-offload requires a TUN interface")
+	}
+	privileges, err := privFlags.config()
+	if err != nil {
+		log.Fatalf("Validation error %v", err)
+	}
+	relay, err := rlFlags.config()
+	if err != nil {
+		log.Fatalf("Validation error %v", err)
+	}
+
+	// Logger configuration
+	if connectCmd.Parsed() || listenCmd.Parsed() || relayCmd.Parsed() {
+		if logger, err = lgFlags.logger(); err != nil {
+			log.Fatalf("Validation error %v", err)
+		}
+	}
+
+	// Mktun command
+	if mktunCmd.Parsed() {
+		name, err := MakeTun(ifConfig)
+		if err != nil {
+			log.Fatalf("Error creating interface: %v", err)
+		}
+		fmt.Println(name)
+	}
+
+	// Rmtun command
+	if rmtunCmd.Parsed() {
+		if err := RemoveTun(ifConfig.Name); err != nil {
+			log.Fatalf("Error deleting interface: %v", err)
+		}
+	}
+
+	// Status command
+	if statusCmd.Parsed() {
+		resp, err := SendControl(controlSocket, ControlRequest{Command: "status"})
+		if err != nil {
+			log.Fatalf("Status error: %v", err)
+		}
+		switch output {
+		case "text":
+			resp.Status.WriteText(os.Stdout)
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(resp.Status)
+		default:
+			log.Fatalf("Invalid output format %q", output)
+		}
+	}
+
+	// Down command
+	if downCmd.Parsed() {
+		if _, err := SendControl(controlSocket, ControlRequest{Command: "down"}); err != nil {
+			log.Fatalf("Down error: %v", err)
+		}
+	}
+
+	// Kick command
+	if kickCmd.Parsed() {
+		if _, err := SendControl(controlSocket, ControlRequest{Command: "kick", Session: *kickSession}); err != nil {
+			log.Fatalf("Kick error: %v", err)
+		}
+	}
+
+	// Capture command
+	if captureCmd.Parsed() {
+		req := ControlRequest{Command: "capture-stop"}
+		if !*captureStop {
+			if capFlags.file == "" {
+				captureCmd.PrintDefaults()
+				os.Exit(1)
+			}
+			// The file is opened by the running tunnel
+			captureConfig := capFlags.config()
+			if captureConfig.File, err = filepath.Abs(captureConfig.File); err != nil {
+				log.Fatalf("Capture error: %v", err)
+			}
+			req = ControlRequest{Command: "capture-start", Capture: &captureConfig}
+		}
+		if _, err := SendControl(controlSocket, req); err != nil {
+			log.Fatalf("Capture error: %v", err)
+		}
+	}
+
+	// Bench command
+	if benchCmd.Parsed() {
+		var report *BenchReport
+		if *benchInProcess {
+			report, err = BenchInProcess(benchConfig)
+		} else {
+			if *benchHost == "" || *benchPort == 0 {
+				benchCmd.PrintDefaults()
+				os.Exit(1)
+			}
+			report, err = NewClient(net.JoinHostPort(*benchHost, strconv.Itoa(*benchPort))).Bench(benchConfig)
+		}
+		if err != nil {
+			log.Fatalf("Bench error: %v", err)
+		}
+		switch output {
+		case "text":
+			report.WriteText(os.Stdout)
+		case "json":
+			report.WriteJSON(os.Stdout)
+		default:
+			log.Fatalf("Invalid output format %q", output)
+		}
+	}
+
+	// Relay command
+	if relayCmd.Parsed() {
+		if *relayPort == 0 {
+			relayCmd.PrintDefaults()
+			os.Exit(1)
+		}
+		var tunnelRate, totalRate uint64
+		if *relayRateLimit != "" {
+			if tunnelRate, err = parseBitRate(*relayRateLimit); err != nil {
+				log.Fatalf("Validation error %v", err)
+			}
+		}
+		if *relayTotalRateLimit != "" {
+			if totalRate, err = parseBitRate(*relayTotalRateLimit); err != nil {
+				log.Fatalf("Validation error %v", err)
+			}
+		}
+		relayServer := &Relay{
+			Address:        net.JoinHostPort(*relayHost, strconv.Itoa(*relayPort)),
+			RateLimit:      tunnelRate,
+			TotalRateLimit: totalRate,
+			Log:            logger,
+		}
+		if err := relayServer.Listen(); err != nil {
+			logger.Error("Relay error", "err", err)
+		}
+		relayServer.Close()
+		return
+	}
+
 	// Connect command
 	if connectCmd.Parsed() {
 		// Obtain remote port and remote address
-		if *remoteAddress == "" || *remotePort == 0 {
+		if !dryRun && *listenPort == 0 && relay == nil && (*remoteAddress == "" || *remotePort == 0) {
 			connectCmd.PrintDefaults()
 			os.Exit(1)
 		}
+		if relay != nil && *listenPort != 0 {
+			log.Fatalf("Validation error -relay and -listen-port are exclusive")
+		}
 		// Configure a new client
 		remoteHost := net.JoinHostPort(*remoteAddress, strconv.Itoa(*remotePort))
 		// Validate configuration
-		if err := validate(ifAddress, remoteNetwork, remoteGateway); err != nil {
+		if !tap && (*dhcp || *hardwareAddr != "") {
+			log.Fatalf("Validation error -dhcp and -if-mac require -tap")
+		}
+		if tap && *fullTunnel {
+			log.Fatalf("Validation error -full-tunnel is not supported with -tap")
+		}
+		if tap {
+			if *dhcp {
+				ifAddress = ""
+			}
+			err = validateTAP(ifAddress, remoteNetwork, remoteGateway, *hardwareAddr, *dhcp)
+		} else {
+			err = validate(ifAddress, remoteNetwork, remoteGateway)
+		}
+		if err == nil {
+			err = validateCompression(compression)
+		}
+		if err != nil {
 			log.Fatalf("Validation error %v", err)
 			os.Exit(1)
 		}
 		client := NewClient(remoteHost)
+		if *listenPort != 0 {
+			client.ListenAddress = net.JoinHostPort(*listenHost, strconv.Itoa(*listenPort))
+		}
 		client.IfAddress = ifAddress
 		client.RemoteNetwork = remoteNetwork
 		client.RemoteGateway = remoteGateway
+		client.Interface = ifConfig
+		client.Privileges = privileges
+		client.HardwareAddr = *hardwareAddr
+		client.DHCP = *dhcp
+		client.Compression = compression
+		client.FullTunnel = *fullTunnel
+		client.AcceptDNS = *acceptDNS
+		client.AcceptRoutes = *acceptRoutes
+		client.Relay = relay
+		if capFlags.file != "" && !dryRun {
+			if err := client.Capture.Start(capFlags.config()); err != nil {
+				logger.Fatal("Capture error", "err", err)
+			}
+			defer client.Capture.Stop()
+		}
+		if dryRun {
+			// The client can't know the networks exported by the server
+			server := NewServer("")
+			server.acceptRoutes = true
+			report, _, err := DryRun(client, server)
+			if err != nil {
+				log.Fatalf("Dry-run error: %v", err)
+			}
+			if err := printDryRun(report, output); err != nil {
+				log.Fatalf("Dry-run error: %v", err)
+			}
+			return
+		}
+		if metricsAddress != "" {
+			go serveMetrics(client.Metrics, metricsAddress)
+		}
+		if controlSocket != "" {
+			ctl, err := ServeControl(controlSocket, client)
+			if err != nil {
+				logger.Fatal("Control socket error", "err", err)
+			}
+			defer ctl.Close()
+		}
 		// Connect to the server
 		if err := client.Start(); err != nil {
-			log.Printf("Client error: %v", err)
+			logger.Error("Client error", "err", err)
 		}
 		client.Close()
 	}
 
 	// Listen command
 	if listenCmd.Parsed() {
-		if *sourcePort == 0 {
+		if !dryRun && *sourcePort == 0 && *dial == "" && relay == nil {
 			listenCmd.PrintDefaults()
 			os.Exit(1)
 		}
+		if relay != nil && (*sourcePort != 0 || *dial != "") {
+			log.Fatalf("Validation error -relay doesn't accept connections, it can't be used with -src-port or -dial")
+		}
+		if *dial != "" {
+			if *sourcePort != 0 {
+				log.Fatalf("Validation error -dial doesn't accept connections, it can't be used with -src-port")
+			}
+			if _, _, err := net.SplitHostPort(*dial); err != nil {
+				log.Fatalf("Validation error invalid -dial address %q: %v", *dial, err)
+			}
+		}
 
 		// Configure a new Server
 		listenAddress := net.JoinHostPort(*sourceAddress, strconv.Itoa(*sourcePort))
 		server := NewServer(listenAddress)
+		server.DialAddress = *dial
+		server.Relay = relay
 		// Validate configuration
-		if err := validate(ifAddress, "", ""); err != nil {
+		if err := validateCompression(compression); err != nil {
 			log.Fatalf("Validation error %v", err)
-			os.Exit(1)
 		}
-		if ifAddress != "" {
-			server.IfAddress = ifAddress
+		server.Interface = ifConfig
+		// The next sessions couldn't configure their network
+		if privileges != nil && !*once {
+			log.Fatalf("Validation error -user requires -once, the privileges can't be recovered for the next sessions")
+		}
+		server.Privileges = privileges
+		server.Once = *once
+		server.Bridge = *bridge
+		server.Compression = compression
+		if *rateLimit != "" {
+			if server.RateLimit, err = parseRateLimit(*rateLimit); err != nil {
+				log.Fatalf("Validation error %v", err)
+			}
+		}
+		server.PeerRateLimits = peerRateLimits
+		server.ExportNetworks = exportNetworks
+		server.AllowFullTunnel = *allowFullTunnel
+		server.AllowBench = *allowBench
+		if *netns != "" {
+			// Entering the namespace requires privileges on every session
+			if privileges != nil {
+				log.Fatalf("Validation error -netns requires privileges, it can't be used with -user")
+			}
+			if server.Netns, err = netnsPath(*netns); err != nil {
+				log.Fatalf("Validation error %v", err)
+			}
+		}
+		if *docker {
+			server.Docker = &DockerDiscovery{
+				Socket:   *dockerSocket,
+				Networks: dockerNetworks,
+				Log:      logger,
+			}
+		} else if len(dockerNetworks) > 0 {
+			log.Fatalf("Validation error -docker-network requires -docker")
+		}
+		if *dnsForwardUpstream != "" {
+			upstream, err := parseDNSUpstream(*dnsForwardUpstream)
+			if err != nil {
+				log.Fatalf("Validation error %v", err)
+			}
+			upstreamNetns := ""
+			if *dnsForwardNetns != "" {
+				if privileges != nil {
+					log.Fatalf("Validation error -dns-forward-netns requires privileges, it can't be used with -user")
+				}
+				if upstreamNetns, err = netnsPath(*dnsForwardNetns); err != nil {
+					log.Fatalf("Validation error %v", err)
+				}
+			}
+			server.DNSForwarder = &DNSForwarder{
+				Upstream:      upstream,
+				Zones:         dnsForwardZones,
+				UpstreamNetns: upstreamNetns,
+				Metrics:       server.Metrics,
+				Log:           logger,
+			}
+			// The clients use the forwarder for its zones, they route the
+			// tunnel address of the server to reach it
+			if len(dnsServers) == 0 {
+				dnsServers = stringFlags{server.IfAddress}
+			}
+			if len(dnsSearch) == 0 {
+				dnsSearch = dnsForwardZones
+			}
+		} else if len(dnsForwardZones) > 0 || *dnsForwardNetns != "" {
+			log.Fatalf("Validation error -dns-forward-zone and -dns-forward-netns require -dns-forward-upstream")
+		}
+		server.DNS = DNSConfig{Servers: dnsServers, Search: dnsSearch}
+		if err := validateDNSConfig(server.DNS); err != nil {
+			log.Fatalf("Validation error %v", err)
+		}
+		server.ACLs = acls
+		server.LogDenied = *logDenied
+		if capFlags.file != "" && !dryRun {
+			if err := server.Capture.Start(capFlags.config()); err != nil {
+				logger.Fatal("Capture error", "err", err)
+			}
+			defer server.Capture.Stop()
+		}
+		if dryRun {
+			// Simulate a client requesting the remote network
+			if err := validate(ifAddress, remoteNetwork, remoteGateway); err != nil {
+				log.Fatalf("Validation error %v", err)
+			}
+			client := NewClient("")
+			client.IfAddress = ifAddress
+			client.RemoteNetwork = remoteNetwork
+			client.RemoteGateway = remoteGateway
+			_, report, err := DryRun(client, server)
+			if err != nil {
+				log.Fatalf("Dry-run error: %v", err)
+			}
+			if err := printDryRun(report, output); err != nil {
+				log.Fatalf("Dry-run error: %v", err)
+			}
+			return
+		}
+		if server.Docker != nil {
+			if err := server.Docker.Start(); err != nil {
+				logger.Fatal("Docker error", "err", err)
+			}
+			defer server.Docker.Stop()
+		}
+		if metricsAddress != "" {
+			go serveMetrics(server.Metrics, metricsAddress)
+		}
+		if controlSocket != "" {
+			ctl, err := ServeControl(controlSocket, server)
+			if err != nil {
+				logger.Fatal("Control socket error", "err", err)
+			}
+			defer ctl.Close()
 		}
 		// Listen
 		if err := server.Start(); err != nil {
-			log.Printf("Server error: %v", err)
+			logger.Error("Server error", "err", err)
 		}
 		server.Close()
 	}
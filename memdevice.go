@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// memDeviceQueueLen is the number of packets queued in each direction
+const memDeviceQueueLen = 1024
+
+// memDevice is an in-memory packet device that can replace the TUN interface.
+// The tunnel reads the packets injected by the host and writes the packets
+// that the host receives, writes block while the host queue is full so the
+// device itself never drops packets.
+// Like multi-queue TUN interfaces it can have several queues, the packets
+// injected are steered to the queues by flow hash.
+type memDevice struct {
+	in        []chan []byte
+	out       chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMemDevice(queues int) *memDevice {
+	if queues < 1 {
+		queues = 1
+	}
+	d := &memDevice{
+		out:  make(chan []byte, memDeviceQueueLen),
+		done: make(chan struct{}),
+	}
+	for i := 0; i < queues; i++ {
+		d.in = append(d.in, make(chan []byte, memDeviceQueueLen))
+	}
+	return d
+}
+
+// memQueue is a queue of a memDevice
+type memQueue struct {
+	dev *memDevice
+	in  chan []byte
+}
+
+// Read returns the next packet injected by the host in the queue
+func (q memQueue) Read(p []byte) (int, error) {
+	select {
+	case pkt := <-q.in:
+		return copy(p, pkt), nil
+	case <-q.dev.done:
+		return 0, io.EOF
+	}
+}
+
+// Write delivers the packet to the host
+func (q memQueue) Write(p []byte) (int, error) {
+	pkt := make([]byte, len(p))
+	copy(pkt, p)
+	select {
+	case q.dev.out <- pkt:
+		return len(p), nil
+	case <-q.dev.done:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// Queues returns the queues to be used by TunnelQueues
+func (d *memDevice) Queues() []io.ReadWriter {
+	queues := make([]io.ReadWriter, len(d.in))
+	for i, in := range d.in {
+		queues[i] = memQueue{dev: d, in: in}
+	}
+	return queues
+}
+
+// Close unblocks the readers and the host
+func (d *memDevice) Close() error {
+	d.closeOnce.Do(func() { close(d.done) })
+	return nil
+}
+
+// Inject queues a packet to be read by the tunnel, it blocks while the queue is full
+func (d *memDevice) Inject(pkt []byte) error {
+	in := d.in[0]
+	if len(d.in) > 1 {
+		in = d.in[flowHash(pkt, false)%uint32(len(d.in))]
+	}
+	select {
+	case in <- pkt:
+		return nil
+	case <-d.done:
+		return io.ErrClosedPipe
+	}
+}
+
+// Receive returns the next packet written by the tunnel
+func (d *memDevice) Receive() ([]byte, error) {
+	select {
+	case pkt := <-d.out:
+		return pkt, nil
+	case <-d.done:
+		return nil, io.EOF
+	}
+}
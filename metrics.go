@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics tracks the tunnel sessions and exposes them in Prometheus text format
+type Metrics struct {
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[uint64]*Session
+	// closed accumulates the counters of the sessions already finished
+	closed TunnelStats
+	// handshakes by result: "success" or the failure reason
+	handshakes map[string]uint64
+	reconnects uint64
+	peers      map[string]bool
+	// dnsQueries by result of the DNS forwarder
+	dnsQueries map[string]uint64
+}
+
+// NewMetrics returns an empty Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		sessions:   map[uint64]*Session{},
+		handshakes: map[string]uint64{},
+		peers:      map[string]bool{},
+		dnsQueries: map[string]uint64{},
+	}
+}
+
+// NewSession registers a new session with the peer, sessions from peers
+// already seen are accounted as reconnects
+func (m *Metrics) NewSession(peer string) *Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	s := &Session{
+		ID:    m.nextID,
+		Peer:  peer,
+		Start: time.Now(),
+	}
+	m.sessions[s.ID] = s
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		host = peer
+	}
+	if m.peers[host] {
+		m.reconnects++
+	}
+	m.peers[host] = true
+	return s
+}
+
+// EndSession unregisters the session keeping its counters in the totals
+func (m *Metrics) EndSession(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[s.ID]; !ok {
+		return
+	}
+	delete(m.sessions, s.ID)
+	m.closed.add(s.Stats.Snapshot())
+}
+
+// Sessions returns the current sessions ordered by ID
+func (m *Metrics) Sessions() []*Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+// HandshakeSucceeded counts a successful handshake
+func (m *Metrics) HandshakeSucceeded() {
+	m.countHandshake("success")
+}
+
+// HandshakeFailed counts a failed handshake by reason
+func (m *Metrics) HandshakeFailed(reason string) {
+	m.countHandshake(reason)
+}
+
+func (m *Metrics) countHandshake(result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handshakes[result]++
+}
+
+// DNSQuery counts a query of the DNS forwarder by result
+func (m *Metrics) DNSQuery(result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dnsQueries[result]++
+}
+
+// WriteTo writes the metrics in Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	sessions := m.Sessions()
+	m.mu.Lock()
+	total := m.closed
+	handshakes := make(map[string]uint64, len(m.handshakes))
+	for k, v := range m.handshakes {
+		handshakes[k] = v
+	}
+	reconnects := m.reconnects
+	dnsQueries := make(map[string]uint64, len(m.dnsQueries))
+	for k, v := range m.dnsQueries {
+		dnsQueries[k] = v
+	}
+	m.mu.Unlock()
+
+	stats := make([]TunnelStats, len(sessions))
+	for i, s := range sessions {
+		stats[i] = s.Stats.Snapshot()
+		total.add(stats[i])
+	}
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	metric(cw, "tuncat_sessions", "gauge", "Current tunnel sessions.")
+	fmt.Fprintf(cw, "tuncat_sessions %d\n", len(sessions))
+	metric(cw, "tuncat_reconnects_total", "counter", "Sessions from peers that had a previous session.")
+	fmt.Fprintf(cw, "tuncat_reconnects_total %d\n", reconnects)
+
+	metric(cw, "tuncat_handshakes_total", "counter", "Handshakes by result and failure reason.")
+	reasons := make([]string, 0, len(handshakes))
+	for k := range handshakes {
+		reasons = append(reasons, k)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		if reason == "success" {
+			fmt.Fprintf(cw, "tuncat_handshakes_total{result=\"success\"} %d\n", handshakes[reason])
+			continue
+		}
+		fmt.Fprintf(cw, "tuncat_handshakes_total{result=\"failure\",reason=\"%s\"} %d\n", escapeLabel(reason), handshakes[reason])
+	}
+
+	metric(cw, "tuncat_dns_queries_total", "counter", "Queries of the DNS forwarder by result.")
+	results := make([]string, 0, len(dnsQueries))
+	for k := range dnsQueries {
+		results = append(results, k)
+	}
+	sort.Strings(results)
+	for _, result := range results {
+		fmt.Fprintf(cw, "tuncat_dns_queries_total{result=\"%s\"} %d\n", escapeLabel(result), dnsQueries[result])
+	}
+
+	metric(cw, "tuncat_packets_total", "counter", "Packets forwarded through the tunnel.")
+	fmt.Fprintf(cw, "tuncat_packets_total{direction=\"tx\"} %d\n", total.TxPackets)
+	fmt.Fprintf(cw, "tuncat_packets_total{direction=\"rx\"} %d\n", total.RxPackets)
+	metric(cw, "tuncat_bytes_total", "counter", "Bytes forwarded through the tunnel.")
+	fmt.Fprintf(cw, "tuncat_bytes_total{direction=\"tx\"} %d\n", total.TxBytes)
+	fmt.Fprintf(cw, "tuncat_bytes_total{direction=\"rx\"} %d\n", total.RxBytes)
+	metric(cw, "tuncat_dropped_packets_total", "counter", "Packets received that the interface didn't accept.")
+	fmt.Fprintf(cw, "tuncat_dropped_packets_total %d\n", total.Dropped)
+	metric(cw, "tuncat_malformed_frames_total", "counter", "Invalid frames received.")
+	fmt.Fprintf(cw, "tuncat_malformed_frames_total %d\n", total.Malformed)
+
+	metric(cw, "tuncat_shaped_packets_total", "counter", "Packets delayed by the rate limits.")
+	fmt.Fprintf(cw, "tuncat_shaped_packets_total{direction=\"tx\"} %d\n", total.TxShaped)
+	fmt.Fprintf(cw, "tuncat_shaped_packets_total{direction=\"rx\"} %d\n", total.RxShaped)
+	metric(cw, "tuncat_rate_dropped_packets_total", "counter", "Packets dropped by the rate limits.")
+	fmt.Fprintf(cw, "tuncat_rate_dropped_packets_total{direction=\"tx\"} %d\n", total.TxRateDropped)
+	fmt.Fprintf(cw, "tuncat_rate_dropped_packets_total{direction=\"rx\"} %d\n", total.RxRateDropped)
+
+	metric(cw, "tuncat_denied_packets_total", "counter", "Packets received that the access control lists denied.")
+	fmt.Fprintf(cw, "tuncat_denied_packets_total %d\n", total.Denied)
+
+	metric(cw, "tuncat_session_packets_total", "counter", "Packets forwarded by session.")
+	for i, s := range sessions {
+		l := sessionLabels(s)
+		fmt.Fprintf(cw, "tuncat_session_packets_total{%s,direction=\"tx\"} %d\n", l, stats[i].TxPackets)
+		fmt.Fprintf(cw, "tuncat_session_packets_total{%s,direction=\"rx\"} %d\n", l, stats[i].RxPackets)
+	}
+	metric(cw, "tuncat_session_bytes_total", "counter", "Bytes forwarded by session.")
+	for i, s := range sessions {
+		l := sessionLabels(s)
+		fmt.Fprintf(cw, "tuncat_session_bytes_total{%s,direction=\"tx\"} %d\n", l, stats[i].TxBytes)
+		fmt.Fprintf(cw, "tuncat_session_bytes_total{%s,direction=\"rx\"} %d\n", l, stats[i].RxBytes)
+	}
+	metric(cw, "tuncat_session_dropped_packets_total", "counter", "Packets dropped by session.")
+	for i, s := range sessions {
+		fmt.Fprintf(cw, "tuncat_session_dropped_packets_total{%s} %d\n", sessionLabels(s), stats[i].Dropped)
+	}
+	metric(cw, "tuncat_session_malformed_frames_total", "counter", "Invalid frames received by session.")
+	for i, s := range sessions {
+		fmt.Fprintf(cw, "tuncat_session_malformed_frames_total{%s} %d\n", sessionLabels(s), stats[i].Malformed)
+	}
+	metric(cw, "tuncat_session_compressed_bytes_total", "counter", "Bytes sent compressed by session, before and after the compression.")
+	for i, s := range sessions {
+		l := sessionLabels(s)
+		fmt.Fprintf(cw, "tuncat_session_compressed_bytes_total{%s,stage=\"original\"} %d\n", l, stats[i].CompressedBytes)
+		fmt.Fprintf(cw, "tuncat_session_compressed_bytes_total{%s,stage=\"compressed\"} %d\n", l, stats[i].CompressedWireBytes)
+	}
+	metric(cw, "tuncat_session_compression_ratio", "gauge", "Ratio between the bytes sent and their size on the wire by session.")
+	for i, s := range sessions {
+		fmt.Fprintf(cw, "tuncat_session_compression_ratio{%s} %g\n", sessionLabels(s), stats[i].CompressionRatio())
+	}
+	metric(cw, "tuncat_session_shaped_packets_total", "counter", "Packets delayed by the rate limit by session.")
+	for i, s := range sessions {
+		l := sessionLabels(s)
+		fmt.Fprintf(cw, "tuncat_session_shaped_packets_total{%s,direction=\"tx\"} %d\n", l, stats[i].TxShaped)
+		fmt.Fprintf(cw, "tuncat_session_shaped_packets_total{%s,direction=\"rx\"} %d\n", l, stats[i].RxShaped)
+	}
+	metric(cw, "tuncat_session_rate_dropped_packets_total", "counter", "Packets dropped by the rate limit by session.")
+	for i, s := range sessions {
+		l := sessionLabels(s)
+		fmt.Fprintf(cw, "tuncat_session_rate_dropped_packets_total{%s,direction=\"tx\"} %d\n", l, stats[i].TxRateDropped)
+		fmt.Fprintf(cw, "tuncat_session_rate_dropped_packets_total{%s,direction=\"rx\"} %d\n", l, stats[i].RxRateDropped)
+	}
+	metric(cw, "tuncat_session_denied_packets_total", "counter", "Packets denied by the access control list by session.")
+	for i, s := range sessions {
+		fmt.Fprintf(cw, "tuncat_session_denied_packets_total{%s} %d\n", sessionLabels(s), stats[i].Denied)
+	}
+	metric(cw, "tuncat_session_rtt_seconds", "gauge", "Last round trip time measured by session.")
+	for i, s := range sessions {
+		fmt.Fprintf(cw, "tuncat_session_rtt_seconds{%s} %g\n", sessionLabels(s), stats[i].RTT().Seconds())
+	}
+	metric(cw, "tuncat_session_start_time_seconds", "gauge", "Start time of the session since the epoch.")
+	for _, s := range sessions {
+		fmt.Fprintf(cw, "tuncat_session_start_time_seconds{%s} %d\n", sessionLabels(s), s.Start.Unix())
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// ServeHTTP serves the metrics
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// ListenAndServe serves the metrics on address under /metrics
+func (m *Metrics) ListenAndServe(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	logger.Info("Serving metrics", "address", address, "path", "/metrics")
+	return http.ListenAndServe(address, mux)
+}
+
+func metric(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sessionLabels(s *Session) string {
+	return fmt.Sprintf("session=\"%d\",peer=\"%s\"", s.ID, escapeLabel(s.Peer))
+}
+
+// escapeLabel escapes a label value as required by the Prometheus text format
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// countingWriter keeps the number of bytes written and the first error
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
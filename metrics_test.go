@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.HandshakeSucceeded()
+	m.HandshakeSucceeded()
+	m.HandshakeFailed("timeout")
+	m.DNSQuery("forwarded")
+	closed := m.NewSession("10.0.0.1:1000")
+	closed.Stats.addTxBatch(2, 300)
+	closed.Stats.addMalformed()
+	m.EndSession(closed)
+	// A new session of the same peer is a reconnect
+	s := m.NewSession("10.0.0.1:2000")
+	s.Stats.addTxBatch(1, 100)
+	s.Stats.addRx(50)
+	s.Stats.addDropped()
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	lines := map[string]bool{}
+	for _, l := range strings.Split(w.Body.String(), "\n") {
+		lines[l] = true
+	}
+	for _, want := range []string{
+		"# TYPE tuncat_sessions gauge",
+		"tuncat_sessions 1",
+		"tuncat_reconnects_total 1",
+		`tuncat_handshakes_total{result="success"} 2`,
+		`tuncat_handshakes_total{result="failure",reason="timeout"} 1`,
+		`tuncat_dns_queries_total{result="forwarded"} 1`,
+		`tuncat_packets_total{direction="tx"} 3`,
+		`tuncat_packets_total{direction="rx"} 1`,
+		`tuncat_bytes_total{direction="tx"} 400`,
+		`tuncat_bytes_total{direction="rx"} 50`,
+		"tuncat_dropped_packets_total 1",
+		"tuncat_malformed_frames_total 1",
+		`tuncat_session_packets_total{session="2",peer="10.0.0.1:2000",direction="tx"} 1`,
+		`tuncat_session_bytes_total{session="2",peer="10.0.0.1:2000",direction="rx"} 50`,
+		`tuncat_session_dropped_packets_total{session="2",peer="10.0.0.1:2000"} 1`,
+	} {
+		if !lines[want] {
+			t.Errorf("Missing metric line %q", want)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"10.0.0.1:1000", "10.0.0.1:1000"},
+		{`a"b`, `a\"b`},
+		{`a\b`, `a\\b`},
+		{"a\nb", `a\nb`},
+	}
+	for _, tt := range tests {
+		if got := escapeLabel(tt.in); got != tt.want {
+			t.Errorf("escapeLabel(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
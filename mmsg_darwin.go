@@ -0,0 +1,34 @@
+package main
+
+import "net"
+
+// datagramBatcher sends and receives the datagrams of a UDP socket one by
+// one, the batching syscalls are only used on Linux
+type datagramBatcher struct {
+	udp *net.UDPConn
+}
+
+func newDatagramBatcher(udp *net.UDPConn, size int) (*datagramBatcher, error) {
+	return &datagramBatcher{udp: udp}, nil
+}
+
+// write sends the datagrams to addr, it returns the number sent
+func (b *datagramBatcher) write(msgs [][]byte, addr *net.UDPAddr) (int, error) {
+	for i, msg := range msgs {
+		if _, err := b.udp.WriteToUDP(msg, addr); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// read receives a datagram, it returns the number received with their sizes
+// and source addresses
+func (b *datagramBatcher) read(bufs [][]byte, sizes []int, from []net.UDPAddr) (int, error) {
+	n, addr, err := b.udp.ReadFromUDP(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0], from[0] = n, *addr
+	return 1, nil
+}
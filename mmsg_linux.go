@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr is the message header of sendmmsg and recvmmsg
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// datagramBatcher sends and receives the datagrams of a UDP socket in
+// batches, sendmmsg and recvmmsg move the whole batch in one syscall
+type datagramBatcher struct {
+	rc    syscall.RawConn
+	inet6 bool
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrAny
+	// peer is the address the datagrams are sent to
+	peer syscall.RawSockaddrAny
+}
+
+func newDatagramBatcher(udp *net.UDPConn, size int) (*datagramBatcher, error) {
+	rc, err := udp.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	b := &datagramBatcher{
+		rc:    rc,
+		hdrs:  make([]mmsghdr, size),
+		iovs:  make([]syscall.Iovec, size),
+		names: make([]syscall.RawSockaddrAny, size),
+	}
+	// The dual stack sockets reach the IPv4 peers on mapped addresses
+	var sa syscall.Sockaddr
+	err = rc.Control(func(fd uintptr) {
+		sa, err = syscall.Getsockname(int(fd))
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, b.inet6 = sa.(*syscall.SockaddrInet6)
+	return b, nil
+}
+
+// setPeer encodes the address the datagrams are sent to
+func (b *datagramBatcher) setPeer(addr *net.UDPAddr) (uint32, error) {
+	b.peer = syscall.RawSockaddrAny{}
+	if !b.inet6 {
+		ip := addr.IP.To4()
+		if ip == nil {
+			return 0, &net.AddrError{Err: "IPv6 address on an IPv4 socket", Addr: addr.String()}
+		}
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&b.peer))
+		sa.Family = syscall.AF_INET
+		putPort(&sa.Port, addr.Port)
+		copy(sa.Addr[:], ip)
+		return syscall.SizeofSockaddrInet4, nil
+	}
+	sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&b.peer))
+	sa.Family = syscall.AF_INET6
+	putPort(&sa.Port, addr.Port)
+	copy(sa.Addr[:], addr.IP.To16())
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.Scope_id = uint32(ifi.Index)
+		}
+	}
+	return syscall.SizeofSockaddrInet6, nil
+}
+
+// putPort stores the port in network byte order
+func putPort(p *uint16, port int) {
+	b := (*[2]byte)(unsafe.Pointer(p))
+	b[0], b[1] = byte(port>>8), byte(port)
+}
+
+// getPort loads the port stored in network byte order
+func getPort(p *uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(p))
+	return int(b[0])<<8 | int(b[1])
+}
+
+// write sends the datagrams to addr, it returns the number sent
+func (b *datagramBatcher) write(msgs [][]byte, addr *net.UDPAddr) (int, error) {
+	namelen, err := b.setPeer(addr)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for sent < len(msgs) {
+		n := len(msgs) - sent
+		if n > len(b.hdrs) {
+			n = len(b.hdrs)
+		}
+		for i := 0; i < n; i++ {
+			msg := msgs[sent+i]
+			b.iovs[i].Base = &msg[0]
+			b.iovs[i].SetLen(len(msg))
+			b.hdrs[i] = mmsghdr{}
+			b.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&b.peer))
+			b.hdrs[i].hdr.Namelen = namelen
+			b.hdrs[i].hdr.Iov = &b.iovs[i]
+			b.hdrs[i].hdr.Iovlen = 1
+		}
+		var r uintptr
+		var errno syscall.Errno
+		err := b.rc.Write(func(fd uintptr) bool {
+			r, _, errno = syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&b.hdrs[0])), uintptr(n), 0, 0, 0)
+			return errno != syscall.EAGAIN
+		})
+		if err == nil && errno != 0 {
+			err = os.NewSyscallError("sendmmsg", errno)
+		}
+		if err != nil {
+			return sent, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: err}
+		}
+		sent += int(r)
+	}
+	return sent, nil
+}
+
+// read receives up to len(bufs) datagrams, it returns the number received
+// with their sizes and source addresses
+func (b *datagramBatcher) read(bufs [][]byte, sizes []int, from []net.UDPAddr) (int, error) {
+	n := len(bufs)
+	if n > len(b.hdrs) {
+		n = len(b.hdrs)
+	}
+	for i := 0; i < n; i++ {
+		b.iovs[i].Base = &bufs[i][0]
+		b.iovs[i].SetLen(len(bufs[i]))
+		b.hdrs[i] = mmsghdr{}
+		b.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		b.hdrs[i].hdr.Namelen = syscall.SizeofSockaddrAny
+		b.hdrs[i].hdr.Iov = &b.iovs[i]
+		b.hdrs[i].hdr.Iovlen = 1
+	}
+	var r uintptr
+	var errno syscall.Errno
+	err := b.rc.Read(func(fd uintptr) bool {
+		r, _, errno = syscall.Syscall6(sysRecvmmsg, fd, uintptr(unsafe.Pointer(&b.hdrs[0])), uintptr(n), 0, 0, 0)
+		return errno != syscall.EAGAIN
+	})
+	if err == nil && errno != 0 {
+		err = os.NewSyscallError("recvmmsg", errno)
+	}
+	if err != nil {
+		return 0, &net.OpError{Op: "read", Net: "udp", Err: err}
+	}
+	for i := 0; i < int(r); i++ {
+		sizes[i] = int(b.hdrs[i].len)
+		switch b.names[i].Addr.Family {
+		case syscall.AF_INET:
+			sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&b.names[i]))
+			from[i].IP = append(from[i].IP[:0], sa.Addr[:]...)
+			from[i].Port = getPort(&sa.Port)
+		case syscall.AF_INET6:
+			sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&b.names[i]))
+			from[i].IP = append(from[i].IP[:0], sa.Addr[:]...)
+			from[i].Port = getPort(&sa.Port)
+		default:
+			from[i].IP, from[i].Port = from[i].IP[:0], 0
+		}
+	}
+	return int(r), nil
+}
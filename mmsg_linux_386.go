@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// sysSendmmsg is missing in the syscall package of 386
+const (
+	sysSendmmsg = 345
+	sysRecvmmsg = syscall.SYS_RECVMMSG
+)
@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// sysSendmmsg is missing in the syscall package of amd64
+const (
+	sysSendmmsg = 307
+	sysRecvmmsg = syscall.SYS_RECVMMSG
+)
@@ -0,0 +1,82 @@
+package main
+
+import "net"
+
+// NetworkConfigurator configures the host network for one end of the tunnel
+type NetworkConfigurator interface {
+	// SetupNetwork brings the interface up and assigns its address, if any
+	SetupNetwork() error
+	// DeleteAddress removes the address of the interface, i.e. a DHCP lease replaced
+	DeleteAddress() error
+	// CreateRoutes configure the routes associated to the interface
+	CreateRoutes() error
+	// DeleteRoutes deletes the routes associated to the interface
+	DeleteRoutes() error
+	// CreateMasquerade masquerades the tunnel traffic leaving through dev
+	CreateMasquerade(dev string) error
+	// DeleteMasquerade deletes the masquerade rules
+	DeleteMasquerade(dev string) error
+	// SetHardwareAddr sets the MAC address of a TAP interface
+	SetHardwareAddr(mac string) error
+	// SetMaster attaches a TAP interface to the bridge
+	SetMaster(bridge string) error
+	// AddRoute adds a route through a gateway or device
+	AddRoute(r StaticRoute) error
+	// DeleteRoute deletes the route
+	DeleteRoute(r StaticRoute) error
+	// SetDNS configures the DNS servers and search domains of the interface
+	SetDNS(d DNSConfig) error
+	// RevertDNS restores the DNS configuration
+	RevertDNS(d DNSConfig) error
+}
+
+// StaticRoute is a route to a network or a single host through a gateway,
+// a device or both, i.e. the route pinned to the tunnel server
+type StaticRoute struct {
+	Network string `json:"network"`
+	Gateway string `json:"gateway,omitempty"`
+	Dev     string `json:"dev,omitempty"`
+}
+
+func (r StaticRoute) String() string {
+	s := r.Network
+	if r.Gateway != "" {
+		s += " via " + r.Gateway
+	}
+	if r.Dev != "" {
+		s += " dev " + r.Dev
+	}
+	return s
+}
+
+// NetworkConfiguratorFunc returns a NetworkConfigurator for the interface dev
+type NetworkConfiguratorFunc func(ip, remoteNetwork, remoteGateway, dev string) NetworkConfigurator
+
+// newHostNetworkConfigurator returns a NetworkConfigurator that modifies the host
+func newHostNetworkConfigurator(ip, remoteNetwork, remoteGateway, dev string) NetworkConfigurator {
+	return NewNetconfig(ip, remoteNetwork, remoteGateway, dev)
+}
+
+// HostNetwork answers the queries about the current network of the host
+type HostNetwork interface {
+	// ConnectedNetworks returns the networks of the host interfaces
+	ConnectedNetworks() ([]*net.IPNet, error)
+	// HostRoute returns the route the host is reached through now, the
+	// route is empty if the host is a local address
+	HostRoute(host string) (StaticRoute, error)
+}
+
+// hostNetwork queries the network of the host
+type hostNetwork struct{}
+
+func (hostNetwork) ConnectedNetworks() ([]*net.IPNet, error) {
+	return connectedNetworks()
+}
+
+func (hostNetwork) HostRoute(host string) (StaticRoute, error) {
+	return lookupHostRoute(host)
+}
+
+// Interface check
+var _ NetworkConfigurator = Netconfig{}
+var _ HostNetwork = hostNetwork{}
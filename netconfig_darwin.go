@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"os/exec"
+	"strings"
 )
 
 // Route represent a route
@@ -37,6 +39,10 @@ func (n Netconfig) SetupNetwork() error {
 	return nil
 }
 
+func (n Netconfig) DeleteAddress() error {
+	return exec.Command("ifconfig", n.dev, "inet", n.ip, "-alias").Run()
+}
+
 func (n Netconfig) CreateRoutes() error {
 	if len(n.routes.network) == 0 {
 		return nil
@@ -60,3 +66,55 @@ func (n Netconfig) DeleteMasquerade(dev string) error {
 	// Only for Linux
 	return nil
 }
+
+func (n Netconfig) SetHardwareAddr(mac string) error {
+	return fmt.Errorf("TAP mode is only supported on Linux")
+}
+
+func (n Netconfig) SetMaster(bridge string) error {
+	return fmt.Errorf("TAP mode is only supported on Linux")
+}
+
+// lookupHostRoute returns the route the host is reached through now
+func lookupHostRoute(host string) (StaticRoute, error) {
+	out, err := exec.Command("route", "-n", "get", host).Output()
+	if err != nil {
+		return StaticRoute{}, fmt.Errorf("Error looking up the route to %s: %v", host, err)
+	}
+	r := StaticRoute{Network: host}
+	for _, line := range strings.Split(string(out), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "gateway":
+			r.Gateway = strings.TrimSpace(kv[1])
+		case "interface":
+			r.Dev = strings.TrimSpace(kv[1])
+		}
+	}
+	if r.Gateway == "" && r.Dev == "" {
+		return StaticRoute{}, fmt.Errorf("Error looking up the route to %s", host)
+	}
+	return r, nil
+}
+
+func (r StaticRoute) args() []string {
+	kind := "-host"
+	if strings.Contains(r.Network, "/") {
+		kind = "-net"
+	}
+	if r.Gateway != "" {
+		return []string{kind, r.Network, r.Gateway}
+	}
+	return []string{kind, r.Network, "-interface", r.Dev}
+}
+
+func (n Netconfig) AddRoute(r StaticRoute) error {
+	return exec.Command("route", append([]string{"-n", "add"}, r.args()...)...).Run()
+}
+
+func (n Netconfig) DeleteRoute(r StaticRoute) error {
+	return exec.Command("route", append([]string{"-n", "delete"}, r.args()...)...).Run()
+}
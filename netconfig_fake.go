@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// NetworkChange is a single modification of the host network
+type NetworkChange struct {
+	// Action is "add" or "del"
+	Action string `json:"action"`
+	// Kind is one of "link", "address", "route", "rule", "nat" or "dns"
+	Kind     string `json:"kind"`
+	Dev      string `json:"dev,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Network  string `json:"network,omitempty"`
+	Gateway  string `json:"gateway,omitempty"`
+	Table    int    `json:"table,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	// Servers and Search are the DNS configuration of the link
+	Servers []string `json:"servers,omitempty"`
+	Search  []string `json:"search,omitempty"`
+	// HardwareAddr and Master are the MAC address and bridge of a TAP link
+	HardwareAddr string `json:"hardwareAddr,omitempty"`
+	Master       string `json:"master,omitempty"`
+}
+
+func (c NetworkChange) String() string {
+	switch c.Kind {
+	case "link":
+		if c.HardwareAddr != "" {
+			return fmt.Sprintf("link set %s address %s", c.Dev, c.HardwareAddr)
+		}
+		if c.Master != "" {
+			return fmt.Sprintf("link set %s master %s", c.Dev, c.Master)
+		}
+		if c.Action == "add" {
+			return fmt.Sprintf("link set %s up", c.Dev)
+		}
+		return fmt.Sprintf("link set %s down", c.Dev)
+	case "address":
+		return fmt.Sprintf("address %s %s dev %s", c.Action, c.Address, c.Dev)
+	case "route":
+		s := fmt.Sprintf("route %s %s", c.Action, c.Network)
+		if c.Gateway != "" {
+			s += fmt.Sprintf(" via %s", c.Gateway)
+		}
+		if c.Dev != "" {
+			s += fmt.Sprintf(" dev %s", c.Dev)
+		}
+		if c.Table != 0 {
+			s += fmt.Sprintf(" table %d", c.Table)
+		}
+		return s
+	case "rule":
+		return fmt.Sprintf("rule %s from %s table %d priority %d", c.Action, c.Network, c.Table, c.Priority)
+	case "nat":
+		return fmt.Sprintf("nat %s POSTROUTING -o %s -j MASQUERADE", c.Action, c.Dev)
+	case "dns":
+		return fmt.Sprintf("dns %s dev %s servers %s search %s", c.Action, c.Dev, strings.Join(c.Servers, ","), strings.Join(c.Search, ","))
+	}
+	return fmt.Sprintf("%s %s", c.Kind, c.Action)
+}
+
+// NetworkRecorder records the changes done by the NetworkConfigurators it creates
+// instead of applying them to the host
+type NetworkRecorder struct {
+	mu      sync.Mutex
+	changes []NetworkChange
+}
+
+// NewNetworkConfigurator returns a NetworkConfigurator that records its operations,
+// it can be used as a NetworkConfiguratorFunc
+func (r *NetworkRecorder) NewNetworkConfigurator(ip, remoteNetwork, remoteGateway, dev string) NetworkConfigurator {
+	return &fakeNetconfig{
+		recorder: r,
+		ip:       ip,
+		routes: Route{
+			network: remoteNetwork,
+			gw:      remoteGateway,
+		},
+		dev: dev,
+	}
+}
+
+// Changes returns the changes recorded so far
+func (r *NetworkRecorder) Changes() []NetworkChange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changes := make([]NetworkChange, len(r.changes))
+	copy(changes, r.changes)
+	return changes
+}
+
+// Reset forgets the recorded changes
+func (r *NetworkRecorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changes = nil
+}
+
+func (r *NetworkRecorder) record(changes ...NetworkChange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changes = append(r.changes, changes...)
+}
+
+// fakeNetconfig mirrors the operations of the Linux Netconfig
+type fakeNetconfig struct {
+	recorder *NetworkRecorder
+	ip       string
+	routes   Route
+	dev      string
+}
+
+func (n *fakeNetconfig) SetupNetwork() error {
+	n.recorder.record(NetworkChange{Action: "add", Kind: "link", Dev: n.dev})
+	if len(n.ip) == 0 {
+		return nil
+	}
+	n.recorder.record(NetworkChange{Action: "add", Kind: "address", Address: n.ip, Dev: n.dev})
+	return nil
+}
+
+func (n *fakeNetconfig) DeleteAddress() error {
+	if len(n.ip) == 0 {
+		return nil
+	}
+	n.recorder.record(NetworkChange{Action: "del", Kind: "address", Address: n.ip, Dev: n.dev})
+	return nil
+}
+
+func (n *fakeNetconfig) SetHardwareAddr(mac string) error {
+	n.recorder.record(NetworkChange{Action: "add", Kind: "link", Dev: n.dev, HardwareAddr: mac})
+	return nil
+}
+
+func (n *fakeNetconfig) SetMaster(bridge string) error {
+	n.recorder.record(NetworkChange{Action: "add", Kind: "link", Dev: n.dev, Master: bridge})
+	return nil
+}
+
+func (n *fakeNetconfig) CreateRoutes() error {
+	if len(n.routes.network) == 0 {
+		return nil
+	}
+	n.recorder.record(NetworkChange{Action: "add", Kind: "route", Network: n.routes.network, Gateway: n.routes.gw})
+	return nil
+}
+
+func (n *fakeNetconfig) DeleteRoutes() error {
+	if len(n.routes.network) == 0 {
+		return nil
+	}
+	n.recorder.record(NetworkChange{Action: "del", Kind: "route", Network: n.routes.network, Gateway: n.routes.gw})
+	return nil
+}
+
+func (n *fakeNetconfig) CreateMasquerade(dev string) error {
+	n.recorder.record(NetworkChange{Action: "add", Kind: "nat", Dev: dev})
+	if len(n.routes.network) == 0 {
+		return nil
+	}
+	n.recorder.record(
+		NetworkChange{Action: "add", Kind: "route", Network: "default", Gateway: n.ip, Table: 10},
+		NetworkChange{Action: "add", Kind: "rule", Network: n.routes.network, Table: 10, Priority: 10},
+	)
+	return nil
+}
+
+func (n *fakeNetconfig) DeleteMasquerade(dev string) error {
+	n.recorder.record(NetworkChange{Action: "del", Kind: "nat", Dev: dev})
+	if len(n.routes.network) == 0 {
+		return nil
+	}
+	n.recorder.record(
+		NetworkChange{Action: "del", Kind: "route", Network: "default", Gateway: n.ip, Table: 10},
+		NetworkChange{Action: "del", Kind: "rule", Network: n.routes.network, Table: 10, Priority: 10},
+	)
+	return nil
+}
+
+func (n *fakeNetconfig) AddRoute(r StaticRoute) error {
+	n.recorder.record(NetworkChange{Action: "add", Kind: "route", Network: r.Network, Gateway: r.Gateway, Dev: r.Dev})
+	return nil
+}
+
+func (n *fakeNetconfig) DeleteRoute(r StaticRoute) error {
+	n.recorder.record(NetworkChange{Action: "del", Kind: "route", Network: r.Network, Gateway: r.Gateway, Dev: r.Dev})
+	return nil
+}
+
+func (n *fakeNetconfig) SetDNS(d DNSConfig) error {
+	n.recorder.record(NetworkChange{Action: "add", Kind: "dns", Dev: n.dev, Servers: d.Servers, Search: d.Search})
+	return nil
+}
+
+func (n *fakeNetconfig) RevertDNS(d DNSConfig) error {
+	n.recorder.record(NetworkChange{Action: "del", Kind: "dns", Dev: n.dev, Servers: d.Servers, Search: d.Search})
+	return nil
+}
+
+// FakeHostNetwork answers the host queries with fixed networks and routes,
+// the hosts without a route are local
+type FakeHostNetwork struct {
+	Networks []*net.IPNet
+	Routes   map[string]StaticRoute
+}
+
+func (f FakeHostNetwork) ConnectedNetworks() ([]*net.IPNet, error) {
+	return f.Networks, nil
+}
+
+func (f FakeHostNetwork) HostRoute(host string) (StaticRoute, error) {
+	return f.Routes[host], nil
+}
+
+// Interface check
+var _ HostNetwork = FakeHostNetwork{}
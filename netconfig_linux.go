@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"os/exec"
+	"strings"
 )
 
 // Route represent a route
@@ -35,12 +37,34 @@ func (n Netconfig) SetupNetwork() error {
 	if err := exec.Command("ip", "link", "set", n.dev, "up").Run(); err != nil {
 		return err
 	}
+	// The address can be assigned later, i.e. by DHCP
+	if len(n.ip) == 0 {
+		return nil
+	}
 	if err := exec.Command("ip", "addr", "add", n.ip, "dev", n.dev).Run(); err != nil {
 		return err
 	}
 	return nil
 }
 
+// DeleteAddress removes the address of the interface
+func (n Netconfig) DeleteAddress() error {
+	if len(n.ip) == 0 {
+		return nil
+	}
+	return exec.Command("ip", "addr", "del", n.ip, "dev", n.dev).Run()
+}
+
+// SetHardwareAddr sets the MAC address of the interface
+func (n Netconfig) SetHardwareAddr(mac string) error {
+	return exec.Command("ip", "link", "set", "dev", n.dev, "address", mac).Run()
+}
+
+// SetMaster attaches the interface to the bridge
+func (n Netconfig) SetMaster(bridge string) error {
+	return exec.Command("ip", "link", "set", "dev", n.dev, "master", bridge).Run()
+}
+
 // CreateRoutes configure the routes associated to the interface
 func (n Netconfig) CreateRoutes() error {
 	if len(n.routes.network) == 0 {
@@ -58,15 +82,16 @@ func (n Netconfig) DeleteRoutes() error {
 }
 
 // CreateMasquerade configures the network so the outgoing traffic is masquerade
-// and the incoming traffic is sent through the tunnel using policy based source routing
+// and the incoming traffic from the remote network, if any, is sent through the
+// tunnel using policy based source routing
 func (n Netconfig) CreateMasquerade(dev string) error {
-	if len(n.routes.network) == 0 {
-		return nil
-	}
 	// Masquerade the tunnel traffic with the external interface
 	if err := exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING", "-o", dev, "-j", "MASQUERADE").Run(); err != nil {
 		return err
 	}
+	if len(n.routes.network) == 0 {
+		return nil
+	}
 	if err := exec.Command("ip", "route", "add", "table", "10", "to", "default", "via", n.ip).Run(); err != nil {
 		return err
 	}
@@ -78,12 +103,12 @@ func (n Netconfig) CreateMasquerade(dev string) error {
 
 // DeleteMasquerade rules
 func (n Netconfig) DeleteMasquerade(dev string) error {
-	if len(n.routes.network) == 0 {
-		return nil
-	}
 	if err := exec.Command("iptables", "-t", "nat", "-D", "POSTROUTING", "-o", dev, "-j", "MASQUERADE").Run(); err != nil {
 		return err
 	}
+	if len(n.routes.network) == 0 {
+		return nil
+	}
 
 	if err := exec.Command("ip", "route", "flush", "10").Run(); err != nil {
 		return err
@@ -94,3 +119,51 @@ func (n Netconfig) DeleteMasquerade(dev string) error {
 	}
 	return nil
 }
+
+// lookupHostRoute returns the route the host is reached through now, the
+// route is empty if the host is a local address
+func lookupHostRoute(host string) (StaticRoute, error) {
+	out, err := exec.Command("ip", "route", "get", host).Output()
+	if err != nil {
+		return StaticRoute{}, fmt.Errorf("Error looking up the route to %s: %v", host, err)
+	}
+	r := StaticRoute{Network: host}
+	fields := strings.Fields(string(out))
+	// The local routes take precedence over the tunnel routes
+	if len(fields) > 0 && fields[0] == "local" {
+		return StaticRoute{}, nil
+	}
+	for i := 0; i < len(fields)-1; i++ {
+		switch fields[i] {
+		case "via":
+			r.Gateway = fields[i+1]
+		case "dev":
+			r.Dev = fields[i+1]
+		}
+	}
+	if r.Dev == "" {
+		return StaticRoute{}, fmt.Errorf("Error looking up the route to %s: %s", host, strings.TrimSpace(string(out)))
+	}
+	return r, nil
+}
+
+func (r StaticRoute) args() []string {
+	args := []string{r.Network}
+	if r.Gateway != "" {
+		args = append(args, "via", r.Gateway)
+	}
+	if r.Dev != "" {
+		args = append(args, "dev", r.Dev)
+	}
+	return args
+}
+
+// AddRoute adds the route
+func (n Netconfig) AddRoute(r StaticRoute) error {
+	return exec.Command("ip", append([]string{"route", "add"}, r.args()...)...).Run()
+}
+
+// DeleteRoute deletes the route
+func (n Netconfig) DeleteRoute(r StaticRoute) error {
+	return exec.Command("ip", append([]string{"route", "del"}, r.args()...)...).Run()
+}
@@ -43,6 +43,10 @@ func (n Netconfig) SetupNetwork() error {
 	return cmd.Run()
 }
 
+func (n Netconfig) DeleteAddress() error {
+	return exec.Command("netsh", "interface", "ip", "delete", "address", fmt.Sprintf("name=%s", n.dev), fmt.Sprintf("addr=%s", n.ip)).Run()
+}
+
 func (n Netconfig) CreateRoutes() error {
 	// TODO
 	return nil
@@ -62,3 +66,27 @@ func (n Netconfig) DeleteMasquerade(dev string) error {
 	// Only for Linux
 	return nil
 }
+
+func (n Netconfig) SetHardwareAddr(mac string) error {
+	return fmt.Errorf("TAP mode is only supported on Linux")
+}
+
+func (n Netconfig) SetMaster(bridge string) error {
+	return fmt.Errorf("TAP mode is only supported on Linux")
+}
+
+// lookupHostRoute returns the route the host is reached through now
+func lookupHostRoute(host string) (StaticRoute, error) {
+	// TODO
+	return StaticRoute{Network: host}, nil
+}
+
+func (n Netconfig) AddRoute(r StaticRoute) error {
+	// TODO
+	return nil
+}
+
+func (n Netconfig) DeleteRoute(r StaticRoute) error {
+	// TODO
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// netnsPath returns the path of the network namespace, the namespace of a
+// process can be given by its PID
+func netnsPath(s string) (string, error) {
+	if pid, err := strconv.Atoi(s); err == nil {
+		if pid <= 0 {
+			return "", fmt.Errorf("Invalid network namespace PID %d", pid)
+		}
+		s = fmt.Sprintf("/proc/%d/ns/net", pid)
+	}
+	if _, err := os.Stat(s); err != nil {
+		return "", fmt.Errorf("Invalid network namespace %q: %v", s, err)
+	}
+	return s, nil
+}
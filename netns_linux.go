@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// cloneNewNet is the namespace type of the network namespaces
+const cloneNewNet = 0x40000000
+
+func setns(f *os.File) error {
+	if _, _, errno := syscall.RawSyscall(sysSetns, f.Fd(), cloneNewNet, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// inNetns runs f in the network namespace at path, i.e. /proc/<pid>/ns/net or
+// /var/run/netns/<name>, the sockets created and the commands started by f
+// belong to that namespace. f runs in the current namespace if path is empty.
+func inNetns(path string, f func() error) error {
+	if path == "" {
+		return f()
+	}
+	target, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Error opening network namespace: %v", err)
+	}
+	defer target.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		// The namespace belongs to the thread
+		runtime.LockOSThread()
+		current, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("Error opening network namespace: %v", err)
+			return
+		}
+		defer current.Close()
+		if err := setns(target); err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("Error entering network namespace %s: %v", path, err)
+			return
+		}
+		errCh <- f()
+		// The thread is destroyed with the goroutine if it can't go back
+		if setns(current) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+	return <-errCh
+}
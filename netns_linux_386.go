@@ -0,0 +1,4 @@
+package main
+
+// sysSetns is missing in the syscall package of 386
+const sysSetns = 346
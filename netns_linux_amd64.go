@@ -0,0 +1,4 @@
+package main
+
+// sysSetns is missing in the syscall package of amd64
+const sysSetns = 308
@@ -0,0 +1,11 @@
+package main
+
+import "fmt"
+
+// inNetns runs f, network namespaces are only supported on Linux
+func inNetns(path string, f func() error) error {
+	if path != "" {
+		return fmt.Errorf("Network namespaces are only supported on Linux")
+	}
+	return f()
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// With offloads enabled every packet read from or written to the TUN interface
+// is preceded by a virtio-net header, it describes the super-packets that the
+// kernel hands over without segmenting them and the checksums left to compute,
+// see include/uapi/linux/virtio_net.h
+const (
+	virtioNetHdrLen = 10
+
+	virtioNetHdrNeedsCsum = 1
+
+	virtioNetHdrGSONone  = 0
+	virtioNetHdrGSOTCPv4 = 1
+	virtioNetHdrGSOTCPv6 = 4
+	virtioNetHdrGSOUDPL4 = 5
+	virtioNetHdrGSOECN   = 0x80
+)
+
+// TCP flags modified when segmenting or coalescing
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagCWR = 0x80
+)
+
+// virtioNetHdr is the header of the packets of interfaces with offloads
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+// The header is little endian, the byte order is set when opening the interface
+func parseVirtioNetHdr(b []byte) (virtioNetHdr, error) {
+	if len(b) < virtioNetHdrLen {
+		return virtioNetHdr{}, fmt.Errorf("Short virtio-net header: %d bytes", len(b))
+	}
+	return virtioNetHdr{
+		flags:      b[0],
+		gsoType:    b[1],
+		hdrLen:     binary.LittleEndian.Uint16(b[2:]),
+		gsoSize:    binary.LittleEndian.Uint16(b[4:]),
+		csumStart:  binary.LittleEndian.Uint16(b[6:]),
+		csumOffset: binary.LittleEndian.Uint16(b[8:]),
+	}, nil
+}
+
+func (h virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.LittleEndian.PutUint16(b[2:], h.hdrLen)
+	binary.LittleEndian.PutUint16(b[4:], h.gsoSize)
+	binary.LittleEndian.PutUint16(b[6:], h.csumStart)
+	binary.LittleEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+// vnetQueue is a queue of a TUN interface with offloads, reads return and
+// writes take a virtio-net header followed by the packet
+type vnetQueue struct {
+	*os.File
+	name string
+}
+
+// Name returns the name of the interface
+func (q *vnetQueue) Name() string {
+	return q.name
+}
+
+// checksum adds b to the one's complement sum
+func checksum(b []byte, sum uint32) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// foldChecksum folds the sum to 16 bits
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+// pseudoHeaderChecksum is the sum of the pseudo header of the TCP and UDP checksums
+func pseudoHeaderChecksum(packet []byte, proto uint8, length int) uint32 {
+	var sum uint32
+	if packet[0]>>4 == 4 {
+		sum = checksum(packet[12:20], 0)
+	} else {
+		sum = checksum(packet[8:40], 0)
+	}
+	return sum + uint32(proto) + uint32(length)
+}
+
+// setL4Checksum computes the TCP or UDP checksum of the packet, l4 is the
+// offset of the transport header
+func setL4Checksum(packet []byte, proto uint8, l4 int) {
+	field := l4 + 16
+	if proto == protoUDP {
+		field = l4 + 6
+	}
+	packet[field], packet[field+1] = 0, 0
+	sum := ^foldChecksum(checksum(packet[l4:], pseudoHeaderChecksum(packet, proto, len(packet)-l4)))
+	// A zero UDP checksum means no checksum
+	if proto == protoUDP && sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(packet[field:], sum)
+}
+
+// setIPv4Checksum computes the header checksum of an IPv4 packet
+func setIPv4Checksum(packet []byte) {
+	ihl := int(packet[0]&0x0f) * 4
+	packet[10], packet[11] = 0, 0
+	binary.BigEndian.PutUint16(packet[10:], ^foldChecksum(checksum(packet[:ihl], 0)))
+}
+
+// completeChecksum finishes the partial checksum of a packet with the
+// NEEDS_CSUM flag, the checksum field holds the pseudo header sum
+func completeChecksum(hdr virtioNetHdr, packet []byte) error {
+	start := int(hdr.csumStart)
+	field := start + int(hdr.csumOffset)
+	if field+2 > len(packet) {
+		return fmt.Errorf("Invalid checksum offsets start %d offset %d", hdr.csumStart, hdr.csumOffset)
+	}
+	sum := ^foldChecksum(checksum(packet[start:], 0))
+	binary.BigEndian.PutUint16(packet[field:], sum)
+	return nil
+}
+
+// gsoSegment splits the super-packet into packets of at most gsoSize bytes of
+// payload with their headers and checksums fixed, emit is called with each
+// packet in a buffer that is reused, packets without GSO are only checksummed
+func gsoSegment(hdr virtioNetHdr, packet []byte, emit func([]byte) error) error {
+	gsoType := hdr.gsoType &^ virtioNetHdrGSOECN
+	if gsoType == virtioNetHdrGSONone {
+		if hdr.flags&virtioNetHdrNeedsCsum != 0 {
+			if err := completeChecksum(hdr, packet); err != nil {
+				return err
+			}
+		}
+		return emit(packet)
+	}
+	if len(packet) < 1 {
+		return fmt.Errorf("Empty GSO packet")
+	}
+	version := packet[0] >> 4
+	proto := uint8(protoTCP)
+	switch {
+	case gsoType == virtioNetHdrGSOTCPv4 && version == 4:
+	case gsoType == virtioNetHdrGSOTCPv6 && version == 6:
+	case gsoType == virtioNetHdrGSOUDPL4 && (version == 4 || version == 6):
+		proto = protoUDP
+	default:
+		return fmt.Errorf("Unsupported GSO type %d for IPv%d", hdr.gsoType, version)
+	}
+	// The transport header starts where the checksum does
+	l4 := int(hdr.csumStart)
+	if (version == 4 && l4 < 20) || (version == 6 && l4 < 40) {
+		return fmt.Errorf("Invalid GSO transport offset %d", l4)
+	}
+	l4Len := 8
+	if proto == protoTCP {
+		if l4+13 > len(packet) {
+			return fmt.Errorf("Short GSO packet: %d bytes", len(packet))
+		}
+		l4Len = int(packet[l4+12]>>4) * 4
+		if l4Len < 20 {
+			return fmt.Errorf("Invalid TCP header length %d", l4Len)
+		}
+	}
+	hdrLen := l4 + l4Len
+	if hdrLen > len(packet) {
+		return fmt.Errorf("Short GSO packet: %d bytes", len(packet))
+	}
+	gsoSize := int(hdr.gsoSize)
+	if gsoSize == 0 {
+		return fmt.Errorf("Invalid GSO size 0")
+	}
+	payload := packet[hdrLen:]
+	seg := make([]byte, hdrLen+gsoSize)
+	var seq uint32
+	var flags byte
+	var id uint16
+	if proto == protoTCP {
+		seq = binary.BigEndian.Uint32(packet[l4+4:])
+		flags = packet[l4+13]
+	}
+	if version == 4 {
+		id = binary.BigEndian.Uint16(packet[4:])
+	}
+	for i := 0; i == 0 || len(payload) > 0; i++ {
+		n := gsoSize
+		if n > len(payload) {
+			n = len(payload)
+		}
+		last := n == len(payload)
+		seg = seg[:hdrLen+n]
+		copy(seg, packet[:hdrLen])
+		copy(seg[hdrLen:], payload[:n])
+		if version == 4 {
+			binary.BigEndian.PutUint16(seg[2:], uint16(len(seg)))
+			binary.BigEndian.PutUint16(seg[4:], id+uint16(i))
+			setIPv4Checksum(seg)
+		} else {
+			binary.BigEndian.PutUint16(seg[4:], uint16(len(seg)-40))
+		}
+		if proto == protoTCP {
+			binary.BigEndian.PutUint32(seg[l4+4:], seq)
+			f := flags
+			// FIN and PSH belong to the last segment, CWR to the first
+			if !last {
+				f &^= tcpFlagFIN | tcpFlagPSH
+			}
+			if i > 0 {
+				f &^= tcpFlagCWR
+			}
+			seg[l4+13] = f
+			seq += uint32(n)
+		} else {
+			binary.BigEndian.PutUint16(seg[l4+4:], uint16(len(seg)-l4))
+		}
+		setL4Checksum(seg, proto, l4)
+		if err := emit(seg); err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	return nil
+}
+
+// sendOffload sends a packet read from an interface with offloads, the
+// super-packets are segmented unless the peer accepts them. It returns false
+// if the tunnel is done.
+func sendOffload(p *packetBuffer, session *Session, send func(*packetBuffer) bool) bool {
+	hdr, err := parseVirtioNetHdr(p.bytes())
+	if err != nil {
+		session.Stats.addMalformed()
+		putPacketBuffer(p)
+		return true
+	}
+	if hdr.gsoType == virtioNetHdrGSONone {
+		p.off = virtioNetHdrLen
+		if hdr.flags&virtioNetHdrNeedsCsum != 0 {
+			if err := completeChecksum(hdr, p.bytes()); err != nil {
+				session.Stats.addMalformed()
+				putPacketBuffer(p)
+				return true
+			}
+		}
+		return send(p)
+	}
+	if session.GSO && p.n <= maxPacketSize {
+		p.gso = true
+		return send(p)
+	}
+	ok := true
+	err = gsoSegment(hdr, p.buf[virtioNetHdrLen:p.n], func(segment []byte) error {
+		s := getPacketBuffer()
+		s.n = copy(s.buf[:], segment)
+		if ok = send(s); !ok {
+			return io.ErrClosedPipe
+		}
+		return nil
+	})
+	putPacketBuffer(p)
+	if err != nil && ok {
+		session.Stats.addMalformed()
+	}
+	return ok
+}
+
+// queueWriter writes the packets received from the peer to an interface queue
+type queueWriter interface {
+	// writePacket writes a packet, it may be held until flush
+	writePacket(packet []byte) error
+	// writeGSO writes a virtio-net header followed by a super-packet
+	writeGSO(payload []byte) error
+	// flush writes the packets held
+	flush() error
+}
+
+// newQueueWriter returns the writer of the interface queue
+func newQueueWriter(q io.Writer) queueWriter {
+	if _, ok := q.(*vnetQueue); ok {
+		return &groWriter{
+			q:   q,
+			buf: make([]byte, virtioNetHdrLen, virtioNetHdrLen+maxPacketSize),
+		}
+	}
+	return plainWriter{q}
+}
+
+// plainWriter writes to interfaces without offloads, super-packets are segmented
+type plainWriter struct {
+	q io.Writer
+}
+
+func (w plainWriter) writePacket(packet []byte) error {
+	_, err := w.q.Write(packet)
+	return err
+}
+
+func (w plainWriter) writeGSO(payload []byte) error {
+	hdr, err := parseVirtioNetHdr(payload)
+	if err != nil {
+		return err
+	}
+	return gsoSegment(hdr, payload[virtioNetHdrLen:], w.writePacket)
+}
+
+func (w plainWriter) flush() error {
+	return nil
+}
+
+// groWriter writes to interfaces with offloads, consecutive TCP segments of
+// the same flow are coalesced in a super-packet that the kernel handles at once
+type groWriter struct {
+	q io.Writer
+	// buf holds the virtio-net header and the packet being coalesced
+	buf []byte
+	// segments coalesced in buf, 0 if empty
+	segments int
+	l4       int
+	gsoSize  int
+	nextSeq  uint32
+}
+
+func (w *groWriter) writePacket(packet []byte) error {
+	if w.segments > 0 {
+		if ok, end := w.coalesce(packet); ok {
+			if end {
+				return w.flush()
+			}
+			return nil
+		}
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	w.buf = append(w.buf[:virtioNetHdrLen], packet...)
+	if l4, ok := groCandidate(packet); ok {
+		w.segments = 1
+		w.l4 = l4
+		w.gsoSize = len(packet) - l4 - tcpHeaderLen(packet, l4)
+		w.nextSeq = binary.BigEndian.Uint32(packet[l4+4:]) + uint32(w.gsoSize)
+		// A segment with PSH can't be followed by others
+		if packet[l4+13]&tcpFlagPSH != 0 {
+			return w.flush()
+		}
+		return nil
+	}
+	w.segments = 1
+	return w.flush()
+}
+
+func (w *groWriter) writeGSO(payload []byte) error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	_, err := w.q.Write(payload)
+	return err
+}
+
+// flush writes the packet held, it is a super-packet if segments were coalesced
+func (w *groWriter) flush() error {
+	if w.segments == 0 {
+		return nil
+	}
+	hdr := virtioNetHdr{}
+	packet := w.buf[virtioNetHdrLen:]
+	if w.segments > 1 {
+		// The kernel computes the checksums of the segments from the pseudo header sum
+		l4Len := tcpHeaderLen(packet, w.l4)
+		hdr = virtioNetHdr{
+			flags:      virtioNetHdrNeedsCsum,
+			gsoType:    virtioNetHdrGSOTCPv4,
+			hdrLen:     uint16(w.l4 + l4Len),
+			gsoSize:    uint16(w.gsoSize),
+			csumStart:  uint16(w.l4),
+			csumOffset: 16,
+		}
+		if packet[0]>>4 == 4 {
+			binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+			setIPv4Checksum(packet)
+		} else {
+			hdr.gsoType = virtioNetHdrGSOTCPv6
+			binary.BigEndian.PutUint16(packet[4:], uint16(len(packet)-40))
+		}
+		binary.BigEndian.PutUint16(packet[w.l4+16:], foldChecksum(pseudoHeaderChecksum(packet, protoTCP, len(packet)-w.l4)))
+	}
+	hdr.encode(w.buf)
+	w.segments = 0
+	_, err := w.q.Write(w.buf)
+	return err
+}
+
+// coalesce appends the payload of the packet to the super-packet if it is the
+// next segment of the same flow with the same headers, end is set if the
+// super-packet can't take more segments
+func (w *groWriter) coalesce(packet []byte) (ok, end bool) {
+	pending := w.buf[virtioNetHdrLen:]
+	l4, ok := groCandidate(packet)
+	if !ok || l4 != w.l4 {
+		return false, false
+	}
+	l4Len := tcpHeaderLen(packet, l4)
+	hdrLen := l4 + l4Len
+	n := len(packet) - hdrLen
+	if n == 0 || n > w.gsoSize || len(pending)+n > maxPacketSize || l4Len != tcpHeaderLen(pending, l4) {
+		return false, false
+	}
+	if binary.BigEndian.Uint32(packet[l4+4:]) != w.nextSeq {
+		return false, false
+	}
+	// Addresses, ports, ACK, window, options and the IP fields other than
+	// the length, ID and checksum must match
+	if packet[0]>>4 == 4 {
+		if packet[1] != pending[1] || packet[6]&0xe0 != pending[6]&0xe0 || packet[8] != pending[8] ||
+			!bytes.Equal(packet[12:20], pending[12:20]) {
+			return false, false
+		}
+	} else if !bytes.Equal(packet[:4], pending[:4]) || !bytes.Equal(packet[6:40], pending[6:40]) {
+		return false, false
+	}
+	if !bytes.Equal(packet[l4:l4+4], pending[l4:l4+4]) || !bytes.Equal(packet[l4+8:l4+13], pending[l4+8:l4+13]) ||
+		!bytes.Equal(packet[l4+14:l4+16], pending[l4+14:l4+16]) ||
+		!bytes.Equal(packet[l4+20:hdrLen], pending[l4+20:hdrLen]) {
+		return false, false
+	}
+	w.buf = append(w.buf, packet[hdrLen:]...)
+	w.segments++
+	w.nextSeq += uint32(n)
+	// The super-packet ends with a short segment or one with PSH
+	pending = w.buf[virtioNetHdrLen:]
+	pending[l4+13] |= packet[l4+13] & tcpFlagPSH
+	return true, n < w.gsoSize || packet[l4+13]&tcpFlagPSH != 0
+}
+
+// groCandidate returns the offset of the TCP header if the packet can be
+// coalesced: TCP with payload, no IP options or fragments and only ACK or PSH
+func groCandidate(packet []byte) (int, bool) {
+	if len(packet) < 1 {
+		return 0, false
+	}
+	var l4 int
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 || packet[0]&0x0f != 5 || packet[9] != protoTCP ||
+			int(binary.BigEndian.Uint16(packet[2:])) != len(packet) ||
+			binary.BigEndian.Uint16(packet[6:])&0x3fff != 0 {
+			return 0, false
+		}
+		l4 = 20
+	case 6:
+		if len(packet) < 40 || packet[6] != protoTCP ||
+			int(binary.BigEndian.Uint16(packet[4:]))+40 != len(packet) {
+			return 0, false
+		}
+		l4 = 40
+	default:
+		return 0, false
+	}
+	if len(packet) < l4+20 {
+		return 0, false
+	}
+	l4Len := tcpHeaderLen(packet, l4)
+	if l4Len < 20 || l4+l4Len >= len(packet) {
+		return 0, false
+	}
+	if flags := packet[l4+13]; flags&^tcpFlagPSH != tcpFlagACK {
+		return 0, false
+	}
+	return l4, true
+}
+
+func tcpHeaderLen(packet []byte, l4 int) int {
+	return int(packet[l4+12]>>4) * 4
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"fmt"
+)
+
+// newOffloadInterface is only supported on Linux
+func newOffloadInterface(cfg InterfaceConfig) (*vnetQueue, error) {
+	return nil, fmt.Errorf("Interface offloads are only supported on Linux")
+}
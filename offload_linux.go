@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// TUN flags and offloads, see include/uapi/linux/if_tun.h
+const (
+	iffTUN        = 0x0001
+	iffNoPI       = 0x1000
+	iffMultiQueue = 0x0100
+	iffPersist    = 0x0800
+	iffVnetHdr    = 0x4000
+
+	tunFCsum = 0x01
+	tunFTSO4 = 0x02
+	tunFTSO6 = 0x04
+	tunFUSO4 = 0x20
+	tunFUSO6 = 0x40
+
+	tunSetVnetLE = 0x400454dc
+)
+
+type ifReq struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	pad   [40 - syscall.IFNAMSIZ - 2]byte
+}
+
+func tunIoctl(fd uintptr, request uintptr, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// newOffloadInterface creates a TUN interface with virtio-net headers and the
+// TCP segmentation offloads enabled, the kernel reads and writes super-packets
+// of up to 64KB. UDP segmentation is enabled if the kernel supports it.
+func newOffloadInterface(cfg InterfaceConfig) (*vnetQueue, error) {
+	if cfg.TAP {
+		return nil, fmt.Errorf("Offloads are only supported on TUN interfaces")
+	}
+	fd, err := syscall.Open("/dev/net/tun", os.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating interface: %v", err)
+	}
+	name, err := setupOffload(uintptr(fd), cfg)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Error creating interface: %v", err)
+	}
+	return &vnetQueue{File: os.NewFile(uintptr(fd), "tun"), name: name}, nil
+}
+
+func setupOffload(fd uintptr, cfg InterfaceConfig) (string, error) {
+	var req ifReq
+	req.Flags = iffTUN | iffNoPI | iffVnetHdr
+	if cfg.Queues > 1 {
+		req.Flags |= iffMultiQueue
+	}
+	copy(req.Name[:], cfg.Name)
+	if err := tunIoctl(fd, syscall.TUNSETIFF, uintptr(unsafe.Pointer(&req))); err != nil {
+		return "", fmt.Errorf("TUNSETIFF: %v", err)
+	}
+	hdrLen := int32(virtioNetHdrLen)
+	if err := tunIoctl(fd, syscall.TUNSETVNETHDRSZ, uintptr(unsafe.Pointer(&hdrLen))); err != nil {
+		return "", fmt.Errorf("TUNSETVNETHDRSZ: %v", err)
+	}
+	le := int32(1)
+	if err := tunIoctl(fd, tunSetVnetLE, uintptr(unsafe.Pointer(&le))); err != nil {
+		return "", fmt.Errorf("TUNSETVNETLE: %v", err)
+	}
+	// UDP segmentation requires Linux 6.2
+	offloads := uintptr(tunFCsum | tunFTSO4 | tunFTSO6)
+	if err := tunIoctl(fd, syscall.TUNSETOFFLOAD, offloads|tunFUSO4|tunFUSO6); err != nil {
+		if err := tunIoctl(fd, syscall.TUNSETOFFLOAD, offloads); err != nil {
+			return "", fmt.Errorf("TUNSETOFFLOAD: %v", err)
+		}
+	}
+	if cfg.Owner >= 0 {
+		if err := tunIoctl(fd, syscall.TUNSETOWNER, uintptr(cfg.Owner)); err != nil {
+			return "", fmt.Errorf("TUNSETOWNER: %v", err)
+		}
+	}
+	if cfg.Group >= 0 {
+		if err := tunIoctl(fd, syscall.TUNSETGROUP, uintptr(cfg.Group)); err != nil {
+			return "", fmt.Errorf("TUNSETGROUP: %v", err)
+		}
+	}
+	persist := uintptr(0)
+	if cfg.Persist {
+		persist = 1
+	}
+	if err := tunIoctl(fd, syscall.TUNSETPERSIST, persist); err != nil {
+		return "", fmt.Errorf("TUNSETPERSIST: %v", err)
+	}
+	return strings.TrimRight(string(req.Name[:]), "\x00"), nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// newSuperPacket returns an IPv4 or IPv6 packet with a TCP or UDP header
+// followed by size bytes of payload
+func newSuperPacket(version int, proto uint8, size int, tcpFlags byte) []byte {
+	l4 := 20
+	if version == 6 {
+		l4 = 40
+	}
+	l4Len := 8
+	if proto == protoTCP {
+		l4Len = 20
+	}
+	pkt := make([]byte, l4+l4Len+size)
+	if version == 4 {
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		binary.BigEndian.PutUint16(pkt[4:], 0x1000)
+		pkt[8] = 64
+		pkt[9] = proto
+		copy(pkt[12:16], net.ParseIP("10.0.0.1").To4())
+		copy(pkt[16:20], net.ParseIP("10.0.0.2").To4())
+		setIPv4Checksum(pkt)
+	} else {
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+		pkt[6] = proto
+		pkt[7] = 64
+		copy(pkt[8:24], net.ParseIP("fd00::1"))
+		copy(pkt[24:40], net.ParseIP("fd00::2"))
+	}
+	binary.BigEndian.PutUint16(pkt[l4:], 40000)
+	binary.BigEndian.PutUint16(pkt[l4+2:], 443)
+	if proto == protoTCP {
+		binary.BigEndian.PutUint32(pkt[l4+4:], 0xfffff000)
+		pkt[l4+12] = 5 << 4
+		pkt[l4+13] = tcpFlags
+		binary.BigEndian.PutUint16(pkt[l4+14:], 0xffff)
+	} else {
+		binary.BigEndian.PutUint16(pkt[l4+4:], uint16(len(pkt)-l4))
+	}
+	for i := l4 + l4Len; i < len(pkt); i++ {
+		pkt[i] = byte(i * 7)
+	}
+	return pkt
+}
+
+// validL4Checksum checks the TCP or UDP checksum of the packet
+func validL4Checksum(packet []byte, proto uint8, l4 int) bool {
+	return foldChecksum(checksum(packet[l4:], pseudoHeaderChecksum(packet, proto, len(packet)-l4))) == 0xffff
+}
+
+func TestChecksum(t *testing.T) {
+	// RFC 1071 example
+	b := []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}
+	if got := foldChecksum(checksum(b, 0)); got != 0xddf2 {
+		t.Errorf("checksum() = %#x, want 0xddf2", got)
+	}
+	// The odd byte is padded with zero
+	if got, want := checksum([]byte{0x01, 0x02, 0x03}, 0), checksum([]byte{0x01, 0x02, 0x03, 0x00}, 0); got != want {
+		t.Errorf("checksum() of an odd length = %#x, want %#x", got, want)
+	}
+	pkt := newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 1000, 53, 100)
+	if got := foldChecksum(checksum(pkt[:20], 0)); got != 0xffff {
+		t.Errorf("IPv4 header checksum invalid, sum %#x", got)
+	}
+	for _, version := range []int{4, 6} {
+		for _, proto := range []uint8{protoTCP, protoUDP} {
+			pkt := newSuperPacket(version, proto, 101, tcpFlagACK)
+			l4 := len(pkt) - 101 - 20
+			if proto == protoUDP {
+				l4 = len(pkt) - 101 - 8
+			}
+			setL4Checksum(pkt, proto, l4)
+			if !validL4Checksum(pkt, proto, l4) {
+				t.Errorf("IPv%d proto %d: setL4Checksum() invalid", version, proto)
+			}
+		}
+	}
+}
+
+func TestCompleteChecksum(t *testing.T) {
+	pkt := newSuperPacket(4, protoTCP, 333, tcpFlagACK)
+	// The kernel leaves the pseudo header sum in the checksum field
+	binary.BigEndian.PutUint16(pkt[36:], foldChecksum(pseudoHeaderChecksum(pkt, protoTCP, len(pkt)-20)))
+	hdr := virtioNetHdr{flags: virtioNetHdrNeedsCsum, csumStart: 20, csumOffset: 16}
+	if err := completeChecksum(hdr, pkt); err != nil {
+		t.Fatalf("completeChecksum() error: %v", err)
+	}
+	if !validL4Checksum(pkt, protoTCP, 20) {
+		t.Errorf("completeChecksum() left an invalid checksum")
+	}
+	hdr.csumOffset = uint16(len(pkt))
+	if err := completeChecksum(hdr, pkt); err == nil {
+		t.Errorf("completeChecksum() with the field out of the packet succeeded")
+	}
+}
+
+func TestVirtioNetHdr(t *testing.T) {
+	hdr := virtioNetHdr{flags: virtioNetHdrNeedsCsum, gsoType: virtioNetHdrGSOTCPv6, hdrLen: 60, gsoSize: 1440, csumStart: 40, csumOffset: 16}
+	b := make([]byte, virtioNetHdrLen)
+	hdr.encode(b)
+	got, err := parseVirtioNetHdr(b)
+	if err != nil || got != hdr {
+		t.Errorf("parseVirtioNetHdr() = %+v, %v, want %+v", got, err, hdr)
+	}
+	if _, err := parseVirtioNetHdr(b[:virtioNetHdrLen-1]); err == nil {
+		t.Errorf("parseVirtioNetHdr() of a short header succeeded")
+	}
+}
+
+func TestGSOSegment(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		proto   uint8
+		gsoType uint8
+		payload int
+		gsoSize int
+		flags   byte
+		sizes   []int
+	}{
+		{"tcp4", 4, protoTCP, virtioNetHdrGSOTCPv4, 3000, 1000, tcpFlagACK | tcpFlagPSH, []int{1000, 1000, 1000}},
+		{"tcp4 remainder", 4, protoTCP, virtioNetHdrGSOTCPv4, 2501, 1000, tcpFlagACK | tcpFlagFIN, []int{1000, 1000, 501}},
+		{"tcp4 single segment", 4, protoTCP, virtioNetHdrGSOTCPv4, 500, 1000, tcpFlagACK, []int{500}},
+		{"tcp4 no payload", 4, protoTCP, virtioNetHdrGSOTCPv4, 0, 1000, tcpFlagACK | tcpFlagFIN, []int{0}},
+		{"tcp4 ecn", 4, protoTCP, virtioNetHdrGSOTCPv4 | virtioNetHdrGSOECN, 2000, 1000, tcpFlagACK | tcpFlagCWR, []int{1000, 1000}},
+		{"tcp6", 6, protoTCP, virtioNetHdrGSOTCPv6, 4000, 1440, tcpFlagACK, []int{1440, 1440, 1120}},
+		{"udp4", 4, protoUDP, virtioNetHdrGSOUDPL4, 2800, 1400, 0, []int{1400, 1400}},
+		{"udp6 remainder", 6, protoUDP, virtioNetHdrGSOUDPL4, 3001, 1000, 0, []int{1000, 1000, 1000, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := newSuperPacket(tt.version, tt.proto, tt.payload, tt.flags)
+			l4 := 20
+			if tt.version == 6 {
+				l4 = 40
+			}
+			l4Len := 8
+			if tt.proto == protoTCP {
+				l4Len = 20
+			}
+			hdrLen := l4 + l4Len
+			hdr := virtioNetHdr{
+				flags:      virtioNetHdrNeedsCsum,
+				gsoType:    tt.gsoType,
+				hdrLen:     uint16(hdrLen),
+				gsoSize:    uint16(tt.gsoSize),
+				csumStart:  uint16(l4),
+				csumOffset: 16,
+			}
+			var segments [][]byte
+			err := gsoSegment(hdr, pkt, func(seg []byte) error {
+				segments = append(segments, append([]byte(nil), seg...))
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("gsoSegment() error: %v", err)
+			}
+			if len(segments) != len(tt.sizes) {
+				t.Fatalf("gsoSegment() = %d segments, want %d", len(segments), len(tt.sizes))
+			}
+			var payload []byte
+			seq := uint32(0xfffff000)
+			for i, seg := range segments {
+				if got := len(seg) - hdrLen; got != tt.sizes[i] {
+					t.Errorf("segment %d payload = %d bytes, want %d", i, got, tt.sizes[i])
+				}
+				payload = append(payload, seg[hdrLen:]...)
+				if tt.version == 4 {
+					if got := int(binary.BigEndian.Uint16(seg[2:])); got != len(seg) {
+						t.Errorf("segment %d IPv4 length = %d, want %d", i, got, len(seg))
+					}
+					if got := binary.BigEndian.Uint16(seg[4:]); got != 0x1000+uint16(i) {
+						t.Errorf("segment %d IPv4 ID = %#x, want %#x", i, got, 0x1000+i)
+					}
+					if foldChecksum(checksum(seg[:20], 0)) != 0xffff {
+						t.Errorf("segment %d IPv4 header checksum invalid", i)
+					}
+				} else if got := int(binary.BigEndian.Uint16(seg[4:])); got != len(seg)-40 {
+					t.Errorf("segment %d IPv6 payload length = %d, want %d", i, got, len(seg)-40)
+				}
+				if !validL4Checksum(seg, tt.proto, l4) {
+					t.Errorf("segment %d checksum invalid", i)
+				}
+				if tt.proto == protoUDP {
+					if got := int(binary.BigEndian.Uint16(seg[l4+4:])); got != len(seg)-l4 {
+						t.Errorf("segment %d UDP length = %d, want %d", i, got, len(seg)-l4)
+					}
+					continue
+				}
+				// The sequence numbers wrap around
+				if got := binary.BigEndian.Uint32(seg[l4+4:]); got != seq {
+					t.Errorf("segment %d sequence = %#x, want %#x", i, got, seq)
+				}
+				seq += uint32(len(seg) - hdrLen)
+				want := tt.flags
+				if i < len(segments)-1 {
+					want &^= tcpFlagFIN | tcpFlagPSH
+				}
+				if i > 0 {
+					want &^= tcpFlagCWR
+				}
+				if got := seg[l4+13]; got != want {
+					t.Errorf("segment %d TCP flags = %#x, want %#x", i, got, want)
+				}
+			}
+			if !bytes.Equal(payload, pkt[hdrLen:]) {
+				t.Errorf("segments payload differs from the super-packet")
+			}
+		})
+	}
+}
+
+func TestGSOSegmentErrors(t *testing.T) {
+	tcp4 := newSuperPacket(4, protoTCP, 3000, tcpFlagACK)
+	tcp6 := newSuperPacket(6, protoTCP, 3000, tcpFlagACK)
+	badTCPLen := append([]byte(nil), tcp4...)
+	badTCPLen[32] = 4 << 4
+	valid := virtioNetHdr{gsoType: virtioNetHdrGSOTCPv4, gsoSize: 1000, csumStart: 20, csumOffset: 16}
+	tests := []struct {
+		name   string
+		hdr    virtioNetHdr
+		packet []byte
+	}{
+		{"empty", valid, nil},
+		{"type mismatch", valid, tcp6},
+		{"unknown type", virtioNetHdr{gsoType: 3, gsoSize: 1000, csumStart: 20}, tcp4},
+		{"transport offset", virtioNetHdr{gsoType: virtioNetHdrGSOTCPv4, gsoSize: 1000, csumStart: 10}, tcp4},
+		{"short", valid, tcp4[:30]},
+		{"tcp header length", valid, badTCPLen},
+		{"zero gso size", virtioNetHdr{gsoType: virtioNetHdrGSOTCPv4, csumStart: 20}, tcp4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := gsoSegment(tt.hdr, tt.packet, func([]byte) error { return nil })
+			if err == nil {
+				t.Errorf("gsoSegment() succeeded")
+			}
+		})
+	}
+	// The errors of emit stop the segmentation
+	errEmit := errors.New("emit")
+	calls := 0
+	err := gsoSegment(valid, tcp4, func([]byte) error {
+		calls++
+		return errEmit
+	})
+	if err != errEmit || calls != 1 {
+		t.Errorf("gsoSegment() = %v after %d calls, want %v after 1", err, calls, errEmit)
+	}
+}
+
+func TestGSOSegmentCoalesce(t *testing.T) {
+	// The segments of a super-packet are coalesced back by the GRO writer
+	for _, version := range []int{4, 6} {
+		pkt := newSuperPacket(version, protoTCP, 5000, tcpFlagACK|tcpFlagPSH)
+		l4 := 20
+		if version == 6 {
+			l4 = 40
+		}
+		var out bytes.Buffer
+		w := &groWriter{q: &out, buf: make([]byte, virtioNetHdrLen, virtioNetHdrLen+maxPacketSize)}
+		hdr := virtioNetHdr{gsoType: virtioNetHdrGSOTCPv4, gsoSize: 1200, csumStart: uint16(l4), csumOffset: 16}
+		if version == 6 {
+			hdr.gsoType = virtioNetHdrGSOTCPv6
+		}
+		if err := gsoSegment(hdr, pkt, w.writePacket); err != nil {
+			t.Fatalf("IPv%d: gsoSegment() error: %v", version, err)
+		}
+		if err := w.flush(); err != nil {
+			t.Fatalf("IPv%d: flush() error: %v", version, err)
+		}
+		got, err := parseVirtioNetHdr(out.Bytes())
+		if err != nil {
+			t.Fatalf("IPv%d: %v", version, err)
+		}
+		if got.gsoType != hdr.gsoType || got.gsoSize != hdr.gsoSize || got.hdrLen != uint16(l4+20) {
+			t.Errorf("IPv%d: coalesced header = %+v", version, got)
+		}
+		coalesced := out.Bytes()[virtioNetHdrLen:]
+		if len(coalesced) != len(pkt) || !bytes.Equal(coalesced[l4+20:], pkt[l4+20:]) {
+			t.Errorf("IPv%d: coalesced packet of %d bytes differs from the super-packet of %d bytes", version, len(coalesced), len(pkt))
+		}
+		if coalesced[l4+13] != tcpFlagACK|tcpFlagPSH {
+			t.Errorf("IPv%d: coalesced TCP flags = %#x, want ACK and PSH", version, coalesced[l4+13])
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// IP protocol numbers
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// EtherTypes of the frames of TAP sessions
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeVLAN = 0x8100
+	etherTypeIPv6 = 0x86dd
+	// etherTypeQinQ tags the outer VLAN of stacked VLANs, some switches
+	// use the pre-standard etherTypeQinQOld
+	etherTypeQinQ    = 0x88a8
+	etherTypeQinQOld = 0x9100
+)
+
+// packetInfo is the summary of an IP packet
+type packetInfo struct {
+	version int
+	proto   uint8
+	src     net.IP
+	dst     net.IP
+	srcPort uint16
+	dstPort uint16
+	length  int
+	// etherType is the type of the payload of an Ethernet frame that is not IP
+	etherType uint16
+}
+
+// parseIPPacket parses the headers of an IPv4 or IPv6 packet
+func parseIPPacket(b []byte) (packetInfo, bool) {
+	var p packetInfo
+	if len(b) < 1 {
+		return p, false
+	}
+	p.length = len(b)
+	p.version = int(b[0] >> 4)
+	var payload []byte
+	switch p.version {
+	case 4:
+		if len(b) < 20 {
+			return p, false
+		}
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < 20 || len(b) < ihl {
+			return p, false
+		}
+		p.proto = b[9]
+		p.src = net.IP(b[12:16])
+		p.dst = net.IP(b[16:20])
+		// Only the first fragment has the transport header
+		if binary.BigEndian.Uint16(b[6:8])&0x1fff != 0 {
+			return p, true
+		}
+		payload = b[ihl:]
+	case 6:
+		if len(b) < 40 {
+			return p, false
+		}
+		p.proto = b[6]
+		p.src = net.IP(b[8:24])
+		p.dst = net.IP(b[24:40])
+		payload = b[40:]
+		// Skip the extension headers
+		for {
+			switch p.proto {
+			case 0, 43, 60:
+				if len(payload) < 8 || len(payload) < (int(payload[1])+1)*8 {
+					return p, true
+				}
+				p.proto = payload[0]
+				payload = payload[(int(payload[1])+1)*8:]
+				continue
+			case 44:
+				if len(payload) < 8 {
+					return p, true
+				}
+				p.proto = payload[0]
+				// Only the first fragment has the transport header
+				if binary.BigEndian.Uint16(payload[2:4])>>3 != 0 {
+					return p, true
+				}
+				payload = payload[8:]
+				continue
+			}
+			break
+		}
+	default:
+		return p, false
+	}
+	if (p.proto == protoTCP || p.proto == protoUDP) && len(payload) >= 4 {
+		p.srcPort = binary.BigEndian.Uint16(payload[0:2])
+		p.dstPort = binary.BigEndian.Uint16(payload[2:4])
+	}
+	return p, true
+}
+
+// parseEthernetFrame parses the IP packet inside an Ethernet frame, the
+// VLAN tags are skipped, stacked or not
+func parseEthernetFrame(b []byte) (packetInfo, bool) {
+	if len(b) < 14 {
+		return packetInfo{}, false
+	}
+	etherType := binary.BigEndian.Uint16(b[12:14])
+	payload := b[14:]
+	for (etherType == etherTypeVLAN || etherType == etherTypeQinQ || etherType == etherTypeQinQOld) && len(payload) >= 4 {
+		etherType = binary.BigEndian.Uint16(payload[2:4])
+		payload = payload[4:]
+	}
+	if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+		return packetInfo{length: len(b), etherType: etherType}, false
+	}
+	p, ok := parseIPPacket(payload)
+	p.length = len(b)
+	return p, ok
+}
+
+// protoName returns the name of the transport protocol
+func (p packetInfo) protoName() string {
+	switch p.proto {
+	case protoICMP:
+		return "icmp"
+	case protoTCP:
+		return "tcp"
+	case protoUDP:
+		return "udp"
+	case protoICMPv6:
+		return "icmp6"
+	}
+	return fmt.Sprintf("proto-%d", p.proto)
+}
+
+// String returns a one line summary of the packet
+func (p packetInfo) String() string {
+	if p.proto == protoTCP || p.proto == protoUDP {
+		return fmt.Sprintf("%s %s -> %s len %d", p.protoName(),
+			net.JoinHostPort(p.src.String(), fmt.Sprint(p.srcPort)),
+			net.JoinHostPort(p.dst.String(), fmt.Sprint(p.dstPort)), p.length)
+	}
+	return fmt.Sprintf("%s %s -> %s len %d", p.protoName(), p.src, p.dst, p.length)
+}
+
+// flowHash returns a hash of the addresses, protocol and ports of the packet,
+// the packets that can't be parsed hash to 0
+func flowHash(packet []byte, tap bool) uint32 {
+	var p packetInfo
+	var ok bool
+	if tap {
+		p, ok = parseEthernetFrame(packet)
+	} else {
+		p, ok = parseIPPacket(packet)
+	}
+	if !ok {
+		return 0
+	}
+	// FNV-1a
+	h := uint32(2166136261)
+	add := func(b ...byte) {
+		for _, c := range b {
+			h ^= uint32(c)
+			h *= 16777619
+		}
+	}
+	add(p.src...)
+	add(p.dst...)
+	add(p.proto, byte(p.srcPort>>8), byte(p.srcPort), byte(p.dstPort>>8), byte(p.dstPort))
+	return h
+}
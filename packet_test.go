@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// newTestFrame returns the Ethernet frame of the IPv4 packet
+func newTestFrame(pkt []byte) []byte {
+	return newEthernetFrame(etherTypeIPv4, pkt)
+}
+
+// newEthernetFrame returns the frame with the payload of the type, tagged
+// with the VLAN tags of the types given from the outer one
+func newEthernetFrame(etherType uint16, payload []byte, tags ...uint16) []byte {
+	frame := make([]byte, 12, 14+4*len(tags)+len(payload))
+	copy(frame[0:6], []byte{0x02, 0, 0, 0, 0, 0x02})
+	copy(frame[6:12], []byte{0x02, 0, 0, 0, 0, 0x01})
+	for i, tag := range tags {
+		// The tag type is followed by the VLAN ID
+		frame = append(frame, byte(tag>>8), byte(tag), 0, byte(10+i))
+	}
+	frame = append(frame, byte(etherType>>8), byte(etherType))
+	return append(frame, payload...)
+}
+
+func TestParseEthernetFrame(t *testing.T) {
+	pkt := newTestPacket(protoTCP, "10.0.0.1", "10.0.0.2", 1000, 80, 100)
+	tests := []struct {
+		name      string
+		frame     []byte
+		ok        bool
+		etherType uint16
+	}{
+		{"untagged", newEthernetFrame(etherTypeIPv4, pkt), true, 0},
+		{"vlan", newEthernetFrame(etherTypeIPv4, pkt, etherTypeVLAN), true, 0},
+		{"qinq", newEthernetFrame(etherTypeIPv4, pkt, etherTypeQinQ, etherTypeVLAN), true, 0},
+		{"double 802.1q", newEthernetFrame(etherTypeIPv4, pkt, etherTypeVLAN, etherTypeVLAN), true, 0},
+		{"pre-standard qinq", newEthernetFrame(etherTypeIPv4, pkt, etherTypeQinQOld, etherTypeVLAN), true, 0},
+		{"arp", newEthernetFrame(etherTypeARP, make([]byte, 28)), false, etherTypeARP},
+		{"tagged arp", newEthernetFrame(etherTypeARP, make([]byte, 28), etherTypeVLAN), false, etherTypeARP},
+		{"lldp", newEthernetFrame(0x88cc, make([]byte, 40)), false, 0x88cc},
+		{"truncated tag", newEthernetFrame(etherTypeVLAN, []byte{0, 10}), false, etherTypeVLAN},
+		{"short", make([]byte, 13), false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, ok := parseEthernetFrame(tt.frame)
+			if ok != tt.ok || info.etherType != tt.etherType {
+				t.Fatalf("parseEthernetFrame() = %v, etherType %#04x, want %v, etherType %#04x", ok, info.etherType, tt.ok, tt.etherType)
+			}
+			if ok && (!info.dst.Equal(net.ParseIP("10.0.0.2")) || info.dstPort != 80) {
+				t.Errorf("parseEthernetFrame() = %v", info)
+			}
+		})
+	}
+}
+
+func TestParseIPv6Fragment(t *testing.T) {
+	// newFragment returns the fragment at the offset, in 8-byte units, of a
+	// TCP packet to port 80
+	newFragment := func(offset uint16) []byte {
+		pkt := newTestPacket6(44, "fd00:1::2", 0)[:40]
+		pkt[5] = 16
+		fragment := []byte{protoTCP, 0, byte(offset >> 5), byte(offset<<3) | 1, 0, 0, 0, 1}
+		return append(append(pkt, fragment...), 0x9c, 0x40, 0, 80, 0, 0, 0, 0)
+	}
+	tests := []struct {
+		name    string
+		pkt     []byte
+		dstPort uint16
+	}{
+		{"first", newFragment(0), 80},
+		{"next", newFragment(185), 0},
+		{"last byte of the offset", newFragment(1), 0},
+	}
+	for _, tt := range tests {
+		info, ok := parseIPPacket(tt.pkt)
+		if !ok || info.proto != protoTCP || info.dstPort != tt.dstPort {
+			t.Errorf("%s: parseIPPacket() = %v, %v, want TCP to port %d", tt.name, info, ok, tt.dstPort)
+		}
+	}
+}
+
+func TestFlowHash(t *testing.T) {
+	pkt := newTestPacket(protoTCP, "10.0.0.1", "10.0.0.2", 1000, 80, 100)
+	h := flowHash(pkt, false)
+	if h == 0 {
+		t.Fatalf("flowHash() of a TCP packet = 0")
+	}
+	// The size and the payload are not part of the flow
+	if got := flowHash(newTestPacket(protoTCP, "10.0.0.1", "10.0.0.2", 1000, 80, 1400), false); got != h {
+		t.Errorf("flowHash() of the same flow = %d, want %d", got, h)
+	}
+	if got := flowHash(newTestFrame(pkt), true); got != h {
+		t.Errorf("flowHash() of the Ethernet frame = %d, want %d", got, h)
+	}
+	others := [][]byte{
+		newTestPacket(protoTCP, "10.0.0.1", "10.0.0.2", 1001, 80, 100),
+		newTestPacket(protoTCP, "10.0.0.3", "10.0.0.2", 1000, 80, 100),
+		newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 1000, 80, 100),
+	}
+	for i, o := range others {
+		if flowHash(o, false) == h {
+			t.Errorf("flowHash() of flow %d equals the first flow", i)
+		}
+	}
+	if got := flowHash([]byte{0x45, 0, 0}, false); got != 0 {
+		t.Errorf("flowHash() of a truncated packet = %d, want 0", got)
+	}
+}
+
+func TestFlowHashSpread(t *testing.T) {
+	const queues = 4
+	var used [queues]int
+	for port := uint16(0); port < 64; port++ {
+		pkt := newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 10000+port, 53, 64)
+		used[flowHash(pkt, false)%queues]++
+	}
+	for q, n := range used {
+		if n == 0 {
+			t.Errorf("No flow steered to queue %d of %d: %v", q, queues, used)
+		}
+	}
+}
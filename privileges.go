@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// PrivilegeConfig represent the unprivileged identity used once the network is configured
+type PrivilegeConfig struct {
+	UID int
+	GID int
+	// CleanupHelper delegates the network teardown to a privileged helper
+	// process and drops all the capabilities, otherwise CAP_NET_ADMIN is kept
+	CleanupHelper bool
+}
+
+// cleanupSpec describes the network configuration the helper has to delete
+type cleanupSpec struct {
+	IfAddress     string `json:"ifAddress"`
+	RemoteNetwork string `json:"remoteNetwork"`
+	RemoteGateway string `json:"remoteGateway"`
+	Dev           string `json:"dev"`
+	// MasqueradeDev is the external interface masqueraded, empty if none
+	MasqueradeDev string `json:"masqueradeDev,omitempty"`
+	// Routes are the static routes added, deleted in reverse order
+	Routes []StaticRoute `json:"routes,omitempty"`
+	// DNS is the DNS configuration applied, if any
+	DNS *DNSConfig `json:"dns,omitempty"`
+}
+
+// cleanupHelper is a privileged process that deletes the network
+// configuration when its standard input is closed
+type cleanupHelper struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// startCleanupHelper starts a copy of the current executable as cleanup helper.
+// The helper does the teardown if tuncat dies without closing it.
+func startCleanupHelper(spec cleanupSpec) (*cleanupHelper, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exe, "cleanup-helper")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Error starting cleanup helper: %v", err)
+	}
+	if err := json.NewEncoder(stdin).Encode(spec); err != nil {
+		stdin.Close()
+		cmd.Wait()
+		return nil, fmt.Errorf("Error configuring cleanup helper: %v", err)
+	}
+	return &cleanupHelper{cmd: cmd, stdin: stdin}, nil
+}
+
+// Close asks the helper to delete the network configuration and waits for it
+func (h *cleanupHelper) Close() error {
+	h.stdin.Close()
+	return h.cmd.Wait()
+}
+
+// runCleanupHelper reads the cleanup specification from r and deletes
+// the network configuration once r is closed
+func runCleanupHelper(r io.Reader) error {
+	// The helper has to survive the signals that stop tuncat
+	signal.Ignore(os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	var spec cleanupSpec
+	if err := json.NewDecoder(r).Decode(&spec); err != nil {
+		return fmt.Errorf("Error reading cleanup specification: %v", err)
+	}
+	// Wait for tuncat to close the pipe or exit
+	io.Copy(ioutil.Discard, r)
+
+	logger.Info("Cleaning up interface network", "interface", spec.Dev)
+	netCfg := newHostNetworkConfigurator(spec.IfAddress, spec.RemoteNetwork, spec.RemoteGateway, spec.Dev)
+	if spec.DNS != nil {
+		if err := netCfg.RevertDNS(*spec.DNS); err != nil {
+			logger.Error("Error restoring DNS configuration", "interface", spec.Dev, "err", err)
+		}
+	}
+	if err := netCfg.DeleteRoutes(); err != nil {
+		logger.Error("Error deleting routes", "interface", spec.Dev, "err", err)
+	}
+	for i := len(spec.Routes) - 1; i >= 0; i-- {
+		if err := netCfg.DeleteRoute(spec.Routes[i]); err != nil {
+			logger.Error("Error deleting routes", "interface", spec.Dev, "err", err)
+		}
+	}
+	if spec.MasqueradeDev != "" {
+		if err := netCfg.DeleteMasquerade(spec.MasqueradeDev); err != nil {
+			logger.Error("Error deleting masquerade rules", "interface", spec.Dev, "err", err)
+		}
+	}
+	return nil
+}
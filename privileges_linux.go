@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	capNetAdmin             = 12
+	linuxCapabilityVersion3 = 0x20080522
+	prGetKeepCaps           = 7
+	prSetKeepCaps           = 8
+	prCapAmbient            = 47
+	prCapAmbientRaise       = 2
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// errCgoPrivileges is returned if the binary links cgo, i.e. for the os/user
+// and net resolvers, the runtime can't change the credentials of the threads
+// started by C code
+var errCgoPrivileges = fmt.Errorf("Dropping privileges requires a binary built with CGO_ENABLED=0 or the netgo,osusergo tags")
+
+// checkDropPrivileges returns an error if the privileges can't be dropped
+func checkDropPrivileges() error {
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prGetKeepCaps, 0, 0); errno == syscall.ENOTSUP {
+		return errCgoPrivileges
+	}
+	return nil
+}
+
+// dropPrivileges switches to the unprivileged user and group keeping only
+// CAP_NET_ADMIN, or no capabilities if the cleanup is delegated to a helper.
+// It returns the helper, if any, that has to be closed to tear down the network.
+func dropPrivileges(cfg PrivilegeConfig, spec cleanupSpec) (*cleanupHelper, error) {
+	// Capabilities are per thread, they have to be changed in all the runtime threads
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetKeepCaps, 1, 0); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return nil, errCgoPrivileges
+		}
+		return nil, fmt.Errorf("Error keeping capabilities: %v", errno)
+	}
+
+	var helper *cleanupHelper
+	if cfg.CleanupHelper {
+		var err error
+		helper, err = startCleanupHelper(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := switchUser(cfg); err != nil {
+		if helper != nil {
+			helper.Close()
+		}
+		return nil, err
+	}
+	return helper, nil
+}
+
+func switchUser(cfg PrivilegeConfig) error {
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("Error dropping supplementary groups: %v", err)
+	}
+	if err := syscall.Setgid(cfg.GID); err != nil {
+		return fmt.Errorf("Error switching to group %d: %v", cfg.GID, err)
+	}
+	if err := syscall.Setuid(cfg.UID); err != nil {
+		return fmt.Errorf("Error switching to user %d: %v", cfg.UID, err)
+	}
+
+	hdr := capHeader{version: linuxCapabilityVersion3}
+	var data [2]capData
+	if !cfg.CleanupHelper {
+		data[0].effective = 1 << capNetAdmin
+		data[0].permitted = 1 << capNetAdmin
+		data[0].inheritable = 1 << capNetAdmin
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("Error setting capabilities: %v", errno)
+	}
+	if cfg.CleanupHelper {
+		return nil
+	}
+	// The ip and iptables commands need to inherit CAP_NET_ADMIN
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientRaise, capNetAdmin); errno != 0 {
+		return fmt.Errorf("Error raising ambient capabilities: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"fmt"
+)
+
+// checkDropPrivileges is only supported on Linux
+func checkDropPrivileges() error {
+	return fmt.Errorf("Dropping privileges is only supported on Linux")
+}
+
+// dropPrivileges is only supported on Linux
+func dropPrivileges(cfg PrivilegeConfig, spec cleanupSpec) (*cleanupHelper, error) {
+	return nil, fmt.Errorf("Dropping privileges is only supported on Linux")
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// punchTimeout is the time the peers try to reach each other over UDP
+	punchTimeout = 3 * time.Second
+	// punchInterval is the interval between the datagrams sent to the peer
+	punchInterval = 100 * time.Millisecond
+	// registerTimeout is the time to wait for the relay to answer the registration
+	registerTimeout = 2 * time.Second
+	// datagramSize is the size the frames are packed in, about the Internet
+	// path MTU without the IP and UDP headers, larger frames are sent alone
+	datagramSize = 1400
+	// maxDatagramSize is the largest UDP payload, larger frames can't be sent
+	maxDatagramSize = 65507
+	// datagramBatchSize is the number of datagrams sent or received in a syscall
+	datagramBatchSize = 16
+	// datagramIdleIntervals is the number of keepalive intervals without
+	// datagrams after which the peer is considered gone
+	datagramIdleIntervals = 3
+	// UDP messages of the relay and the hole punching, the frames never start
+	// with the prefix because the frame types are lower
+	punchMsgPrefix     = "tuncat-"
+	relayRegisterMsg   = "tuncat-register"
+	relayRegisteredMsg = "tuncat-registered"
+	punchMsg           = "tuncat-punch"
+)
+
+// parseRelayRegistration parses "tuncat-register <nonce>", the nonce is the
+// one given by the relay on the TCP connection of the peer
+func parseRelayRegistration(msg string) (string, bool) {
+	fields := strings.Fields(msg)
+	if len(fields) != 2 || fields[0] != relayRegisterMsg || validateRelayToken(fields[1]) != nil {
+		return "", false
+	}
+	return fields[1], true
+}
+
+// registerUDP opens the UDP socket used for the hole punching and registers
+// it in the relay, so the relay learns its public address
+func registerUDP(relay, nonce string) (*net.UDPConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", relay)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	msg := []byte(relayRegisterMsg + " " + nonce)
+	buf := make([]byte, 512)
+	deadline := time.Now().Add(registerTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := udp.WriteToUDP(msg, raddr); err != nil {
+			udp.Close()
+			return nil, err
+		}
+		udp.SetReadDeadline(time.Now().Add(2 * punchInterval))
+		for {
+			n, from, err := udp.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			if from.IP.Equal(raddr.IP) && strings.HasPrefix(string(buf[:n]), relayRegisteredMsg+" ") {
+				udp.SetReadDeadline(time.Time{})
+				return udp, nil
+			}
+		}
+	}
+	udp.Close()
+	return nil, fmt.Errorf("The relay %s didn't answer the UDP registration", relay)
+}
+
+// punchHole sends datagrams to the public address of the peer until both
+// peers receive the datagrams of the other, each datagram tells if the peer
+// was already seen. It returns the address the peer is reached on.
+func punchHole(udp *net.UDPConn, peer, token string) (*net.UDPAddr, bool) {
+	paddr, err := net.ResolveUDPAddr("udp", peer)
+	if err != nil {
+		return nil, false
+	}
+	defer udp.SetReadDeadline(time.Time{})
+	seen, seenByPeer := false, false
+	buf := make([]byte, 512)
+	deadline := time.Now().Add(punchTimeout)
+	for time.Now().Before(deadline) {
+		flag := "0"
+		if seen {
+			flag = "1"
+		}
+		msg := []byte(punchMsg + " " + token + " " + flag)
+		if seen && seenByPeer {
+			// The peer may still wait to know it was seen
+			for i := 0; i < 3; i++ {
+				udp.WriteToUDP(msg, paddr)
+			}
+			return paddr, true
+		}
+		udp.WriteToUDP(msg, paddr)
+		udp.SetReadDeadline(time.Now().Add(punchInterval))
+		for {
+			n, from, err := udp.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			fields := strings.Fields(string(buf[:n]))
+			if len(fields) != 3 || fields[0] != punchMsg || fields[1] != token || !from.IP.Equal(paddr.IP) {
+				continue
+			}
+			// The NAT of the peer may use another port than the one seen by the relay
+			seen, paddr = true, from
+			if fields[2] == "1" {
+				seenByPeer = true
+			}
+		}
+	}
+	return nil, false
+}
+
+// datagramConn carries the frames of the tunnel in UDP datagrams, the frames
+// are packed in the datagrams without splitting them, so a datagram lost
+// loses whole frames and the stream of frames stays in sync. The datagrams
+// are sent and received in batches.
+type datagramConn struct {
+	*net.UDPConn
+	peer    *net.UDPAddr
+	batcher *datagramBatcher
+	// bufs are the datagrams of the last batch received, next is the first
+	// not read yet
+	bufs     [][]byte
+	sizes    []int
+	froms    []net.UDPAddr
+	received int
+	next     int
+	pending  []byte
+	// msgs are the datagrams of the frames written
+	msgs [][]byte
+}
+
+func newDatagramConn(udp *net.UDPConn, peer *net.UDPAddr) (*datagramConn, error) {
+	return newDatagramConnBatch(udp, peer, datagramBatchSize)
+}
+
+// newDatagramConnBatch returns a datagramConn that moves up to batch
+// datagrams in a syscall
+func newDatagramConnBatch(udp *net.UDPConn, peer *net.UDPAddr, batch int) (*datagramConn, error) {
+	batcher, err := newDatagramBatcher(udp, batch)
+	if err != nil {
+		return nil, err
+	}
+	d := &datagramConn{
+		UDPConn: udp,
+		peer:    peer,
+		batcher: batcher,
+		sizes:   make([]int, batch),
+		froms:   make([]net.UDPAddr, batch),
+	}
+	for i := 0; i < batch; i++ {
+		d.bufs = append(d.bufs, make([]byte, maxDatagramSize))
+	}
+	return d, nil
+}
+
+func (d *datagramConn) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		if d.next == d.received {
+			// The keepalives arrive while the peer is up, nothing tells it is gone
+			d.UDPConn.SetReadDeadline(time.Now().Add(datagramIdleIntervals * pingInterval))
+			n, err := d.batcher.read(d.bufs, d.sizes, d.froms)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					return 0, fmt.Errorf("Peer %s unreachable over UDP", d.peer)
+				}
+				return 0, err
+			}
+			d.received, d.next = n, 0
+			continue
+		}
+		buf, from := d.bufs[d.next][:d.sizes[d.next]], d.froms[d.next]
+		d.next++
+		// The punching datagrams can arrive late, and only the address and
+		// port the hole was punched to belong to the peer
+		if from.Port != d.peer.Port || !from.IP.Equal(d.peer.IP) || bytes.HasPrefix(buf, []byte(punchMsgPrefix)) {
+			continue
+		}
+		d.pending = buf
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+// Write sends whole frames, as the tunnel writes them
+func (d *datagramConn) Write(p []byte) (int, error) {
+	d.msgs = d.msgs[:0]
+	rest := p
+	for len(rest) > 0 {
+		n := 0
+		for n+frameHeaderLen <= len(rest) {
+			size := frameHeaderLen + int(binary.BigEndian.Uint16(rest[n+1:n+frameHeaderLen]))
+			if n > 0 && n+size > datagramSize {
+				break
+			}
+			n += size
+		}
+		if n == 0 || n > len(rest) {
+			return 0, fmt.Errorf("Invalid frame written to the datagram connection")
+		}
+		// The super-packets are not negotiated on the direct path
+		if n > maxDatagramSize {
+			return 0, fmt.Errorf("Frame of %d bytes too large for a datagram", n)
+		}
+		d.msgs = append(d.msgs, rest[:n])
+		rest = rest[n:]
+	}
+	if _, err := d.batcher.write(d.msgs, d.peer); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (d *datagramConn) RemoteAddr() net.Addr {
+	return d.peer
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// newDatagramPair returns the datagram connections of two peers on loopback
+func newDatagramPair(t testing.TB, batch int) (*datagramConn, *datagramConn) {
+	t.Helper()
+	a, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	da, err := newDatagramConnBatch(a, b.LocalAddr().(*net.UDPAddr), batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := newDatagramConnBatch(b, a.LocalAddr().(*net.UDPAddr), batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return da, db
+}
+
+func TestDatagramConn(t *testing.T) {
+	for _, batch := range []int{1, datagramBatchSize} {
+		t.Run(fmt.Sprintf("batch=%d", batch), func(t *testing.T) {
+			a, b := newDatagramPair(t, batch)
+			defer a.Close()
+			defer b.Close()
+			// The small frames are packed, the large ones sent alone
+			var stream []byte
+			for i, size := range []int{40, 100, 1300, 1500, 9000, 60, 64} {
+				stream = appendFrame(stream, frameData, newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", uint16(1000+i), 53, size))
+			}
+			if n, err := a.Write(stream); err != nil || n != len(stream) {
+				t.Fatalf("Write() = %d, %v, want %d", n, err, len(stream))
+			}
+			got := make([]byte, 0, len(stream))
+			buf := make([]byte, 512)
+			for len(got) < len(stream) {
+				n, err := b.Read(buf)
+				if err != nil {
+					t.Fatalf("Read() error: %v", err)
+				}
+				got = append(got, buf[:n]...)
+			}
+			if !bytes.Equal(got, stream) {
+				t.Errorf("frames received differ from the frames sent")
+			}
+		})
+	}
+}
+
+func TestDatagramConnFilter(t *testing.T) {
+	a, b := newDatagramPair(t, datagramBatchSize)
+	defer a.Close()
+	defer b.Close()
+	otherPort, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherPort.Close()
+	frame := appendFrame(nil, frameData, []byte{1, 2, 3, 4})
+	// The late punching datagrams and the ones of other hosts or other ports
+	// of the peer host are skipped
+	a.UDPConn.WriteToUDP([]byte(punchMsg+" token 1"), a.peer)
+	otherPort.WriteToUDP(appendFrame(nil, frameData, []byte{9, 10, 11, 12}), a.peer)
+	if other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)}); err == nil {
+		defer other.Close()
+		other.WriteToUDP(appendFrame(nil, frameData, []byte{5, 6, 7, 8}), a.peer)
+	}
+	if _, err := a.Write(frame); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	buf := make([]byte, 512)
+	n, err := b.Read(buf)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if !bytes.Equal(buf[:n], frame) {
+		t.Errorf("Read() = %v, want %v", buf[:n], frame)
+	}
+}
+
+func TestDatagramConnInvalidFrame(t *testing.T) {
+	a, b := newDatagramPair(t, datagramBatchSize)
+	defer a.Close()
+	defer b.Close()
+	frame := appendFrame(nil, frameData, []byte{1, 2, 3, 4})
+	if _, err := a.Write(frame[:len(frame)-1]); err == nil {
+		t.Errorf("Write() of a truncated frame succeeded")
+	}
+	// The frames that don't fit in a datagram are not dropped silently
+	large := appendFrame(nil, frameData, make([]byte, maxDatagramSize))
+	if _, err := a.Write(large); err == nil {
+		t.Errorf("Write() of a frame larger than a datagram succeeded")
+	}
+}
+
+// BenchmarkDatagramConn measures the packets per second sent with one
+// syscall per datagram and with the batches
+func BenchmarkDatagramConn(b *testing.B) {
+	const frames = 64
+	var stream []byte
+	for i := 0; i < frames; i++ {
+		stream = appendFrame(stream, frameData, newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", uint16(1000+i), 53, datagramSize-frameHeaderLen))
+	}
+	for _, batch := range []int{1, datagramBatchSize} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			tx, rx := newDatagramPair(b, batch)
+			defer tx.Close()
+			// The receiver drains the socket, the datagrams dropped don't matter
+			go func() {
+				buf := make([]byte, maxDatagramSize)
+				for {
+					if _, err := rx.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+			defer rx.Close()
+			b.SetBytes(int64(len(stream)))
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				if _, err := tx.Write(stream); err != nil {
+					b.Fatalf("Write() error: %v", err)
+				}
+			}
+			b.ReportMetric(float64(b.N*frames)/time.Since(start).Seconds(), "pps")
+		})
+	}
+}
+
+func TestDatagramConnDualStack(t *testing.T) {
+	// The sockets of the hole punching listen on all the addresses
+	a, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := a.LocalAddr().(*net.UDPAddr).Port
+	da, err := newDatagramConn(a, b.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer da.Close()
+	db, err := newDatagramConn(b, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	buf := make([]byte, 512)
+	for _, tt := range []struct{ from, to *datagramConn }{{da, db}, {db, da}} {
+		frame := appendFrame(nil, frameData, []byte{1, 2, 3, 4})
+		if _, err := tt.from.Write(frame); err != nil {
+			t.Fatalf("Write() error: %v", err)
+		}
+		n, err := tt.to.Read(buf)
+		if err != nil {
+			t.Fatalf("Read() error: %v", err)
+		}
+		if !bytes.Equal(buf[:n], frame) {
+			t.Errorf("Read() = %v, want %v", buf[:n], frame)
+		}
+	}
+}
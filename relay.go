@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// relayRequestTimeout is the time to wait for the request of a peer
+	relayRequestTimeout = 10 * time.Second
+	// relayNonceSize is the number of random bytes of the UDP registrations
+	relayNonceSize = 16
+	// relayMaxWaiting is the number of peers that can wait for their peer,
+	// relayMaxWaitingPerIP of them from the same address
+	relayMaxWaiting      = 1024
+	relayMaxWaitingPerIP = 16
+	// relayMaxToken is the longest session token
+	relayMaxToken = 128
+	// relayBufferSize is the size of the reads forwarded
+	relayBufferSize = 32 * 1024
+	// relay peer roles, the client requests the tunnel and the server exports its networks
+	relayRoleClient = "client"
+	relayRoleServer = "server"
+)
+
+// relayWaitTimeout is the time a peer can wait for its peer, the peers dial
+// the relay again so a token can't be held forever
+var relayWaitTimeout = 10 * time.Minute
+
+// RelayConfig is the relay used to reach a peer that is not publicly reachable,
+// the peers connect outbound to the relay and are paired by the token
+type RelayConfig struct {
+	Address string
+	Token   string
+	// Punch tries to send the frames directly to the peer over UDP, the relay
+	// is used if the hole punching fails
+	Punch bool
+}
+
+// Relay pairs the client and the server that connect with the same token and
+// forwards the bytes between them as they are, the frames are not inspected.
+// The UDP socket on the same port tells the peers their public address for
+// the hole punching.
+type Relay struct {
+	Address string
+	// RateLimit is the bandwidth of each tunnel and direction in bits per
+	// second, 0 is unlimited
+	RateLimit uint64
+	// TotalRateLimit is the bandwidth of the relay shared by all the tunnels
+	// in bits per second, 0 is unlimited
+	TotalRateLimit uint64
+	Log            *Logger
+
+	mu      sync.Mutex
+	ln      net.Listener
+	udp     net.PacketConn
+	total   *relayLimiter
+	waiting map[string]*relayPeer
+	// registering are the peers that register their UDP address, by the
+	// nonce given on their TCP connection
+	registering map[string]*relayPeer
+}
+
+// relayPeer is a peer connected to the relay
+type relayPeer struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	role   string
+	punch  bool
+	// udpAddr is the public UDP address registered for the hole punching
+	udpAddr string
+	// paired is set once the peer leaves the waiting list for a tunnel
+	paired bool
+	// watched is closed when the peer is no longer watched while waiting
+	watched chan struct{}
+}
+
+// Listen serves the peers on the address until Close
+func (r *Relay) Listen() error {
+	ln, err := net.Listen("tcp", r.Address)
+	if err != nil {
+		return fmt.Errorf("Can't Listen on address %s : %v", r.Address, err)
+	}
+	// The same port, the one assigned if there was none
+	udp, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		return fmt.Errorf("Can't Listen on address %s : %v", r.Address, err)
+	}
+	r.mu.Lock()
+	r.ln, r.udp = ln, udp
+	r.total = newRelayLimiter(r.TotalRateLimit)
+	r.waiting = map[string]*relayPeer{}
+	r.registering = map[string]*relayPeer{}
+	r.mu.Unlock()
+	r.Log.Info("Relay listening", "address", r.Address, "rate_limit", formatBitRate(r.RateLimit), "total_rate_limit", formatBitRate(r.TotalRateLimit))
+	go r.serveUDP(udp)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("Can't accept connection on address %s : %v", r.Address, err)
+		}
+		go r.handle(conn)
+	}
+}
+
+// Close stops the relay, the tunnels relayed are closed once their peers disconnect
+func (r *Relay) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ln != nil {
+		r.ln.Close()
+		r.udp.Close()
+	}
+	for token, p := range r.waiting {
+		p.conn.Close()
+		delete(r.waiting, token)
+	}
+}
+
+// serveUDP answers the registrations with the address they come from, only
+// the nonces given to the peers registering are accepted
+func (r *Relay) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		nonce, ok := parseRelayRegistration(string(buf[:n]))
+		if !ok {
+			continue
+		}
+		r.mu.Lock()
+		p, ok := r.registering[nonce]
+		if ok {
+			p.udpAddr = addr.String()
+		}
+		r.mu.Unlock()
+		if ok {
+			conn.WriteTo([]byte(relayRegisteredMsg+" "+addr.String()), addr)
+		}
+	}
+}
+
+// register gives a nonce to the peer that registers its UDP address for the
+// hole punching and waits for the result, the peer can't punch if it fails
+func (r *Relay) register(p *relayPeer) error {
+	b := make([]byte, relayNonceSize)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(b)
+	r.mu.Lock()
+	r.registering[nonce] = p
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.registering, nonce)
+		r.mu.Unlock()
+	}()
+	if _, err := fmt.Fprintf(p.conn, "relay:register %s\n", nonce); err != nil {
+		return err
+	}
+	p.conn.SetReadDeadline(time.Now().Add(relayRequestTimeout))
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	p.conn.SetReadDeadline(time.Time{})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch strings.TrimSpace(line) {
+	case "register:ok":
+		p.punch = p.udpAddr != ""
+	case "register:failed":
+		p.punch = false
+	default:
+		return fmt.Errorf("Invalid registration result %q", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+// handle reads the request of the peer and pairs it or keeps it waiting
+func (r *Relay) handle(conn net.Conn) {
+	log := r.Log.With("peer", conn.RemoteAddr().String())
+	conn.SetReadDeadline(time.Now().Add(relayRequestTimeout))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		log.Warn("Can't read relay request", "err", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	token, role, punch, err := parseRelayRequest(line)
+	if err != nil {
+		log.Warn("Invalid relay request", "err", err)
+		fmt.Fprintf(conn, "relay:error %v\n", err)
+		conn.Close()
+		return
+	}
+	peer := &relayPeer{conn: conn, reader: reader, role: role, watched: make(chan struct{})}
+	if punch {
+		if err := r.register(peer); err != nil {
+			log.Warn("Can't register the UDP address", "err", err)
+			conn.Close()
+			return
+		}
+	}
+	r.mu.Lock()
+	other, ok := r.waiting[token]
+	if ok && other.role == role {
+		r.mu.Unlock()
+		log.Warn("Relay request refused, the role is already waiting", "role", role)
+		fmt.Fprintf(conn, "relay:error a %s is already waiting for the token\n", role)
+		conn.Close()
+		return
+	}
+	if !ok {
+		if err := r.canWait(conn.RemoteAddr()); err != nil {
+			r.mu.Unlock()
+			log.Warn("Relay request refused", "err", err)
+			fmt.Fprintf(conn, "relay:error %v\n", err)
+			conn.Close()
+			return
+		}
+		r.waiting[token] = peer
+		wait := relayWaitTimeout
+		r.mu.Unlock()
+		log.Info("Peer waiting", "role", role)
+		fmt.Fprintf(conn, "relay:waiting\n")
+		go r.watch(token, peer, wait)
+		return
+	}
+	delete(r.waiting, token)
+	other.paired = true
+	r.mu.Unlock()
+	r.pair(other, peer)
+}
+
+// canWait returns an error if the peer at the address can't wait for its peer,
+// the relay has to be locked
+func (r *Relay) canWait(addr net.Addr) error {
+	if len(r.waiting) >= relayMaxWaiting {
+		return fmt.Errorf("too many peers waiting at the relay")
+	}
+	host := relayHost(addr)
+	n := 0
+	for _, p := range r.waiting {
+		if relayHost(p.conn.RemoteAddr()) == host {
+			n++
+		}
+	}
+	if n >= relayMaxWaitingPerIP {
+		return fmt.Errorf("too many peers waiting from %s", host)
+	}
+	return nil
+}
+
+// relayHost returns the IP address of the peer
+func relayHost(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// watch detects the waiting peers that disconnect or wait longer than wait,
+// nothing is sent while waiting
+func (r *Relay) watch(token string, p *relayPeer, wait time.Duration) {
+	defer close(p.watched)
+	p.conn.SetReadDeadline(time.Now().Add(wait))
+	// Peek doesn't consume the bytes, they are forwarded once paired
+	_, err := p.reader.Peek(1)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p.paired {
+		return
+	}
+	if r.waiting[token] == p {
+		delete(r.waiting, token)
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		fmt.Fprintf(p.conn, "relay:error waited more than %s for the peer\n", wait)
+	}
+	p.conn.Close()
+	if err == nil {
+		err = fmt.Errorf("unexpected data while waiting")
+	}
+	r.Log.Info("Peer left", "peer", p.conn.RemoteAddr().String(), "role", p.role, "err", err)
+}
+
+// pair tells the peers their addresses and forwards the bytes between them
+func (r *Relay) pair(waiting, p *relayPeer) {
+	// Stop watching the waiting peer before reading from it
+	waiting.conn.SetReadDeadline(time.Unix(1, 0))
+	<-waiting.watched
+	waiting.conn.SetReadDeadline(time.Time{})
+	// The reader keeps the error of the interrupted read, its bytes are kept
+	buffered, _ := waiting.reader.Peek(waiting.reader.Buffered())
+	waiting.reader = bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), waiting.conn))
+
+	// The UDP addresses are only given if both peers can try the hole punching
+	wAddr, pAddr := "none", "none"
+	if waiting.punch && p.punch {
+		wAddr, pAddr = waiting.udpAddr, p.udpAddr
+	}
+	if _, err := fmt.Fprintf(waiting.conn, "relay:paired %s %s\n", p.conn.RemoteAddr(), pAddr); err != nil {
+		waiting.conn.Close()
+		p.conn.Close()
+		return
+	}
+	if _, err := fmt.Fprintf(p.conn, "relay:paired %s %s\n", waiting.conn.RemoteAddr(), wAddr); err != nil {
+		waiting.conn.Close()
+		p.conn.Close()
+		return
+	}
+	client, server := waiting, p
+	if server.role == relayRoleClient {
+		client, server = server, client
+	}
+	log := r.Log.With("client", client.conn.RemoteAddr().String(), "server", server.conn.RemoteAddr().String())
+	log.Info("Tunnel paired", "punch", wAddr != "none")
+	start := time.Now()
+
+	var tx, rx int64
+	done := make(chan struct{}, 2)
+	go func() {
+		tx = r.copy(server.conn, client.reader, newRelayLimiter(r.RateLimit))
+		done <- struct{}{}
+	}()
+	go func() {
+		rx = r.copy(client.conn, server.reader, newRelayLimiter(r.RateLimit))
+		done <- struct{}{}
+	}()
+	<-done
+	client.conn.Close()
+	server.conn.Close()
+	<-done
+	log.Info("Tunnel closed", "duration", time.Since(start).Round(time.Second), "client_bytes", tx, "server_bytes", rx)
+}
+
+// copy forwards the bytes within the rate limits until a side fails, it
+// returns the number of bytes forwarded
+func (r *Relay) copy(dst io.Writer, src io.Reader, tunnel *relayLimiter) int64 {
+	var total int64
+	buf := make([]byte, relayBufferSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			tunnel.wait(n)
+			r.total.wait(n)
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return total
+			}
+			total += int64(n)
+		}
+		if err != nil {
+			return total
+		}
+	}
+}
+
+// relayLimiter delays the bytes forwarded to the rate, the TCP flow control
+// slows down the peer instead of dropping its packets
+type relayLimiter struct {
+	mu     sync.Mutex
+	bucket *tokenBucket
+}
+
+// newRelayLimiter returns the limiter for the rate in bits per second, nil if unlimited
+func newRelayLimiter(bps uint64) *relayLimiter {
+	bucket := newTokenBucket(bps)
+	if bucket == nil {
+		return nil
+	}
+	return &relayLimiter{bucket: bucket}
+}
+
+// wait blocks until n bytes can be sent
+func (l *relayLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		wait, ok := l.bucket.reserve(n, 0)
+		if ok {
+			time.Sleep(wait)
+			return
+		}
+		time.Sleep(shapingMaxDelay)
+	}
+}
+
+// parseRelayRequest parses "relay:<token> <client|server> <punch|none>"
+func parseRelayRequest(line string) (string, string, bool, error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "relay:") {
+		return "", "", false, fmt.Errorf("Invalid relay request %q", line)
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, "relay:"))
+	if len(fields) != 3 {
+		return "", "", false, fmt.Errorf("Invalid relay request %q", line)
+	}
+	token, role, punch := fields[0], fields[1], fields[2]
+	if err := validateRelayToken(token); err != nil {
+		return "", "", false, err
+	}
+	if role != relayRoleClient && role != relayRoleServer {
+		return "", "", false, fmt.Errorf("Invalid relay role %q", role)
+	}
+	if punch != "punch" && punch != "none" {
+		return "", "", false, fmt.Errorf("Invalid relay punch option %q", punch)
+	}
+	return token, role, punch == "punch", nil
+}
+
+// validateRelayToken checks the session token is a single printable word
+func validateRelayToken(token string) error {
+	if token == "" || len(token) > relayMaxToken {
+		return fmt.Errorf("Invalid relay token, expected 1 to %d characters", relayMaxToken)
+	}
+	for _, c := range token {
+		if c <= ' ' || c > '~' {
+			return fmt.Errorf("Invalid relay token, expected printable ASCII characters without spaces")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestRelay runs a relay on the loopback and returns its address
+func startTestRelay(t *testing.T) (*Relay, string) {
+	t.Helper()
+	r := &Relay{Address: "127.0.0.1:0", Log: logger}
+	go r.Listen()
+	t.Cleanup(r.Close)
+	for i := 0; i < 100; i++ {
+		r.mu.Lock()
+		ln := r.ln
+		r.mu.Unlock()
+		if ln != nil {
+			return r, ln.Addr().String()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("The relay is not listening")
+	return nil, ""
+}
+
+// connectRelayPeers pairs a client and a server at the relay
+func connectRelayPeers(t *testing.T, address string, punch bool) (net.Conn, net.Conn) {
+	t.Helper()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	connectors := map[string]*relayConnector{}
+	for _, role := range []string{relayRoleClient, relayRoleServer} {
+		connectors[role] = newRelayConnector(RelayConfig{Address: address, Token: "test-token", Punch: punch}, role, logger)
+	}
+	for _, role := range []string{relayRoleClient, relayRoleServer} {
+		c := connectors[role]
+		go func() {
+			conn, err := c.Connect()
+			results <- result{conn, err}
+		}()
+		// The client waits for the server
+		time.Sleep(50 * time.Millisecond)
+	}
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				t.Fatalf("Connect() error: %v", r.err)
+			}
+			t.Cleanup(func() { r.conn.Close() })
+			conns = append(conns, r.conn)
+		case <-time.After(10 * time.Second):
+			for _, c := range connectors {
+				c.Close()
+			}
+			t.Fatalf("The peers were not paired")
+		}
+	}
+	return conns[0], conns[1]
+}
+
+// dialRelay sends the request to the relay and returns the connection and its reader
+func dialRelay(t *testing.T, address, request string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "%s\n", request)
+	return conn, bufio.NewReader(conn)
+}
+
+func readRelayLine(t *testing.T, reader *bufio.Reader) string {
+	t.Helper()
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Relay connection error: %v", err)
+	}
+	return strings.TrimSpace(line)
+}
+
+func TestRelayPair(t *testing.T) {
+	_, address := startTestRelay(t)
+	a, b := connectRelayPeers(t, address, false)
+	if directPath(a) || directPath(b) {
+		t.Fatalf("Direct path without hole punching")
+	}
+	msg := []byte("hello through the relay")
+	if _, err := a.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := b.Read(buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Errorf("Read() = %q, %v, want %q", buf, err, msg)
+	}
+}
+
+func TestRelayPunch(t *testing.T) {
+	_, address := startTestRelay(t)
+	a, b := connectRelayPeers(t, address, true)
+	if !directPath(a) || !directPath(b) {
+		t.Fatalf("No direct path with the hole punching on the loopback")
+	}
+	da, db := dataConn(a, nil), dataConn(b, nil)
+	frame := appendFrame(nil, frameData, []byte{1, 2, 3, 4})
+	if _, err := da.Write(frame); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	buf := make([]byte, 512)
+	n, err := db.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], frame) {
+		t.Errorf("Read() = %v, %v, want %v", buf[:n], err, frame)
+	}
+}
+
+func TestRelayRegistration(t *testing.T) {
+	_, address := startTestRelay(t)
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	raddr, _ := net.ResolveUDPAddr("udp", address)
+	register := func(msg string) (string, bool) {
+		udp.WriteToUDP([]byte(msg), raddr)
+		udp.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, 512)
+		n, _, err := udp.ReadFromUDP(buf)
+		if err != nil {
+			return "", false
+		}
+		return string(buf[:n]), true
+	}
+	// Nobody can register an address without the nonce of a peer
+	for _, msg := range []string{relayRegisterMsg + " test-token client", relayRegisterMsg + " 00112233445566778899aabbccddeeff"} {
+		if answer, ok := register(msg); ok {
+			t.Errorf("Registration %q answered %q", msg, answer)
+		}
+	}
+
+	conn, reader := dialRelay(t, address, "relay:test-token client punch")
+	line := readRelayLine(t, reader)
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != "relay:register" {
+		t.Fatalf("Relay answer %q, want a registration nonce", line)
+	}
+	nonce := fields[1]
+	want := relayRegisteredMsg + " " + udp.LocalAddr().String()
+	if answer, ok := register(relayRegisterMsg + " " + nonce); !ok || answer != want {
+		t.Fatalf("Registration answered %q, want %q", answer, want)
+	}
+	fmt.Fprintf(conn, "register:ok\n")
+	if line := readRelayLine(t, reader); line != "relay:waiting" {
+		t.Fatalf("Relay answer %q, want relay:waiting", line)
+	}
+	// The nonce is only valid while the peer registers
+	if answer, ok := register(relayRegisterMsg + " " + nonce); ok {
+		t.Errorf("Registration with a used nonce answered %q", answer)
+	}
+}
+
+func TestRelayWaitingLimit(t *testing.T) {
+	_, address := startTestRelay(t)
+	for i := 0; i < relayMaxWaitingPerIP; i++ {
+		_, reader := dialRelay(t, address, fmt.Sprintf("relay:token-%d client none", i))
+		if line := readRelayLine(t, reader); line != "relay:waiting" {
+			t.Fatalf("Relay answer %q, want relay:waiting", line)
+		}
+	}
+	_, reader := dialRelay(t, address, "relay:one-more client none")
+	if line := readRelayLine(t, reader); !strings.HasPrefix(line, "relay:error too many peers waiting") {
+		t.Errorf("Relay answer %q, want an error", line)
+	}
+	// The peers paired don't wait
+	_, reader = dialRelay(t, address, "relay:token-0 server none")
+	if line := readRelayLine(t, reader); !strings.HasPrefix(line, "relay:paired") {
+		t.Errorf("Relay answer %q, want relay:paired", line)
+	}
+}
+
+func TestRelayWaitTimeout(t *testing.T) {
+	defer func(d time.Duration) { relayWaitTimeout = d }(relayWaitTimeout)
+	relayWaitTimeout = 100 * time.Millisecond
+	r, address := startTestRelay(t)
+	_, reader := dialRelay(t, address, "relay:test-token server none")
+	if line := readRelayLine(t, reader); line != "relay:waiting" {
+		t.Fatalf("Relay answer %q, want relay:waiting", line)
+	}
+	if line := readRelayLine(t, reader); !strings.HasPrefix(line, "relay:error waited more than") {
+		t.Errorf("Relay answer %q, want an error", line)
+	}
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("The relay kept the connection of the expired peer")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.waiting) != 0 {
+		t.Errorf("%d peers waiting, want 0", len(r.waiting))
+	}
+}
+
+func TestParseRelayRequest(t *testing.T) {
+	token, role, punch, err := parseRelayRequest("relay:test-token client punch\n")
+	if err != nil || token != "test-token" || role != relayRoleClient || !punch {
+		t.Errorf("parseRelayRequest() = %q, %q, %v, %v", token, role, punch, err)
+	}
+	for _, line := range []string{
+		"",
+		"test-token client punch",
+		"relay:test-token client",
+		"relay:test-token peer none",
+		"relay:test-token server maybe",
+		"relay:" + strings.Repeat("t", relayMaxToken+1) + " client none",
+	} {
+		if _, _, _, err := parseRelayRequest(line); err == nil {
+			t.Errorf("parseRelayRequest(%q) succeeded", line)
+		}
+	}
+	if nonce, ok := parseRelayRegistration(relayRegisterMsg + " abcd"); !ok || nonce != "abcd" {
+		t.Errorf("parseRelayRegistration() = %q, %v", nonce, ok)
+	}
+	for _, msg := range []string{"", relayRegisterMsg, relayRegisterMsg + " abcd client", punchMsg + " abcd"} {
+		if _, ok := parseRelayRegistration(msg); ok {
+			t.Errorf("parseRelayRegistration(%q) succeeded", msg)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Reasons of the route rejections
+const (
+	rejectInvalid    = "invalid"
+	rejectNotAllowed = "not-allowed"
+	rejectOverlap    = "overlap"
+)
+
+// rejectedKey is the handshake key of the answers to the refused parameters
+const rejectedKey = "rejected"
+
+// RouteRejection is the answer of the server to the routes it refuses to install
+type RouteRejection struct {
+	Parameter string `json:"parameter"`
+	Reason    string `json:"reason"`
+	Message   string `json:"message"`
+}
+
+func (r *RouteRejection) Error() string {
+	return fmt.Sprintf("Route rejected by the server, %s %s: %s", r.Parameter, r.Reason, r.Message)
+}
+
+// message returns the handshake line with the rejection
+func (r *RouteRejection) message() string {
+	b, _ := json.Marshal(r)
+	return fmt.Sprintf("%s:%s\n", rejectedKey, b)
+}
+
+// parseRouteRejection parses the handshake line with the rejection
+func parseRouteRejection(message string) (*RouteRejection, bool) {
+	m := strings.SplitN(strings.TrimSpace(message), ":", 2)
+	if len(m) != 2 || m[0] != rejectedKey {
+		return nil, false
+	}
+	r := &RouteRejection{}
+	if err := json.Unmarshal([]byte(m[1]), r); err != nil {
+		return nil, false
+	}
+	return r, true
+}
+
+// Networks with shorter prefixes are too broad to be routed through the
+// tunnel, like the halves of the address space they replace the default route
+const (
+	minRoutePrefix4 = 8
+	minRoutePrefix6 = 16
+)
+
+// routeTooBroad returns true if the network is too broad to be routed through the tunnel
+func routeTooBroad(n *net.IPNet) bool {
+	ones, bits := n.Mask.Size()
+	if bits == 32 {
+		return ones < minRoutePrefix4
+	}
+	return ones < minRoutePrefix6
+}
+
+// validateRemoteRoute validates the route requested by a client, the network
+// has to be inside one of the allowed networks, nothing is allowed if there
+// are none, and can't overlap the networks connected to the server or the
+// ones used by other sessions. It returns the network with the host bits
+// cleared.
+func validateRemoteRoute(network, gateway string, allowed, connected, inUse []*net.IPNet) (string, *RouteRejection) {
+	if network == "" {
+		if gateway != "" {
+			return "", &RouteRejection{"remoteGateway", rejectInvalid, "a gateway requires a remote network"}
+		}
+		return "", nil
+	}
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return "", &RouteRejection{"remoteNetwork", rejectInvalid, fmt.Sprintf("invalid network %q", network)}
+	}
+	if routeTooBroad(ipNet) {
+		return "", &RouteRejection{"remoteNetwork", rejectNotAllowed, fmt.Sprintf("%s is too broad to be routed through the tunnel", ipNet)}
+	}
+	gw := net.ParseIP(gateway)
+	if gw == nil {
+		return "", &RouteRejection{"remoteGateway", rejectInvalid, fmt.Sprintf("invalid gateway %q", gateway)}
+	}
+	if gw.IsUnspecified() || gw.IsLoopback() || gw.IsMulticast() || (gw.To4() == nil) != (ipNet.IP.To4() == nil) {
+		return "", &RouteRejection{"remoteGateway", rejectInvalid, fmt.Sprintf("gateway %s can't route %s", gateway, ipNet)}
+	}
+	if len(allowed) == 0 {
+		return "", &RouteRejection{"remoteNetwork", rejectNotAllowed, "the server doesn't export any network"}
+	}
+	if !networkAllowed(ipNet, allowed) {
+		return "", &RouteRejection{"remoteNetwork", rejectNotAllowed, fmt.Sprintf("%s is not exported by the server", ipNet)}
+	}
+	for _, n := range connected {
+		if networksOverlap(ipNet, n) {
+			return "", &RouteRejection{"remoteNetwork", rejectOverlap, fmt.Sprintf("%s overlaps the connected network %s", ipNet, n)}
+		}
+	}
+	for _, n := range inUse {
+		if networksOverlap(ipNet, n) {
+			return "", &RouteRejection{"remoteNetwork", rejectOverlap, fmt.Sprintf("%s overlaps %s used by another session", ipNet, n)}
+		}
+	}
+	return ipNet.String(), nil
+}
+
+// validateTunnelAddress validates the tunnel address of a client in full tunnel
+// mode, the server routes it through the tunnel so it can't overlap the
+// networks connected to the server
+func validateTunnelAddress(address string, connected []*net.IPNet) (string, *RouteRejection) {
+	ip := net.ParseIP(address)
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() || ip.IsMulticast() {
+		return "", &RouteRejection{"fullTunnel", rejectInvalid, fmt.Sprintf("invalid tunnel address %q", address)}
+	}
+	host, _ := parseNetwork(ip.String())
+	for _, n := range connected {
+		if networksOverlap(host, n) {
+			return "", &RouteRejection{"fullTunnel", rejectOverlap, fmt.Sprintf("%s overlaps the connected network %s", ip, n)}
+		}
+	}
+	return ip.String(), nil
+}
+
+// networkAllowed returns true if the network is inside one of the allowed networks
+func networkAllowed(n *net.IPNet, allowed []*net.IPNet) bool {
+	ones, bits := n.Mask.Size()
+	for _, a := range allowed {
+		aOnes, aBits := a.Mask.Size()
+		if bits == aBits && aOnes <= ones && a.Contains(n.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// networksOverlap returns true if the networks share addresses
+func networksOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// connectedNetworks returns the networks of the addresses of the host
+// interfaces, the addresses without network are host networks
+func connectedNetworks() ([]*net.IPNet, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var networks []*net.IPNet
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		networks = append(networks, &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask})
+	}
+	return networks, nil
+}
+
+// routesHandshakeValue returns the value of the routes parameter with the
+// networks advertised, none if the server doesn't advertise networks
+func routesHandshakeValue(routes []string, advertise bool) string {
+	if !advertise {
+		return "none"
+	}
+	b, _ := json.Marshal(routes)
+	return string(b)
+}
+
+// parseRoutesHandshake parses the value of the routes parameter
+func parseRoutesHandshake(value string) ([]string, error) {
+	if value == "none" {
+		return nil, nil
+	}
+	var routes []string
+	if err := json.Unmarshal([]byte(value), &routes); err != nil {
+		return nil, fmt.Errorf("Connection error, invalid routes %q", value)
+	}
+	return routes, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func mustNetworks(t *testing.T, networks ...string) []*net.IPNet {
+	t.Helper()
+	var nets []*net.IPNet
+	for _, n := range networks {
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			t.Fatalf("ParseCIDR(%q) error: %v", n, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func TestValidateRemoteRoute(t *testing.T) {
+	tests := []struct {
+		name      string
+		network   string
+		gateway   string
+		allowed   []string
+		connected []string
+		inUse     []string
+		want      string
+		parameter string
+		reason    string
+	}{
+		{name: "no route"},
+		{name: "gateway without network", gateway: "10.0.0.1", parameter: "remoteGateway", reason: rejectInvalid},
+		{name: "allowed", network: "172.17.0.5/16", gateway: "10.0.0.1", allowed: []string{"172.17.0.0/16"}, want: "172.17.0.0/16"},
+		{name: "allowed subnet", network: "172.17.1.0/24", gateway: "10.0.0.1", allowed: []string{"172.17.0.0/16"}, want: "172.17.1.0/24"},
+		{name: "allowed ipv6", network: "fd00:1::/64", gateway: "fd00::1", allowed: []string{"fd00:1::/48"}, want: "fd00:1::/64"},
+		{name: "invalid network", network: "172.17.0.0", gateway: "10.0.0.1", allowed: []string{"172.17.0.0/16"}, parameter: "remoteNetwork", reason: rejectInvalid},
+		{name: "invalid gateway", network: "172.17.0.0/16", gateway: "gw", allowed: []string{"172.17.0.0/16"}, parameter: "remoteGateway", reason: rejectInvalid},
+		{name: "loopback gateway", network: "172.17.0.0/16", gateway: "127.0.0.1", allowed: []string{"172.17.0.0/16"}, parameter: "remoteGateway", reason: rejectInvalid},
+		{name: "gateway family", network: "172.17.0.0/16", gateway: "fd00::1", allowed: []string{"172.17.0.0/16"}, parameter: "remoteGateway", reason: rejectInvalid},
+		{name: "nothing exported", network: "172.17.0.0/16", gateway: "10.0.0.1", parameter: "remoteNetwork", reason: rejectNotAllowed},
+		{name: "not exported", network: "172.18.0.0/16", gateway: "10.0.0.1", allowed: []string{"172.17.0.0/16"}, parameter: "remoteNetwork", reason: rejectNotAllowed},
+		{name: "wider than exported", network: "172.16.0.0/12", gateway: "10.0.0.1", allowed: []string{"172.17.0.0/16"}, parameter: "remoteNetwork", reason: rejectNotAllowed},
+		{name: "default route", network: "0.0.0.0/0", gateway: "10.0.0.1", allowed: []string{"0.0.0.0/0"}, parameter: "remoteNetwork", reason: rejectNotAllowed},
+		{name: "lower half", network: "0.0.0.0/1", gateway: "10.0.0.1", parameter: "remoteNetwork", reason: rejectNotAllowed},
+		{name: "upper half", network: "128.0.0.0/1", gateway: "10.0.0.1", parameter: "remoteNetwork", reason: rejectNotAllowed},
+		{name: "lower half exported", network: "0.0.0.0/1", gateway: "10.0.0.1", allowed: []string{"0.0.0.0/0"}, parameter: "remoteNetwork", reason: rejectNotAllowed},
+		{name: "upper half exported", network: "128.0.0.0/1", gateway: "10.0.0.1", allowed: []string{"0.0.0.0/0"}, parameter: "remoteNetwork", reason: rejectNotAllowed},
+		{name: "too broad ipv6", network: "::/1", gateway: "fd00::1", allowed: []string{"::/0"}, parameter: "remoteNetwork", reason: rejectNotAllowed},
+		{name: "overlaps connected", network: "172.17.0.0/16", gateway: "10.0.0.1", allowed: []string{"172.17.0.0/16"}, connected: []string{"172.17.0.0/24"}, parameter: "remoteNetwork", reason: rejectOverlap},
+		{name: "overlaps session", network: "172.17.1.0/24", gateway: "10.0.0.1", allowed: []string{"172.17.0.0/16"}, inUse: []string{"172.17.0.0/16"}, parameter: "remoteNetwork", reason: rejectOverlap},
+		{name: "other session", network: "172.17.1.0/24", gateway: "10.0.0.1", allowed: []string{"172.17.0.0/16"}, inUse: []string{"172.17.2.0/24"}, want: "172.17.1.0/24"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rejection := validateRemoteRoute(tt.network, tt.gateway, mustNetworks(t, tt.allowed...), mustNetworks(t, tt.connected...), mustNetworks(t, tt.inUse...))
+			if tt.parameter == "" {
+				if rejection != nil {
+					t.Fatalf("validateRemoteRoute() rejection: %v", rejection)
+				}
+				if got != tt.want {
+					t.Errorf("validateRemoteRoute() = %q, want %q", got, tt.want)
+				}
+				return
+			}
+			if rejection == nil {
+				t.Fatalf("validateRemoteRoute() = %q, want a rejection", got)
+			}
+			if rejection.Parameter != tt.parameter || rejection.Reason != tt.reason {
+				t.Errorf("validateRemoteRoute() rejection = %s %s, want %s %s", rejection.Parameter, rejection.Reason, tt.parameter, tt.reason)
+			}
+		})
+	}
+}
+
+func TestRouteTooBroad(t *testing.T) {
+	tests := []struct {
+		network string
+		want    bool
+	}{
+		{"0.0.0.0/0", true},
+		{"0.0.0.0/1", true},
+		{"128.0.0.0/1", true},
+		{"10.0.0.0/7", true},
+		{"10.0.0.0/8", false},
+		{"172.17.0.0/16", false},
+		{"::/0", true},
+		{"8000::/1", true},
+		{"fd00::/15", true},
+		{"fd00::/16", false},
+	}
+	for _, tt := range tests {
+		if got := routeTooBroad(mustNetworks(t, tt.network)[0]); got != tt.want {
+			t.Errorf("routeTooBroad(%s) = %v, want %v", tt.network, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTunnelAddress(t *testing.T) {
+	connected := mustNetworks(t, "192.168.1.0/24")
+	if got, rejection := validateTunnelAddress("10.0.0.2", connected); rejection != nil || got != "10.0.0.2" {
+		t.Errorf("validateTunnelAddress() = %q, %v", got, rejection)
+	}
+	for _, address := range []string{"", "10.0.0", "0.0.0.0", "127.0.0.1", "224.0.0.1", "192.168.1.10"} {
+		if _, rejection := validateTunnelAddress(address, connected); rejection == nil || rejection.Parameter != "fullTunnel" {
+			t.Errorf("validateTunnelAddress(%q) rejection = %v", address, rejection)
+		}
+	}
+}
+
+func TestRouteRejectionMessage(t *testing.T) {
+	r := &RouteRejection{"remoteNetwork", rejectNotAllowed, "the server doesn't export any network"}
+	got, ok := parseRouteRejection(r.message())
+	if !ok {
+		t.Fatalf("parseRouteRejection(%q) failed", r.message())
+	}
+	if !reflect.DeepEqual(got, r) {
+		t.Errorf("parseRouteRejection() = %+v, want %+v", got, r)
+	}
+	for _, message := range []string{"", "routes:", "rejected", "rejected:{"} {
+		if _, ok := parseRouteRejection(message); ok {
+			t.Errorf("parseRouteRejection(%q) succeeded", message)
+		}
+	}
+}
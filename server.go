@@ -3,12 +3,10 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/songgao/water"
 )
 
 const defaultInterface = "eth0"
@@ -16,11 +14,108 @@ const defaultInterface = "eth0"
 // Server represents a server instance.
 type Server struct {
 	conn   net.Conn
-	ifce   *water.Interface
-	netCfg Netconfig
+	ifce   tunDevice
+	reader *bufio.Reader
+	netCfg NetworkConfigurator
+	helper *cleanupHelper
+	// session is the current tunnel session
+	session *Session
+	// newDevice creates the interface of the sessions
+	newDevice func(cfg InterfaceConfig) (tunDevice, error)
+	// tap is set if the client requested a TAP interface
+	tap bool
+	// bench is set if the client requested a benchmark session
+	bench bool
+	// gso is set if the client accepts super-packets
+	gso bool
+	// compression is the codec negotiated with the client
+	compression string
+	connector   Connector
+	// done is closed when the server is shut down
+	done     chan struct{}
+	downOnce sync.Once
+	started  time.Time
+	// mu protects the session state used by the control socket
+	mu sync.Mutex
+	// NewNetworkConfigurator creates the configurator used to modify the host network
+	NewNetworkConfigurator NetworkConfiguratorFunc
+	// HostNetwork answers the queries about the current network of the host
+	HostNetwork HostNetwork
+	// Metrics of the tunnel sessions, the servers running on the same host
+	// can share them to reject the routes requested by the other sessions
+	Metrics *Metrics
+	// Capture of the tunnel packets
+	Capture *PacketCapture
+	// Log is the logger of the server, log adds the context of the current session
+	Log *Logger
+	log *Logger
 	// Config
 	IfAddress     string
+	Interface     InterfaceConfig
 	ListenAddress string
+	// DialAddress, if set, is the address of a client waiting for the server
+	// to connect (reverse tunnel), the server doesn't listen then
+	DialAddress string
+	// Relay, if set, is where the server meets the clients, the server
+	// doesn't listen then
+	Relay *RelayConfig
+	// Bridge is the Linux bridge where TAP interfaces are attached
+	Bridge string
+	// Privileges, if set, is the identity used once the network is configured,
+	// the privileges are not recovered so it requires Once
+	Privileges *PrivilegeConfig
+	// Once stops the server when the first session finishes
+	Once bool
+	// Compression is the codec accepted to compress the frames, none refuses the compression
+	Compression string
+	// RateLimit is the bandwidth allowed to each session, PeerRateLimits
+	// override it for the peers in their networks
+	RateLimit      RateLimit
+	PeerRateLimits []PeerRateLimit
+	// Netns, if set, is the network namespace where the interface is created
+	// and the network configured, i.e. the one of a container, the tunnel
+	// connections are still accepted in the namespace of the server
+	Netns string
+	// ExportNetworks are the networks the clients can request routes to, the
+	// clients can't request routes if it's empty
+	ExportNetworks []*net.IPNet
+	// DNS are the DNS servers and search domains pushed to the clients
+	DNS DNSConfig
+	// DNSForwarder, if set, answers the DNS queries of the clients on the
+	// tunnel address, it keeps listening across the sessions
+	DNSForwarder *DNSForwarder
+	dnsListening bool
+	// Docker, if set, discovers the docker networks advertised to the clients
+	// that accept them, advertise is set if the client accepted them and
+	// unsubscribe stops sending their changes to the session
+	Docker      *DockerDiscovery
+	advertise   bool
+	unsubscribe func()
+	// AllowFullTunnel masquerades all the traffic of the clients that route
+	// everything through the tunnel
+	AllowFullTunnel bool
+	// AllowBench answers the benchmark sessions of the clients, they are
+	// refused by default because any client could load the server with them
+	AllowBench bool
+	// ACLs restrict the destinations the peers in their networks can reach,
+	// LogDenied logs the flows they deny
+	ACLs      []PeerACL
+	LogDenied bool
+	// acceptRoutes skips the validation of the routes requested, it is used by
+	// the server simulated in the client dry-run
+	acceptRoutes bool
+	// fullTunnel is the tunnel address of a client in full tunnel mode, the
+	// server routes it through the interface
+	fullTunnel string
+	// dnsClient is the tunnel address of a client that uses the DNS forwarder,
+	// the server routes its answers through the interface
+	dnsClient string
+	// routesClient is the tunnel address of a client that routes the
+	// advertised networks, the server routes their replies through the interface
+	routesClient string
+	// routes and masquerade are the network configuration of the session
+	routes     []StaticRoute
+	masquerade bool
 	//
 	remoteNetwork string
 	remoteGateway string
@@ -29,24 +124,82 @@ type Server struct {
 // NewServer returns a new instance of Server with default settings.
 func NewServer(listenAddress string) *Server {
 	return &Server{
+		done:          make(chan struct{}),
 		ListenAddress: listenAddress,
 		// Configure one that doesn't overlap
-		IfAddress: "192.168.166.1",
+		IfAddress:              "192.168.166.1",
+		Interface:              NewInterfaceConfig(),
+		NewNetworkConfigurator: newHostNetworkConfigurator,
+		HostNetwork:            hostNetwork{},
+		newDevice:              newTunDevice,
+		Metrics:                NewMetrics(),
+		Capture:                &PacketCapture{},
+		Log:                    logger,
+		Compression:            compressionNone,
+	}
+}
+
+// handshakeError is a handshake failure, reason classifies it in the metrics
+type handshakeError struct {
+	reason string
+	err    error
+}
+
+func (h *handshakeError) Error() string {
+	return h.err.Error()
+}
+
+// handshakeFailureReason returns the reason of the handshake error
+func handshakeFailureReason(err error) string {
+	if h, ok := err.(*handshakeError); ok {
+		return h.reason
 	}
+	return "error"
 }
 
 // Start a new tunnel client
 func (s *Server) Start() error {
-	ln, err := net.Listen("tcp", s.ListenAddress)
-	if err != nil {
-		log.Fatalf("Can't Listen on address %s : %v", s.ListenAddress, err)
+	// The next sessions couldn't configure their network
+	if s.Privileges != nil && !s.Once {
+		return fmt.Errorf("Dropping privileges requires a server that stops after the first session")
+	}
+	s.started = time.Now()
+	var connector Connector
+	if s.Relay != nil {
+		// The server waits for a new client at the relay once the session finishes
+		connector = newRelayConnector(*s.Relay, relayRoleServer, s.Log)
+		s.Log.Info("Connecting to relay", "address", s.Relay.Address, "punch", s.Relay.Punch)
+	} else if s.DialAddress != "" {
+		// The client is dialed again once the session finishes
+		connector = newDialConnector(s.DialAddress, s.Log)
+		s.Log.Info("Connecting to client", "address", s.DialAddress)
+	} else {
+		ln, err := newListenConnector(s.ListenAddress)
+		if err != nil {
+			return err
+		}
+		connector = ln
+		s.Log.Info("Listening", "address", s.ListenAddress)
 	}
+	s.mu.Lock()
+	s.connector = connector
+	s.mu.Unlock()
 
 	for {
-		s.conn, err = ln.Accept()
+		conn, err := connector.Connect()
 		if err != nil {
-			log.Fatalf("Can't accept connection on address %s : %v", s.ListenAddress, err)
+			select {
+			case <-s.done:
+				// Shut down on purpose
+				return nil
+			default:
+			}
+			return err
 		}
+		s.mu.Lock()
+		s.conn = conn
+		s.log = s.Log.With("peer", conn.RemoteAddr().String())
+		s.mu.Unlock()
 		// Establish the connection: receive the tunnel parameters
 		errChan := make(chan error, 1)
 		timeout := 10 * time.Second
@@ -59,124 +212,605 @@ func (s *Server) Start() error {
 		case err := <-errChan:
 			if err != nil {
 				// Closeon error and wait for a new connection
-				log.Printf("Can't establish connection: %v", err)
+				s.log.Warn("Can't establish connection", "err", err)
+				s.Metrics.HandshakeFailed(handshakeFailureReason(err))
 				s.conn.Close()
 				continue
 			}
 		case <-time.After(timeout):
 			// Closeon error and wait for a new connection
-			log.Printf("Can't establish connection: TimeOut")
+			s.log.Warn("Can't establish connection", "err", "timeout")
+			s.Metrics.HandshakeFailed("timeout")
 			s.conn.Close()
 			continue
 		}
+		s.Metrics.HandshakeSucceeded()
+		// The handshake reader may have buffered the first frames
+		s.mu.Lock()
+		s.conn = dataConn(s.conn, s.reader)
+		s.session = s.Metrics.NewSession(s.conn.RemoteAddr().String())
+		s.session.TAP = s.tap
+		s.session.GSO = s.gso
+		s.session.Compression = s.compression
+		s.session.RemoteNetwork = s.remoteNetwork
+		s.session.Limit = rateLimitFor(s.session.Peer, s.RateLimit, s.PeerRateLimits)
+		s.session.ACL = aclFor(s.session.Peer, s.ACLs)
+		s.session.logDenied = s.LogDenied
+		s.session.capture = s.Capture
+		if s.advertise {
+			s.session.routeUpdates, s.unsubscribe = s.Docker.Subscribe()
+		}
+		s.log = s.log.With("session", s.session.ID)
+		s.mu.Unlock()
+		s.log.Info("Session established", "compression", s.compression, "rateLimit", s.session.Limit)
+		if s.session.ACL != nil {
+			s.log.Info("Access control list", "rules", s.session.ACL)
+		}
+
+		// Benchmark sessions are answered from an in-memory device
+		if s.bench {
+			s.log.Info("Running benchmark session")
+			s.session.log = s.log
+			dev := newMemDevice(1)
+			go benchResponder(dev)
+			// The client can't keep the session longer than a benchmark
+			timer := time.AfterFunc(maxBenchSession, func() { s.conn.Close() })
+			TunnelQueues(s.conn, dev.Queues(), s.session)
+			timer.Stop()
+			dev.Close()
+			s.Close()
+			if s.Once {
+				return nil
+			}
+			continue
+		}
 
 		// Create the Host Interface
-		log.Println("Create Host Interface ...")
-		err = s.createInterface()
+		err = inNetns(s.Netns, s.createInterface)
 		if err != nil {
 			return fmt.Errorf("Error creating Host Interface: %v", err)
 		}
 		// Configure the interface network
-		log.Println("Setup Interface Network...")
-		err = s.setupNetwork()
+		err = inNetns(s.Netns, func() error {
+			return s.setupNetwork(s.ifce.Name())
+		})
 		if err != nil {
 			return fmt.Errorf("Error creating Host Interface: %v", err)
 		}
+		s.session.log = s.log
+		// Port 53 requires privileges
+		if s.DNSForwarder != nil && !s.tap && !s.dnsListening {
+			address := net.JoinHostPort(s.IfAddress, "53")
+			err := inNetns(s.Netns, func() error {
+				return s.DNSForwarder.Listen(address)
+			})
+			if err != nil {
+				return err
+			}
+			s.log.Info("DNS forwarder listening", "address", address, "upstream", s.DNSForwarder.Upstream, "zones", strings.Join(s.DNSForwarder.Zones, ","))
+			s.dnsListening = true
+		}
+		// Root is no longer needed, the server stops after the session
+		if s.Privileges != nil {
+			masqueradeDev := ""
+			if s.masquerade {
+				masqueradeDev = defaultInterface
+			}
+			s.log.Info("Dropping privileges", "uid", s.Privileges.UID, "gid", s.Privileges.GID)
+			s.helper, err = dropPrivileges(*s.Privileges, cleanupSpec{
+				IfAddress:     s.IfAddress,
+				RemoteNetwork: s.remoteNetwork,
+				RemoteGateway: s.remoteGateway,
+				Dev:           s.ifce.Name(),
+				MasqueradeDev: masqueradeDev,
+				Routes:        s.routes,
+			})
+			if err != nil {
+				return fmt.Errorf("Error dropping privileges: %v", err)
+			}
+		}
 		// Run the tunnel and block we only accept one connection
-		Tunnel(s.conn, s.ifce)
+		TunnelQueues(s.conn, s.ifce.readWriters(), s.session)
 		s.Close()
+		if s.Once {
+			return nil
+		}
 	}
 }
 
-// Close disconnects the underlying connection to the server.
+// Close disconnects the current session and deletes its network configuration.
 func (s *Server) Close() {
 	dev := defaultInterface
-	log.Println("Shutting down the server...")
-	// Close the connection
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.log == nil {
+		s.log = s.Log
+	}
+	s.log.Info("Shutting down the server")
+	// Close the connection, it is kept for the handshake that may still use it
 	if s.conn != nil {
 		s.conn.Close()
 	}
-	// Delete host interface network configuration
-	if err := s.netCfg.DeleteRoutes(); err != nil {
-		log.Printf("Error deleting routes: %v", err)
+	if s.session != nil {
+		s.Metrics.EndSession(s.session)
+		s.session = nil
 	}
-	// Delete host interface network configuration
-	if err := s.netCfg.DeleteMasquerade(dev); err != nil {
-		log.Printf("Error deleting masquerade rules: %v", err)
+	if s.unsubscribe != nil {
+		s.unsubscribe()
+		s.unsubscribe = nil
+	}
+	if s.helper != nil {
+		if err := s.helper.Close(); err != nil {
+			s.log.Error("Error cleaning up network", "err", err)
+		}
+		s.helper = nil
+		s.netCfg = nil
+	} else if s.netCfg != nil {
+		err := inNetns(s.Netns, func() error {
+			// Delete host interface network configuration
+			if err := s.netCfg.DeleteRoutes(); err != nil {
+				s.log.Error("Error deleting routes", "err", err)
+			}
+			for i := len(s.routes) - 1; i >= 0; i-- {
+				if err := s.netCfg.DeleteRoute(s.routes[i]); err != nil {
+					s.log.Error("Error deleting routes", "err", err)
+				}
+			}
+			// Delete host interface network configuration
+			if s.masquerade {
+				if err := s.netCfg.DeleteMasquerade(dev); err != nil {
+					s.log.Error("Error deleting masquerade rules", "err", err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			s.log.Error("Error cleaning up network", "err", err)
+		}
+		s.netCfg = nil
 	}
+	s.routes = nil
+	s.masquerade = false
 	// Close interface
 	if s.ifce != nil {
 		s.ifce.Close()
+		s.ifce = nil
 	}
+	// Drop the context of the closed session
+	s.log = s.Log
+}
+
+// Status returns the status of the server
+func (s *Server) Status() *Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := &Status{
+		Mode:     "server",
+		Uptime:   time.Since(s.started).Round(time.Second).String(),
+		Capture:  s.Capture.File(),
+		Sessions: []SessionStatus{},
+	}
+	if s.ifce != nil {
+		status.Interface = s.ifce.Name()
+		inNetns(s.Netns, func() error {
+			status.Addresses = interfaceAddresses(s.ifce.Name())
+			return nil
+		})
+		if s.remoteNetwork != "" {
+			status.Routes = []string{fmt.Sprintf("%s via %s", s.remoteNetwork, s.remoteGateway)}
+		}
+		for _, r := range s.routes {
+			status.Routes = append(status.Routes, r.String())
+		}
+	}
+	if s.Docker != nil {
+		status.Advertised = s.Docker.Routes()
+	}
+	if s.session != nil {
+		status.Peer = s.session.Peer
+	}
+	for _, session := range s.Metrics.Sessions() {
+		status.Sessions = append(status.Sessions, sessionStatus(session))
+	}
+	return status
+}
+
+// Down stops accepting connections and tears down the current session
+func (s *Server) Down() error {
+	s.downOnce.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		if s.connector != nil {
+			s.connector.Close()
+		}
+		if s.dnsListening {
+			s.DNSForwarder.Close()
+		}
+		s.mu.Unlock()
+	})
+	s.Close()
+	return nil
+}
+
+// Kick closes the session, the server waits for a new connection
+func (s *Server) Kick(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session == nil || s.session.ID != id {
+		return fmt.Errorf("Session %d not found", id)
+	}
+	s.log.Info("Kicking session")
+	return s.conn.Close()
+}
+
+func (s *Server) packetCapture() *PacketCapture {
+	return s.Capture
 }
 
 // handShake do the tunnel connection negotiation sending the configuration parameters for the serveer
 // messages has to be echoed from the server in order to the connection to be established
 func (s *Server) handShake() error {
-	reader := bufio.NewReader(s.conn)
+	var err error
+	s.reader = bufio.NewReader(s.conn)
 	// Receive the configuration parameters
-	// will listen for message to process ending in newline (\n)
-	message, _ := reader.ReadString('\n')
-	// output message received
-	log.Printf("Message Received: %s", message)
-	// process for string received, we should receive the remoteNetwork parameter
-	m := strings.Split(message, ":")
-	if m[0] != "remoteNetwork" {
-		return fmt.Errorf("Connection error, Received: %s Expected: remoteNetwork", m[0])
-	}
-	s.remoteNetwork = strings.TrimSpace(m[1])
-	// send string back to client for ACK
+	if s.remoteNetwork, err = s.receiveParameter(s.reader, "remoteNetwork"); err != nil {
+		return err
+	}
+	if s.remoteGateway, err = s.receiveParameter(s.reader, "remoteGateway"); err != nil {
+		return err
+	}
+	// The device type is acknowledged once the routes are validated
+	message, deviceType, err := s.readParameter(s.reader, "deviceType")
+	if err != nil {
+		return err
+	}
+	s.tap = false
+	s.bench = false
+	switch deviceType {
+	case "tun":
+		if s.acceptRoutes {
+			break
+		}
+		if err := s.validateRoutes(); err != nil {
+			if r, ok := err.(*RouteRejection); ok {
+				s.conn.Write([]byte(r.message()))
+				return &handshakeError{"rejected", r}
+			}
+			return err
+		}
+	case "bench":
+		if !s.AllowBench {
+			r := &RouteRejection{"deviceType", rejectNotAllowed, "the server doesn't allow benchmark sessions"}
+			s.conn.Write([]byte(r.message()))
+			return &handshakeError{"rejected", r}
+		}
+		// Benchmark sessions don't modify the network
+		s.bench = true
+		s.remoteNetwork = ""
+		s.remoteGateway = ""
+	case "tap":
+		// TAP interfaces are attached to the bridge
+		if s.Bridge == "" {
+			return &handshakeError{"unsupported", fmt.Errorf("Connection error, TAP mode requires a bridge")}
+		}
+		s.tap = true
+		// The remote networks are reached through the bridge
+		s.remoteNetwork = ""
+		s.remoteGateway = ""
+	default:
+		return &handshakeError{"protocol", fmt.Errorf("Connection error, Received: %s Expected: tun or tap", deviceType)}
+	}
 	s.conn.Write([]byte(message))
-	// will listen for message to process ending in newline (\n)
-	message, _ = reader.ReadString('\n')
-	// output message received
-	log.Printf("Message Received: %s", message)
-	// process for string received, , we should receive the remoteGateway parameter
-	m = strings.Split(message, ":")
-	if m[0] != "remoteGateway" {
-		return fmt.Errorf("Connection error, Received: %s Expected: remoteGateway", m[0])
-	}
-	s.remoteGateway = strings.TrimSpace(m[1])
-	// send string back to client for ACK
+	// Each side announces if it wants to receive super-packets, they are never
+	// sent on the direct UDP path
+	offload := "none"
+	if s.Interface.Offload && !s.tap && !s.bench && !directPath(s.conn) {
+		offload = "gso"
+	}
+	clientOffload, err := s.negotiateParameter(s.reader, "offload", offload)
+	if err != nil {
+		return err
+	}
+	s.gso = clientOffload == "gso" && !directPath(s.conn)
+	// The client requests a codec and the server answers the one used
+	_, requested, err := s.readParameter(s.reader, "compression")
+	if err != nil {
+		return err
+	}
+	s.compression = compressionNone
+	if requested != compressionNone && requested == s.Compression {
+		s.compression = requested
+	}
+	s.conn.Write([]byte(fmt.Sprintf("compression:%s\n", s.compression)))
+	// The clients in full tunnel mode send their tunnel address
+	message, s.fullTunnel, err = s.readParameter(s.reader, "fullTunnel")
+	if err != nil {
+		return err
+	}
+	if s.fullTunnel == "none" {
+		s.fullTunnel = ""
+	} else if !s.acceptRoutes {
+		if err := s.validateFullTunnel(); err != nil {
+			if r, ok := err.(*RouteRejection); ok {
+				s.conn.Write([]byte(r.message()))
+				return &handshakeError{"rejected", r}
+			}
+			return err
+		}
+	}
 	s.conn.Write([]byte(message))
+	// The DNS configuration is pushed to the clients that accept it
+	_, acceptDNS, err := s.readParameter(s.reader, "dns")
+	if err != nil {
+		return err
+	}
+	dns := "none"
+	s.dnsClient = ""
+	// The clients send their tunnel address to reach the forwarder
+	if fields := strings.Fields(acceptDNS); len(fields) > 0 && fields[0] == "accept" && !s.bench {
+		pushed := s.pushedDNS()
+		if len(pushed.Tunnel) > 0 && len(fields) > 1 {
+			if err := s.validateDNSClient(fields[1]); err != nil {
+				return err
+			}
+		}
+		dns = pushed.handshakeValue()
+	}
+	s.conn.Write([]byte(fmt.Sprintf("dns:%s\n", dns)))
+	// The networks discovered are advertised to the clients that accept them
+	_, acceptRoutes, err := s.readParameter(s.reader, "routes")
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(acceptRoutes)
+	s.advertise = len(fields) > 0 && fields[0] == "accept" && s.Docker != nil && !s.bench && !s.tap
+	s.routesClient = ""
+	var advertised []string
+	if s.advertise {
+		// The clients send their tunnel address to get the replies back
+		if len(fields) > 1 {
+			if err := s.validateRoutesClient(fields[1]); err != nil {
+				return err
+			}
+		}
+		advertised = s.Docker.Routes()
+	}
+	s.conn.Write([]byte(fmt.Sprintf("routes:%s\n", routesHandshakeValue(advertised, s.advertise))))
+	return nil
+}
+
+// validateRoutes validates the remote network requested by the client, it
+// returns a *RouteRejection if the server refuses to route it
+func (s *Server) validateRoutes() error {
+	connected, err := s.connectedNetworks()
+	if err != nil {
+		return err
+	}
+	// The servers that share the metrics share the routes of the host
+	var inUse []*net.IPNet
+	for _, session := range s.Metrics.Sessions() {
+		if _, network, err := net.ParseCIDR(session.RemoteNetwork); err == nil {
+			inUse = append(inUse, network)
+		}
+	}
+	network, rejection := validateRemoteRoute(s.remoteNetwork, s.remoteGateway, s.ExportNetworks, connected, inUse)
+	if rejection != nil {
+		return rejection
+	}
+	s.remoteNetwork = network
+	return nil
+}
+
+// pushedDNS returns the DNS configuration pushed to the client, the DNS
+// forwarder listens on the tunnel address that the clients have to route
+func (s *Server) pushedDNS() DNSConfig {
+	d := s.DNS
+	d.Tunnel = nil
+	if s.DNSForwarder == nil || s.tap {
+		return d
+	}
+	for _, server := range d.Servers {
+		if server == s.IfAddress {
+			d.Tunnel = []string{server}
+		}
+	}
+	return d
+}
+
+// validateDNSClient validates the tunnel address of a client that uses the DNS
+// forwarder, the answers are routed to it so it can't overlap the networks
+// connected to the server
+func (s *Server) validateDNSClient(address string) error {
+	connected, err := s.connectedNetworks()
+	if err != nil {
+		return err
+	}
+	address, rejection := validateTunnelAddress(address, connected)
+	if rejection != nil {
+		rejection.Parameter = "dns"
+		s.conn.Write([]byte(rejection.message()))
+		return &handshakeError{"rejected", rejection}
+	}
+	s.dnsClient = address
+	return nil
+}
+
+// validateRoutesClient validates the tunnel address of a client that routes
+// the advertised networks, their replies are routed to it so it can't overlap
+// the networks connected to the server
+func (s *Server) validateRoutesClient(address string) error {
+	connected, err := s.connectedNetworks()
+	if err != nil {
+		return err
+	}
+	address, rejection := validateTunnelAddress(address, connected)
+	if rejection != nil {
+		rejection.Parameter = "routes"
+		s.conn.Write([]byte(rejection.message()))
+		return &handshakeError{"rejected", rejection}
+	}
+	s.routesClient = address
 	return nil
 }
 
+// validateFullTunnel validates the tunnel address of a client in full tunnel
+// mode, it returns a *RouteRejection if the server refuses to route it
+func (s *Server) validateFullTunnel() error {
+	if !s.AllowFullTunnel || s.tap || s.bench {
+		return &RouteRejection{"fullTunnel", rejectNotAllowed, "the server doesn't allow full tunnels"}
+	}
+	connected, err := s.connectedNetworks()
+	if err != nil {
+		return err
+	}
+	address, rejection := validateTunnelAddress(s.fullTunnel, connected)
+	if rejection != nil {
+		return rejection
+	}
+	s.fullTunnel = address
+	return nil
+}
+
+// connectedNetworks returns the networks connected to the server and its tunnel address
+func (s *Server) connectedNetworks() ([]*net.IPNet, error) {
+	var connected []*net.IPNet
+	err := inNetns(s.Netns, func() error {
+		var err error
+		connected, err = s.HostNetwork.ConnectedNetworks()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing connected networks: %v", err)
+	}
+	if tunnel, err := parseNetwork(s.IfAddress); err == nil {
+		connected = append(connected, tunnel)
+	}
+	return connected, nil
+}
+
+// receiveParameter waits for the configuration parameter key and acknowledges it
+func (s *Server) receiveParameter(reader *bufio.Reader, key string) (string, error) {
+	message, value, err := s.readParameter(reader, key)
+	if err != nil {
+		return "", err
+	}
+	// send string back to client for ACK
+	s.conn.Write([]byte(message))
+	return value, nil
+}
+
+// negotiateParameter waits for the configuration parameter key and answers it with the value of the server
+func (s *Server) negotiateParameter(reader *bufio.Reader, key, value string) (string, error) {
+	_, clientValue, err := s.readParameter(reader, key)
+	if err != nil {
+		return "", err
+	}
+	s.conn.Write([]byte(fmt.Sprintf("%s:%s\n", key, value)))
+	return clientValue, nil
+}
+
+// readParameter reads the configuration parameter key, it returns the message and the value
+func (s *Server) readParameter(reader *bufio.Reader, key string) (string, string, error) {
+	// will listen for message to process ending in newline (\n)
+	message, _ := reader.ReadString('\n')
+	s.log.Debug("Handshake message received", "message", strings.TrimSpace(message))
+	// process for string received, we should receive the key parameter
+	m := strings.SplitN(message, ":", 2)
+	if m[0] != key || len(m) != 2 {
+		return "", "", &handshakeError{"protocol", fmt.Errorf("Connection error, Received: %s Expected: %s", m[0], key)}
+	}
+	return message, strings.TrimSpace(m[1]), nil
+}
+
 func (s *Server) createInterface() error {
 	// Create TUN interface
-	// TODO: Windows have some network specific parameters
-	// https://github.com/songgao/water/blob/master/params_windows.go
-	var err error
-	s.ifce, err = water.New(water.Config{
-		DeviceType: water.TUN,
-	})
+	cfg := s.Interface
+	cfg.TAP = s.tap
+	cfg.Address = s.IfAddress
+	// TAP interfaces are created without offloads
+	cfg.Offload = cfg.Offload && !s.tap
+	ifce, err := s.newDevice(cfg)
 	if err != nil {
-		return fmt.Errorf("Error creating interface: %v", err)
+		return err
 	}
-	log.Printf("Interface Name: %s\n", s.ifce.Name())
+	s.mu.Lock()
+	s.ifce = ifce
+	s.log = s.log.With("interface", ifce.Name())
+	s.mu.Unlock()
+	s.log.Info("Interface created")
 	return nil
 }
 
-func (s *Server) setupNetwork() error {
+func (s *Server) setupNetwork(ifName string) error {
 	// Create the networking configuration
 	dev := defaultInterface
 	// Set up routes to remote network depending if we are a server or a client
-	s.netCfg = NewNetconfig(s.IfAddress, s.remoteNetwork, s.remoteGateway, s.ifce.Name())
+	ip := s.IfAddress
+	if s.tap {
+		// Bridge ports don't have addresses
+		ip = ""
+	}
+	s.netCfg = s.NewNetworkConfigurator(ip, s.remoteNetwork, s.remoteGateway, ifName)
 	// The network configuration is deleted when the interface is destroyed
 	if err := s.netCfg.SetupNetwork(); err != nil {
 		return fmt.Errorf("Error configuting interface network: %v", err)
 	}
-	log.Printf("Interface Up: %s\n", s.ifce.Name())
+	s.log.Info("Interface up")
+	// TAP interfaces only need to be attached to the bridge
+	if s.tap {
+		s.log.Info("Attach interface to bridge", "bridge", s.Bridge)
+		if err := s.netCfg.SetMaster(s.Bridge); err != nil {
+			return fmt.Errorf("Error attaching interface to bridge: %v", err)
+		}
+		return nil
+	}
 
-	log.Printf("Add route %v\n", s.netCfg.routes)
+	s.log.Info("Add route", "network", s.remoteNetwork, "gateway", s.remoteGateway)
 	if err := s.netCfg.CreateRoutes(); err != nil {
 		return fmt.Errorf("Error creating routes: %v", err)
 	}
+	// The traffic of the client in full tunnel mode goes back through the interface
+	if s.fullTunnel != "" {
+		r := StaticRoute{Network: s.fullTunnel, Dev: ifName}
+		s.log.Info("Add full tunnel route", "network", r.Network, "dev", r.Dev)
+		if err := s.netCfg.AddRoute(r); err != nil {
+			return fmt.Errorf("Error creating routes: %v", err)
+		}
+		s.mu.Lock()
+		s.routes = append(s.routes, r)
+		s.mu.Unlock()
+	}
+	// The answers of the DNS forwarder go back through the interface too
+	if s.dnsClient != "" && s.dnsClient != s.fullTunnel {
+		r := StaticRoute{Network: s.dnsClient, Dev: ifName}
+		s.log.Info("Add DNS client route", "network", r.Network, "dev", r.Dev)
+		if err := s.netCfg.AddRoute(r); err != nil {
+			return fmt.Errorf("Error creating routes: %v", err)
+		}
+		s.mu.Lock()
+		s.routes = append(s.routes, r)
+		s.mu.Unlock()
+	}
+	// The replies of the advertised networks go back through the interface
+	if s.routesClient != "" && s.routesClient != s.fullTunnel && s.routesClient != s.dnsClient {
+		r := StaticRoute{Network: s.routesClient, Dev: ifName}
+		s.log.Info("Add advertised routes client route", "network", r.Network, "dev", r.Dev)
+		if err := s.netCfg.AddRoute(r); err != nil {
+			return fmt.Errorf("Error creating routes: %v", err)
+		}
+		s.mu.Lock()
+		s.routes = append(s.routes, r)
+		s.mu.Unlock()
+	}
+	if s.remoteNetwork == "" && s.fullTunnel == "" {
+		return nil
+	}
 	// Masquerade traffic in server mode and Linux
-	log.Printf("Add Masquerade on interface %s\n", dev)
+	s.log.Info("Add masquerade", "dev", dev)
 	if err := s.netCfg.CreateMasquerade(dev); err != nil {
 		return fmt.Errorf("Error adding masquerade: %v", err)
 
 	}
+	s.masquerade = true
 	return nil
 }
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Keep the test output readable
+	logger, _ = NewLogger(ioutil.Discard, "logfmt", LevelError, 0)
+}
+
+// changeStrings returns the changes in their text form
+func changeStrings(changes []NetworkChange) []string {
+	s := []string{}
+	for _, c := range changes {
+		s = append(s, c.String())
+	}
+	return s
+}
+
+func TestServerSetupNetwork(t *testing.T) {
+	tests := []struct {
+		name          string
+		remoteNetwork string
+		remoteGateway string
+		fullTunnel    string
+		dnsClient     string
+		routesClient  string
+		tap           bool
+		setup         []string
+		teardown      []string
+	}{
+		{
+			name: "no remote network",
+			setup: []string{
+				"link set tun0 up",
+				"address add 192.168.166.1 dev tun0",
+			},
+			teardown: []string{},
+		},
+		{
+			name:          "remote network",
+			remoteNetwork: "172.17.0.0/16",
+			remoteGateway: "172.17.0.1",
+			setup: []string{
+				"link set tun0 up",
+				"address add 192.168.166.1 dev tun0",
+				"route add 172.17.0.0/16 via 172.17.0.1",
+				"nat add POSTROUTING -o eth0 -j MASQUERADE",
+				"route add default via 192.168.166.1 table 10",
+				"rule add from 172.17.0.0/16 table 10 priority 10",
+			},
+			teardown: []string{
+				"route del 172.17.0.0/16 via 172.17.0.1",
+				"nat del POSTROUTING -o eth0 -j MASQUERADE",
+				"route del default via 192.168.166.1 table 10",
+				"rule del from 172.17.0.0/16 table 10 priority 10",
+			},
+		},
+		{
+			name:       "full tunnel",
+			fullTunnel: "192.168.166.2",
+			setup: []string{
+				"link set tun0 up",
+				"address add 192.168.166.1 dev tun0",
+				"route add 192.168.166.2 dev tun0",
+				"nat add POSTROUTING -o eth0 -j MASQUERADE",
+			},
+			teardown: []string{
+				"route del 192.168.166.2 dev tun0",
+				"nat del POSTROUTING -o eth0 -j MASQUERADE",
+			},
+		},
+		{
+			name:      "dns client",
+			dnsClient: "192.168.166.2",
+			setup: []string{
+				"link set tun0 up",
+				"address add 192.168.166.1 dev tun0",
+				"route add 192.168.166.2 dev tun0",
+			},
+			teardown: []string{
+				"route del 192.168.166.2 dev tun0",
+			},
+		},
+		{
+			name:         "advertised routes client",
+			routesClient: "192.168.166.2",
+			setup: []string{
+				"link set tun0 up",
+				"address add 192.168.166.1 dev tun0",
+				"route add 192.168.166.2 dev tun0",
+			},
+			teardown: []string{
+				"route del 192.168.166.2 dev tun0",
+			},
+		},
+		{
+			name:         "dns and advertised routes client",
+			dnsClient:    "192.168.166.2",
+			routesClient: "192.168.166.2",
+			setup: []string{
+				"link set tun0 up",
+				"address add 192.168.166.1 dev tun0",
+				"route add 192.168.166.2 dev tun0",
+			},
+			teardown: []string{
+				"route del 192.168.166.2 dev tun0",
+			},
+		},
+		{
+			name: "tap",
+			tap:  true,
+			setup: []string{
+				"link set tun0 up",
+				"link set tun0 master br0",
+			},
+			teardown: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rec NetworkRecorder
+			s := NewServer("")
+			s.NewNetworkConfigurator = rec.NewNetworkConfigurator
+			s.log = s.Log
+			s.Bridge = "br0"
+			s.remoteNetwork = tt.remoteNetwork
+			s.remoteGateway = tt.remoteGateway
+			s.fullTunnel = tt.fullTunnel
+			s.dnsClient = tt.dnsClient
+			s.routesClient = tt.routesClient
+			s.tap = tt.tap
+			if err := s.setupNetwork("tun0"); err != nil {
+				t.Fatalf("setupNetwork() error: %v", err)
+			}
+			if got := changeStrings(rec.Changes()); !reflect.DeepEqual(got, tt.setup) {
+				t.Errorf("setup changes:\n got %q\nwant %q", got, tt.setup)
+			}
+			rec.Reset()
+			s.Close()
+			if got := changeStrings(rec.Changes()); !reflect.DeepEqual(got, tt.teardown) {
+				t.Errorf("teardown changes:\n got %q\nwant %q", got, tt.teardown)
+			}
+		})
+	}
+}
+
+// testDevice is an in-memory interface for the server sessions
+type testDevice struct {
+	*memDevice
+}
+
+func (d testDevice) Name() string {
+	return "tun0"
+}
+
+func (d testDevice) readWriters() []io.ReadWriter {
+	return d.Queues()
+}
+
+// newTestServer returns a server that dials the clients accepted by ln and
+// records its network changes
+func newTestServer(ln net.Listener, rec *NetworkRecorder) *Server {
+	_, exported, _ := net.ParseCIDR("172.17.0.0/16")
+	s := NewServer("")
+	s.DialAddress = ln.Addr().String()
+	s.ExportNetworks = []*net.IPNet{exported}
+	s.NewNetworkConfigurator = rec.NewNetworkConfigurator
+	s.HostNetwork = FakeHostNetwork{}
+	s.newDevice = func(cfg InterfaceConfig) (tunDevice, error) {
+		return testDevice{newMemDevice(cfg.Queues)}, nil
+	}
+	return s
+}
+
+// runTestSession accepts the server connection, runs the handshake of a
+// client and closes the session
+func runTestSession(t *testing.T, ln net.Listener) {
+	t.Helper()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error: %v", err)
+	}
+	defer conn.Close()
+	c := NewClient("")
+	c.conn = conn
+	c.IfAddress = "192.168.166.2"
+	c.RemoteNetwork = "172.17.0.0/16"
+	c.RemoteGateway = "172.17.0.1"
+	if err := c.handShake(); err != nil {
+		t.Fatalf("handShake() error: %v", err)
+	}
+}
+
+func TestServerSessions(t *testing.T) {
+	defer func(d time.Duration) { dialRetryInterval = d }(dialRetryInterval)
+	// The server is stopped while it waits to dial again
+	dialRetryInterval = 500 * time.Millisecond
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var rec NetworkRecorder
+	s := newTestServer(ln, &rec)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- s.Start()
+	}()
+
+	runTestSession(t, ln)
+	runTestSession(t, ln)
+
+	session := []string{
+		"link set tun0 up",
+		"address add 192.168.166.1 dev tun0",
+		"route add 172.17.0.0/16 via 172.17.0.1",
+		"nat add POSTROUTING -o eth0 -j MASQUERADE",
+		"route add default via 192.168.166.1 table 10",
+		"rule add from 172.17.0.0/16 table 10 priority 10",
+		"route del 172.17.0.0/16 via 172.17.0.1",
+		"nat del POSTROUTING -o eth0 -j MASQUERADE",
+		"route del default via 192.168.166.1 table 10",
+		"rule del from 172.17.0.0/16 table 10 priority 10",
+	}
+	want := append(append([]string{}, session...), session...)
+	// Wait for the teardown of the second session
+	for i := 0; i < 100 && len(rec.Changes()) < len(want); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ln.Close()
+	s.Down()
+	if err := <-errChan; err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if got := changeStrings(rec.Changes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes:\n got %q\nwant %q", got, want)
+	}
+	if got := s.Metrics.handshakes["success"]; got != 2 {
+		t.Errorf("successful handshakes = %d, want 2", got)
+	}
+}
+
+func TestServerOnce(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var rec NetworkRecorder
+	s := newTestServer(ln, &rec)
+	s.Once = true
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- s.Start()
+	}()
+	runTestSession(t, ln)
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Fatalf("Start() error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		s.Down()
+		t.Fatalf("The server didn't stop after the first session")
+	}
+}
+
+func TestServerPrivilegesRequireOnce(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	s.Privileges = &PrivilegeConfig{UID: 65534, GID: 65534}
+	if err := s.Start(); err == nil {
+		s.Down()
+		t.Fatalf("Start() dropping privileges without Once succeeded")
+	}
+}
+
+func TestServerSharedMetricsOverlap(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var rec NetworkRecorder
+	s := newTestServer(ln, &rec)
+	// Another server on the host routes the network for its session
+	other := s.Metrics.NewSession("192.0.2.1:5000")
+	other.RemoteNetwork = "172.17.0.0/16"
+	defer s.Metrics.EndSession(other)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- s.Start()
+	}()
+	defer func() {
+		s.Down()
+		<-errChan
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error: %v", err)
+	}
+	defer conn.Close()
+	c := NewClient("")
+	c.conn = conn
+	c.IfAddress = "192.168.166.2"
+	c.RemoteNetwork = "172.17.1.0/24"
+	c.RemoteGateway = "172.17.0.1"
+	err = c.handShake()
+	if r, ok := err.(*RouteRejection); !ok || r.Parameter != "remoteNetwork" || r.Reason != rejectOverlap {
+		t.Fatalf("handShake() error = %v, want a remoteNetwork overlap rejection", err)
+	}
+}
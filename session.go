@@ -0,0 +1,169 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TunnelStats are the counters of a tunnel, tx is the traffic sent
+// to the remote peer and rx the traffic received from it. They are updated
+// atomically, so they stay the first words of the struct to be 8-byte
+// aligned on 32-bit platforms.
+type TunnelStats struct {
+	TxPackets uint64
+	TxBytes   uint64
+	RxPackets uint64
+	RxBytes   uint64
+	// Dropped are the packets received that the interface didn't accept
+	Dropped uint64
+	// Malformed are the frames received that are not valid
+	Malformed uint64
+	// CompressedPackets are the packets sent compressed, CompressedBytes
+	// their size and CompressedWireBytes their size once compressed
+	CompressedPackets   uint64
+	CompressedBytes     uint64
+	CompressedWireBytes uint64
+	// Shaped are the packets delayed by the rate limit and RateDropped the
+	// ones dropped because they would wait too long
+	TxShaped      uint64
+	RxShaped      uint64
+	TxRateDropped uint64
+	RxRateDropped uint64
+	// Denied are the packets received that the access control list didn't allow
+	Denied uint64
+	// rtt is the last round trip time measured in nanoseconds
+	rtt int64
+}
+
+func (t *TunnelStats) addTxBatch(packets, bytes int) {
+	atomic.AddUint64(&t.TxPackets, uint64(packets))
+	atomic.AddUint64(&t.TxBytes, uint64(bytes))
+}
+
+func (t *TunnelStats) addRx(n int) {
+	atomic.AddUint64(&t.RxPackets, 1)
+	atomic.AddUint64(&t.RxBytes, uint64(n))
+}
+
+func (t *TunnelStats) addDropped() {
+	atomic.AddUint64(&t.Dropped, 1)
+}
+
+func (t *TunnelStats) addMalformed() {
+	atomic.AddUint64(&t.Malformed, 1)
+}
+
+func (t *TunnelStats) addCompressed(bytes, wireBytes int) {
+	atomic.AddUint64(&t.CompressedPackets, 1)
+	atomic.AddUint64(&t.CompressedBytes, uint64(bytes))
+	atomic.AddUint64(&t.CompressedWireBytes, uint64(wireBytes))
+}
+
+// CompressionRatio returns the ratio between the bytes sent and their size
+// on the wire, 1 if nothing was compressed
+func (t TunnelStats) CompressionRatio() float64 {
+	wire := t.TxBytes - t.CompressedBytes + t.CompressedWireBytes
+	if t.CompressedPackets == 0 || wire == 0 {
+		return 1
+	}
+	return float64(t.TxBytes) / float64(wire)
+}
+
+func (t *TunnelStats) addTxShaped() {
+	atomic.AddUint64(&t.TxShaped, 1)
+}
+
+func (t *TunnelStats) addRxShaped() {
+	atomic.AddUint64(&t.RxShaped, 1)
+}
+
+func (t *TunnelStats) addTxRateDropped() {
+	atomic.AddUint64(&t.TxRateDropped, 1)
+}
+
+func (t *TunnelStats) addRxRateDropped() {
+	atomic.AddUint64(&t.RxRateDropped, 1)
+}
+
+func (t *TunnelStats) addDenied() {
+	atomic.AddUint64(&t.Denied, 1)
+}
+
+func (t *TunnelStats) setRTT(d time.Duration) {
+	atomic.StoreInt64(&t.rtt, int64(d))
+}
+
+// RTT returns the last round trip time measured, zero if unknown
+func (t *TunnelStats) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.rtt))
+}
+
+// Snapshot returns a consistent copy of the counters
+func (t *TunnelStats) Snapshot() TunnelStats {
+	return TunnelStats{
+		TxPackets:           atomic.LoadUint64(&t.TxPackets),
+		TxBytes:             atomic.LoadUint64(&t.TxBytes),
+		RxPackets:           atomic.LoadUint64(&t.RxPackets),
+		RxBytes:             atomic.LoadUint64(&t.RxBytes),
+		Dropped:             atomic.LoadUint64(&t.Dropped),
+		Malformed:           atomic.LoadUint64(&t.Malformed),
+		CompressedPackets:   atomic.LoadUint64(&t.CompressedPackets),
+		CompressedBytes:     atomic.LoadUint64(&t.CompressedBytes),
+		CompressedWireBytes: atomic.LoadUint64(&t.CompressedWireBytes),
+		TxShaped:            atomic.LoadUint64(&t.TxShaped),
+		RxShaped:            atomic.LoadUint64(&t.RxShaped),
+		TxRateDropped:       atomic.LoadUint64(&t.TxRateDropped),
+		RxRateDropped:       atomic.LoadUint64(&t.RxRateDropped),
+		Denied:              atomic.LoadUint64(&t.Denied),
+		rtt:                 atomic.LoadInt64(&t.rtt),
+	}
+}
+
+func (t *TunnelStats) add(o TunnelStats) {
+	t.TxPackets += o.TxPackets
+	t.TxBytes += o.TxBytes
+	t.RxPackets += o.RxPackets
+	t.RxBytes += o.RxBytes
+	t.Dropped += o.Dropped
+	t.Malformed += o.Malformed
+	t.CompressedPackets += o.CompressedPackets
+	t.CompressedBytes += o.CompressedBytes
+	t.CompressedWireBytes += o.CompressedWireBytes
+	t.TxShaped += o.TxShaped
+	t.RxShaped += o.RxShaped
+	t.TxRateDropped += o.TxRateDropped
+	t.RxRateDropped += o.RxRateDropped
+	t.Denied += o.Denied
+}
+
+// Session is a tunnel established with a remote peer
+type Session struct {
+	// Stats goes first, the 64-bit atomic counters have to be 8-byte aligned
+	// on 32-bit platforms
+	Stats TunnelStats
+	ID    uint64
+	Peer  string
+	Start time.Time
+	// TAP is set if the session forwards Ethernet frames instead of IP packets
+	TAP bool
+	// RemoteNetwork is the network routed through the session
+	RemoteNetwork string
+	// GSO is set if the peer accepts super-packets with their virtio-net header
+	GSO bool
+	// Compression is the codec negotiated to compress the frames
+	Compression string
+	// Limit is the bandwidth allowed to the session
+	Limit RateLimit
+	// ACL, if set, filters the packets received from the peer
+	ACL *ACL
+	// logDenied logs the flows denied by the access control list
+	logDenied bool
+	// routeUpdates, if set, receives the networks advertised to the peer
+	// and onRoutes, if set, is called with the ones the peer advertises
+	routeUpdates <-chan []string
+	onRoutes     func(routes []string)
+	// capture, if set, receives the packets forwarded by the session
+	capture *PacketCapture
+	// log is the logger with the session context
+	log *Logger
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// shapingMaxDelay is the longest a packet waits for the rate limit, the
+	// packets that would wait longer are dropped to keep the latency bounded
+	shapingMaxDelay = 100 * time.Millisecond
+	// shapingBurst is the time of traffic at the full rate allowed at once
+	shapingBurst = 50 * time.Millisecond
+	// shapingMinBurst allows at least a super-packet at once
+	shapingMinBurst = maxPacketSize
+	// shapingFlowQueues is the number of queues of a shaped direction, the
+	// flows are hashed to them
+	shapingFlowQueues = 64
+	// shapingQueueLen is the number of packets held by each flow queue
+	shapingQueueLen = 64
+	// shapingQuantum is the number of bytes each flow queue sends per round
+	shapingQuantum = 1514
+)
+
+// RateLimit is the bandwidth allowed to a session in bits per second in each
+// direction, tx is the traffic sent to the peer and rx the traffic received
+// from it, 0 is unlimited
+type RateLimit struct {
+	Tx uint64 `json:"tx,omitempty"`
+	Rx uint64 `json:"rx,omitempty"`
+}
+
+// String returns the limits in the format parsed by parseRateLimit
+func (r RateLimit) String() string {
+	return formatBitRate(r.Tx) + "/" + formatBitRate(r.Rx)
+}
+
+// PeerRateLimit is the rate limit of the peers in a network
+type PeerRateLimit struct {
+	Network *net.IPNet
+	Limit   RateLimit
+}
+
+// rateLimitFor returns the limit of the most specific network containing
+// the peer address, def if there is none
+func rateLimitFor(peer string, def RateLimit, peers []PeerRateLimit) RateLimit {
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		host = peer
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return def
+	}
+	limit := def
+	best := -1
+	for _, p := range peers {
+		if ones, _ := p.Network.Mask.Size(); p.Network.Contains(ip) && ones > best {
+			best = ones
+			limit = p.Limit
+		}
+	}
+	return limit
+}
+
+// parseRateLimit parses "tx/rx" or a single rate used for both directions
+func parseRateLimit(s string) (RateLimit, error) {
+	var err error
+	var limit RateLimit
+	parts := strings.SplitN(s, "/", 2)
+	if limit.Tx, err = parseBitRate(parts[0]); err != nil {
+		return limit, err
+	}
+	limit.Rx = limit.Tx
+	if len(parts) == 2 {
+		if limit.Rx, err = parseBitRate(parts[1]); err != nil {
+			return limit, err
+		}
+	}
+	return limit, nil
+}
+
+// parsePeerRateLimit parses "network=tx/rx", a single address is a host network
+func parsePeerRateLimit(s string) (PeerRateLimit, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return PeerRateLimit{}, fmt.Errorf("Invalid peer rate limit %q, expected network=tx/rx", s)
+	}
+	ipnet, err := parseNetwork(parts[0])
+	if err != nil {
+		return PeerRateLimit{}, fmt.Errorf("Invalid peer rate limit network %q", parts[0])
+	}
+	limit, err := parseRateLimit(parts[1])
+	if err != nil {
+		return PeerRateLimit{}, err
+	}
+	return PeerRateLimit{Network: ipnet, Limit: limit}, nil
+}
+
+// parseBitRate parses a rate in bits per second with an optional k, M or G
+// suffix, i.e. 10M is 10 megabits per second
+func parseBitRate(rate string) (uint64, error) {
+	s := strings.TrimSuffix(strings.TrimSpace(rate), "bit")
+	multiplier := uint64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			multiplier = 1000
+		case 'm', 'M':
+			multiplier = 1000 * 1000
+		case 'g', 'G':
+			multiplier = 1000 * 1000 * 1000
+		}
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("Invalid rate %q", rate)
+	}
+	return uint64(v * float64(multiplier)), nil
+}
+
+func formatBitRate(bps uint64) string {
+	switch {
+	case bps == 0:
+		return "0"
+	case bps%(1000*1000*1000) == 0:
+		return fmt.Sprintf("%dG", bps/(1000*1000*1000))
+	case bps%(1000*1000) == 0:
+		return fmt.Sprintf("%dM", bps/(1000*1000))
+	case bps%1000 == 0:
+		return fmt.Sprintf("%dk", bps/1000)
+	}
+	return strconv.FormatUint(bps, 10)
+}
+
+// tokenBucket shapes the traffic of a direction, it is used by a single goroutine
+type tokenBucket struct {
+	// rate in bytes per second
+	rate  float64
+	burst float64
+	// tokens are bytes, negative while the packets sent wait for the rate
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns the bucket for the rate in bits per second, nil if unlimited
+func newTokenBucket(bps uint64) *tokenBucket {
+	if bps == 0 {
+		return nil
+	}
+	rate := float64(bps) / 8
+	burst := rate * shapingBurst.Seconds()
+	if burst < shapingMinBurst {
+		burst = shapingMinBurst
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes the tokens of a packet of n bytes that was queued for some
+// time, it returns the time to wait before sending it or false if it has to
+// be dropped because it would wait more than shapingMaxDelay in total
+func (b *tokenBucket) reserve(n int, queued time.Duration) (time.Duration, bool) {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	if queued+wait > shapingMaxDelay {
+		return 0, false
+	}
+	b.tokens -= float64(n)
+	return wait, true
+}
+
+// flowScheduler holds the packets of a shaped direction in one queue per flow
+// and serves them with deficit round robin, so a bulk flow gets its share of
+// the rate without delaying the packets of the others behind its backlog
+type flowScheduler struct {
+	mu      sync.Mutex
+	queues  [shapingFlowQueues][]*packetBuffer
+	deficit [shapingFlowQueues]int
+	// active are the queues with packets in the order they are served
+	active []int
+	// ready is signaled when a packet is queued
+	ready chan struct{}
+}
+
+func newFlowScheduler() *flowScheduler {
+	return &flowScheduler{ready: make(chan struct{}, 1)}
+}
+
+// enqueue queues the packet of the flow with the hash, it returns false if
+// the queue of the flow is full
+func (s *flowScheduler) enqueue(p *packetBuffer, hash uint32) bool {
+	q := int(hash % shapingFlowQueues)
+	s.mu.Lock()
+	if len(s.queues[q]) >= shapingQueueLen {
+		s.mu.Unlock()
+		return false
+	}
+	if len(s.queues[q]) == 0 {
+		s.active = append(s.active, q)
+		s.deficit[q] = 0
+	}
+	s.queues[q] = append(s.queues[q], p)
+	s.mu.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// dequeue returns the next packet to send, nil if there are none
+func (s *flowScheduler) dequeue() *packetBuffer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.active) > 0 {
+		q := s.active[0]
+		p := s.queues[q][0]
+		n := len(p.packet())
+		if s.deficit[q] < n {
+			// The queue waits for its next round
+			s.deficit[q] += shapingQuantum
+			s.active = append(s.active[1:], q)
+			continue
+		}
+		s.deficit[q] -= n
+		s.queues[q][0] = nil
+		s.queues[q] = s.queues[q][1:]
+		if len(s.queues[q]) == 0 {
+			s.active = s.active[1:]
+		}
+		return p
+	}
+	return nil
+}
+
+// drain releases the packets queued
+func (s *flowScheduler) drain() {
+	for p := s.dequeue(); p != nil; p = s.dequeue() {
+		putPacketBuffer(p)
+	}
+}
+
+// shape sends the packets queued at the rate of the bucket until done or
+// send fails, the packets that would wait more than shapingMaxDelay since
+// they were read are dropped. It runs in its own goroutine, the frames of the
+// control path are never delayed by the rate limit. shaped and dropped count
+// the packets delayed and dropped.
+func (s *flowScheduler) shape(bucket *tokenBucket, send func(*packetBuffer) bool, shaped, dropped func(), done <-chan struct{}) {
+	defer s.drain()
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		p := s.dequeue()
+		if p == nil {
+			select {
+			case <-s.ready:
+				continue
+			case <-done:
+				return
+			}
+		}
+		wait, ok := bucket.reserve(len(p.packet()), time.Since(p.read))
+		if !ok {
+			dropped()
+			putPacketBuffer(p)
+			continue
+		}
+		if wait > 0 {
+			shaped()
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-done:
+				putPacketBuffer(p)
+				return
+			}
+		}
+		if !send(p) {
+			return
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// newShapedPacket returns a buffer with a packet of the flow from port
+func newShapedPacket(port uint16, size int) *packetBuffer {
+	p := getPacketBuffer()
+	p.n = copy(p.buf[:], newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", port, 53, size))
+	p.read = time.Now()
+	return p
+}
+
+func TestFlowScheduler(t *testing.T) {
+	s := newFlowScheduler()
+	bulk := newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 1000, 53, 64)
+	small := newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 2000, 53, 64)
+	if flowHash(bulk, false)%shapingFlowQueues == flowHash(small, false)%shapingFlowQueues {
+		t.Fatalf("The test flows share a queue")
+	}
+	// The backlog of the bulk flow doesn't delay the other flow
+	for i := 0; i < 20; i++ {
+		if !s.enqueue(newShapedPacket(1000, 1400), flowHash(bulk, false)) {
+			t.Fatalf("enqueue() of packet %d failed", i)
+		}
+	}
+	s.enqueue(newShapedPacket(2000, 100), flowHash(small, false))
+	for i := 0; ; i++ {
+		p := s.dequeue()
+		if p == nil {
+			t.Fatalf("The small flow packet was not dequeued")
+		}
+		port := binary.BigEndian.Uint16(p.packet()[20:22])
+		putPacketBuffer(p)
+		if port == 2000 {
+			if i > 1 {
+				t.Errorf("The small flow packet was dequeued after %d bulk packets", i)
+			}
+			break
+		}
+	}
+	s.drain()
+	if p := s.dequeue(); p != nil {
+		t.Errorf("dequeue() after drain() returned a packet")
+	}
+}
+
+func TestFlowSchedulerFairness(t *testing.T) {
+	s := newFlowScheduler()
+	// Flows of large and small packets get the same bytes per round
+	large := newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 1000, 53, 64)
+	small := newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 2000, 53, 64)
+	for i := 0; i < shapingQueueLen; i++ {
+		s.enqueue(newShapedPacket(1000, 1500), flowHash(large, false))
+		s.enqueue(newShapedPacket(2000, 300), flowHash(small, false))
+	}
+	bytes := map[uint16]int{}
+	for i := 0; i < 30; i++ {
+		p := s.dequeue()
+		bytes[binary.BigEndian.Uint16(p.packet()[20:22])] += len(p.packet())
+		putPacketBuffer(p)
+	}
+	s.drain()
+	// 30 packets are about 5 rounds of a large packet and 5 small ones
+	if bytes[2000] < bytes[1000]/2 {
+		t.Errorf("bytes dequeued large flow %d small flow %d, want a fair share", bytes[1000], bytes[2000])
+	}
+}
+
+func TestFlowSchedulerFull(t *testing.T) {
+	s := newFlowScheduler()
+	for i := 0; i < shapingQueueLen; i++ {
+		if !s.enqueue(newShapedPacket(1000, 64), 1) {
+			t.Fatalf("enqueue() of packet %d failed", i)
+		}
+	}
+	p := newShapedPacket(1000, 64)
+	if s.enqueue(p, 1) {
+		t.Errorf("enqueue() in a full queue succeeded")
+	}
+	putPacketBuffer(p)
+	// Other queues have room
+	if !s.enqueue(newShapedPacket(1001, 64), 2) {
+		t.Errorf("enqueue() in another queue failed")
+	}
+	s.drain()
+}
+
+func TestTokenBucket(t *testing.T) {
+	if newTokenBucket(0) != nil {
+		t.Errorf("newTokenBucket(0) is not unlimited")
+	}
+	// 8 Mbps is 1 MB per second with a burst of 64 kB
+	b := newTokenBucket(8 * 1000 * 1000)
+	if wait, ok := b.reserve(int(b.burst), 0); !ok || wait != 0 {
+		t.Errorf("reserve() of the burst = %v, %v, want no wait", wait, ok)
+	}
+	// The packet that empties the bucket is sent, the next one waits
+	b.reserve(1000, 0)
+	wait, ok := b.reserve(1000, 0)
+	if !ok || wait <= 0 {
+		t.Errorf("reserve() after the burst = %v, %v, want a wait", wait, ok)
+	}
+	// The packets that would wait too long are dropped
+	if _, ok := b.reserve(1000, shapingMaxDelay); ok {
+		t.Errorf("reserve() of a packet queued for the maximum delay succeeded")
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want RateLimit
+		err  bool
+	}{
+		{"10M", RateLimit{Tx: 10000000, Rx: 10000000}, false},
+		{"1.5Mbit/500k", RateLimit{Tx: 1500000, Rx: 500000}, false},
+		{"1G/0", RateLimit{Tx: 1000000000}, false},
+		{"fast", RateLimit{}, true},
+		{"-1M", RateLimit{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRateLimit(tt.in)
+		if (err != nil) != tt.err || (!tt.err && got != tt.want) {
+			t.Errorf("parseRateLimit(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+	if got := (RateLimit{Tx: 10000000, Rx: 500000}).String(); got != "10M/500k" {
+		t.Errorf("String() = %q, want 10M/500k", got)
+	}
+}
+
+func TestRateLimitFor(t *testing.T) {
+	_, wide, _ := net.ParseCIDR("10.0.0.0/8")
+	_, narrow, _ := net.ParseCIDR("10.1.0.0/16")
+	def := RateLimit{Tx: 1000}
+	peers := []PeerRateLimit{{wide, RateLimit{Tx: 2000}}, {narrow, RateLimit{Tx: 3000}}}
+	tests := map[string]uint64{
+		"10.1.2.3:4000": 3000,
+		"10.2.0.1:4000": 2000,
+		"192.168.1.1":   1000,
+		"relay":         1000,
+	}
+	for peer, want := range tests {
+		if got := rateLimitFor(peer, def, peers); got.Tx != want {
+			t.Errorf("rateLimitFor(%q) = %d, want %d", peer, got.Tx, want)
+		}
+	}
+}
+
+func TestTunnelShapingPing(t *testing.T) {
+	defer func(d time.Duration) { pingInterval = d }(pingInterval)
+	pingInterval = 20 * time.Millisecond
+	// The server is limited to 1 Mbps in both directions
+	client := &Session{}
+	server := &Session{Limit: RateLimit{Tx: 1000000, Rx: 1000000}}
+	tun := newTestTunnel(client, server, 1)
+	defer tun.Close()
+	// The bulk flow fills the shaped queues
+	for i := 0; i < 2*shapingQueueLen; i++ {
+		tun.client.Inject(newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 1000, 53, 1400))
+		tun.server.Inject(newTestPacket(protoUDP, "10.0.0.2", "10.0.0.1", 53, 1000, 1400))
+	}
+	start := time.Now()
+	// The other flows and the keepalives are not stuck behind it
+	small := newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 2000, 53, 100)
+	tun.client.Inject(small)
+	for {
+		pkt := receive(t, tun.server)
+		if binary.BigEndian.Uint16(pkt[20:22]) == 2000 {
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed > shapingMaxDelay {
+		t.Errorf("The small flow waited %v behind the bulk flow", elapsed)
+	}
+	for server.Stats.RTT() == 0 || client.Stats.RTT() == 0 {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("No RTT measured while shaping, client %v server %v", client.Stats.RTT(), server.Stats.RTT())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rtt := server.Stats.RTT(); rtt > shapingMaxDelay {
+		t.Errorf("server RTT = %v while shaping, the pongs were delayed", rtt)
+	}
+	stats := server.Stats.Snapshot()
+	if stats.RxShaped == 0 && stats.RxRateDropped == 0 {
+		t.Errorf("The received packets were not shaped: %+v", stats)
+	}
+}
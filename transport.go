@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dialRetryInterval is the time to wait to dial the peer again
+var dialRetryInterval = 5 * time.Second
+
+// Connector establishes the connections of the tunnel. The peer that dials is
+// independent of the roles in the handshake, where the client requests the
+// tunnel and the server exports its networks, so a server behind NAT can dial
+// a client that listens (reverse tunnel).
+type Connector interface {
+	// Connect waits for the next connection with the peer
+	Connect() (net.Conn, error)
+	// Close stops waiting, Connect returns an error once closed
+	Close() error
+}
+
+// listenConnector accepts the connections of the peers
+type listenConnector struct {
+	ln net.Listener
+}
+
+// newListenConnector listens on the address
+func newListenConnector(address string) (*listenConnector, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Can't Listen on address %s : %v", address, err)
+	}
+	return &listenConnector{ln: ln}, nil
+}
+
+func (l *listenConnector) Connect() (net.Conn, error) {
+	conn, err := l.ln.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("Can't accept connection on address %s : %v", l.ln.Addr(), err)
+	}
+	return conn, nil
+}
+
+func (l *listenConnector) Close() error {
+	return l.ln.Close()
+}
+
+// dialConnector dials the peer until it answers, the attempts are at least
+// dialRetryInterval apart, so a peer that refuses the tunnel isn't flooded
+type dialConnector struct {
+	address string
+	log     *Logger
+	done    chan struct{}
+	once    sync.Once
+	// last is the time of the last attempt
+	last time.Time
+}
+
+func newDialConnector(address string, log *Logger) *dialConnector {
+	return &dialConnector{
+		address: address,
+		log:     log,
+		done:    make(chan struct{}),
+	}
+}
+
+func (d *dialConnector) Connect() (net.Conn, error) {
+	for {
+		select {
+		case <-d.done:
+			return nil, fmt.Errorf("Can't connect to %s: connector closed", d.address)
+		case <-time.After(time.Until(d.last.Add(dialRetryInterval))):
+		}
+		d.last = time.Now()
+		conn, err := net.DialTimeout("tcp", d.address, dialRetryInterval)
+		if err == nil {
+			return conn, nil
+		}
+		d.log.Warn("Can't connect to peer", "address", d.address, "err", err, "retry", dialRetryInterval)
+	}
+}
+
+func (d *dialConnector) Close() error {
+	d.once.Do(func() { close(d.done) })
+	return nil
+}
+
+// relayConnector meets the peer at a relay, the peers with the same token are
+// paired. With the hole punching the frames are sent directly to the peer if
+// both peers reach each other over UDP.
+type relayConnector struct {
+	relay  RelayConfig
+	role   string
+	dialer *dialConnector
+	log    *Logger
+	mu     sync.Mutex
+	// conn is the connection to the relay, closed to stop waiting for the peer
+	conn net.Conn
+}
+
+func newRelayConnector(relay RelayConfig, role string, log *Logger) *relayConnector {
+	return &relayConnector{
+		relay:  relay,
+		role:   role,
+		dialer: newDialConnector(relay.Address, log),
+		log:    log,
+	}
+}
+
+func (r *relayConnector) Connect() (net.Conn, error) {
+	for {
+		conn, err := r.dialer.Connect()
+		if err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		r.conn = conn
+		r.mu.Unlock()
+		select {
+		case <-r.dialer.done:
+			conn.Close()
+			return nil, fmt.Errorf("Can't connect to %s: connector closed", r.relay.Address)
+		default:
+		}
+		pc, err := r.pair(conn)
+		if err == nil {
+			return pc, nil
+		}
+		conn.Close()
+		select {
+		case <-r.dialer.done:
+			return nil, err
+		default:
+		}
+		r.log.Warn("Can't pair with peer", "relay", r.relay.Address, "err", err, "retry", dialRetryInterval)
+	}
+}
+
+func (r *relayConnector) Close() error {
+	r.dialer.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	return nil
+}
+
+// pair sends the request to the relay and waits for the peer
+func (r *relayConnector) pair(conn net.Conn) (net.Conn, error) {
+	var udp *net.UDPConn
+	closeUDP := func() {
+		if udp != nil {
+			udp.Close()
+		}
+	}
+	punch := "none"
+	if r.relay.Punch {
+		punch = "punch"
+	}
+	if _, err := fmt.Fprintf(conn, "relay:%s %s %s\n", r.relay.Token, r.role, punch); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	var fields []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			closeUDP()
+			return nil, fmt.Errorf("Relay connection error: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "relay:") {
+			closeUDP()
+			return nil, fmt.Errorf("Invalid relay answer %q", line)
+		}
+		fields = strings.Fields(strings.TrimPrefix(line, "relay:"))
+		if len(fields) == 0 {
+			closeUDP()
+			return nil, fmt.Errorf("Invalid relay answer %q", line)
+		}
+		// The UDP address is registered with the nonce given on the connection
+		if fields[0] == "register" && len(fields) == 2 && udp == nil {
+			result := "ok"
+			if udp, err = registerUDP(r.relay.Address, fields[1]); err != nil {
+				r.log.Warn("Hole punching disabled", "err", err)
+				result = "failed"
+			}
+			if _, err := fmt.Fprintf(conn, "register:%s\n", result); err != nil {
+				closeUDP()
+				return nil, err
+			}
+			continue
+		}
+		if fields[0] == "waiting" {
+			r.log.Info("Waiting for the peer at the relay", "relay", r.relay.Address, "role", r.role)
+			continue
+		}
+		if fields[0] == "error" {
+			closeUDP()
+			return nil, fmt.Errorf("Relay error: %s", strings.Join(fields[1:], " "))
+		}
+		if fields[0] != "paired" || len(fields) != 3 {
+			closeUDP()
+			return nil, fmt.Errorf("Invalid relay answer %q", line)
+		}
+		break
+	}
+	peer, err := net.ResolveTCPAddr("tcp", fields[1])
+	if err != nil {
+		closeUDP()
+		return nil, fmt.Errorf("Invalid relay answer, peer address %q", fields[1])
+	}
+	rc := &relayConn{Conn: conn, r: reader, peer: peer}
+	if udp == nil || fields[2] == "none" {
+		closeUDP()
+		r.log.Info("Paired with peer through the relay", "relay", r.relay.Address, "peer", peer.String())
+		return rc, nil
+	}
+	// Both peers try the hole punching and agree on the result
+	direct, ok := punchHole(udp, fields[2], r.relay.Token)
+	result := "failed"
+	if ok {
+		result = "ok"
+	}
+	if _, err := fmt.Fprintf(conn, "punch:%s\n", result); err != nil {
+		udp.Close()
+		return nil, err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		udp.Close()
+		return nil, fmt.Errorf("Relay connection error: %v", err)
+	}
+	if !ok || strings.TrimSpace(line) != "punch:ok" {
+		udp.Close()
+		r.log.Info("Hole punching failed, paired with peer through the relay", "relay", r.relay.Address, "peer", peer.String())
+		return rc, nil
+	}
+	if rc.direct, err = newDatagramConn(udp, direct); err != nil {
+		// The peer agreed on the direct path, the relay can't be used
+		udp.Close()
+		return nil, fmt.Errorf("Can't use the direct UDP path: %v", err)
+	}
+	r.log.Info("Paired with peer directly over UDP", "relay", r.relay.Address, "peer", direct.String())
+	return rc, nil
+}
+
+// directPath returns true if the frames are sent directly to the peer over
+// UDP, the super-packets don't fit in the datagrams
+func directPath(conn net.Conn) bool {
+	rc, ok := conn.(*relayConn)
+	return ok && rc.direct != nil
+}
+
+// relayConn is the connection to the peer through the relay, its address is
+// the one of the peer so the ACLs and the rate limits apply to it. direct, if
+// set, carries the frames once the handshake finishes.
+type relayConn struct {
+	net.Conn
+	r      *bufio.Reader
+	peer   net.Addr
+	direct net.Conn
+}
+
+func (c *relayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *relayConn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+func (c *relayConn) Close() error {
+	if c.direct != nil {
+		c.direct.Close()
+	}
+	return c.Conn.Close()
+}
+
+// dataConn returns the connection the frames are sent through once the
+// handshake finishes, the handshake reader may have buffered the first frames
+func dataConn(conn net.Conn, r *bufio.Reader) net.Conn {
+	if rc, ok := conn.(*relayConn); ok && rc.direct != nil {
+		// Nothing else is sent through the relay
+		rc.Conn.Close()
+		return rc.direct
+	}
+	return bufferedConn{Conn: conn, r: r}
+}
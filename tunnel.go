@@ -1,37 +1,538 @@
 package main
 
 import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
+)
+
+// Every packet is sent through the connection in a frame with a 3 bytes header:
+// the frame type followed by the payload length in network byte order
+const (
+	frameData = 0
+	framePing = 1
+	framePong = 2
+	// frameGSO carries a super-packet preceded by its virtio-net header,
+	// it is only sent to peers that negotiated it
+	frameGSO = 3
+	// frameCompressed carries the type and the compressed payload of a data
+	// or GSO frame, it is only sent to peers that negotiated the compression
+	frameCompressed = 4
+	// frameRoutes carries the networks the server advertises, encoded in
+	// JSON, it is only sent to peers that accepted the routes
+	frameRoutes = 5
+
+	frameHeaderLen = 3
+	maxPacketSize  = 65535
+)
+
+// pingInterval is the interval between the keepalives used to measure the RTT
+var pingInterval = 10 * time.Second
 
-	"github.com/songgao/water"
+// The packets read from the interface are sent in batches of frames with a
+// single write, a batch takes the packets already read and never waits for
+// more, so batching doesn't add latency beyond the write of one batch.
+const (
+	maxBatchSize = 64 * 1024
+	// packetQueueLen is the number of packets read waiting to be sent
+	packetQueueLen = 128
+	// readBufferSize is the size of the connection read buffer
+	readBufferSize = 256 * 1024
 )
 
-// Tunnel copies the data from the conn to the interface
-// and viceversa
-func Tunnel(conn net.Conn, ifce *water.Interface) error {
-	errCh := make(chan error, 2)
-	// Copy from the Tun interface to the connection
+// packetBuffer is a buffer of the data path, it is recycled through packetPool.
+// It has room for the virtio-net header of the interfaces with offloads.
+type packetBuffer struct {
+	buf [virtioNetHdrLen + maxPacketSize]byte
+	off int
+	n   int
+	// gso is set if the buffer holds a virtio-net header and a super-packet
+	gso bool
+	// read is the time the packet was read, only set if the session is shaped
+	read time.Time
+}
+
+// bytes returns the payload of the frame
+func (p *packetBuffer) bytes() []byte {
+	return p.buf[p.off:p.n]
+}
+
+// packet returns the packet without the virtio-net header
+func (p *packetBuffer) packet() []byte {
+	if p.gso {
+		return p.buf[p.off+virtioNetHdrLen : p.n]
+	}
+	return p.bytes()
+}
+
+func (p *packetBuffer) frameType() byte {
+	if p.gso {
+		return frameGSO
+	}
+	return frameData
+}
+
+var packetPool = sync.Pool{
+	New: func() interface{} { return new(packetBuffer) },
+}
+
+func getPacketBuffer() *packetBuffer {
+	return packetPool.Get().(*packetBuffer)
+}
+
+func putPacketBuffer(p *packetBuffer) {
+	p.off = 0
+	p.n = 0
+	p.gso = false
+	p.read = time.Time{}
+	packetPool.Put(p)
+}
+
+// frameWriter serializes the frames written to the connection
+type frameWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+func newFrameWriter(w io.Writer) *frameWriter {
+	return &frameWriter{
+		w:   w,
+		buf: make([]byte, frameHeaderLen+maxPacketSize),
+	}
+}
+
+// WriteFrame writes the payload in a single frame
+func (f *frameWriter) WriteFrame(frameType byte, payload []byte) error {
+	if len(payload) > maxPacketSize {
+		return fmt.Errorf("Packet too big: %d bytes", len(payload))
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.w.Write(appendFrame(f.buf[:0], frameType, payload))
+	return err
+}
+
+// WriteBatch writes frames already encoded with appendFrame
+func (f *frameWriter) WriteBatch(batch []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.w.Write(batch)
+	return err
+}
+
+// appendFrame appends the frame with the payload to b
+func appendFrame(b []byte, frameType byte, payload []byte) []byte {
+	b = append(b, frameType, byte(len(payload)>>8), byte(len(payload)))
+	return append(b, payload...)
+}
+
+// readFrame reads a frame into buf and returns its type and payload
+func readFrame(r *bufio.Reader, buf []byte) (byte, []byte, error) {
+	// The header is read in buf too to avoid allocating it
+	if _, err := io.ReadFull(r, buf[:frameHeaderLen]); err != nil {
+		return 0, nil, err
+	}
+	frameType := buf[0]
+	n := int(binary.BigEndian.Uint16(buf[1:frameHeaderLen]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, nil, err
+	}
+	return frameType, buf[:n], nil
+}
+
+// bufferedConn is a connection whose first bytes were already read in a buffer
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// Tunnel copies the packets from the conn to the interface
+// and viceversa, until one of them fails
+func Tunnel(conn net.Conn, ifce io.ReadWriter, session *Session) error {
+	return TunnelQueues(conn, []io.ReadWriter{ifce}, session)
+}
+
+// workerQueueLen is the number of packets queued for each interface queue
+const workerQueueLen = 256
+
+// TunnelQueues is Tunnel for multi-queue interfaces. Each queue is read by its
+// own goroutine, the packets received are written by one worker per queue and
+// steered by flow hash, so the packets of the same flow keep their order.
+func TunnelQueues(conn net.Conn, queues []io.ReadWriter, session *Session) error {
+	stats := &session.Stats
+	fw := newFrameWriter(conn)
+	// The queue readers, the batch writer, the frame reader, the keepalives
+	// and the route updates send their error, it is never waited for twice
+	senders := len(queues) + 3
+	if session.routeUpdates != nil {
+		senders++
+	}
+	errCh := make(chan error, senders)
+	done := make(chan struct{})
+	defer close(done)
+
+	// The routes advertised by the peer are applied out of the data path,
+	// only the last ones are kept while the previous ones are applied
+	var peerRoutes chan []string
+	if session.onRoutes != nil {
+		peerRoutes = make(chan []string, 1)
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case routes := <-peerRoutes:
+					session.onRoutes(routes)
+				}
+			}
+		}()
+	}
+
+	// Read from the Tun interface queues
+	packets := make(chan *packetBuffer, packetQueueLen)
+	toBatch := func(p *packetBuffer) bool {
+		select {
+		case packets <- p:
+			return true
+		case <-done:
+			putPacketBuffer(p)
+			return false
+		}
+	}
+	// The shaped packets wait in the flow queues, not in the batches
+	var txQueues *flowScheduler
+	if bucket := newTokenBucket(session.Limit.Tx); bucket != nil {
+		txQueues = newFlowScheduler()
+		go txQueues.shape(bucket, toBatch, stats.addTxShaped, stats.addTxRateDropped, done)
+	}
+	send := func(p *packetBuffer) bool {
+		session.capture.Write(session, true, p.packet())
+		session.log.Packet(true, session.TAP, p.packet())
+		if txQueues == nil {
+			return toBatch(p)
+		}
+		p.read = time.Now()
+		if !txQueues.enqueue(p, flowHash(p.packet(), session.TAP)) {
+			stats.addTxRateDropped()
+			putPacketBuffer(p)
+		}
+		return true
+	}
+	for _, q := range queues {
+		go func(q io.ReadWriter) {
+			_, vnet := q.(*vnetQueue)
+			for {
+				p := getPacketBuffer()
+				n, err := q.Read(p.buf[:])
+				if err != nil {
+					putPacketBuffer(p)
+					errCh <- err
+					return
+				}
+				p.n = n
+				if vnet {
+					if !sendOffload(p, session, send) {
+						return
+					}
+					continue
+				}
+				if !send(p) {
+					return
+				}
+			}
+		}(q)
+	}
+
+	// Send the packets read to the connection in batches
 	go func() {
+		batch := make([]byte, 0, maxBatchSize+frameHeaderLen+maxPacketSize)
+		var compressor *frameCompressor
+		if session.Compression == compressionDeflate {
+			compressor = newFrameCompressor()
+		}
+		// appendPacket appends the frame of the packet, compressed if it shrinks
+		appendPacket := func(b []byte, p *packetBuffer) []byte {
+			if compressor != nil {
+				if payload, ok := compressor.compress(p.frameType(), p.bytes()); ok {
+					stats.addCompressed(len(p.packet()), len(payload))
+					return appendFrame(b, frameCompressed, payload)
+				}
+			}
+			return appendFrame(b, p.frameType(), p.bytes())
+		}
+		var n, bytes int
+		// writeBatch writes the frames batched
+		writeBatch := func() error {
+			if n == 0 {
+				return nil
+			}
+			if err := fw.WriteBatch(batch); err != nil {
+				return err
+			}
+			stats.addTxBatch(n, bytes)
+			batch, n, bytes = batch[:0], 0, 0
+			return nil
+		}
 		for {
-			_, err := io.Copy(conn, ifce)
-			errCh <- err
+			var p *packetBuffer
+			select {
+			case p = <-packets:
+			case <-done:
+				return
+			}
+			for p != nil {
+				batch = appendPacket(batch, p)
+				n++
+				bytes += len(p.packet())
+				putPacketBuffer(p)
+				p = nil
+				if len(batch) < maxBatchSize {
+					select {
+					case p = <-packets:
+					default:
+					}
+				}
+			}
+			if err := writeBatch(); err != nil {
+				errCh <- err
+				return
+			}
 		}
 	}()
 
+	writers := make([]queueWriter, len(queues))
+	for i, q := range queues {
+		writers[i] = newQueueWriter(q)
+	}
+	// writePacket writes the packet to the interface queue
+	writePacket := func(w queueWriter, payload []byte, gso bool) {
+		var err error
+		if gso {
+			err = w.writeGSO(payload)
+		} else {
+			err = w.writePacket(payload)
+		}
+		// The interface rejects invalid packets
+		if err != nil {
+			stats.addDropped()
+			return
+		}
+		if gso {
+			stats.addRx(len(payload) - virtioNetHdrLen)
+			return
+		}
+		stats.addRx(len(payload))
+	}
+	// flush writes the packets held to be coalesced once there are no more to read
+	flush := func(w queueWriter) {
+		if err := w.flush(); err != nil {
+			stats.addDropped()
+		}
+	}
+	// With multiple queues the packets are handed to the workers, the shaped
+	// packets too because they are written by the shaping goroutine
+	rxBucket := newTokenBucket(session.Limit.Rx)
+	var workers []chan *packetBuffer
+	if len(queues) > 1 || rxBucket != nil {
+		for _, w := range writers {
+			ch := make(chan *packetBuffer, workerQueueLen)
+			workers = append(workers, ch)
+			go func(w queueWriter, ch chan *packetBuffer) {
+				for {
+					select {
+					case <-done:
+						return
+					case p := <-ch:
+						writePacket(w, p.bytes(), p.gso)
+						putPacketBuffer(p)
+						if len(ch) == 0 {
+							flush(w)
+						}
+					}
+				}
+			}(w, ch)
+		}
+	}
+
+	// pongs are the answers to the keepalives of the peer
+	pongs := make(chan []byte, 1)
+	// toWorker hands the packet to the worker of its flow
+	toWorker := func(p *packetBuffer) bool {
+		packet := p.packet()
+		session.capture.Write(session, false, packet)
+		session.log.Packet(false, session.TAP, packet)
+		select {
+		case workers[flowHash(packet, session.TAP)%uint32(len(workers))] <- p:
+			return true
+		case <-done:
+			putPacketBuffer(p)
+			return false
+		}
+	}
+	var rxQueues *flowScheduler
+	if rxBucket != nil {
+		rxQueues = newFlowScheduler()
+		go rxQueues.shape(rxBucket, toWorker, stats.addRxShaped, stats.addRxRateDropped, done)
+	}
+
 	// Copy from the the connection to the Tun interface
 	go func() {
+		reader := bufio.NewReaderSize(conn, readBufferSize)
+		buf := make([]byte, maxPacketSize)
+		var decompressor *frameDecompressor
+		if session.Compression == compressionDeflate {
+			decompressor = newFrameDecompressor()
+		}
+		var deniedLog *deniedFlowLog
+		if session.logDenied {
+			deniedLog = newDeniedFlowLog(session.log)
+		}
 		for {
-			_, err := io.Copy(ifce, conn)
-			errCh <- err
+			if workers == nil && reader.Buffered() == 0 {
+				flush(writers[0])
+			}
+			frameType, payload, err := readFrame(reader, buf)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if frameType == frameCompressed {
+				if decompressor == nil {
+					stats.addMalformed()
+					continue
+				}
+				if frameType, payload, err = decompressor.decompress(payload); err != nil || frameType == frameCompressed {
+					stats.addMalformed()
+					continue
+				}
+			}
+			switch frameType {
+			case frameData, frameGSO:
+				gso := frameType == frameGSO
+				packet := payload
+				if gso {
+					if len(payload) < virtioNetHdrLen {
+						stats.addMalformed()
+						continue
+					}
+					packet = payload[virtioNetHdrLen:]
+				}
+				if len(packet) == 0 {
+					stats.addMalformed()
+					continue
+				}
+				if session.ACL != nil {
+					if info, ok := session.ACL.Allow(packet, session.TAP); !ok {
+						stats.addDenied()
+						if deniedLog != nil {
+							deniedLog.Log(info, len(packet))
+						}
+						continue
+					}
+				}
+				if workers == nil {
+					session.capture.Write(session, false, packet)
+					session.log.Packet(false, session.TAP, packet)
+					writePacket(writers[0], payload, gso)
+					continue
+				}
+				// The buffer is reused for the next frame
+				p := getPacketBuffer()
+				p.n = copy(p.buf[:], payload)
+				p.gso = gso
+				if rxQueues == nil {
+					if !toWorker(p) {
+						return
+					}
+					continue
+				}
+				// The reader never waits for the rate, the pings are answered
+				p.read = time.Now()
+				if !rxQueues.enqueue(p, flowHash(packet, session.TAP)) {
+					stats.addRxRateDropped()
+					putPacketBuffer(p)
+				}
+			case framePing:
+				// The reader never blocks on the connection, the peer may be
+				// blocked writing to it too
+				select {
+				case pongs <- append([]byte(nil), payload...):
+				default:
+				}
+			case frameRoutes:
+				var routes []string
+				if peerRoutes == nil || json.Unmarshal(payload, &routes) != nil {
+					stats.addMalformed()
+					continue
+				}
+				// The reader is the only sender, the send never blocks
+				select {
+				case <-peerRoutes:
+				default:
+				}
+				peerRoutes <- routes
+			case framePong:
+				if len(payload) != 8 {
+					stats.addMalformed()
+					continue
+				}
+				sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+				stats.setRTT(time.Since(sent))
+			default:
+				stats.addMalformed()
+			}
 		}
 	}()
 
-	for i := 0; i < 2; i++ {
-		if err := <-errCh; err != nil {
-			return fmt.Errorf("Tunnel Error: %v", err)
+	// Send keepalives to measure the round trip time and answer the ones of the peer
+	interval := pingInterval
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ts := make([]byte, 8)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				binary.BigEndian.PutUint64(ts, uint64(time.Now().UnixNano()))
+				fw.WriteFrame(framePing, ts)
+			case pong := <-pongs:
+				if err := fw.WriteFrame(framePong, pong); err != nil {
+					errCh <- err
+					return
+				}
+			}
 		}
+	}()
+
+	// Send the networks advertised every time they change
+	if session.routeUpdates != nil {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case routes := <-session.routeUpdates:
+					payload, _ := json.Marshal(routes)
+					if err := fw.WriteFrame(frameRoutes, payload); err != nil {
+						errCh <- err
+						return
+					}
+				}
+			}
+		}()
 	}
-	return nil
+
+	return fmt.Errorf("Tunnel Error: %v", <-errCh)
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestPacket returns an IPv4 packet of size bytes with a TCP or UDP header
+func newTestPacket(proto uint8, src, dst string, srcPort, dstPort uint16, size int) []byte {
+	if size < 40 {
+		size = 40
+	}
+	pkt := make([]byte, size)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(size))
+	pkt[8] = 64
+	pkt[9] = proto
+	copy(pkt[12:16], net.ParseIP(src).To4())
+	copy(pkt[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(pkt[20:22], srcPort)
+	binary.BigEndian.PutUint16(pkt[22:24], dstPort)
+	switch proto {
+	case protoTCP:
+		pkt[32] = 5 << 4
+	case protoUDP:
+		binary.BigEndian.PutUint16(pkt[24:26], uint16(size-20))
+	}
+	for i := 40; i < size; i++ {
+		pkt[i] = byte(i)
+	}
+	setIPv4Checksum(pkt)
+	return pkt
+}
+
+// testTunnel is a tunnel between two in-memory devices
+type testTunnel struct {
+	client, server         *memDevice
+	clientConn, serverConn net.Conn
+	errs                   chan error
+}
+
+// newTestTunnel runs the sessions over an in-memory connection
+func newTestTunnel(client, server *Session, queues int) *testTunnel {
+	t := &testTunnel{
+		client: newMemDevice(queues),
+		server: newMemDevice(queues),
+		errs:   make(chan error, 2),
+	}
+	t.clientConn, t.serverConn = net.Pipe()
+	go func() {
+		t.errs <- TunnelQueues(t.clientConn, t.client.Queues(), client)
+	}()
+	go func() {
+		t.errs <- TunnelQueues(t.serverConn, t.server.Queues(), server)
+	}()
+	return t
+}
+
+// Close stops both ends and waits for them
+func (t *testTunnel) Close() {
+	t.clientConn.Close()
+	t.serverConn.Close()
+	t.client.Close()
+	t.server.Close()
+	<-t.errs
+	<-t.errs
+}
+
+// receive returns the next packet of the device or fails after a timeout
+func receive(t testing.TB, dev *memDevice) []byte {
+	t.Helper()
+	ch := make(chan []byte, 1)
+	go func() {
+		pkt, _ := dev.Receive()
+		ch <- pkt
+	}()
+	select {
+	case pkt := <-ch:
+		return pkt
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No packet received")
+		return nil
+	}
+}
+
+func TestFrames(t *testing.T) {
+	tests := []struct {
+		name      string
+		frameType byte
+		payload   []byte
+	}{
+		{"empty", frameData, []byte{}},
+		{"ping", framePing, []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"packet", frameData, newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 1000, 53, 1500)},
+		{"largest", frameGSO, bytes.Repeat([]byte{0xaa}, maxPacketSize)},
+	}
+	var stream bytes.Buffer
+	fw := newFrameWriter(&stream)
+	for _, tt := range tests {
+		if err := fw.WriteFrame(tt.frameType, tt.payload); err != nil {
+			t.Fatalf("%s: WriteFrame() error: %v", tt.name, err)
+		}
+	}
+	r := bufio.NewReader(&stream)
+	buf := make([]byte, maxPacketSize)
+	for _, tt := range tests {
+		frameType, payload, err := readFrame(r, buf)
+		if err != nil {
+			t.Fatalf("%s: readFrame() error: %v", tt.name, err)
+		}
+		if frameType != tt.frameType || !bytes.Equal(payload, tt.payload) {
+			t.Errorf("%s: readFrame() = type %d, %d bytes, want type %d, %d bytes", tt.name, frameType, len(payload), tt.frameType, len(tt.payload))
+		}
+	}
+	if _, _, err := readFrame(r, buf); err != io.EOF {
+		t.Errorf("readFrame() at the end error = %v, want EOF", err)
+	}
+}
+
+func TestFrameErrors(t *testing.T) {
+	fw := newFrameWriter(&bytes.Buffer{})
+	if err := fw.WriteFrame(frameData, make([]byte, maxPacketSize+1)); err == nil {
+		t.Errorf("WriteFrame() of an oversize packet succeeded")
+	}
+	tests := []struct {
+		name   string
+		stream []byte
+	}{
+		{"truncated header", []byte{frameData, 0}},
+		{"truncated payload", appendFrame(nil, frameData, []byte{1, 2, 3, 4})[:5]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readFrame(bufio.NewReader(bytes.NewReader(tt.stream)), make([]byte, maxPacketSize))
+			if err != io.ErrUnexpectedEOF {
+				t.Errorf("readFrame() error = %v, want %v", err, io.ErrUnexpectedEOF)
+			}
+		})
+	}
+}
+
+func TestTunnelStats(t *testing.T) {
+	client, server := &Session{}, &Session{}
+	tun := newTestTunnel(client, server, 1)
+	sizes := []int{40, 100, 1500}
+	total := 0
+	for _, size := range sizes {
+		pkt := newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 1000, 53, size)
+		tun.client.Inject(pkt)
+		if got := receive(t, tun.server); !bytes.Equal(got, pkt) {
+			t.Fatalf("Packet of %d bytes corrupted", size)
+		}
+		total += size
+	}
+	reply := newTestPacket(protoUDP, "10.0.0.2", "10.0.0.1", 53, 1000, 200)
+	tun.server.Inject(reply)
+	receive(t, tun.client)
+	tun.Close()
+
+	c, s := client.Stats.Snapshot(), server.Stats.Snapshot()
+	if c.TxPackets != uint64(len(sizes)) || c.TxBytes != uint64(total) {
+		t.Errorf("client tx = %d packets %d bytes, want %d packets %d bytes", c.TxPackets, c.TxBytes, len(sizes), total)
+	}
+	if s.RxPackets != uint64(len(sizes)) || s.RxBytes != uint64(total) {
+		t.Errorf("server rx = %d packets %d bytes, want %d packets %d bytes", s.RxPackets, s.RxBytes, len(sizes), total)
+	}
+	if c.RxPackets != 1 || c.RxBytes != 200 || s.TxPackets != 1 || s.TxBytes != 200 {
+		t.Errorf("reply counted client rx %d/%d server tx %d/%d, want 1/200", c.RxPackets, c.RxBytes, s.TxPackets, s.TxBytes)
+	}
+}
+
+func TestTunnelMalformed(t *testing.T) {
+	server := &Session{}
+	clientConn, serverConn := net.Pipe()
+	dev := newMemDevice(1)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- TunnelQueues(serverConn, dev.Queues(), server)
+	}()
+	// A frame with an unknown type is skipped
+	clientConn.Write(appendFrame(nil, 0x7f, []byte{1, 2, 3}))
+	pkt := newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 1000, 53, 64)
+	clientConn.Write(appendFrame(nil, frameData, pkt))
+	if got := receive(t, dev); !bytes.Equal(got, pkt) {
+		t.Fatalf("Packet after the malformed frame corrupted")
+	}
+	clientConn.Close()
+	dev.Close()
+	<-errs
+	if got := server.Stats.Snapshot().Malformed; got != 1 {
+		t.Errorf("malformed = %d, want 1", got)
+	}
+}
+
+// newFlowPacket returns the packet seq of the UDP flow from port
+func newFlowPacket(port uint16, seq uint32, size int) []byte {
+	pkt := newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", port, 53, size)
+	binary.BigEndian.PutUint32(pkt[28:32], seq)
+	return pkt
+}
+
+func TestTunnelQueuesOrder(t *testing.T) {
+	const flows, perFlow = 16, 200
+	tun := newTestTunnel(&Session{}, &Session{}, 4)
+	defer tun.Close()
+	go func() {
+		for seq := uint32(0); seq < perFlow; seq++ {
+			for port := uint16(0); port < flows; port++ {
+				tun.client.Inject(newFlowPacket(1000+port, seq, 100))
+			}
+		}
+	}()
+	// The flows are forwarded in parallel, the packets of each flow in order
+	next := map[uint16]uint32{}
+	for i := 0; i < flows*perFlow; i++ {
+		pkt := receive(t, tun.server)
+		port := binary.BigEndian.Uint16(pkt[20:22])
+		seq := binary.BigEndian.Uint32(pkt[28:32])
+		if seq != next[port] {
+			t.Fatalf("flow %d received packet %d, want %d", port, seq, next[port])
+		}
+		next[port]++
+	}
+}
+
+func BenchmarkTunnelQueues(b *testing.B) {
+	const flows = 64
+	for _, queues := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("queues=%d", queues), func(b *testing.B) {
+			tun := newTestTunnel(&Session{}, &Session{}, queues)
+			defer tun.Close()
+			pkts := make([][]byte, flows)
+			for i := range pkts {
+				pkts[i] = newFlowPacket(uint16(1000+i), 0, 1400)
+			}
+			b.SetBytes(1400)
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					tun.client.Inject(pkts[i%flows])
+				}
+			}()
+			for i := 0; i < b.N; i++ {
+				if _, err := tun.server.Receive(); err != nil {
+					b.Fatalf("Receive() error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestTunnelRoutesOffDataPath(t *testing.T) {
+	release := make(chan struct{})
+	applied := make(chan []string, 4)
+	server := &Session{onRoutes: func(routes []string) {
+		<-release
+		applied <- routes
+	}}
+	clientConn, serverConn := net.Pipe()
+	dev := newMemDevice(1)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- TunnelQueues(serverConn, dev.Queues(), server)
+	}()
+	// The packets keep flowing while the routes are applied
+	clientConn.Write(appendFrame(nil, frameRoutes, []byte(`["172.18.0.0/16"]`)))
+	pkt := newTestPacket(protoUDP, "10.0.0.1", "10.0.0.2", 1000, 53, 64)
+	clientConn.Write(appendFrame(nil, frameData, pkt))
+	if got := receive(t, dev); !bytes.Equal(got, pkt) {
+		t.Fatalf("Packet after the routes corrupted")
+	}
+	close(release)
+	select {
+	case routes := <-applied:
+		if len(routes) != 1 || routes[0] != "172.18.0.0/16" {
+			t.Errorf("routes applied = %q, want [172.18.0.0/16]", routes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Routes not applied")
+	}
+	clientConn.Close()
+	dev.Close()
+	<-errs
+}